@@ -0,0 +1,197 @@
+package main
+
+import (
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// abDialer dials through the global forwarders(a) and mirrors the tcp connections with their
+// first request to the forwarder b, then logs the connectivity, connect latency and time to
+// first byte of both, see -abforward. The replies of b are discarded.
+type abDialer struct {
+	Dialer // a
+	b      Dialer
+
+	count, aFails, bFails, aWins, bWins int64 // atomic
+}
+
+// newABDialer returns an ab dialer of a and the forwarder chain b
+func newABDialer(a Dialer, chain string) (*abDialer, error) {
+	b, err := chainDialer(chain, NewDirect(0, conf.Mark, conf.Interface, conf.SourceIP))
+	if err != nil {
+		return nil, err
+	}
+	return &abDialer{Dialer: a, b: b}, nil
+}
+
+// abSide is the result of a or b
+type abSide struct {
+	connect time.Duration
+	ttfb    time.Duration
+	err     error
+}
+
+func (s *abSide) String() string {
+	if s.err != nil {
+		return "error: " + s.err.Error()
+	}
+	if s.ttfb == 0 {
+		return "connect " + s.connect.String() + ", no reply"
+	}
+	return "connect " + s.connect.String() + ", ttfb " + s.ttfb.String()
+}
+
+// abTest is a mirrored connection
+type abTest struct {
+	d    *abDialer
+	addr string
+	a, b abSide
+
+	pending int32 // the sides not finished, atomic
+}
+
+// done finishes a side, the result is logged when both are finished
+func (t *abTest) done() {
+	if atomic.AddInt32(&t.pending, -1) != 0 {
+		return
+	}
+
+	d := t.d
+	n := atomic.AddInt64(&d.count, 1)
+	switch {
+	case t.a.err != nil && t.b.err == nil:
+		atomic.AddInt64(&d.aFails, 1)
+	case t.a.err == nil && t.b.err != nil:
+		atomic.AddInt64(&d.bFails, 1)
+	case t.a.ttfb > 0 && t.b.ttfb > 0:
+		if t.a.ttfb < t.b.ttfb {
+			atomic.AddInt64(&d.aWins, 1)
+		} else {
+			atomic.AddInt64(&d.bWins, 1)
+		}
+	}
+
+	log.Printf("abtest %s: a %s; b %s [%d tests, faster: a %d b %d, only failed: a %d b %d]",
+		t.addr, &t.a, &t.b, n, atomic.LoadInt64(&d.aWins), atomic.LoadInt64(&d.bWins),
+		atomic.LoadInt64(&d.aFails), atomic.LoadInt64(&d.bFails))
+}
+
+// Dial connects to addr via a and mirrors the connection to b.
+func (d *abDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialVia(network, addr, "")
+}
+
+// DialVia is Dial with the via chain passed on to both sides
+func (d *abDialer) DialVia(network, addr, via string) (net.Conn, error) {
+	return d.DialFrom(network, addr, via, nil)
+}
+
+// DialFrom is Dial with the via chain and the client src passed on to both sides
+func (d *abDialer) DialFrom(network, addr, via string, src net.IP) (net.Conn, error) {
+	if network != "tcp" {
+		return dialFrom(d.Dialer, network, addr, via, src)
+	}
+
+	t := &abTest{d: d, addr: addr, pending: 2}
+
+	shadow := make(chan net.Conn, 1)
+	go func() {
+		start := time.Now()
+		c, err := dialFrom(d.b, network, addr, via, src)
+		t.b.connect, t.b.err = time.Since(start), err
+		shadow <- c
+	}()
+
+	start := time.Now()
+	c, err := dialFrom(d.Dialer, network, addr, via, src)
+	t.a.connect, t.a.err = time.Since(start), err
+	if err != nil {
+		t.done()
+		go func() {
+			if sc := <-shadow; sc != nil {
+				sc.Close()
+			}
+			t.done()
+		}()
+		return nil, err
+	}
+
+	return &abConn{Conn: c, test: t, shadow: shadow, start: time.Now().UnixNano()}, nil
+}
+
+// DialUDPFrom connects to addr via a for the client src, udp is not mirrored
+func (d *abDialer) DialUDPFrom(network, addr string, src net.IP) (net.PacketConn, net.Addr, error) {
+	return dialUDPFrom(d.Dialer, network, addr, src)
+}
+
+// abConn is the connection via a, the first write is mirrored to b
+type abConn struct {
+	net.Conn
+	test   *abTest
+	shadow chan net.Conn
+
+	start     int64 // unix nano, connected or the first request sent, atomic
+	wonce     sync.Once
+	ronce     sync.Once
+	closeOnce sync.Once
+}
+
+func (c *abConn) Write(b []byte) (int, error) {
+	c.wonce.Do(func() {
+		atomic.StoreInt64(&c.start, time.Now().UnixNano())
+		go c.mirror(append([]byte{}, b...))
+	})
+	return c.Conn.Write(b)
+}
+
+func (c *abConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.ronce.Do(func() {
+			c.test.a.ttfb = time.Since(time.Unix(0, atomic.LoadInt64(&c.start)))
+			c.test.done()
+		})
+	}
+	return n, err
+}
+
+func (c *abConn) Close() error {
+	c.closeOnce.Do(func() {
+		// nothing written, b waits for the reply with an empty request
+		c.wonce.Do(func() { go c.mirror(nil) })
+		c.ronce.Do(c.test.done)
+	})
+	return c.Conn.Close()
+}
+
+// mirror sends req to b and waits for the first byte
+func (c *abConn) mirror(req []byte) {
+	t := c.test
+	defer t.done()
+
+	sc := <-c.shadow
+	if sc == nil {
+		return
+	}
+	defer sc.Close()
+
+	start := time.Now()
+	if len(req) > 0 {
+		if _, err := sc.Write(req); err != nil {
+			t.b.err = err
+			return
+		}
+	}
+
+	sc.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err := sc.Read(make([]byte, 1)); err != nil {
+		if err, ok := err.(net.Error); !ok || !err.Timeout() {
+			t.b.err = err
+		}
+		return
+	}
+	t.b.ttfb = time.Since(start)
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// acctRecord is the metadata of an upstream connection, sent to the accounting socket when closed
+type acctRecord struct {
+	Tag      string `json:"tag"` // rule name, or "global"
+	Network  string `json:"network"`
+	Dst      string `json:"dst"`
+	Local    string `json:"local"`    // local address of the upstream socket
+	Upstream string `json:"upstream"` // remote address of the upstream socket, the forwarder or dst
+	Start    int64  `json:"start"`    // unix seconds
+	Duration int64  `json:"duration"` // milliseconds
+	Up       int64  `json:"up"`
+	Down     int64  `json:"down"`
+
+	start time.Time
+}
+
+// acctCh queues the records to the accounting socket, records are dropped when full
+var acctCh chan *acctRecord
+
+// startAcct sends the records as json datagrams to the unix datagram socket path,
+// e.g. for ulogd or a custom collector to attribute upstream traffic to the rules.
+func startAcct(path string) {
+	acctCh = make(chan *acctRecord, 1024)
+
+	go func() {
+		var c net.Conn
+		for r := range acctCh {
+			if c == nil {
+				var err error
+				if c, err = net.Dial("unixgram", path); err != nil {
+					logf("acct: connect to %s error: %s", path, err)
+					c = nil
+					continue
+				}
+			}
+
+			b, _ := json.Marshal(r)
+			if _, err := c.Write(b); err != nil {
+				logf("acct: write to %s error: %s", path, err)
+				c.Close()
+				c = nil
+			}
+		}
+	}()
+}
+
+// sendAcct queues r without blocking
+func sendAcct(r *acctRecord) {
+	select {
+	case acctCh <- r:
+	default:
+	}
+}
+
+// acctDialer tags the upstream connections of a rule for accounting
+type acctDialer struct {
+	Dialer
+	tag string
+}
+
+// newAcctDialer returns d with accounting if enabled
+func newAcctDialer(d Dialer, tag string) Dialer {
+	if acctCh == nil {
+		return d
+	}
+	return &acctDialer{Dialer: d, tag: tag}
+}
+
+func (d *acctDialer) record(network, addr string, local, remote net.Addr) *acctRecord {
+	now := time.Now()
+	r := &acctRecord{Tag: d.tag, Network: network, Dst: addr, Start: now.Unix(), start: now}
+	if local != nil {
+		r.Local = local.String()
+	}
+	if remote != nil {
+		r.Upstream = remote.String()
+	}
+	return r
+}
+
+func (d *acctDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialVia(network, addr, "")
+}
+
+func (d *acctDialer) DialVia(network, addr, via string) (net.Conn, error) {
+	return d.DialFrom(network, addr, via, nil)
+}
+
+func (d *acctDialer) DialFrom(network, addr, via string, src net.IP) (net.Conn, error) {
+	c, err := dialFrom(d.Dialer, network, addr, via, src)
+	if err != nil {
+		return c, err
+	}
+
+	return &acctConn{Conn: c, r: d.record(network, addr, c.LocalAddr(), c.RemoteAddr())}, nil
+}
+
+func (d *acctDialer) DialUDP(network, addr string) (net.PacketConn, net.Addr, error) {
+	return d.DialUDPFrom(network, addr, nil)
+}
+
+func (d *acctDialer) DialUDPFrom(network, addr string, src net.IP) (net.PacketConn, net.Addr, error) {
+	pc, writeTo, err := dialUDPFrom(d.Dialer, network, addr, src)
+	if err != nil {
+		return pc, writeTo, err
+	}
+
+	return &acctPacketConn{PacketConn: pc, r: d.record(network, addr, pc.LocalAddr(), writeTo)}, writeTo, nil
+}
+
+// acctConn counts the traffic of a connection, and sends the record when closed
+type acctConn struct {
+	net.Conn
+	r      *acctRecord
+	closed int32
+}
+
+func (c *acctConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&c.r.Down, int64(n))
+	return n, err
+}
+
+func (c *acctConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&c.r.Up, int64(n))
+	return n, err
+}
+
+func (c *acctConn) Close() error {
+	if atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		c.r.finish()
+	}
+	return c.Conn.Close()
+}
+
+// WriteTo copies from the underlying conn to w and counts the bytes when done,
+// so the WriterTo of it is used, e.g. splice between tcp conns on linux.
+func (c *acctConn) WriteTo(w io.Writer) (int64, error) {
+	n, err := io.Copy(w, c.Conn)
+	atomic.AddInt64(&c.r.Down, n)
+	return n, err
+}
+
+// ReadFrom copies from r to the underlying conn and counts the bytes when done,
+// so the ReaderFrom of it is used.
+func (c *acctConn) ReadFrom(r io.Reader) (int64, error) {
+	n, err := io.Copy(c.Conn, r)
+	atomic.AddInt64(&c.r.Up, n)
+	return n, err
+}
+
+// acctPacketConn counts the traffic of a udp session, and sends the record when closed
+type acctPacketConn struct {
+	net.PacketConn
+	r      *acctRecord
+	closed int32
+}
+
+func (pc *acctPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := pc.PacketConn.ReadFrom(b)
+	atomic.AddInt64(&pc.r.Down, int64(n))
+	return n, addr, err
+}
+
+func (pc *acctPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	n, err := pc.PacketConn.WriteTo(b, addr)
+	atomic.AddInt64(&pc.r.Up, int64(n))
+	return n, err
+}
+
+func (pc *acctPacketConn) Close() error {
+	if atomic.CompareAndSwapInt32(&pc.closed, 0, 1) {
+		pc.r.finish()
+	}
+	return pc.PacketConn.Close()
+}
+
+// finish sends a copy of the record with the duration
+func (r *acctRecord) finish() {
+	rec := *r
+	rec.Duration = time.Since(r.start).Nanoseconds() / int64(time.Millisecond)
+	rec.Up, rec.Down = atomic.LoadInt64(&r.Up), atomic.LoadInt64(&r.Down)
+	sendAcct(&rec)
+}
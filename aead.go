@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"runtime"
+	"strings"
+
+	"golang.org/x/sys/cpu"
+)
+
+// the aead preferences of -aead
+const (
+	aeadAuto     = "auto"
+	aeadAES      = "aes"
+	aeadChacha20 = "chacha20"
+)
+
+// aeadPreferAES reports whether aes-gcm is preferred over chacha20-poly1305 where the protocol
+// lets the client choose(vmess security=auto), set by initAEAD.
+var aeadPreferAES = true
+
+// aesHardware reports whether aes-gcm of go runs on hardware instructions on this cpu,
+// with the name of the instructions. elsewhere, e.g. mips and 32-bit arm routers,
+// chacha20-poly1305 is several times faster.
+func aesHardware() (bool, string) {
+	switch runtime.GOARCH {
+	case "amd64":
+		return cpu.X86.HasAES && cpu.X86.HasPCLMULQDQ, "aes-ni pclmulqdq"
+	case "arm64":
+		return cpu.ARM64.HasAES && cpu.ARM64.HasPMULL, "aes pmull"
+	case "s390x":
+		return cpu.S390X.HasAES && cpu.S390X.HasAESGCM, "kma"
+	case "ppc64", "ppc64le":
+		return true, "power8 crypto"
+	}
+	return false, ""
+}
+
+// initAEAD selects the aead path by pref: auto(by the cpu features), aes or chacha20,
+// the latter two force it, e.g. for benchmarking on embedded targets.
+func initAEAD(pref string) error {
+	hw, insts := aesHardware()
+	switch pref {
+	case aeadAuto:
+		aeadPreferAES = hw
+	case aeadAES:
+		aeadPreferAES = true
+	case aeadChacha20:
+		aeadPreferAES = false
+	default:
+		return errors.New("aead: unknown '" + pref + "', available: auto aes chacha20")
+	}
+
+	name := "chacha20-poly1305"
+	if aeadPreferAES {
+		name = "aes-gcm"
+	}
+
+	if hw {
+		logf("aead: %s/%s with %s, prefer %s(%s)", runtime.GOOS, runtime.GOARCH, insts, name, pref)
+	} else {
+		logf("aead: %s/%s without aes hardware, prefer %s(%s)", runtime.GOOS, runtime.GOARCH, name, pref)
+	}
+	return nil
+}
+
+// checkAESMethod logs a hint when the aes-gcm method of ss runs in software on this cpu
+func checkAESMethod(proto, method string) {
+	if hw, _ := aesHardware(); !hw && strings.Contains(strings.ToLower(method), "aes") {
+		logf("%s: %s is slow without aes hardware on %s, chacha20-ietf-poly1305 is recommended", proto, method, runtime.GOARCH)
+	}
+}
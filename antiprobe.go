@@ -0,0 +1,73 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// probeStats counts the active probes observed by the listeners
+var probeStats struct {
+	Timeouts  int64 // no valid handshake within the read timeout
+	Malformed int64 // malformed handshakes, e.g. wrong key or invalid address
+	Tarpitted int64 // probes held by the tar pit
+}
+
+func init() {
+	rand.Seed(time.Now().UnixNano())
+	apiMux.HandleFunc("/stats/probes", handleProbes)
+}
+
+// handshakeTimeout returns a random read timeout for the first packet, in [15s, 45s),
+// so the timeout can not be used to fingerprint the server.
+func handshakeTimeout() time.Duration {
+	return 15*time.Second + time.Duration(rand.Int63n(int64(30*time.Second)))
+}
+
+// defendProbe handles a connection with a failed handshake without responding anything:
+// keeps reading until the client gives up or a random timeout, so it looks the same as
+// a server waiting for more data. when tarpit is set, drip-feeds the read for a long time.
+func defendProbe(c net.Conn, err error, tarpit bool) {
+	if e, ok := err.(net.Error); ok && e.Timeout() {
+		atomic.AddInt64(&probeStats.Timeouts, 1)
+		return
+	}
+
+	atomic.AddInt64(&probeStats.Malformed, 1)
+
+	if !tarpit {
+		c.SetReadDeadline(time.Now().Add(handshakeTimeout()))
+		io.Copy(ioutil.Discard, c)
+		return
+	}
+
+	atomic.AddInt64(&probeStats.Tarpitted, 1)
+	logf("tarpit %s", c.RemoteAddr())
+
+	// read 1 byte every 10 seconds for at most 10 minutes
+	buf := make([]byte, 1)
+	c.SetReadDeadline(time.Now().Add(10 * time.Minute))
+	for {
+		if _, err := c.Read(buf); err != nil {
+			return
+		}
+		time.Sleep(10 * time.Second)
+	}
+}
+
+// handleProbes serves the probe counters: /stats/probes
+func handleProbes(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, struct {
+		Timeouts  int64 `json:"timeouts"`
+		Malformed int64 `json:"malformed"`
+		Tarpitted int64 `json:"tarpitted"`
+	}{
+		atomic.LoadInt64(&probeStats.Timeouts),
+		atomic.LoadInt64(&probeStats.Malformed),
+		atomic.LoadInt64(&probeStats.Tarpitted),
+	})
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+)
+
+// apiMux is the http handler of the management api
+var apiMux = http.NewServeMux()
+
+// apiListenAndServe serves the management api on addr
+func apiListenAndServe(addr string) {
+	logf("api listening TCP on %s", addr)
+
+	if err := http.ListenAndServe(addr, apiMux); err != nil {
+		logf("api failed to listen on %s: %v", addr, err)
+	}
+}
+
+// writeJSON writes v to w in json format
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		logf("api write response error: %s", err)
+	}
+}
+
+// apiLocal restricts the api handler h to the loopback clients unless -apiremote is set, the api has
+// no authentication and h acts via the forwarders, e.g. dialing any address, draining them.
+func apiLocal(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !conf.APIRemote {
+			host, _, _ := net.SplitHostPort(r.RemoteAddr)
+			if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+				logf("api: %s %s from %s refused, only allowed from loopback(see -apiremote)", r.Method, r.URL.Path, r.RemoteAddr)
+				http.Error(w, "forbidden, only allowed from loopback", http.StatusForbidden)
+				return
+			}
+		}
+		h(w, r)
+	}
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Authenticator authenticates the users of listeners
+type Authenticator interface {
+	// Auth reports whether the user and password are valid.
+	Auth(user, pass string) bool
+}
+
+// NewAuthenticator returns the authenticator of a listener according to the auth param in rawQuery:
+//
+//	auth=file:///etc/glider/users                      file backend, "USER:PASSWORD" per line
+//	auth=http://127.0.0.1:8000/auth                    http callback, 200 means ok
+//	auth=ldap://10.0.0.1:389/uid={user},ou=people,dc=x ldap simple bind
+//	auth=ldaps://10.0.0.1:636/uid={user},ou=people,dc=x ldap simple bind over tls
+//
+// the passwords are sent in cleartext by ldap://, use ldaps:// unless the ldap server is local.
+//
+// without the auth param, the user and password in the listen url are used(if any).
+// with token=true, the session tokens issued on -tokenlisten(see token.go) are accepted as the user.
+// returns nil if no authentication is required.
+func NewAuthenticator(user, pass, rawQuery string) (Authenticator, error) {
+	p, _ := url.ParseQuery(rawQuery)
+
+	var a Authenticator
+	if s := p.Get("auth"); s != "" {
+		var err error
+		if a, err = newAuthBackend(s); err != nil {
+			return nil, err
+		}
+	} else if user != "" {
+		a = &staticAuth{user: user, pass: pass}
+	}
+
+	// session tokens issued by the api are also accepted as the user
+	if p.Get("token") == "true" {
+		return &tokenAuth{a}, nil
+	}
+
+	return a, nil
+}
+
+// listenerAuthed reports whether the clients of a listener must authenticate: by a keyed protocol,
+// the user or auth backend, the client certificates of tls or the psk of a tunnel.
+// The inner protocol of a transport listener is also checked, e.g. tls://:443?cert=x&key=y,socks5://user:pass@
+func listenerAuthed(scheme, user, rawQuery, inner string) bool {
+	p, _ := url.ParseQuery(rawQuery)
+	switch {
+	case scheme == "ss" || scheme == "trojan" || scheme == "mtproto":
+		return true
+	case user != "" || p.Get("auth") != "" || p.Get("token") == "true":
+		return true
+	case scheme == "tls" && p.Get("ca") != "":
+		return true
+	case p.Get("psk") != "":
+		return true
+	case inner == "":
+		return false
+	}
+
+	s := inner
+	inner = ""
+	if i := strings.IndexByte(s, ','); i > 0 {
+		s, inner = s[:i], s[i+1:]
+	}
+
+	u, err := url.Parse(s)
+	if err != nil {
+		return false
+	}
+
+	user = ""
+	if u.User != nil {
+		user = u.User.Username()
+	}
+	return listenerAuthed(u.Scheme, user, u.RawQuery, inner)
+}
+
+// newAuthBackend returns the authenticator according to the backend url s
+func newAuthBackend(s string) (Authenticator, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "file":
+		return newFileAuth(u.Path)
+	case "http", "https":
+		return newHTTPAuth(s), nil
+	case "ldap", "ldaps":
+		return newLDAPAuth(u.Host, strings.TrimPrefix(u.Path, "/"), u.Scheme == "ldaps")
+	}
+
+	return nil, errors.New("unknown auth backend '" + u.Scheme + "'")
+}
+
+// staticAuth is the user and password in the listen url
+type staticAuth struct {
+	user, pass string
+}
+
+// Auth compares in constant time, so the credentials can not be guessed by timing.
+func (a *staticAuth) Auth(user, pass string) bool {
+	u := subtle.ConstantTimeCompare([]byte(user), []byte(a.user))
+	p := subtle.ConstantTimeCompare([]byte(pass), []byte(a.pass))
+	return u&p == 1
+}
+
+// fileAuth reads "USER:PASSWORD" lines from a file, reloads it when modified
+type fileAuth struct {
+	mu      sync.Mutex
+	path    string
+	modTime time.Time
+	users   map[string]string
+}
+
+func newFileAuth(path string) (*fileAuth, error) {
+	a := &fileAuth{path: path}
+	if err := a.load(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// load reads the user file if it's modified since the last load
+func (a *fileAuth) load() error {
+	fi, err := os.Stat(a.path)
+	if err != nil {
+		return err
+	}
+
+	if fi.ModTime().Equal(a.modTime) {
+		return nil
+	}
+
+	f, err := os.Open(a.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		if i := strings.IndexByte(line, ':'); i > 0 {
+			users[line[:i]] = line[i+1:]
+		}
+	}
+
+	a.users, a.modTime = users, fi.ModTime()
+	logf("auth loaded %d users from %s", len(users), a.path)
+
+	return scanner.Err()
+}
+
+func (a *fileAuth) Auth(user, pass string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if err := a.load(); err != nil {
+		logf("auth load %s error: %s", a.path, err)
+	}
+
+	p, ok := a.users[user]
+	return ok && subtle.ConstantTimeCompare([]byte(p), []byte(pass)) == 1
+}
+
+// httpAuthCacheSize is the max number of the cached results of httpAuth
+const httpAuthCacheSize = 1024
+
+// httpAuth posts {"user": USER, "password": PASSWORD} to the callback url,
+// the status code 200 means ok. successful results are cached for a minute,
+// up to httpAuthCacheSize of them, the failed ones are not cached.
+type httpAuth struct {
+	url    string
+	client *http.Client
+
+	mu    sync.Mutex
+	cache map[[sha256.Size]byte]time.Time // sha256(user:pass) -> expire time
+}
+
+func newHTTPAuth(url string) *httpAuth {
+	return &httpAuth{
+		url:    url,
+		client: &http.Client{Timeout: 10 * time.Second},
+		cache:  make(map[[sha256.Size]byte]time.Time),
+	}
+}
+
+func (a *httpAuth) Auth(user, pass string) bool {
+	key := sha256.Sum256([]byte(user + ":" + pass))
+
+	a.mu.Lock()
+	expire, ok := a.cache[key]
+	a.mu.Unlock()
+	if ok && time.Now().Before(expire) {
+		return true
+	}
+
+	b, _ := json.Marshal(map[string]string{"user": user, "password": pass})
+	resp, err := a.client.Post(a.url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		logf("auth callback %s error: %s", a.url, err)
+		return false
+	}
+	resp.Body.Close()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if resp.StatusCode != http.StatusOK {
+		delete(a.cache, key)
+		return false
+	}
+
+	if len(a.cache) >= httpAuthCacheSize {
+		now := time.Now()
+		for k, v := range a.cache {
+			if now.After(v) {
+				delete(a.cache, k)
+			}
+		}
+		// still full, evict one of them
+		for k := range a.cache {
+			if len(a.cache) < httpAuthCacheSize {
+				break
+			}
+			delete(a.cache, k)
+		}
+	}
+	a.cache[key] = time.Now().Add(time.Minute)
+	return true
+}
+
+// ldapAuth authenticates users by ldap simple bind, https://tools.ietf.org/html/rfc4511#section-4.2
+type ldapAuth struct {
+	addr string
+	dn   string      // bind dn template, {user} is replaced by the user
+	tls  *tls.Config // ldaps, nil: the passwords are sent in cleartext
+}
+
+func newLDAPAuth(addr, dn string, secure bool) (*ldapAuth, error) {
+	if !strings.Contains(dn, "{user}") {
+		return nil, errors.New("ldap bind dn must contain {user}: " + dn)
+	}
+
+	port := "389"
+	if secure {
+		port = "636"
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, port)
+	}
+
+	a := &ldapAuth{addr: addr, dn: dn}
+	host, _, _ := net.SplitHostPort(addr)
+	if secure {
+		a.tls = &tls.Config{ServerName: host}
+	} else if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		logf("auth ldap: WARNING: the passwords are sent to %s in cleartext, use ldaps://", addr)
+	}
+
+	return a, nil
+}
+
+func (a *ldapAuth) Auth(user, pass string) bool {
+	// an empty password means an unauthenticated bind, which always succeeds
+	if user == "" || pass == "" {
+		return false
+	}
+
+	var c net.Conn
+	var err error
+	if a.tls != nil {
+		c, err = tls.DialWithDialer(&net.Dialer{Timeout: 10 * time.Second}, "tcp", a.addr, a.tls)
+	} else {
+		c, err = net.DialTimeout("tcp", a.addr, 10*time.Second)
+	}
+	if err != nil {
+		logf("auth ldap dial %s error: %s", a.addr, err)
+		return false
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(10 * time.Second))
+
+	dn := strings.Replace(a.dn, "{user}", ldapEscape(user), -1)
+
+	// BindRequest ::= [APPLICATION 0] SEQUENCE { version INTEGER(3), name LDAPDN, simple [0] OCTET STRING }
+	bind := berTLV(0x02, []byte{3})
+	bind = append(bind, berTLV(0x04, []byte(dn))...)
+	bind = append(bind, berTLV(0x80, []byte(pass))...)
+
+	// LDAPMessage ::= SEQUENCE { messageID INTEGER(1), protocolOp }
+	msg := berTLV(0x02, []byte{1})
+	msg = append(msg, berTLV(0x60, bind)...)
+
+	if _, err := c.Write(berTLV(0x30, msg)); err != nil {
+		logf("auth ldap write error: %s", err)
+		return false
+	}
+
+	// LDAPMessage { messageID, BindResponse [APPLICATION 1] { resultCode ENUMERATED, ... } }
+	r := bufio.NewReader(c)
+	if _, _, err := berReadHeader(r, 0x30); err != nil {
+		logf("auth ldap read error: %s", err)
+		return false
+	}
+
+	_, l, err := berReadHeader(r, 0x02)
+	if err != nil {
+		logf("auth ldap read error: %s", err)
+		return false
+	}
+	if _, err := r.Discard(l); err != nil {
+		return false
+	}
+
+	if _, _, err := berReadHeader(r, 0x61); err != nil {
+		logf("auth ldap read error: %s", err)
+		return false
+	}
+
+	_, l, err = berReadHeader(r, 0x0a)
+	if err != nil || l != 1 {
+		logf("auth ldap read result code error: %v", err)
+		return false
+	}
+
+	code, err := r.ReadByte()
+	return err == nil && code == 0 // 0: success
+}
+
+// ldapEscape escapes the special characters in a dn attribute value, https://tools.ietf.org/html/rfc4514#section-2.4
+func ldapEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case ',', '+', '"', '\\', '<', '>', ';', '=', '#':
+			b.WriteByte('\\')
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// berTLV encodes a ber tag-length-value
+func berTLV(tag byte, v []byte) []byte {
+	b := []byte{tag}
+
+	l := len(v)
+	switch {
+	case l < 0x80:
+		b = append(b, byte(l))
+	case l <= 0xff:
+		b = append(b, 0x81, byte(l))
+	default:
+		b = append(b, 0x82, byte(l>>8), byte(l))
+	}
+
+	return append(b, v...)
+}
+
+// berReadHeader reads the tag and length of a ber element, the tag must be the expected one
+func berReadHeader(r *bufio.Reader, expect byte) (byte, int, error) {
+	tag, err := r.ReadByte()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if tag != expect {
+		return tag, 0, errors.New("unexpected ber tag")
+	}
+
+	b, err := r.ReadByte()
+	if err != nil {
+		return tag, 0, err
+	}
+
+	if b < 0x80 {
+		return tag, int(b), nil
+	}
+
+	n := int(b & 0x7f)
+	if n > 4 {
+		return tag, 0, errors.New("ber length too long")
+	}
+
+	var l int
+	for i := 0; i < n; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return tag, 0, err
+		}
+		l = l<<8 | int(b)
+	}
+
+	return tag, l, nil
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// autoRouteMark is the fwmark of the outbound sockets with -autoroute when -mark is not set,
+// the marked connections of glider itself bypass the installed routes and redirect rules.
+const autoRouteMark = 0x1d2
+
+// autoRouteTable is the routing table of the tun device installed by -autoroute
+const autoRouteTable = 2022
+
+// autoRoute is the state of -autoroute
+var autoRoute struct {
+	sync.Mutex
+	marks    []int        // fwmarks of the outbound sockets, they bypass the routes and rules
+	excludes []net.IP     // servers connected directly, never routed back to glider
+	undo     [][][]string // commands to remove the installed routes and rules, run on exit
+}
+
+// routeStep is a command to install a route or rule, with the commands to remove it
+type routeStep struct {
+	add []string
+	del [][]string
+}
+
+// initAutoRoute marks the outbound sockets of the global forwarders and the rules without a mark,
+// and resolves the servers to exclude, called before the dialers are built.
+func initAutoRoute() {
+	if conf.Mark == 0 {
+		conf.Mark = autoRouteMark
+	}
+	for _, r := range conf.rules {
+		if r.Mark == 0 {
+			r.Mark = conf.Mark
+		}
+	}
+
+	autoRoute.Lock()
+	autoRoute.marks = autoRouteMarks()
+	autoRoute.excludes = autoRouteExcludes()
+	autoRoute.Unlock()
+}
+
+// runRouteSteps installs the routes or rules of steps, the stale ones left by a killed instance are removed first
+func runRouteSteps(steps []routeStep) error {
+	for i := len(steps) - 1; i >= 0; i-- {
+		for _, args := range steps[i].del {
+			exec.Command(args[0], args[1:]...).Run()
+		}
+	}
+
+	for _, s := range steps {
+		if err := runCmd(s.add); err != nil {
+			return err
+		}
+		if len(s.del) > 0 {
+			autoRoute.Lock()
+			autoRoute.undo = append(autoRoute.undo, s.del)
+			autoRoute.Unlock()
+		}
+	}
+	return nil
+}
+
+// cleanAutoRoute removes the installed routes and rules in reverse order, called on exit
+func cleanAutoRoute() {
+	autoRoute.Lock()
+	defer autoRoute.Unlock()
+
+	for i := len(autoRoute.undo) - 1; i >= 0; i-- {
+		for _, args := range autoRoute.undo[i] {
+			if err := runCmd(args); err != nil {
+				logf("auto-route: %s", err)
+			}
+		}
+	}
+	autoRoute.undo = nil
+}
+
+// runCmd runs the command args, the error contains its output
+func runCmd(args []string) error {
+	if out, err := exec.Command(args[0], args[1:]...).CombinedOutput(); err != nil {
+		msg := strings.TrimSpace(string(out))
+		if msg == "" {
+			msg = err.Error()
+		}
+		return errors.New(strings.Join(args, " ") + ": " + msg)
+	}
+	return nil
+}
+
+// autoRoutePort returns the port of the first redir listener, the routes of the tun listeners
+// are installed by themselves when the devices are up.
+func autoRoutePort(listens []string) string {
+	for _, s := range listens {
+		if u, err := url.Parse(s); err == nil && u.Scheme == "redir" {
+			return u.Port()
+		}
+	}
+	return ""
+}
+
+// hasTransparent reports whether there's a redir or tun listener for -autoroute
+func hasTransparent(listens []string) bool {
+	for _, s := range listens {
+		if strings.HasPrefix(s, "redir://") || strings.HasPrefix(s, "tun://") {
+			return true
+		}
+	}
+	return false
+}
+
+// autoRouteMarks returns the distinct fwmarks of the outbound sockets: the global one,
+// the ones of the rules and the ones set by mark=MARK on the first hop of the chains.
+func autoRouteMarks() []int {
+	m := map[int]bool{conf.Mark: true}
+	for _, r := range conf.rules {
+		m[r.Mark] = true
+	}
+
+	for _, chain := range autoRouteChains() {
+		u, err := url.Parse(strings.Split(chain, ",")[0])
+		if err != nil {
+			continue
+		}
+		if mark, err := strconv.Atoi(u.Query().Get("mark")); err == nil {
+			m[mark] = true
+		}
+	}
+
+	var marks []int
+	for mark := range m {
+		if mark != 0 {
+			marks = append(marks, mark)
+		}
+	}
+	sort.Ints(marks)
+	return marks
+}
+
+// autoRouteExcludes returns the ips of the servers connected directly(the first hop of the chains),
+// so the connections to them are never routed back to glider, even from the other hosts.
+func autoRouteExcludes() []net.IP {
+	seen := make(map[string]bool)
+	var ips []net.IP
+	for _, chain := range autoRouteChains() {
+		u, err := url.Parse(strings.Split(chain, ",")[0])
+		if err != nil || u.Hostname() == "" {
+			continue
+		}
+
+		host := u.Hostname()
+		addrs := []net.IP{net.ParseIP(host)}
+		if addrs[0] == nil {
+			if addrs, err = net.LookupIP(host); err != nil {
+				logf("auto-route: resolve %s error: %s", host, err)
+				continue
+			}
+		}
+
+		for _, ip := range addrs {
+			ip = normalizeIP(ip)
+			if !seen[ip.String()] {
+				seen[ip.String()] = true
+				ips = append(ips, ip)
+			}
+		}
+	}
+	return ips
+}
+
+// autoRouteChains returns the forwarder chains of the global forwarders, the rules and the listeners
+func autoRouteChains() []string {
+	chains := append([]string{}, conf.Forward...)
+	for _, r := range conf.rules {
+		for _, chain := range r.Forward {
+			if !strings.HasPrefix(chain, groupPrefix) {
+				chains = append(chains, chain)
+			}
+		}
+	}
+	if conf.ABForward != "" {
+		chains = append(chains, conf.ABForward)
+	}
+	for _, listen := range conf.Listen {
+		listen = strings.Split(listen, ",")[0]
+		if i := strings.IndexByte(listen, '?'); i > 0 {
+			for _, chain := range listenForwards(listen[i+1:]) {
+				if !strings.HasPrefix(chain, groupPrefix) {
+					chains = append(chains, chain)
+				}
+			}
+		}
+	}
+	return chains
+}
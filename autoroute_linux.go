@@ -0,0 +1,161 @@
+package main
+
+import (
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// the private and special destinations, never redirected
+var (
+	reservedCIDRs4 = []string{"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16", "172.16.0.0/12", "192.168.0.0/16", "224.0.0.0/4", "240.0.0.0/4"}
+	reservedCIDRs6 = []string{"::1/128", "fc00::/7", "fe80::/10", "ff00::/8"}
+)
+
+// setupRedirRules installs the rules redirecting the tcp connections, forwarded or from local,
+// to the redir listener on port, with nftables if nft exists, otherwise iptables and ip6tables.
+func setupRedirRules(port string) error {
+	autoRoute.Lock()
+	marks, excludes := autoRoute.marks, autoRoute.excludes
+	autoRoute.Unlock()
+
+	if _, err := exec.LookPath("nft"); err == nil {
+		logf("auto-route: redirect tcp to :%s with nftables, %d servers excluded", port, len(excludes))
+		return runRouteSteps(nftRedirSteps(port, marks, excludes))
+	}
+
+	var steps []routeStep
+	for _, bin := range []string{"iptables", "ip6tables"} {
+		if _, err := exec.LookPath(bin); err == nil {
+			steps = append(steps, iptablesRedirSteps(bin, port, marks, excludes)...)
+		}
+	}
+	logf("auto-route: redirect tcp to :%s with iptables, %d servers excluded", port, len(excludes))
+	return runRouteSteps(steps)
+}
+
+// nftRedirSteps returns the steps of table inet glider
+func nftRedirSteps(port string, marks []int, excludes []net.IP) []routeStep {
+	steps := []routeStep{
+		{add: []string{"nft", "add", "table", "inet", "glider"}, del: [][]string{{"nft", "delete", "table", "inet", "glider"}}},
+		{add: []string{"nft", "add", "chain", "inet", "glider", "prerouting", "{ type nat hook prerouting priority -100 ; }"}},
+		{add: []string{"nft", "add", "chain", "inet", "glider", "output", "{ type nat hook output priority -100 ; }"}},
+		{add: []string{"nft", "add", "chain", "inet", "glider", "redir"}},
+	}
+
+	rule := func(args ...string) {
+		steps = append(steps, routeStep{add: append([]string{"nft", "add", "rule", "inet", "glider", "redir"}, args...)})
+	}
+
+	rule("fib", "daddr", "type", "local", "return")
+	rule("ip", "daddr", "{ "+strings.Join(reservedCIDRs4, ", ")+" }", "return")
+	rule("ip6", "daddr", "{ "+strings.Join(reservedCIDRs6, ", ")+" }", "return")
+
+	var ips4, ips6 []string
+	for _, ip := range excludes {
+		if ip.To4() != nil {
+			ips4 = append(ips4, ip.String())
+		} else {
+			ips6 = append(ips6, ip.String())
+		}
+	}
+	if len(ips4) > 0 {
+		rule("ip", "daddr", "{ "+strings.Join(ips4, ", ")+" }", "return")
+	}
+	if len(ips6) > 0 {
+		rule("ip6", "daddr", "{ "+strings.Join(ips6, ", ")+" }", "return")
+	}
+
+	for _, mark := range marks {
+		rule("meta", "mark", strconv.Itoa(mark), "return")
+	}
+	rule("meta", "l4proto", "tcp", "redirect", "to", ":"+port)
+
+	for _, chain := range []string{"prerouting", "output"} {
+		steps = append(steps, routeStep{add: []string{"nft", "add", "rule", "inet", "glider", chain, "meta", "l4proto", "tcp", "jump", "redir"}})
+	}
+	return steps
+}
+
+// iptablesRedirSteps returns the steps of chain GLIDER in the nat table of bin, iptables or ip6tables
+func iptablesRedirSteps(bin, port string, marks []int, excludes []net.IP) []routeStep {
+	v6 := bin == "ip6tables"
+	nat := func(args ...string) []string { return append([]string{bin, "-t", "nat"}, args...) }
+
+	steps := []routeStep{{add: nat("-N", "GLIDER"), del: [][]string{nat("-F", "GLIDER"), nat("-X", "GLIDER")}}}
+	rule := func(args ...string) {
+		steps = append(steps, routeStep{add: nat(append([]string{"-A", "GLIDER"}, args...)...)})
+	}
+
+	rule("-m", "addrtype", "--dst-type", "LOCAL", "-j", "RETURN")
+
+	cidrs := append([]string{}, reservedCIDRs4...)
+	if v6 {
+		cidrs = append([]string{}, reservedCIDRs6...)
+	}
+	for _, ip := range excludes {
+		if (ip.To4() == nil) == v6 {
+			cidrs = append(cidrs, ip.String())
+		}
+	}
+	for _, cidr := range cidrs {
+		rule("-d", cidr, "-j", "RETURN")
+	}
+
+	for _, mark := range marks {
+		rule("-m", "mark", "--mark", strconv.Itoa(mark), "-j", "RETURN")
+	}
+	rule("-p", "tcp", "-j", "REDIRECT", "--to-ports", port)
+
+	for _, chain := range []string{"PREROUTING", "OUTPUT"} {
+		steps = append(steps, routeStep{
+			add: nat("-A", chain, "-p", "tcp", "-j", "GLIDER"),
+			del: [][]string{nat("-D", chain, "-p", "tcp", "-j", "GLIDER")},
+		})
+	}
+	return steps
+}
+
+// setupTunRoutes routes all the traffic to the tun device dev with policy routing, except the excluded
+// servers, the marked sockets and the more specific routes in the main table(e.g. the lan).
+func setupTunRoutes(dev string, v6 bool) error {
+	autoRoute.Lock()
+	marks, excludes := autoRoute.marks, autoRoute.excludes
+	autoRoute.Unlock()
+
+	families := []string{"-4"}
+	if v6 {
+		families = append(families, "-6")
+	}
+
+	table := strconv.Itoa(autoRouteTable)
+
+	var steps []routeStep
+	for _, f := range families {
+		ip := func(args ...string) []string { return append([]string{"ip", f}, args...) }
+		step := func(args ...string) {
+			steps = append(steps, routeStep{add: ip(append([]string{"rule", "add"}, args...)...),
+				del: [][]string{ip(append([]string{"rule", "del"}, args...)...)}})
+		}
+
+		steps = append(steps, routeStep{
+			add: ip("route", "replace", "default", "dev", dev, "table", table),
+			del: [][]string{ip("route", "del", "default", "dev", dev, "table", table)},
+		})
+
+		for _, addr := range excludes {
+			if (addr.To4() == nil) == (f == "-6") {
+				step("to", addr.String(), "lookup", "main", "priority", "9000")
+			}
+		}
+		for _, mark := range marks {
+			step("fwmark", strconv.Itoa(mark), "lookup", "main", "priority", "9001")
+		}
+		step("lookup", "main", "suppress_prefixlength", "0", "priority", "9002")
+		step("lookup", table, "priority", "9003")
+	}
+
+	logf("auto-route: route all to %s, %d servers excluded", dev, len(excludes))
+	return runRouteSteps(steps)
+}
@@ -0,0 +1,15 @@
+// +build !linux
+
+package main
+
+import "errors"
+
+// setupRedirRules .
+func setupRedirRules(port string) error {
+	return errors.New("auto route not supported on this os")
+}
+
+// setupTunRoutes .
+func setupTunRoutes(dev string, v6 bool) error {
+	return errors.New("auto route not supported on this os")
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// bittorrent policies
+const (
+	btAllow  = "allow"
+	btDeny   = "deny"
+	btDirect = "direct" // relay via the direct dialer instead of the forwarders
+)
+
+var errBitTorrent = newError(ErrRejected, "bittorrent traffic denied by policy")
+
+// isBitTorrent reports whether b, the first data sent by the client on tcp, is bittorrent:
+// the peer wire handshake or a http tracker request.
+func isBitTorrent(b []byte) bool {
+	if len(b) >= 20 && b[0] == 19 && string(b[1:20]) == "BitTorrent protocol" {
+		return true
+	}
+
+	line := b
+	if i := bytes.IndexByte(b, '\n'); i >= 0 {
+		line = b[:i]
+	}
+	return bytes.HasPrefix(line, []byte("GET /")) && bytes.Contains(line, []byte("info_hash="))
+}
+
+// udpTrackerMagic is the protocol id of the udp tracker connect request(BEP 15)
+const udpTrackerMagic = 0x41727101980
+
+// isBitTorrentUDP reports whether b, the first packet sent by the client on udp, is bittorrent:
+// a DHT query(BEP 5), a uTP SYN(BEP 29) or a udp tracker connect request(BEP 15).
+func isBitTorrentUDP(b []byte) bool {
+	// bencoded dictionary: d1:ad2:id20:... or d1:q4:ping...
+	if bytes.HasPrefix(b, []byte("d1:")) && (bytes.Contains(b, []byte("1:y1:q")) ||
+		bytes.Contains(b, []byte("1:y1:r")) || bytes.Contains(b, []byte("1:y1:e"))) {
+		return true
+	}
+
+	if isUTPSyn(b) {
+		return true
+	}
+
+	// protocol_id(8), action(4) 0: connect, transaction_id(4)
+	return len(b) >= 16 && binary.BigEndian.Uint64(b) == udpTrackerMagic && binary.BigEndian.Uint32(b[8:]) == 0
+}
+
+// isUTPSyn reports whether b is a uTP SYN: a bare 20 bytes header without extensions or payload,
+// type(4) ST_SYN | version(4) 1, extension(1) 0, connection_id(2), timestamp(4),
+// timestamp_difference(4) 0, wnd_size(4), seq_nr(2), ack_nr(2).
+// A dns query is only 20 bytes with a 2 letters name, then wnd_size is the label "\x02xy\x00",
+// more than 32M which is not a plausible window.
+func isUTPSyn(b []byte) bool {
+	if len(b) != 20 || b[0] != 0x41 || b[1] != 0 || binary.BigEndian.Uint32(b[8:]) != 0 {
+		return false
+	}
+
+	wnd := binary.BigEndian.Uint32(b[12:])
+	return wnd >= 1024 && wnd <= 16<<20
+}
+
+// btDialer enforces the bittorrent policy on the connections of a dialer,
+// the first data sent by the client is inspected.
+type btDialer struct {
+	Dialer
+	policy string
+	direct Dialer
+}
+
+// newBTDialer returns d with the bittorrent policy, d itself if bittorrent is allowed.
+func newBTDialer(d Dialer, policy string, direct Dialer) Dialer {
+	if policy == "" || policy == btAllow {
+		return d
+	}
+	return &btDialer{Dialer: d, policy: policy, direct: direct}
+}
+
+// Dial returns a connection which dials on the first write, so the policy is applied
+// before the forwarders are used. If the remote speaks first, it dials via the forwarders
+// after btWait, the dial error is returned by the first read or write.
+func (d *btDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialVia(network, addr, "")
+}
+
+// DialVia is Dial with the via chain passed on
+func (d *btDialer) DialVia(network, addr, via string) (net.Conn, error) {
+	return d.DialFrom(network, addr, via, nil)
+}
+
+// DialFrom is Dial with the via chain and the client src passed on
+func (d *btDialer) DialFrom(network, addr, via string, src net.IP) (net.Conn, error) {
+	return &btConn{d: d, network: network, addr: addr, via: via, src: src, ready: make(chan struct{})}, nil
+}
+
+// DialUDP connects to the given address.
+func (d *btDialer) DialUDP(network, addr string) (net.PacketConn, net.Addr, error) {
+	return d.DialUDPFrom(network, addr, nil)
+}
+
+// DialUDPFrom connects to the given address for the client src.
+func (d *btDialer) DialUDPFrom(network, addr string, src net.IP) (net.PacketConn, net.Addr, error) {
+	pc, writeTo, err := dialUDPFrom(d.Dialer, network, addr, src)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &btPacketConn{pc: pc, d: d, network: network, addr: addr, writeTo: writeTo}, writeTo, nil
+}
+
+// btWait is how long a read waits for the first write before dialing via the forwarders
+const btWait = 100 * time.Millisecond
+
+var errBTClosed = errors.New("use of closed bittorrent connection")
+
+// btConn dials on the first write, via the direct dialer if it's bittorrent
+type btConn struct {
+	mu     sync.Mutex
+	rc     net.Conn
+	err    error
+	dialed bool
+	ready  chan struct{} // closed after dialed
+
+	rd, wd time.Time // deadlines set before dialed
+
+	d       *btDialer
+	network string
+	addr    string
+	via     string
+	src     net.IP
+}
+
+// dial dials with d and applies the deadlines, the lock must be held
+func (c *btConn) dial(d Dialer) {
+	c.dialed = true
+	c.rc, c.err = dialFrom(d, c.network, c.addr, c.via, c.src)
+	if c.err == nil {
+		if !c.rd.IsZero() {
+			c.rc.SetReadDeadline(c.rd)
+		}
+		if !c.wd.IsZero() {
+			c.rc.SetWriteDeadline(c.wd)
+		}
+	}
+	close(c.ready)
+}
+
+// fail marks the connection as failed with err without dialing, the lock must be held
+func (c *btConn) fail(err error) {
+	c.dialed = true
+	c.err = err
+	close(c.ready)
+}
+
+func (c *btConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	if !c.dialed {
+		d := c.d.Dialer
+		if isBitTorrent(b) {
+			if c.d.policy == btDeny {
+				logf("proxy-bittorrent %s denied", c.addr)
+				c.fail(errBitTorrent)
+				c.mu.Unlock()
+				return 0, errBitTorrent
+			}
+			logf("proxy-bittorrent %s via direct", c.addr)
+			d = c.d.direct
+		}
+		c.dial(d)
+	}
+	rc, err := c.rc, c.err
+	c.mu.Unlock()
+
+	if err != nil {
+		return 0, err
+	}
+	return rc.Write(b)
+}
+
+// Read waits for the first write for btWait, then dials via the forwarders for the remote speaking first.
+func (c *btConn) Read(b []byte) (int, error) {
+	select {
+	case <-c.ready:
+	case <-time.After(btWait):
+		c.mu.Lock()
+		if !c.dialed {
+			c.dial(c.d.Dialer)
+		}
+		c.mu.Unlock()
+	}
+
+	c.mu.Lock()
+	rc, err := c.rc, c.err
+	c.mu.Unlock()
+
+	if err != nil {
+		return 0, err
+	}
+	return rc.Read(b)
+}
+
+func (c *btConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.dialed {
+		c.fail(errBTClosed)
+		return nil
+	}
+	if c.rc != nil {
+		return c.rc.Close()
+	}
+	return nil
+}
+
+func (c *btConn) conn() net.Conn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.rc
+}
+
+// LocalAddr returns nil before dialed
+func (c *btConn) LocalAddr() net.Addr {
+	if rc := c.conn(); rc != nil {
+		return rc.LocalAddr()
+	}
+	return nil
+}
+
+// RemoteAddr returns nil before dialed
+func (c *btConn) RemoteAddr() net.Addr {
+	if rc := c.conn(); rc != nil {
+		return rc.RemoteAddr()
+	}
+	return nil
+}
+
+func (c *btConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+func (c *btConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rd = t
+	if c.rc != nil {
+		return c.rc.SetReadDeadline(t)
+	}
+	return nil
+}
+
+func (c *btConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.wd = t
+	if c.rc != nil {
+		return c.rc.SetWriteDeadline(t)
+	}
+	return nil
+}
+
+// btPacketConn checks the first packet and switches to the direct packet conn if needed
+type btPacketConn struct {
+	mu      sync.Mutex
+	pc      net.PacketConn
+	checked bool
+
+	d       *btDialer
+	network string
+	addr    string
+	writeTo net.Addr // the address to write to of the original packet conn
+	direct  net.Addr // the address to write to of the direct packet conn
+
+	rd, wd time.Time // deadlines to apply to the direct packet conn
+}
+
+func (c *btPacketConn) conn() net.PacketConn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.pc
+}
+
+func (c *btPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	if !c.checked {
+		c.checked = true
+		if isBitTorrentUDP(b) {
+			if err := c.apply(); err != nil {
+				c.mu.Unlock()
+				return 0, err
+			}
+		}
+	}
+	pc, direct := c.pc, c.direct
+	c.mu.Unlock()
+
+	if direct != nil && addr.String() == c.writeTo.String() {
+		addr = direct
+	}
+
+	return pc.WriteTo(b, addr)
+}
+
+// apply applies the policy, the lock must be held
+func (c *btPacketConn) apply() error {
+	if c.d.policy == btDeny {
+		logf("proxy-bittorrent udp %s denied", c.addr)
+		c.pc.Close()
+		return errBitTorrent
+	}
+
+	pc, writeTo, err := c.d.direct.DialUDP(c.network, c.addr)
+	if err != nil {
+		c.pc.Close()
+		return err
+	}
+
+	if !c.rd.IsZero() {
+		pc.SetReadDeadline(c.rd)
+	}
+	if !c.wd.IsZero() {
+		pc.SetWriteDeadline(c.wd)
+	}
+
+	logf("proxy-bittorrent udp %s switched to direct", c.addr)
+	c.pc.Close()
+	c.pc, c.direct = pc, writeTo
+	return nil
+}
+
+// ReadFrom reads from the current packet conn, retries if it's switched while reading.
+func (c *btPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	pc := c.conn()
+	n, addr, err := pc.ReadFrom(b)
+	if err != nil {
+		if cur := c.conn(); cur != pc {
+			return cur.ReadFrom(b)
+		}
+	}
+	return n, addr, err
+}
+
+func (c *btPacketConn) Close() error        { return c.conn().Close() }
+func (c *btPacketConn) LocalAddr() net.Addr { return c.conn().LocalAddr() }
+
+func (c *btPacketConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+func (c *btPacketConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rd = t
+	return c.pc.SetReadDeadline(t)
+}
+
+func (c *btPacketConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.wd = t
+	return c.pc.SetWriteDeadline(t)
+}
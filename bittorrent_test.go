@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestIsBitTorrent(t *testing.T) {
+	tests := []struct {
+		name string
+		b    string
+		want bool
+	}{
+		{"handshake", "\x13BitTorrent protocol\x00\x00\x00\x00\x00\x10\x00\x05", true},
+		{"tracker", "GET /announce?info_hash=%12%34&peer_id=-qB4250-&port=6881 HTTP/1.1\r\nHost: t\r\n", true},
+		{"http", "GET /index.html HTTP/1.1\r\nHost: example.com\r\n\r\n", false},
+		{"info_hash in header", "GET / HTTP/1.1\r\nReferer: /?info_hash=1\r\n\r\n", false},
+		{"tls", "\x16\x03\x01\x02\x00\x01\x00\x01\xfc\x03\x03", false},
+		{"short", "\x13BitTorrent", false},
+	}
+
+	for _, tt := range tests {
+		if got := isBitTorrent([]byte(tt.b)); got != tt.want {
+			t.Errorf("%s: isBitTorrent = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestIsBitTorrentUDP(t *testing.T) {
+	utp := make([]byte, 20)
+	utp[0], utp[1] = 0x41, 0
+	binary.BigEndian.PutUint16(utp[2:], 0x1234)
+	binary.BigEndian.PutUint32(utp[4:], 0x89abcdef)
+	binary.BigEndian.PutUint32(utp[12:], 1<<20)
+	binary.BigEndian.PutUint16(utp[16:], 1)
+
+	tracker := make([]byte, 16)
+	binary.BigEndian.PutUint64(tracker, udpTrackerMagic)
+	binary.BigEndian.PutUint32(tracker[12:], 0xdeadbeef)
+
+	// dns query with id 0x4100 and no EDNS: nscount and arcount are 0 as timestamp_difference of uTP
+	dns := []byte{0x41, 0x00, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0, 2, 'x', 'y', 0, 0, 1, 0, 1}
+	dnsLong := append([]byte{0x41, 0x02, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0}, "\x07example\x03com\x00\x00\x01\x00\x01"...)
+
+	tests := []struct {
+		name string
+		b    []byte
+		want bool
+	}{
+		{"dht query", []byte("d1:ad2:id20:abcdefghij0123456789e1:q4:ping1:t2:aa1:y1:qe"), true},
+		{"dht response", []byte("d1:rd2:id20:abcdefghij0123456789e1:t2:aa1:y1:re"), true},
+		{"utp syn", utp, true},
+		{"udp tracker", tracker, true},
+		{"dns 20 bytes", dns, false},
+		{"dns", dnsLong, false},
+		{"quic", []byte{0xc3, 0, 0, 0, 1, 8, 1, 2, 3, 4, 5, 6, 7, 8, 0, 0, 0, 0, 0, 0, 0}, false},
+		{"bencode", []byte("d1:ai1ee"), false},
+	}
+
+	for _, tt := range tests {
+		if got := isBitTorrentUDP(tt.b); got != tt.want {
+			t.Errorf("%s: isBitTorrentUDP = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// pipeDialer counts the dials and returns one end of a pipe, the other end is sent to peers
+type pipeDialer struct {
+	Dialer
+	dials int
+	peers chan net.Conn
+}
+
+func (d *pipeDialer) Dial(network, addr string) (net.Conn, error) {
+	d.dials++
+	c1, c2 := net.Pipe()
+	d.peers <- c2
+	return c1, nil
+}
+
+func TestBTConn(t *testing.T) {
+	handshake := []byte("\x13BitTorrent protocol\x00\x00\x00\x00\x00\x10\x00\x05")
+
+	fwd := &pipeDialer{peers: make(chan net.Conn, 1)}
+	direct := &pipeDialer{peers: make(chan net.Conn, 1)}
+
+	// deny: nothing is dialed
+	c, _ := newBTDialer(fwd, btDeny, direct).Dial("tcp", "example.com:6881")
+	if _, err := c.Write(handshake); err != errBitTorrent {
+		t.Fatalf("deny: err = %v, want %v", err, errBitTorrent)
+	}
+	if _, err := c.Read(make([]byte, 1)); err != errBitTorrent {
+		t.Fatalf("deny: read err = %v, want %v", err, errBitTorrent)
+	}
+	if fwd.dials != 0 || direct.dials != 0 {
+		t.Fatalf("deny: dialed %d forwarders and %d direct", fwd.dials, direct.dials)
+	}
+
+	// direct: only the direct dialer is used, and the deadline set before is applied
+	c, _ = newBTDialer(fwd, btDirect, direct).Dial("tcp", "example.com:6881")
+	c.SetReadDeadline(time.Now().Add(-time.Second))
+	go c.Write(handshake)
+	peer := <-direct.peers
+	peer.Read(make([]byte, len(handshake)))
+	if _, err := c.Read(make([]byte, 1)); err == nil {
+		t.Fatal("direct: the read deadline is lost")
+	}
+	if fwd.dials != 0 || direct.dials != 1 {
+		t.Fatalf("direct: dialed %d forwarders and %d direct", fwd.dials, direct.dials)
+	}
+	c.Close()
+
+	// remote speaks first: dials via the forwarders after btWait
+	c, _ = newBTDialer(fwd, btDirect, direct).Dial("tcp", "example.com:25")
+	go func() {
+		peer := <-fwd.peers
+		peer.Write([]byte("220"))
+	}()
+	b := make([]byte, 3)
+	if _, err := c.Read(b); err != nil || string(b) != "220" {
+		t.Fatalf("server first: read %q, %v", b, err)
+	}
+	if fwd.dials != 1 {
+		t.Fatalf("server first: dialed %d forwarders", fwd.dials)
+	}
+	c.Close()
+}
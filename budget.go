@@ -0,0 +1,283 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// budget limits the resources of a listener, so one tenant's port can't starve others on a shared instance:
+//
+//	maxconns=100   max concurrent tcp connections
+//	maxudp=50      max concurrent udp sessions
+//	maxbw=1024     max bandwidth in KB/s, both directions of all the connections and udp sessions
+type budget struct {
+	addr string
+
+	maxConns int64
+	maxUDP   int64
+	bw       *rateLimiter
+
+	conns    int64 // atomic
+	udp      int64 // atomic
+	rejected int64 // atomic
+}
+
+// budgets stores the budgets of listeners, listen addr -> *budget
+var budgets sync.Map
+
+func init() {
+	apiMux.HandleFunc("/stats/budgets", handleBudgets)
+}
+
+// newBudget returns the budget according to the params in rawQuery, 0 means unlimited.
+// every listener has a budget, so the usage can be inspected even without limits.
+func newBudget(addr, rawQuery string) (*budget, error) {
+	p, _ := url.ParseQuery(rawQuery)
+
+	var limits [3]int
+	for i, k := range []string{"maxconns", "maxudp", "maxbw"} {
+		v := p.Get(k)
+		if v == "" {
+			continue
+		}
+
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return nil, errors.New("invalid " + k + " '" + v + "'")
+		}
+		limits[i] = n
+	}
+
+	b := &budget{addr: addr, maxConns: int64(limits[0]), maxUDP: int64(limits[1])}
+	if limits[2] > 0 {
+		b.bw = newRateLimiter(limits[2] * 1024)
+	}
+
+	return b, nil
+}
+
+// setBudget registers the budget of the listener on addr
+func setBudget(addr string, b *budget) {
+	if b != nil {
+		budgets.Store(addr, b)
+	}
+}
+
+// budgetOf returns the budget of the listener on addr, nil means unlimited
+func budgetOf(addr string) *budget {
+	if v, ok := budgets.Load(addr); ok {
+		return v.(*budget)
+	}
+	return nil
+}
+
+// rangeBudgets calls f for each budget once, the ports of a range listener share the same budget.
+func rangeBudgets(f func(b *budget)) {
+	seen := make(map[*budget]bool)
+	budgets.Range(func(k, v interface{}) bool {
+		if b := v.(*budget); !seen[b] {
+			seen[b] = true
+			f(b)
+		}
+		return true
+	})
+}
+
+// acquireConn reserves a tcp connection, reports whether it's within the budget and the memory ceiling.
+func (b *budget) acquireConn() bool {
+	if !memAcquire(connMem) {
+		b.reject()
+		return false
+	}
+
+	if b != nil && !b.acquire(&b.conns, b.maxConns) {
+		memRelease(connMem)
+		return false
+	}
+	return true
+}
+
+// releaseConn releases a tcp connection reserved by acquireConn
+func (b *budget) releaseConn() {
+	memRelease(connMem)
+	if b != nil {
+		atomic.AddInt64(&b.conns, -1)
+	}
+}
+
+// acquireUDP reserves a udp session, reports whether it's within the budget and the memory ceiling.
+func (b *budget) acquireUDP() bool {
+	if !memAcquire(udpMem) {
+		b.reject()
+		return false
+	}
+
+	if b != nil && !b.acquire(&b.udp, b.maxUDP) {
+		memRelease(udpMem)
+		return false
+	}
+	return true
+}
+
+// releaseUDP releases a udp session reserved by acquireUDP
+func (b *budget) releaseUDP() {
+	memRelease(udpMem)
+	if b != nil {
+		atomic.AddInt64(&b.udp, -1)
+	}
+}
+
+func (b *budget) acquire(n *int64, max int64) bool {
+	if atomic.AddInt64(n, 1) > max && max > 0 {
+		atomic.AddInt64(n, -1)
+		b.reject()
+		return false
+	}
+
+	return true
+}
+
+// reject counts a rejected connection or udp session
+func (b *budget) reject() {
+	if b != nil {
+		atomic.AddInt64(&b.rejected, 1)
+	}
+}
+
+// limit returns c with the bandwidth limit of the budget
+func (b *budget) limit(c net.Conn) net.Conn {
+	if b == nil || b.bw == nil {
+		return c
+	}
+
+	if c, ok := c.(*net.TCPConn); ok {
+		c.SetKeepAlive(true)
+	}
+
+	return &limitConn{Conn: c, bw: b.bw}
+}
+
+// limitPacket returns pc with the bandwidth limit of the budget
+func (b *budget) limitPacket(pc net.PacketConn) net.PacketConn {
+	if b == nil || b.bw == nil {
+		return pc
+	}
+	return &limitPacketConn{PacketConn: pc, bw: b.bw}
+}
+
+type limitConn struct {
+	net.Conn
+	bw *rateLimiter
+}
+
+func (c *limitConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.bw.wait(n)
+	return n, err
+}
+
+func (c *limitConn) Write(b []byte) (int, error) {
+	c.bw.wait(len(b))
+	return c.Conn.Write(b)
+}
+
+type limitPacketConn struct {
+	net.PacketConn
+	bw *rateLimiter
+}
+
+func (pc *limitPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := pc.PacketConn.ReadFrom(b)
+	pc.bw.wait(n)
+	return n, addr, err
+}
+
+func (pc *limitPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	pc.bw.wait(len(b))
+	return pc.PacketConn.WriteTo(b, addr)
+}
+
+// handleBudgets serves the resource usage of listeners: /stats/budgets
+func handleBudgets(w http.ResponseWriter, r *http.Request) {
+	type usage struct {
+		Listen   string `json:"listen"`
+		Conns    int64  `json:"conns"`
+		MaxConns int64  `json:"maxconns,omitempty"`
+		UDP      int64  `json:"udp"`
+		MaxUDP   int64  `json:"maxudp,omitempty"`
+		Rejected int64  `json:"rejected"`
+	}
+
+	list := []usage{}
+	rangeBudgets(func(b *budget) {
+		list = append(list, usage{
+			Listen:   b.addr,
+			Conns:    atomic.LoadInt64(&b.conns),
+			MaxConns: b.maxConns,
+			UDP:      atomic.LoadInt64(&b.udp),
+			MaxUDP:   b.maxUDP,
+			Rejected: atomic.LoadInt64(&b.rejected),
+		})
+	})
+
+	writeJSON(w, list)
+}
+
+// rateLimiter is a simple token bucket, refilled rate tokens per second
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate int) *rateLimiter {
+	return &rateLimiter{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+// refill adds the tokens since the last call, at most 1 second of burst
+func (l *rateLimiter) refill() {
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+}
+
+// allow reports whether a packet can be sent now
+func (l *rateLimiter) allow() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.refill()
+	if l.tokens < 1 {
+		return false
+	}
+
+	l.tokens--
+	return true
+}
+
+// wait takes n tokens, blocks until the debt is paid off
+func (l *rateLimiter) wait(n int) {
+	if n <= 0 {
+		return
+	}
+
+	l.mu.Lock()
+	l.refill()
+	l.tokens -= float64(n)
+	debt := -l.tokens
+	l.mu.Unlock()
+
+	if debt > 0 {
+		time.Sleep(time.Duration(debt / l.rate * float64(time.Second)))
+	}
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// clashConf is the part of the Clash config converted by -import
+type clashConf struct {
+	Port      int  `yaml:"port"`
+	SocksPort int  `yaml:"socks-port"`
+	MixedPort int  `yaml:"mixed-port"`
+	RedirPort int  `yaml:"redir-port"`
+	AllowLAN  bool `yaml:"allow-lan"`
+
+	Proxies     []clashProxy `yaml:"proxies"`
+	ProxyGroups []clashGroup `yaml:"proxy-groups"`
+	Rules       []string     `yaml:"rules"`
+}
+
+// clashProxy is a proxy of Clash, the fields of all the types
+type clashProxy struct {
+	Name   string `yaml:"name"`
+	Type   string `yaml:"type"`
+	Server string `yaml:"server"`
+	Port   string `yaml:"port"`
+
+	Cipher   string `yaml:"cipher"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	UUID     string `yaml:"uuid"`
+	AlterID  int    `yaml:"alterId"`
+
+	TLS            bool     `yaml:"tls"`
+	SNI            string   `yaml:"sni"`
+	ServerName     string   `yaml:"servername"`
+	SkipCertVerify bool     `yaml:"skip-cert-verify"`
+	ALPN           []string `yaml:"alpn"`
+
+	Network string `yaml:"network"`
+	WSOpts  struct {
+		Path    string            `yaml:"path"`
+		Headers map[string]string `yaml:"headers"`
+	} `yaml:"ws-opts"`
+	GRPCOpts struct {
+		ServiceName string `yaml:"grpc-service-name"`
+	} `yaml:"grpc-opts"`
+
+	Plugin     string            `yaml:"plugin"`
+	PluginOpts map[string]string `yaml:"plugin-opts"`
+
+	Obfs         string `yaml:"obfs"`
+	ObfsPassword string `yaml:"obfs-password"`
+	Down         string `yaml:"down"`
+	UDPRelayMode string `yaml:"udp-relay-mode"`
+}
+
+// clashGroup is a proxy group of Clash
+type clashGroup struct {
+	Name      string   `yaml:"name"`
+	Type      string   `yaml:"type"`
+	Proxies   []string `yaml:"proxies"`
+	URL       string   `yaml:"url"`
+	Interval  int      `yaml:"interval"`
+	Tolerance int      `yaml:"tolerance"`
+	Strategy  string   `yaml:"strategy"`
+}
+
+// clash converts the Clash config: the ports to listeners, the proxies to forwarders,
+// the targets of the rules to glider rules, and the target of MATCH to the global forwarders.
+func (im *importer) clash(b []byte) error {
+	var c clashConf
+	if err := yaml.Unmarshal(b, &c); err != nil {
+		return errors.New("parse clash config error: " + err.Error())
+	}
+
+	for _, l := range []struct {
+		scheme string
+		port   int
+	}{{"mixed", c.MixedPort}, {"http", c.Port}, {"socks5", c.SocksPort}, {"redir", c.RedirPort}} {
+		if l.port != 0 {
+			im.y.Listen = append(im.y.Listen, listenAddr(l.scheme, l.port, c.AllowLAN))
+		}
+	}
+
+	proxies := make(map[string]string)
+	for _, p := range c.Proxies {
+		u, err := clashProxyURL(&p)
+		if err != nil {
+			im.warn("proxy %s skipped: %s", p.Name, err)
+			continue
+		}
+		proxies[p.Name] = u
+	}
+
+	groups := make(map[string]*clashGroup)
+	for i := range c.ProxyGroups {
+		groups[c.ProxyGroups[i].Name] = &c.ProxyGroups[i]
+	}
+
+	cv := &clashConverter{im: im, proxies: proxies, groups: groups}
+	for _, s := range c.Rules {
+		f := strings.Split(s, ",")
+		for i := range f {
+			f[i] = strings.TrimSpace(f[i])
+		}
+
+		kind := strings.ToUpper(f[0])
+		if kind == "MATCH" || kind == "FINAL" {
+			if len(f) < 2 {
+				return errors.New("clash rule: invalid '" + s + "'")
+			}
+			if forward, strategy, ok := cv.target(f[1]); ok {
+				im.y.Forward, im.y.Strategy = forward, strategy
+			}
+			continue
+		}
+
+		if len(f) < 3 {
+			return errors.New("clash rule: invalid '" + s + "'")
+		}
+
+		switch kind {
+		case "DOMAIN", "DOMAIN-SUFFIX", "IP-CIDR", "IP-CIDR6":
+		default:
+			im.skipped[kind+" rules"]++
+			continue
+		}
+
+		forward, strategy, ok := cv.target(f[2])
+		if !ok {
+			continue
+		}
+		addDest(im.rule(f[2], forward, strategy), strings.TrimPrefix(f[1], "."))
+	}
+
+	return nil
+}
+
+// clashConverter converts the targets of the rules
+type clashConverter struct {
+	im      *importer
+	proxies map[string]string
+	groups  map[string]*clashGroup
+	unknown map[string]bool
+}
+
+// target returns the forwarders and the strategy of a proxy, a group, DIRECT or REJECT
+func (cv *clashConverter) target(name string) ([]string, yamlStrategy, bool) {
+	switch name {
+	case "DIRECT":
+		return nil, yamlStrategy{}, true
+	case "REJECT", "REJECT-DROP":
+		return []string{"reject://"}, yamlStrategy{}, true
+	}
+
+	if u, ok := cv.proxies[name]; ok {
+		return []string{u}, yamlStrategy{}, true
+	}
+
+	g, ok := cv.groups[name]
+	if !ok {
+		if cv.unknown == nil {
+			cv.unknown = make(map[string]bool)
+		}
+		if !cv.unknown[name] {
+			cv.unknown[name] = true
+			cv.im.warn("rules to %s skipped: no such proxy or group, or it's skipped", name)
+		}
+		return nil, yamlStrategy{}, false
+	}
+
+	forward := cv.flatten(g, map[string]bool{})
+	if len(forward) == 0 {
+		return nil, yamlStrategy{}, true
+	}
+
+	// the strategies of glider check the forwarders by themselves, the first available one is used
+	// like select and fallback, the fastest one like url-test, and load-balance hashes the
+	// destination(consistent-hashing) or the client(sticky-sessions) unless it's round-robin.
+	s := yamlStrategy{Strategy: "ha", CheckWebSite: checkWebSite(g.URL), CheckDuration: g.Interval}
+	switch g.Type {
+	case "load-balance":
+		switch g.Strategy {
+		case "round-robin":
+			s.Strategy = "rr"
+		case "sticky-sessions":
+			s.Strategy = "sh"
+		default:
+			s.Strategy = "dh"
+		}
+	case "url-test":
+		s.Strategy, s.Tolerance = "lha", g.Tolerance
+	}
+	return forward, s, true
+}
+
+// flatten returns the forwarders of group g and its nested groups in order
+func (cv *clashConverter) flatten(g *clashGroup, seen map[string]bool) []string {
+	seen[g.Name] = true
+
+	var forward []string
+	for _, name := range g.Proxies {
+		if u, ok := cv.proxies[name]; ok {
+			forward = append(forward, u)
+		} else if sub, ok := cv.groups[name]; ok && !seen[name] {
+			forward = append(forward, cv.flatten(sub, seen)...)
+		} else if name == "DIRECT" && len(g.Proxies) > 1 {
+			cv.im.warn("DIRECT in group %s skipped, glider has no direct forwarder", g.Name)
+		}
+	}
+	return forward
+}
+
+// clashProxyURL returns the forwarder url(chain) of a clash proxy
+func clashProxyURL(p *clashProxy) (string, error) {
+	sni := p.SNI
+	if sni == "" {
+		sni = p.ServerName
+	}
+
+	switch p.Type {
+	case "ss":
+		q := url.Values{}
+		if p.Plugin != "" {
+			plugin, err := clashPlugin(p.Plugin, p.PluginOpts)
+			if err != nil {
+				return "", err
+			}
+			q.Set("plugin", plugin)
+		}
+		return proxyURL("ss", p.Cipher, p.Password, p.Server, p.Port, "", q), nil
+
+	case "socks5", "http":
+		u := proxyURL(p.Type, p.Username, p.Password, p.Server, p.Port, "", nil)
+		if !p.TLS {
+			return u, nil
+		}
+		if p.Type == "http" {
+			return proxyURL("https", p.Username, p.Password, p.Server, p.Port, "", tlsQuery(sni, p.SkipCertVerify)), nil
+		}
+		return proxyURL("tls", "", "", p.Server, p.Port, "", tlsQuery(sni, p.SkipCertVerify)) + "," + u, nil
+
+	case "trojan":
+		if p.Network != "" && p.Network != "tcp" {
+			return "", errors.New("trojan over " + p.Network + " not supported")
+		}
+		return proxyURL("trojan", p.Password, "", p.Server, p.Port, "", tlsQuery(sni, p.SkipCertVerify)), nil
+
+	case "vmess":
+		if p.AlterID != 0 {
+			return "", errors.New("alterId must be 0, only the aead header is supported")
+		}
+
+		q := url.Values{}
+		switch p.Cipher {
+		case "", "auto", "aes-128-gcm", "chacha20-poly1305", "none":
+			if p.Cipher != "" {
+				q.Set("security", p.Cipher)
+			}
+		default:
+			return "", errors.New("cipher " + p.Cipher + " not supported")
+		}
+		u := proxyURL("vmess", p.UUID, "", p.Server, p.Port, "", q)
+
+		return clashTransport(p, sni, u)
+
+	case "hysteria2":
+		q := tlsQuery(sni, p.SkipCertVerify)
+		if p.Obfs != "" {
+			q.Set("obfs", p.Obfs)
+			q.Set("obfs-password", p.ObfsPassword)
+		}
+		// e.g. "100 Mbps"
+		if down := strings.TrimSpace(strings.TrimRight(p.Down, "MmBbPpSs ")); down != "" {
+			if _, err := strconv.Atoi(down); err == nil {
+				q.Set("down", down)
+			}
+		}
+		return proxyURL("hysteria2", p.Password, "", p.Server, p.Port, "", q), nil
+
+	case "tuic":
+		q := tlsQuery(sni, p.SkipCertVerify)
+		if p.UDPRelayMode != "" {
+			q.Set("udp_relay_mode", p.UDPRelayMode)
+		}
+		for _, alpn := range p.ALPN {
+			q.Add("alpn", alpn)
+		}
+		return proxyURL("tuic", p.UUID, p.Password, p.Server, p.Port, "", q), nil
+	}
+
+	return "", errors.New("type " + p.Type + " not supported")
+}
+
+// clashTransport returns the chain of the transport(tls, ws or grpc) of p and the proxy u
+func clashTransport(p *clashProxy, sni, u string) (string, error) {
+	q := tlsQuery(sni, p.SkipCertVerify)
+	switch p.Network {
+	case "", "tcp":
+		if !p.TLS {
+			return u, nil
+		}
+		return proxyURL("tls", "", "", p.Server, p.Port, "", q) + "," + u, nil
+
+	case "ws":
+		if host := p.WSOpts.Headers["Host"]; host != "" {
+			q.Set("host", host)
+		}
+		scheme := "ws"
+		if p.TLS {
+			scheme = "wss"
+		}
+		return proxyURL(scheme, "", "", p.Server, p.Port, p.WSOpts.Path, q) + "," + u, nil
+
+	case "grpc":
+		return proxyURL("grpc", "", "", p.Server, p.Port, "/"+p.GRPCOpts.ServiceName, q) + "," + u, nil
+	}
+
+	return "", errors.New("network " + p.Network + " not supported")
+}
+
+// clashPlugin returns the SIP003 plugin "PATH;OPTIONS" of the obfs and v2ray-plugin plugins of clash
+func clashPlugin(plugin string, opts map[string]string) (string, error) {
+	switch plugin {
+	case "obfs":
+		s := "obfs-local;obfs=" + opts["mode"]
+		if opts["host"] != "" {
+			s += ";obfs-host=" + opts["host"]
+		}
+		return s, nil
+
+	case "v2ray-plugin":
+		s := "v2ray-plugin"
+		if opts["mode"] != "" && opts["mode"] != "websocket" {
+			s += ";mode=" + opts["mode"]
+		}
+		if opts["tls"] == "true" {
+			s += ";tls"
+		}
+		for _, k := range []string{"host", "path"} {
+			if opts[k] != "" {
+				s += fmt.Sprintf(";%s=%s", k, opts[k])
+			}
+		}
+		return s, nil
+	}
+
+	return "", errors.New("plugin " + plugin + " not supported")
+}
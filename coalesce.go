@@ -0,0 +1,165 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// coalesce=MS on a forwarder batches the small writes to it for up to MS milliseconds, like Nagle,
+// so the chatty protocols(e.g. ssh) don't send an encrypted record(ss, vmess, trojan, tls...) for
+// every few bytes, coalescesize=BYTES(1400 by default) is the size to send at once.
+const defaultCoalesceSize = 1400
+
+// coalesceDialer batches the small writes of the connections of a forwarder
+type coalesceDialer struct {
+	Dialer
+	delay time.Duration
+	size  int
+}
+
+// newCoalesceDialer returns d with the write coalescing of coalesce=MS in p, d itself if not set
+func newCoalesceDialer(d Dialer, p url.Values) (Dialer, error) {
+	v := p.Get("coalesce")
+	if v == "" {
+		return d, nil
+	}
+
+	ms, err := strconv.Atoi(v)
+	if err != nil || ms < 0 || ms > 1000 {
+		return nil, errors.New("invalid coalesce '" + v + "', 0-1000 milliseconds")
+	}
+	if ms == 0 {
+		return d, nil
+	}
+
+	size := defaultCoalesceSize
+	if v := p.Get("coalescesize"); v != "" {
+		if size, err = strconv.Atoi(v); err != nil || size < 1 || size > 65535 {
+			return nil, errors.New("invalid coalescesize '" + v + "'")
+		}
+	}
+
+	return &coalesceDialer{Dialer: d, delay: time.Duration(ms) * time.Millisecond, size: size}, nil
+}
+
+// Dial connects to addr via the forwarder, the writes are coalesced
+func (d *coalesceDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialVia(network, addr, "")
+}
+
+// DialVia is Dial with the via chain passed on
+func (d *coalesceDialer) DialVia(network, addr, via string) (net.Conn, error) {
+	c, err := dialVia(d.Dialer, network, addr, via)
+	if err != nil {
+		return c, err
+	}
+	return &coalesceConn{Conn: c, delay: d.delay, size: d.size, lock: make(chan struct{}, 1)}, nil
+}
+
+// unwrapDialer returns the forwarder of d if it's wrapped by the write coalescing
+func unwrapDialer(d Dialer) Dialer {
+	if cd, ok := d.(*coalesceDialer); ok {
+		return cd.Dialer
+	}
+	return d
+}
+
+// coalesceConn buffers the writes smaller than size for up to delay, the buffered bytes are sent
+// with the next write reaching size, by the timer, or before the deadlines are changed and closed.
+// The error of a flush by the timer or sync is returned by the next write.
+type coalesceConn struct {
+	net.Conn
+	delay time.Duration
+	size  int
+
+	// held while writing, a channel so the deadlines can be changed without waiting for
+	// a blocked write, e.g. the relay wakes it up with a past deadline
+	lock  chan struct{}
+	buf   []byte
+	timer *time.Timer
+	err   error
+}
+
+func (c *coalesceConn) Write(b []byte) (int, error) {
+	c.lock <- struct{}{}
+	defer func() { <-c.lock }()
+
+	if c.err != nil {
+		return 0, c.err
+	}
+
+	if len(c.buf) == 0 && len(b) >= c.size {
+		return c.Conn.Write(b)
+	}
+
+	c.buf = append(c.buf, b...)
+	if len(c.buf) >= c.size {
+		if err := c.flush(); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+
+	if len(c.buf) == len(b) {
+		if c.timer == nil {
+			c.timer = time.AfterFunc(c.delay, c.onTimer)
+		} else {
+			c.timer.Reset(c.delay)
+		}
+	}
+	return len(b), nil
+}
+
+// onTimer sends the buffered bytes after delay
+func (c *coalesceConn) onTimer() {
+	c.lock <- struct{}{}
+	if c.err == nil {
+		c.err = c.flush()
+	}
+	<-c.lock
+}
+
+// flush sends the buffered bytes, the lock must be held
+func (c *coalesceConn) flush() error {
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	if len(c.buf) == 0 {
+		return nil
+	}
+
+	_, err := c.Conn.Write(c.buf)
+	c.buf = c.buf[:0]
+	return err
+}
+
+// sync sends the buffered bytes before the deadlines are changed and closed, so they are not lost
+// when the relay wakes up the other side with a past deadline. Nothing is buffered while writing.
+func (c *coalesceConn) sync() {
+	select {
+	case c.lock <- struct{}{}:
+		if c.err == nil {
+			c.err = c.flush()
+		}
+		<-c.lock
+	default:
+	}
+}
+
+func (c *coalesceConn) SetDeadline(t time.Time) error {
+	c.sync()
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *coalesceConn) SetWriteDeadline(t time.Time) error {
+	c.sync()
+	return c.Conn.SetWriteDeadline(t)
+}
+
+func (c *coalesceConn) Close() error {
+	c.sync()
+	return c.Conn.Close()
+}
@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"io"
 	"net"
+	"sync/atomic"
 	"time"
 )
 
@@ -28,29 +29,82 @@ func (c conn) Read(p []byte) (int, error) {
 	return c.r.Read(p)
 }
 
-func relay(left, right net.Conn) (int64, int64, error) {
+// relayStat is the traffic of a relay, the bytes are returned by the copies of both directions,
+// so they are counted the same whether copied with the buffers or spliced in the kernel.
+type relayStat struct {
+	Up       int64 // left to right
+	Down     int64 // right to left
+	Duration time.Duration
+}
+
+// relay copies between left and right until one direction ends, the error of the direction ended
+// first is returned if any, the other one is usually the timeout of the wake-up.
+func relay(left, right net.Conn) (relayStat, error) {
 	type res struct {
 		N   int64
 		Err error
 	}
 	ch := make(chan res)
+	start := time.Now()
 
+	var first int32 // 1: left to right ended first, 2: right to left, atomic
 	go func() {
 		n, err := io.Copy(right, left)
+		atomic.CompareAndSwapInt32(&first, 0, 1)
 		right.SetDeadline(time.Now()) // wake up the other goroutine blocking on right
 		left.SetDeadline(time.Now())  // wake up the other goroutine blocking on left
 		ch <- res{n, err}
 	}()
 
 	n, err := io.Copy(left, right)
+	atomic.CompareAndSwapInt32(&first, 0, 2)
 	right.SetDeadline(time.Now()) // wake up the other goroutine blocking on right
 	left.SetDeadline(time.Now())  // wake up the other goroutine blocking on left
 	rs := <-ch
 
-	if err == nil {
+	if err == nil || (atomic.LoadInt32(&first) == 1 && rs.Err != nil) {
 		err = rs.Err
 	}
-	return n, rs.N, err
+	return relayStat{Up: rs.N, Down: n, Duration: time.Since(start)}, err
+}
+
+// copyFirst copies the first read of r to w, then the rest from the underlying reader of r,
+// so r sees the first data and the rest can be copied by ReaderFrom/WriterTo of the conns,
+// e.g. splice between tcp conns on linux.
+func copyFirst(w io.Writer, r, underlying io.Reader) (int64, error) {
+	buf := make([]byte, 32<<10)
+	n, err := r.Read(buf)
+	if n > 0 {
+		if _, werr := w.Write(buf[:n]); werr != nil {
+			return 0, werr
+		}
+	}
+	if err == io.EOF {
+		return int64(n), nil
+	}
+	if err != nil {
+		return int64(n), err
+	}
+
+	written, err := io.Copy(w, underlying)
+	return int64(n) + written, err
+}
+
+// udpKey is the key of a udp client in the nat tables, built without formatting the address
+type udpKey struct {
+	ip   [net.IPv6len]byte
+	port int
+}
+
+// udpKeyOf returns the nat table key of the client address a
+func udpKeyOf(a net.Addr) interface{} {
+	if ua, ok := a.(*net.UDPAddr); ok {
+		var k udpKey
+		copy(k.ip[:], ua.IP.To16())
+		k.port = ua.Port
+		return k
+	}
+	return a.String()
 }
 
 // copy from src to dst at target with read timeout
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// groupPrefix is the prefix of the country groups in the forward list of rules, e.g. "group:us"
+const groupPrefix = "group:"
+
+// countryGroups are the global forwarders grouped by the country of their servers,
+// classified once at startup when a rule uses a group.
+var countryGroups struct {
+	once   sync.Once
+	groups map[string][]string // country -> forwarder chains
+	err    error
+}
+
+// expandGroups replaces the "group:CC" entries in forward with the global forwarders in country CC
+func expandGroups(forward []string) ([]string, error) {
+	var ret []string
+	for _, chain := range forward {
+		if !strings.HasPrefix(chain, groupPrefix) {
+			ret = append(ret, chain)
+			continue
+		}
+
+		countryGroups.once.Do(func() {
+			countryGroups.groups, countryGroups.err = classifyForwarders(conf.Forward, conf.Country)
+		})
+		if countryGroups.err != nil {
+			return nil, countryGroups.err
+		}
+
+		cc := strings.ToLower(strings.TrimPrefix(chain, groupPrefix))
+		chains := countryGroups.groups[cc]
+		if len(chains) == 0 {
+			return nil, errors.New("forward: no global forwarders in " + chain + ", or no list of the country(-country)")
+		}
+		ret = append(ret, chains...)
+	}
+	return ret, nil
+}
+
+// classifyForwarders groups the forwarder chains by the country of their exit servers(the last hop with
+// a host), the servers are resolved once, the country lists are the cidr lists of parseCountries.
+func classifyForwarders(forward, countries []string) (map[string][]string, error) {
+	lists, err := parseCountries(countries)
+	if err != nil {
+		return nil, err
+	}
+	if len(lists) == 0 {
+		return nil, errors.New("forward: no country lists for the groups, set them with -country")
+	}
+
+	cidrs := make(map[string][]*net.IPNet)
+	for cc, src := range lists {
+		b, err := loadCountryList(src)
+		if err != nil {
+			return nil, errors.New("country " + cc + ": " + err.Error())
+		}
+		cidrs[cc] = geoCIDRs(b)
+	}
+
+	// resolve the servers concurrently, as the forwarders are built
+	ips := make([]net.IP, len(forward))
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, buildWorkers)
+	for i, chain := range forward {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, chain string) {
+			defer func() { <-sem; wg.Done() }()
+			ips[i] = exitServerIP(chain)
+		}(i, chain)
+	}
+	wg.Wait()
+
+	groups := make(map[string][]string)
+	for i, chain := range forward {
+		ip := ips[i]
+		if ip == nil {
+			logf("forward group: %s is not grouped, its server is unknown", redactURL(chain))
+			continue
+		}
+
+		for cc, list := range cidrs {
+			for _, cidr := range list {
+				if cidr.Contains(ip) {
+					groups[cc] = append(groups[cc], chain)
+					break
+				}
+			}
+		}
+	}
+
+	var names []string
+	for cc := range lists {
+		names = append(names, cc)
+	}
+	sort.Strings(names)
+	for _, cc := range names {
+		logf("forward group:%s: %d forwarders", cc, len(groups[cc]))
+	}
+
+	return groups, nil
+}
+
+// exitServerIP returns the ip of the last server in chain, nil if unknown, e.g. tor
+func exitServerIP(chain string) net.IP {
+	urls := strings.Split(chain, ",")
+	for i := len(urls) - 1; i >= 0; i-- {
+		u, err := url.Parse(urls[i])
+		if err != nil || u.Hostname() == "" {
+			continue
+		}
+
+		host := u.Hostname()
+		if ip := net.ParseIP(host); ip != nil {
+			return normalizeIP(ip)
+		}
+
+		ips, err := net.LookupIP(host)
+		if err != nil || len(ips) == 0 {
+			logf("forward group: resolve %s error: %v", host, err)
+			return nil
+		}
+		return normalizeIP(ips[0])
+	}
+	return nil
+}
+
+// loadCountryList reads the cidr list from a local file or downloads it directly
+func loadCountryList(src string) ([]byte, error) {
+	if !strings.Contains(src, "://") {
+		return ioutil.ReadFile(src)
+	}
+
+	d := NewDirect(0, conf.Mark, conf.Interface, conf.SourceIP)
+	client := &http.Client{
+		Timeout: time.Minute,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return d.Dial(network, addr)
+			},
+		},
+	}
+	return httpGet(client, src)
+}
+
+// parseCountries parses the country lists "CC=URL|FILE" to country -> url or file
+func parseCountries(list []string) (map[string]string, error) {
+	countries := make(map[string]string)
+	for _, s := range list {
+		i := strings.Index(s, "=")
+		if i <= 0 || i == len(s)-1 || strings.ContainsAny(s[:i], ",: ") {
+			return nil, errors.New("country: invalid '" + s + "', format: CC=URL|FILE")
+		}
+		countries[strings.ToLower(s[:i])] = s[i+1:]
+	}
+	return countries, nil
+}
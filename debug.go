@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"runtime"
+	"runtime/pprof"
+	"sync/atomic"
+	"time"
+)
+
+// dumpState writes the goroutine stacks, the usage of listeners and the states of forwarders to the log,
+// for diagnosing hangs on headless routers, triggered by SIGUSR2.
+func dumpState() {
+	var b bytes.Buffer
+
+	fmt.Fprintf(&b, "=== state dump: %d goroutines ===\n", runtime.NumGoroutine())
+
+	b.WriteString("--- listeners ---\n")
+	rangeBudgets(func(bg *budget) {
+		fmt.Fprintf(&b, "%s: %d conns, %d udp sessions, %d rejected\n",
+			bg.addr, atomic.LoadInt64(&bg.conns), atomic.LoadInt64(&bg.udp), atomic.LoadInt64(&bg.rejected))
+	})
+
+	flows.Lock()
+	fmt.Fprintf(&b, "flows: %d active, %d reaped\n", len(flows.m), atomic.LoadInt64(&flows.reaped))
+	flows.Unlock()
+
+	b.WriteString("--- forwarders ---\n")
+	rrDialers.Lock()
+	for i, rr := range rrDialers.list {
+		for k, d := range rr.dialers {
+			state := "disabled"
+			if rr.enabled(k) {
+				state = "enabled"
+			}
+			if rr.pending(k) {
+				state += ", pending"
+			}
+			if isDraining(d.Addr()) {
+				state += ", draining"
+			}
+			if rr.weight[k] != defaultWeight || rr.priority[k] != 0 {
+				state += fmt.Sprintf(", weight %d, priority %d", rr.weight[k], rr.priority[k])
+			}
+			if rtt := atomic.LoadInt64(&rr.rtt[k]); rtt > 0 {
+				state += ", rtt " + time.Duration(rtt).String()
+			}
+			if k == rr.current() {
+				state += ", current"
+			}
+			fmt.Fprintf(&b, "strategy %d: %s %s\n", i, d.Addr(), state)
+		}
+	}
+	rrDialers.Unlock()
+
+	b.WriteString("--- goroutines ---\n")
+	pprof.Lookup("goroutine").WriteTo(&b, 2)
+
+	log.Print(b.String())
+}
@@ -4,6 +4,9 @@ import (
 	"errors"
 	"net"
 	"net/url"
+	"strconv"
+	"strings"
+	"sync"
 )
 
 // A Dialer means to establish a connection and relay it.
@@ -21,6 +24,103 @@ type Dialer interface {
 	NextDialer(dstAddr string) Dialer
 }
 
+// isUnreachable reports whether the forwarder works but the destination is unreachable via it,
+// e.g. the upstream proxy replies "host unreachable" or "connection refused".
+func isUnreachable(err error) bool {
+	return ErrorKind(err) == ErrUnreachable
+}
+
+// transportSchemes are the forwarders which only carry the next forwarder of a chain,
+// they connect to their own address and ignore the destination.
+var transportSchemes = map[string]bool{"ws": true, "wss": true, "tls": true, "grpc": true, "quic": true, "mux": true, "shadowtls": true}
+
+// udpSchemes are the forwarders which connect to their servers over udp, via the previous hop
+// of a chain, which must relay udp, one of udpRelaySchemes.
+var udpSchemes = map[string]bool{"quic": true, "hysteria2": true, "hy2": true, "tuic": true, "dnstunnel": true}
+
+// udpRelaySchemes are the forwarders which relay udp for the next hop of a chain
+var udpRelaySchemes = map[string]bool{"socks5": true, "ss": true, "trojan": true, "hysteria2": true, "hy2": true, "tuic": true}
+
+// schemeOf returns the scheme of a forwarder url, "" if none
+func schemeOf(s string) string {
+	if i := strings.Index(s, "://"); i > 0 {
+		return s[:i]
+	}
+	return ""
+}
+
+// checkChain returns an error if the last forwarder of chain is a transport only, or a hop can not
+// dial through the previous one: the udp forwarders after a hop without udp, and icmptunnel
+// which sends the icmp packets itself.
+func checkChain(chain string) error {
+	urls := strings.Split(chain, ",")
+	if last := schemeOf(urls[len(urls)-1]); transportSchemes[last] {
+		return errors.New("forward: '" + last + "' is a transport and can not be the last forwarder of '" + chain + "', e.g. " + last + "://host:port,socks5://host:port")
+	}
+
+	for i := 1; i < len(urls); i++ {
+		prev, cur := schemeOf(urls[i-1]), schemeOf(urls[i])
+		if cur == "icmptunnel" {
+			return errors.New("forward: 'icmptunnel' must be the first forwarder of '" + chain + "'")
+		}
+		// ss 2022 has no udp relay, ss://2022-METHOD:PASS@HOST
+		relay := udpRelaySchemes[prev] && !(prev == "ss" && isSS2022(strings.TrimPrefix(urls[i-1], "ss://")))
+		if udpSchemes[cur] && !relay {
+			return errors.New("forward: '" + cur + "' connects over udp, but '" + prev + "' before it in '" + chain + "' can not relay udp, use socks5, ss, trojan, hysteria2 or tuic before it")
+		}
+	}
+
+	_, err := chainOpts(chain)
+	return err
+}
+
+// chainDialer returns the dialer of a forwarder chain "A,B,C" over d
+func chainDialer(chain string, d Dialer) (Dialer, error) {
+	if err := checkChain(chain); err != nil {
+		return nil, err
+	}
+
+	var err error
+	for _, url := range strings.Split(chain, ",") {
+		if d, err = DialerFromURL(url, d); err != nil {
+			return nil, err
+		}
+	}
+
+	o, _ := chainOpts(chain)
+	chainOptsOf.Store(d, o)
+	return d, nil
+}
+
+// buildWorkers is the max number of forwarder chains built at the same time
+const buildWorkers = 16
+
+// chainDialers returns the dialers of the forwarder chains over d in the same order,
+// built concurrently, so the startup time doesn't grow with long subscription lists.
+func chainDialers(chains []string, d Dialer) ([]Dialer, error) {
+	dialers := make([]Dialer, len(chains))
+	errs := make([]error, len(chains))
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, buildWorkers)
+	for i, chain := range chains {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, chain string) {
+			defer func() { <-sem; wg.Done() }()
+			dialers[i], errs[i] = chainDialer(chain, d)
+		}(i, chain)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return dialers, nil
+}
+
 // DialerFromURL parses url and get a Proxy
 // TODO: table
 func DialerFromURL(s string, cDialer Dialer) (Dialer, error) {
@@ -41,14 +141,98 @@ func DialerFromURL(s string, cDialer Dialer) (Dialer, error) {
 		cDialer = Direct
 	}
 
+	// fwmark, interface, source ip and mtu of the sockets to this forwarder, only work on the first hop of a chain,
+	// the quic transports also honor the mtu on other hops
+	q := u.Query()
+	if q.Get("mark") != "" || q.Get("interface") != "" || q.Get("sourceip") != "" || q.Get("mtu") != "" {
+		d, ok := cDialer.(*direct)
+		if !ok {
+			if q.Get("mark") != "" || q.Get("interface") != "" || q.Get("sourceip") != "" {
+				logf("mark, interface and sourceip of %s ignored, only work on the first forwarder of a chain", addr)
+			}
+		} else {
+			nd := *d
+			if v := q.Get("mark"); v != "" {
+				if nd.mark, err = strconv.Atoi(v); err != nil {
+					return nil, errors.New("invalid mark '" + v + "' in " + s)
+				}
+			}
+			if v := q.Get("interface"); v != "" {
+				nd.iface = v
+			}
+			if v := q.Get("sourceip"); v != "" {
+				if nd.src = net.ParseIP(v); nd.src == nil {
+					return nil, errors.New("invalid sourceip '" + v + "' in " + s)
+				}
+			}
+			if nd.mtu, err = parseMTU(q); err != nil {
+				return nil, errors.New(err.Error() + " in " + s)
+			}
+			cDialer = &nd
+		}
+	}
+
+	d, err := schemeDialer(u, addr, user, pass, cDialer)
+	if err != nil {
+		return nil, err
+	}
+
+	// coalesce the small writes to the encrypted forwarders
+	if d, err = newCoalesceDialer(d, q); err != nil {
+		return nil, errors.New(err.Error() + " in " + s)
+	}
+	return d, nil
+}
+
+// schemeDialer returns the dialer of the scheme of u
+func schemeDialer(u *url.URL, addr, user, pass string, cDialer Dialer) (Dialer, error) {
 	switch u.Scheme {
 	case "http":
 		return NewHTTP(addr, user, pass, "", cDialer, nil)
+	case "https":
+		return NewHTTPS(addr, user, pass, u.RawQuery, cDialer)
 	case "socks5":
-		return NewSOCKS5(addr, user, pass, cDialer, nil)
+		return NewSOCKS5(addr, user, pass, "", cDialer, nil)
+	case "socks4", "socks4a":
+		return NewSOCKS4(addr, user, pass, "", u.Scheme == "socks4a", cDialer, nil)
 	case "ss":
-		return NewSS(addr, user, pass, cDialer, nil)
+		if isSS2022(user) {
+			return NewSS2022(addr, user, pass, cDialer)
+		}
+		return NewSS(addr, user, pass, u.RawQuery, cDialer, nil)
+	case "trojan":
+		return NewTrojan(addr, user, u.RawQuery, cDialer, nil)
+	case "tor":
+		return NewTor(addr, user, pass, u.RawQuery, cDialer)
+	case "i2p":
+		return NewI2P(addr, cDialer)
+	case "grpc":
+		return NewGRPC(addr, u.Path, u.RawQuery, cDialer)
+	case "quic":
+		return NewQUIC(addr, u.RawQuery, cDialer)
+	case "mux":
+		return NewMux(addr, u.RawQuery, cDialer)
+	case "tls":
+		return NewTLS(addr, u.RawQuery, cDialer)
+	case "shadowtls":
+		return NewShadowTLS(addr, user, u.RawQuery, cDialer)
+	case "ws", "wss":
+		return NewWS(addr, u.Path, u.RawQuery, u.Scheme == "wss", cDialer)
+	case "vmess":
+		return NewVMess(addr, user, u.RawQuery, cDialer)
+	case "hysteria2", "hy2":
+		return NewHysteria2(addr, user, pass, u.RawQuery, cDialer)
+	case "tuic":
+		return NewTUIC(addr, user, pass, u.RawQuery, cDialer)
+	case "naive":
+		return NewNaive(addr, user, pass, u.RawQuery, cDialer)
+	case "dnstunnel":
+		return NewDNSTunnel(addr, u.RawQuery, cDialer, nil)
+	case "icmptunnel":
+		return NewICMPTunnel(addr, u.RawQuery, cDialer, nil)
+	case "reject":
+		return Reject, nil
 	}
 
-	return nil, errors.New("unknown schema '" + u.Scheme + "'")
+	return nil, newError(ErrUnknownSchema, "unknown schema '"+u.Scheme+"'")
 }
@@ -1,15 +1,37 @@
 package main
 
 import (
+	"context"
 	"net"
+	"strings"
+	"syscall"
 )
 
+// errLoop is returned when the destination is one of glider's own listeners
+var errLoop = newError(ErrRejected, "proxy loop detected: destination is a local listener")
+
 // direct proxy
-type direct struct{}
+type direct struct {
+	dscp  int    // dscp value of outbound packets
+	mark  int    // fwmark of outbound sockets, linux only
+	iface string // interface the outbound sockets are bound to, linux only
+	src   net.IP // source ip of outbound sockets
+	mtu   int    // the mss of the outbound tcp sockets is clamped to fit in it, linux only
+}
 
 // Direct proxy
 var Direct = &direct{}
 
+// NewDirect returns a direct dialer which sets the dscp and fwmark on outbound sockets,
+// and binds them to the interface iface and the source ip src if set.
+func NewDirect(dscp, mark int, iface, src string) Dialer {
+	if dscp == 0 && mark == 0 && iface == "" && src == "" {
+		return Direct
+	}
+
+	return &direct{dscp: dscp, mark: mark, iface: iface, src: net.ParseIP(src)}
+}
+
 func (d *direct) Addr() string { return "DIRECT" }
 
 func (d *direct) Dial(network, addr string) (net.Conn, error) {
@@ -17,11 +39,31 @@ func (d *direct) Dial(network, addr string) (net.Conn, error) {
 		network = "udp"
 	}
 
-	c, err := net.Dial(network, addr)
+	if isListenAddr(addr) {
+		logf("direct dial to %s rejected: %s", addr, errLoop)
+		return nil, errLoop
+	}
+
+	dialer := &net.Dialer{Control: d.control}
+	if d.src != nil {
+		if network == "udp" {
+			dialer.LocalAddr = &net.UDPAddr{IP: d.src}
+		} else {
+			dialer.LocalAddr = &net.TCPAddr{IP: d.src}
+		}
+	}
+
+	c, err := dialer.Dial(network, addr)
 	if err != nil {
 		return nil, err
 	}
 
+	if isLoopConn(addr, c) {
+		c.Close()
+		logf("direct dial to %s(%s) rejected: %s", addr, c.RemoteAddr(), errLoop)
+		return nil, errLoop
+	}
+
 	if c, ok := c.(*net.TCPConn); ok {
 		c.SetKeepAlive(true)
 	}
@@ -31,14 +73,53 @@ func (d *direct) Dial(network, addr string) (net.Conn, error) {
 
 // DialUDP connects to the given address via the proxy
 func (d *direct) DialUDP(network, addr string) (net.PacketConn, net.Addr, error) {
-	pc, err := net.ListenPacket(network, "")
+	if isListenAddr(addr) {
+		logf("direct dialudp to %s rejected: %s", addr, errLoop)
+		return nil, nil, errLoop
+	}
+
+	var laddr string
+	if d.src != nil {
+		laddr = net.JoinHostPort(d.src.String(), "0")
+	}
+
+	lc := &net.ListenConfig{Control: d.control}
+	pc, err := lc.ListenPacket(context.Background(), network, laddr)
 	if err != nil {
 		logf("ListenPacket error: %s", err)
 		return nil, nil, err
 	}
 
 	uAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err == nil && isListenAddr(uAddr.String()) {
+		pc.Close()
+		logf("direct dialudp to %s(%s) rejected: %s", addr, uAddr, errLoop)
+		return nil, nil, errLoop
+	}
 	return pc, uAddr, err
 }
 
 func (d *direct) NextDialer(dstAddr string) Dialer { return d }
+
+// control sets the socket options before connecting
+func (d *direct) control(network, address string, c syscall.RawConn) error {
+	mtu := d.mtu
+	if !strings.HasPrefix(network, "tcp") {
+		mtu = 0
+	}
+
+	if d.dscp == 0 && d.mark == 0 && d.iface == "" && mtu == 0 {
+		return nil
+	}
+
+	var err error
+	c.Control(func(fd uintptr) {
+		err = setSockOpts(int(fd), network, d.dscp, d.mark, d.iface, mtu)
+	})
+
+	if err != nil {
+		logf("direct set socket options error: %s", err)
+	}
+
+	return err
+}
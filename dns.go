@@ -173,7 +173,7 @@ func (s *DNS) ListenAndServe() {
 
 // ListenAndServeUDP .
 func (s *DNS) ListenAndServeUDP() {
-	c, err := net.ListenPacket("udp", s.addr)
+	c, err := listenPacket("udp", s.addr)
 	if err != nil {
 		logf("proxy-dns failed to listen on %s, error: %v", s.addr, err)
 		return
@@ -186,6 +186,9 @@ func (s *DNS) ListenAndServeUDP() {
 		b := make([]byte, DNSUDPMaxLen)
 		n, clientAddr, err := c.ReadFrom(b)
 		if err != nil {
+			if isClosed(err) {
+				return
+			}
 			logf("proxy-dns local read error: %v", err)
 			continue
 		}
@@ -217,7 +220,7 @@ func (s *DNS) ListenAndServeUDP() {
 
 // ListenAndServeTCP .
 func (s *DNS) ListenAndServeTCP() {
-	l, err := net.Listen("tcp", s.addr)
+	l, err := listen("tcp", s.addr)
 	if err != nil {
 		logf("proxy-dns-tcp error: %v", err)
 		return
@@ -228,6 +231,9 @@ func (s *DNS) ListenAndServeTCP() {
 	for {
 		c, err := l.Accept()
 		if err != nil {
+			if isClosed(err) {
+				return
+			}
 			logf("proxy-dns-tcp error: failed to accept: %v", err)
 			continue
 		}
@@ -451,6 +457,9 @@ func parseAnswers(p []byte) ([]*DNSRR, error) {
 		answer.CLASS = binary.BigEndian.Uint16(p[i+2:])
 		answer.TTL = binary.BigEndian.Uint32(p[i+4:])
 		answer.RDLENGTH = binary.BigEndian.Uint16(p[i+8:])
+		if lenP < i+10+int(answer.RDLENGTH) {
+			return nil, errors.New("not enough data")
+		}
 		answer.RDATA = p[i+10 : i+10+int(answer.RDLENGTH)]
 
 		if answer.TYPE == DNSQTypeA {
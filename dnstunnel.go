@@ -0,0 +1,276 @@
+// dns tunnel transport(iodine-style), a last resort for the networks where only dns escapes.
+// it's SLOW: the upstream data is encoded in the query names(base32),
+// and the downstream data in the TXT answers(base64), one exchange at a time(see ptun.go).
+//
+// client: dnstunnel://RESOLVER:53?domain=t.example.com&psk=KEY
+// server: dnstunnel://:53?domain=t.example.com&psk=KEY, t.example.com must be delegated to the server(NS record).
+// the sessions are opened only with the same pre-shared key(psk) on both sides.
+
+package main
+
+import (
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DNSQTypeTXT txt record
+const DNSQTypeTXT = 16
+
+var dnsTunnelBase32 = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// DNSTunnel struct
+type DNSTunnel struct {
+	*Forwarder
+	sDialer Dialer
+
+	domain string
+	psk    []byte
+}
+
+// NewDNSTunnel returns a dns tunnel proxy.
+func NewDNSTunnel(addr, rawQuery string, cDialer Dialer, sDialer Dialer) (*DNSTunnel, error) {
+	p, _ := url.ParseQuery(rawQuery)
+	domain := strings.Trim(strings.ToLower(p.Get("domain")), ".")
+	if domain == "" {
+		return nil, errors.New("proxy-dnstunnel: domain must be specified")
+	}
+
+	psk := p.Get("psk")
+	if psk == "" {
+		return nil, errors.New("proxy-dnstunnel: psk must be specified")
+	}
+
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "53")
+	}
+
+	s := &DNSTunnel{
+		Forwarder: NewForwarder(addr, cDialer),
+		sDialer:   sDialer,
+		domain:    domain,
+		psk:       []byte(psk),
+	}
+
+	return s, nil
+}
+
+// ListenAndServe serves dns tunnel requests.
+func (s *DNSTunnel) ListenAndServe() {
+	c, err := listenPacket("udp", s.addr)
+	if err != nil {
+		logf("proxy-dnstunnel failed to listen on %s: %v", s.addr, err)
+		return
+	}
+	defer c.Close()
+
+	logf("proxy-dnstunnel listening UDP on %s, domain: %s", s.addr, s.domain)
+
+	srv := newPtunServer(s.sDialer, s.psk)
+	for {
+		buf := make([]byte, DNSUDPMaxLen)
+		n, raddr, err := c.ReadFrom(buf)
+		if err != nil {
+			if isClosed(err) {
+				return
+			}
+			logf("proxy-dnstunnel read error: %v", err)
+			continue
+		}
+
+		go func() {
+			if resp := s.serve(srv, buf[:n]); resp != nil {
+				c.WriteTo(resp, raddr)
+			}
+		}()
+	}
+}
+
+// serve handles a dns query and returns the response message
+func (s *DNSTunnel) serve(srv *ptunServer, msg []byte) []byte {
+	q, err := parseQuestion(msg)
+	if err != nil || q.QTYPE != DNSQTypeTXT {
+		return nil
+	}
+
+	name := strings.ToLower(q.QNAME)
+	if !strings.HasSuffix(name, "."+s.domain) {
+		return nil
+	}
+
+	data := strings.Replace(strings.TrimSuffix(name, "."+s.domain), ".", "", -1)
+	req, err := dnsTunnelBase32.DecodeString(strings.ToUpper(data))
+	if err != nil {
+		return nil
+	}
+
+	// keep the response in 512 bytes: header, question, answer(name pointer, type, class, ttl, rdlength), txt length bytes
+	room := DNSUDPMaxLen - q.Offset - 12 - 2
+	resp := srv.handle(req, base64.StdEncoding.DecodedLen(room)-ptunHeaderLen)
+	if resp == nil {
+		return nil
+	}
+
+	// txt: <length><string>..., each string at most 255 bytes
+	txt := base64.StdEncoding.EncodeToString(resp)
+	var rdata []byte
+	for len(txt) > 0 {
+		n := len(txt)
+		if n > 255 {
+			n = 255
+		}
+		rdata = append(rdata, byte(n))
+		rdata = append(rdata, txt[:n]...)
+		txt = txt[n:]
+	}
+
+	b := make([]byte, 0, q.Offset+12+len(rdata))
+	b = append(b, msg[:2]...)             // id
+	b = append(b, 0x84, 0x00)             // QR, AA
+	b = append(b, 0, 1, 0, 1, 0, 0, 0, 0) // qdcount, ancount, nscount, arcount
+	b = append(b, msg[DNSHeaderLen:q.Offset]...)
+	b = append(b, 0xc0, DNSHeaderLen) // name pointer to the question
+	b = append(b, 0, DNSQTypeTXT, 0, 1, 0, 0, 0, 0)
+	b = append(b, byte(len(rdata)>>8), byte(len(rdata)))
+	b = append(b, rdata...)
+
+	return b
+}
+
+// Dial connects to the address addr on the network net via the dns tunnel.
+func (s *DNSTunnel) Dial(network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp6", "tcp4":
+	default:
+		return nil, errors.New("proxy-dnstunnel: no support for connection type " + network)
+	}
+
+	pc, writeTo, err := s.cDialer.DialUDP("udp", s.addr)
+	if err != nil {
+		logf("proxy-dnstunnel dialudp to %s error: %s", s.addr, err)
+		return nil, err
+	}
+
+	ex := &dnsTunnelExchanger{PacketConn: pc, writeTo: writeTo, domain: s.domain}
+
+	// query name: base32 labels + domain, at most 253 chars
+	chars := 253 - len(s.domain) - 1
+	chars -= chars / 64 // dots between labels
+	mtu := chars*5/8 - ptunHeaderLen
+
+	c, err := dialPtun(ex, s.psk, mtu, 0, addr, pc.LocalAddr(), writeTo)
+	if err != nil {
+		logf("proxy-dnstunnel connect to %s via %s error: %s", addr, s.addr, err)
+		return nil, err
+	}
+
+	logf("proxy-dnstunnel connect to %s via %s", addr, s.addr)
+	return c, nil
+}
+
+// DialUDP connects to the given address via the proxy.
+func (s *DNSTunnel) DialUDP(network, addr string) (net.PacketConn, net.Addr, error) {
+	return nil, nil, newError(ErrUDPNotSupported, "dnstunnel client does not support udp")
+}
+
+// dnsTunnelExchanger exchanges ptun packets in dns TXT queries
+type dnsTunnelExchanger struct {
+	net.PacketConn
+	writeTo net.Addr
+	domain  string
+}
+
+func (e *dnsTunnelExchanger) exchange(req []byte) ([]byte, error) {
+	data := dnsTunnelBase32.EncodeToString(req)
+
+	var labels []string
+	for len(data) > 63 {
+		labels = append(labels, data[:63])
+		data = data[63:]
+	}
+	labels = append(labels, data, e.domain)
+	name := strings.Join(labels, ".")
+
+	id := uint16(rand.Uint32())
+	msg := make([]byte, DNSHeaderLen, DNSHeaderLen+len(name)+6)
+	binary.BigEndian.PutUint16(msg, id)
+	msg[2] = 0x01 // RD
+	msg[5] = 1    // qdcount
+	for _, label := range strings.Split(name, ".") {
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0, 0, DNSQTypeTXT, 0, 1)
+
+	if _, err := e.WriteTo(msg, e.writeTo); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 4096)
+	e.SetReadDeadline(time.Now().Add(3 * time.Second))
+	for {
+		n, _, err := e.ReadFrom(buf)
+		if err != nil {
+			return nil, err
+		}
+
+		if n < DNSHeaderLen || binary.BigEndian.Uint16(buf) != id {
+			continue
+		}
+
+		resp, err := parseTXT(buf[:n])
+		if err != nil {
+			return nil, err
+		}
+
+		if !ptunMatch(req, resp) {
+			continue
+		}
+
+		return resp, nil
+	}
+}
+
+// parseTXT returns the base64 decoded data of the first TXT answer in dns response msg
+func parseTXT(msg []byte) ([]byte, error) {
+	if rcode := msg[3] & 0x0f; rcode != 0 {
+		return nil, errors.New("proxy-dnstunnel dns error, rcode: " + strconv.Itoa(int(rcode)))
+	}
+
+	q, err := parseQuestion(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	answers, err := parseAnswers(msg[q.Offset:])
+	if err != nil {
+		return nil, err
+	}
+
+	for _, answer := range answers {
+		if answer.TYPE != DNSQTypeTXT {
+			continue
+		}
+
+		var txt []byte
+		for b := answer.RDATA; len(b) > 0; {
+			n := int(b[0])
+			if len(b) < 1+n {
+				return nil, errors.New("proxy-dnstunnel invalid txt record")
+			}
+			txt = append(txt, b[1:1+n]...)
+			b = b[1+n:]
+		}
+
+		return base64.StdEncoding.DecodeString(string(txt))
+	}
+
+	return nil, errors.New("proxy-dnstunnel no txt answer")
+}
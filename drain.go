@@ -0,0 +1,340 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// drains is the registry of the forwarders being drained, by the address of the forwarder,
+// the last hop of a chain. They are skipped by the strategy dialers like the disabled ones,
+// so new connections go to the others, e.g. for maintenance on the upstream servers.
+var drains struct {
+	sync.Mutex
+	m map[string]*drainEntry
+}
+
+// drainEntry is a forwarder being drained
+type drainEntry struct {
+	since    time.Time
+	deadline time.Time // the existing connections are closed at, zero if kept
+	timer    *time.Timer
+}
+
+// upstreams tracks the connections dialed by the strategy dialers, by the address of the forwarder,
+// so they can be closed when the forwarder is drained.
+var upstreams struct {
+	sync.Mutex
+	m map[string]map[io.Closer]struct{}
+}
+
+func init() {
+	drains.m = make(map[string]*drainEntry)
+	upstreams.m = make(map[string]map[io.Closer]struct{})
+	apiMux.HandleFunc("/forwarders/drain", apiLocal(handleDrain))
+}
+
+// isDraining reports whether the forwarder addr is being drained
+func isDraining(addr string) bool {
+	drains.Lock()
+	_, ok := drains.m[addr]
+	drains.Unlock()
+	return ok
+}
+
+// hasForwarder reports whether a strategy dialer has the forwarder addr
+func hasForwarder(addr string) bool {
+	rrDialers.Lock()
+	defer rrDialers.Unlock()
+
+	for _, rr := range rrDialers.list {
+		for _, d := range rr.dialers {
+			if d.Addr() == addr {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// rebuildDialers recomputes the enabled forwarders of all the strategy dialers
+func rebuildDialers() {
+	rrDialers.Lock()
+	defer rrDialers.Unlock()
+
+	for _, rr := range rrDialers.list {
+		rr.rebuild()
+	}
+}
+
+// drainForwarder stops assigning new connections to the forwarder addr,
+// the existing ones are closed after timeout if it's positive, returns the entry.
+func drainForwarder(addr string, timeout time.Duration) drainEntry {
+	drains.Lock()
+	e, ok := drains.m[addr]
+	if !ok {
+		e = &drainEntry{since: time.Now()}
+		drains.m[addr] = e
+	}
+
+	if e.timer != nil {
+		e.timer.Stop()
+		e.timer, e.deadline = nil, time.Time{}
+	}
+
+	if timeout > 0 {
+		e.deadline = time.Now().Add(timeout)
+		e.timer = time.AfterFunc(timeout, func() {
+			n := closeUpstreams(addr)
+			logf("drain: deadline of %s reached, %d connections closed", addr, n)
+		})
+	}
+	ret := *e
+	drains.Unlock()
+
+	rebuildDialers()
+
+	if timeout > 0 {
+		logf("drain: forwarder %s is draining, %d connections will be closed in %s", addr, countUpstreams(addr), timeout)
+	} else {
+		logf("drain: forwarder %s is draining, %d connections are kept", addr, countUpstreams(addr))
+	}
+
+	return ret
+}
+
+// undrainForwarder puts the forwarder addr back to use, returns false if it's not being drained
+func undrainForwarder(addr string) bool {
+	drains.Lock()
+	e, ok := drains.m[addr]
+	if ok {
+		if e.timer != nil {
+			e.timer.Stop()
+		}
+		delete(drains.m, addr)
+	}
+	drains.Unlock()
+
+	if ok {
+		rebuildDialers()
+		logf("drain: forwarder %s is back in use", addr)
+	}
+	return ok
+}
+
+// trackUpstream tracks c dialed via the forwarder addr until closed,
+// the direct udp sockets are not tracked, as the relays check them to write to any peers.
+func trackUpstream(addr string, c net.Conn) net.Conn {
+	if _, ok := c.(*net.UDPConn); ok {
+		return c
+	}
+
+	tc := &upstreamConn{Conn: c, addr: addr}
+	addUpstream(addr, tc)
+	return tc
+}
+
+// trackUpstreamPacket tracks pc dialed via the forwarder addr until closed
+func trackUpstreamPacket(addr string, pc net.PacketConn) net.PacketConn {
+	if _, ok := pc.(*net.UDPConn); ok {
+		return pc
+	}
+
+	tpc := &upstreamPacketConn{PacketConn: pc, addr: addr}
+	addUpstream(addr, tpc)
+	return tpc
+}
+
+func addUpstream(addr string, c io.Closer) {
+	upstreams.Lock()
+	m := upstreams.m[addr]
+	if m == nil {
+		m = make(map[io.Closer]struct{})
+		upstreams.m[addr] = m
+	}
+	m[c] = struct{}{}
+	upstreams.Unlock()
+}
+
+func removeUpstream(addr string, c io.Closer) {
+	upstreams.Lock()
+	if m := upstreams.m[addr]; m != nil {
+		delete(m, c)
+		if len(m) == 0 {
+			delete(upstreams.m, addr)
+		}
+	}
+	upstreams.Unlock()
+}
+
+func countUpstreams(addr string) int {
+	upstreams.Lock()
+	defer upstreams.Unlock()
+	return len(upstreams.m[addr])
+}
+
+// closeUpstreams closes the connections via the forwarder addr, returns the number closed
+func closeUpstreams(addr string) int {
+	var cs []io.Closer
+	upstreams.Lock()
+	for c := range upstreams.m[addr] {
+		cs = append(cs, c)
+	}
+	upstreams.Unlock()
+
+	for _, c := range cs {
+		c.Close()
+	}
+	return len(cs)
+}
+
+// upstreamConn is a tracked connection, the relays still copy from and to the underlying conn directly
+type upstreamConn struct {
+	net.Conn
+	addr string
+	once sync.Once
+}
+
+func (c *upstreamConn) Close() error {
+	c.once.Do(func() { removeUpstream(c.addr, c) })
+	return c.Conn.Close()
+}
+
+// WriteTo copies from the underlying conn to w, so the WriterTo of it is used.
+func (c *upstreamConn) WriteTo(w io.Writer) (int64, error) {
+	return io.Copy(w, c.Conn)
+}
+
+// ReadFrom copies from r to the underlying conn, so the ReaderFrom of it is used.
+func (c *upstreamConn) ReadFrom(r io.Reader) (int64, error) {
+	return io.Copy(c.Conn, r)
+}
+
+// upstreamPacketConn is a tracked udp session
+type upstreamPacketConn struct {
+	net.PacketConn
+	addr string
+	once sync.Once
+}
+
+func (c *upstreamPacketConn) Close() error {
+	c.once.Do(func() { removeUpstream(c.addr, c) })
+	return c.PacketConn.Close()
+}
+
+// handleDrain lists the draining forwarders on GET, drains or puts back a forwarder on POST,
+// only from loopback unless -apiremote:
+// curl -X POST 'http://API_ADDR/forwarders/drain?addr=1.2.3.4:8443&timeout=300'
+// curl -X POST 'http://API_ADDR/forwarders/drain?addr=1.2.3.4:8443&cancel=true'
+func handleDrain(w http.ResponseWriter, r *http.Request) {
+	type drainInfo struct {
+		Addr     string `json:"addr"`
+		Since    string `json:"since"`
+		Deadline string `json:"deadline,omitempty"`
+		Conns    int    `json:"conns"` // connections still via the forwarder
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		list := []drainInfo{}
+		drains.Lock()
+		for addr, e := range drains.m {
+			info := drainInfo{Addr: addr, Since: e.since.Format(time.RFC3339)}
+			if !e.deadline.IsZero() {
+				info.Deadline = e.deadline.Format(time.RFC3339)
+			}
+			list = append(list, info)
+		}
+		drains.Unlock()
+
+		for i := range list {
+			list[i].Conns = countUpstreams(list[i].Addr)
+		}
+		writeJSON(w, list)
+		return
+
+	case http.MethodPost:
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+	addr := q.Get("addr")
+	if !hasForwarder(addr) {
+		http.Error(w, "forwarder '"+addr+"' not found in the strategy groups", http.StatusNotFound)
+		return
+	}
+
+	if q.Get("cancel") == "true" {
+		if !undrainForwarder(addr) {
+			http.Error(w, "forwarder '"+addr+"' is not draining", http.StatusConflict)
+			return
+		}
+		writeJSON(w, drainInfo{Addr: addr, Conns: countUpstreams(addr)})
+		return
+	}
+
+	var timeout time.Duration
+	if v := q.Get("timeout"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "invalid timeout '"+v+"'", http.StatusBadRequest)
+			return
+		}
+		timeout = time.Duration(n) * time.Second
+	}
+
+	logf("api: drain %s from %s, timeout: %s", addr, r.RemoteAddr, timeout)
+	e := drainForwarder(addr, timeout)
+
+	info := drainInfo{Addr: addr, Since: e.since.Format(time.RFC3339), Conns: countUpstreams(addr)}
+	if !e.deadline.IsZero() {
+		info.Deadline = e.deadline.Format(time.RFC3339)
+	}
+	writeJSON(w, info)
+}
+
+// drainCLI asks the running instance on the api to drain the forwarder conf.Drain,
+// or to put back conf.Undrain, and prints the response.
+func drainCLI() error {
+	if conf.API == "" {
+		return errors.New("the forwarders are drained on the api, -api must be set to the api address of the running instance")
+	}
+
+	q := url.Values{}
+	if conf.Undrain != "" {
+		q.Set("addr", conf.Undrain)
+		q.Set("cancel", "true")
+	} else {
+		q.Set("addr", conf.Drain)
+		q.Set("timeout", strconv.Itoa(conf.DrainTimeout))
+	}
+
+	host := conf.API
+	if strings.HasPrefix(host, ":") {
+		host = "127.0.0.1" + host
+	}
+
+	resp, err := http.Post("http://"+host+"/forwarders/drain?"+q.Encode(), "", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	b, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(strings.TrimSpace(string(b)))
+	}
+
+	os.Stdout.Write(b)
+	return nil
+}
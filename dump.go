@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// confDump is the effective config in json format, see -dump
+type confDump struct {
+	Listen []string        `json:"listen"`
+	Groups []confDumpGroup `json:"groups"`
+	DNS    confDumpDNS     `json:"dns"`
+	API    string          `json:"api,omitempty"`
+}
+
+// confDumpGroup is a forwarder group: the global forwarders or a rule
+type confDumpGroup struct {
+	Name     string         `json:"name"`
+	Strategy StrategyConfig `json:"strategy"`
+	Members  [][]string     `json:"members"` // forwarder chains, "direct" if empty
+
+	Domains int `json:"domains,omitempty"`
+	IPs     int `json:"ips,omitempty"`
+	CIDRs   int `json:"cidrs,omitempty"`
+
+	GeoIPURL   []string `json:"geoipurl,omitempty"`
+	GeoSiteURL []string `json:"geositeurl,omitempty"`
+
+	DNSServer []string `json:"dnsserver,omitempty"`
+	IPSet     string   `json:"ipset,omitempty"`
+}
+
+// confDumpDNS is the dns settings
+type confDumpDNS struct {
+	Listen string              `json:"listen,omitempty"`
+	Server []string            `json:"server"`
+	Domain map[string][]string `json:"domain,omitempty"` // domain -> dns servers set by rules
+}
+
+// dumpConf returns the effective config(flags, yaml, rule files) in json format,
+// the passwords in urls are redacted.
+func dumpConf() ([]byte, error) {
+	d := &confDump{
+		Listen: redactURLs(conf.Listen),
+		DNS:    confDumpDNS{Listen: conf.DNS, Server: conf.DNSServer},
+		API:    conf.API,
+	}
+
+	d.Groups = append(d.Groups, confDumpGroup{
+		Name:     "global",
+		Strategy: conf.StrategyConfig,
+		Members:  dumpChains(conf.Forward),
+		IPSet:    conf.IPSet,
+	})
+
+	for _, r := range conf.rules {
+		d.Groups = append(d.Groups, confDumpGroup{
+			Name:       r.name,
+			Strategy:   r.StrategyConfig,
+			Members:    dumpChains(r.Forward),
+			Domains:    len(r.Domain),
+			IPs:        len(r.IP),
+			CIDRs:      len(r.CIDR),
+			GeoIPURL:   r.GeoIPURL,
+			GeoSiteURL: r.GeoSiteURL,
+			DNSServer:  r.DNSServer,
+			IPSet:      r.IPSet,
+		})
+
+		if len(r.DNSServer) > 0 {
+			if d.DNS.Domain == nil {
+				d.DNS.Domain = make(map[string][]string)
+			}
+			for _, domain := range r.Domain {
+				d.DNS.Domain[domain] = r.DNSServer
+			}
+		}
+	}
+
+	return json.MarshalIndent(d, "", "  ")
+}
+
+// dumpChains splits the forwarder chains into hops
+func dumpChains(forward []string) [][]string {
+	chains := [][]string{}
+	for _, chain := range forward {
+		chains = append(chains, redactURLs(strings.Split(chain, ",")))
+	}
+
+	if len(chains) == 0 {
+		chains = append(chains, []string{"direct"})
+	}
+
+	return chains
+}
+
+// redactURLs returns the urls with the passwords replaced by "xxxxx"
+func redactURLs(urls []string) []string {
+	var r []string
+	for _, s := range urls {
+		r = append(r, redactURL(s))
+	}
+	return r
+}
+
+func redactURL(s string) string {
+	// port range listeners, the password is in the head
+	if head, tail, from, to, ok := portRange(s); ok {
+		return strings.TrimSuffix(redactURL(head+"0"), "0") + strconv.Itoa(from) + "-" + strconv.Itoa(to) + tail
+	}
+
+	u, err := url.Parse(s)
+	if err == nil && u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), "xxxxx")
+			s = u.String()
+		}
+	}
+	return s
+}
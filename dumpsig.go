@@ -0,0 +1,21 @@
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// watchDumpSignal dumps the state to the log on SIGUSR2, e.g. kill -USR2 $(pidof glider)
+func watchDumpSignal() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR2)
+
+	go func() {
+		for range ch {
+			dumpState()
+		}
+	}()
+}
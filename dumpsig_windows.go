@@ -0,0 +1,4 @@
+package main
+
+// watchDumpSignal does nothing on windows, there's no SIGUSR2
+func watchDumpSignal() {}
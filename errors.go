@@ -0,0 +1,33 @@
+package main
+
+import "github.com/nadoo/glider/proxy"
+
+// Kinds of the proxy errors, see the proxy package, use ErrorKind to get the kind of an error:
+//
+//	if ErrorKind(err) == ErrAuth { ... }
+var (
+	ErrAuth            = proxy.ErrAuth
+	ErrUnreachable     = proxy.ErrUnreachable
+	ErrUDPNotSupported = proxy.ErrUDPNotSupported
+	ErrUnknownSchema   = proxy.ErrUnknownSchema
+	ErrInvalidAddr     = proxy.ErrInvalidAddr
+	ErrProtocol        = proxy.ErrProtocol
+	ErrRejected        = proxy.ErrRejected
+	ErrNetwork         = proxy.ErrNetwork
+)
+
+// Error is a proxy error with its kind
+type Error = proxy.Error
+
+// ErrorKind returns the kind of err, the i/o errors are ErrNetwork, nil if unknown.
+var ErrorKind = proxy.ErrorKind
+
+// newError returns an error of kind with msg
+func newError(kind error, msg string) error {
+	return &Error{Kind: kind, Msg: msg}
+}
+
+// wrapError returns an error of kind with msg and err: "msg: err"
+func wrapError(kind error, msg string, err error) error {
+	return &Error{Kind: kind, Msg: msg, Err: err}
+}
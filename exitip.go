@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// exitIPs stores the exit ip of forwarders, forwarder addr -> exit ip
+var exitIPs sync.Map
+
+// checkExitIP gets the exit ip via dialer d periodically, and warns if it's
+// the same as the direct exit ip which means the real address may leak.
+func checkExitIP(d Dialer) {
+	if conf.ExitIPCheck <= 0 || conf.ExitIPURL == "" {
+		return
+	}
+
+	for {
+		checkSlots <- struct{}{}
+		ip, err := getExitIP(d)
+		<-checkSlots
+		if err != nil {
+			logf("exit-ip check via %s error: %s", d.Addr(), err)
+		} else {
+			if old, ok := exitIPs.Load(d.Addr()); !ok || old.(string) != ip {
+				logf("exit-ip via %s: %s", d.Addr(), ip)
+			}
+			exitIPs.Store(d.Addr(), ip)
+
+			if d != Direct {
+				if direct, err := getExitIP(Direct); err == nil && direct == ip {
+					logf("exit-ip WARNING: exit ip via %s is the same as direct: %s, the real address may leak", d.Addr(), ip)
+				}
+			}
+		}
+
+		time.Sleep(time.Duration(conf.ExitIPCheck) * time.Second)
+	}
+}
+
+// getExitIP requests conf.ExitIPURL via d, the response body should be the ip address only.
+func getExitIP(d Dialer) (string, error) {
+	client := &http.Client{
+		Timeout: 30 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return d.Dial(network, addr)
+			},
+		},
+	}
+
+	b, err := httpGet(client, conf.ExitIPURL)
+	if err != nil {
+		return "", err
+	}
+
+	ip := strings.TrimSpace(string(b))
+	if net.ParseIP(ip) == nil {
+		return "", &net.ParseError{Type: "IP address", Text: ip}
+	}
+
+	return ip, nil
+}
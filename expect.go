@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"path"
+	"strings"
+)
+
+// ruleExpect is an assertion in a rule file: expect=DEST -> TARGET,
+// TARGET is a rule name(the rule file name without .rule), "global", or the forwarder picked,
+// e.g. "direct", "reject" or its address.
+type ruleExpect struct {
+	dest   string
+	addr   string // dest with the default port 80
+	target string
+}
+
+// parseExpects parses the assertions "DEST -> TARGET"
+func parseExpects(list []string) ([]ruleExpect, error) {
+	var expects []ruleExpect
+	for _, s := range list {
+		i := strings.Index(s, "->")
+		if i < 0 {
+			return nil, errors.New("expect: invalid '" + s + "', format: DEST -> TARGET")
+		}
+
+		e := ruleExpect{dest: strings.TrimSpace(s[:i]), target: strings.TrimSpace(s[i+2:])}
+		if e.dest == "" || e.target == "" {
+			return nil, errors.New("expect: invalid '" + s + "', format: DEST -> TARGET")
+		}
+
+		e.addr = e.dest
+		if _, _, err := net.SplitHostPort(e.dest); err != nil {
+			e.addr = net.JoinHostPort(strings.Trim(e.dest, "[]"), "80")
+		}
+		expects = append(expects, e)
+	}
+	return expects, nil
+}
+
+// ruleName returns the short name of a rule: the file name without .rule, or the name in yaml
+func ruleName(name string) string {
+	return strings.TrimSuffix(path.Base(name), ".rule")
+}
+
+// checkExpects evaluates the assertions of all the rules against rd, prints the results
+// and returns the number of failed ones.
+func checkExpects(rd *RuleDialer) int {
+	total, failed := 0, 0
+	for _, r := range conf.rules {
+		expects, _ := parseExpects(r.Expect)
+		for _, e := range expects {
+			total++
+
+			t, by := rd.match(e.addr)
+			d := pickForwarder(t.dialer, e.addr)
+
+			if strings.EqualFold(e.target, t.name) || strings.EqualFold(e.target, ruleName(t.name)) ||
+				strings.EqualFold(e.target, d.Addr()) {
+				fmt.Printf("PASS %s: %s -> %s\n", ruleName(r.name), e.dest, e.target)
+				continue
+			}
+
+			failed++
+			if by == "" {
+				by = "no rule matched"
+			}
+			fmt.Printf("FAIL %s: %s -> %s, got rule %s(%s), forwarder %s\n",
+				ruleName(r.name), e.dest, e.target, ruleName(t.name), by, d.Addr())
+		}
+	}
+
+	fmt.Printf("%d assertions, %d failed\n", total, failed)
+	return failed
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// flow is an active relay between a local conn and a remote conn
+type flow struct {
+	id    uint64
+	src   string
+	dst   string
+	start time.Time
+	last  int64        // unix nano of the last activity, atomic
+	proto atomic.Value // protocol sniffed from the first data of the client
+	sni   atomic.Value // server name in the tls client hello of the first data, if any
+
+	c, rc net.Conn
+}
+
+// flows is the registry of active relays
+var flows struct {
+	sync.Mutex
+	m      map[uint64]*flow
+	nextID uint64
+	reaped int64
+}
+
+func init() {
+	flows.m = make(map[uint64]*flow)
+	apiMux.HandleFunc("/stats/flows", handleFlows)
+}
+
+// addFlow registers a relay between c and rc to the registry
+func addFlow(c, rc net.Conn, dst string) *flow {
+	f := &flow{
+		src:   c.RemoteAddr().String(),
+		dst:   dst,
+		start: time.Now(),
+		last:  time.Now().UnixNano(),
+		c:     c,
+		rc:    rc,
+	}
+
+	flows.Lock()
+	flows.nextID++
+	f.id = flows.nextID
+	flows.m[f.id] = f
+	flows.Unlock()
+
+	return f
+}
+
+// removeFlow removes f from the registry
+func removeFlow(f *flow) {
+	flows.Lock()
+	delete(flows.m, f.id)
+	flows.Unlock()
+}
+
+// active updates the last activity time of f
+func (f *flow) active() {
+	atomic.StoreInt64(&f.last, time.Now().UnixNano())
+}
+
+// idle returns the idle duration of f
+func (f *flow) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&f.last)))
+}
+
+// protocol returns the sniffed protocol of f, "none" if the client has sent nothing
+func (f *flow) protocol() string {
+	if p, ok := f.proto.Load().(string); ok {
+		return p
+	}
+	return "none"
+}
+
+// serverName returns the server name sniffed from the client, "" if none
+func (f *flow) serverName() string {
+	sni, _ := f.sni.Load().(string)
+	return sni
+}
+
+// flowConn updates the activity of the flow on read and write,
+// the protocol is sniffed from the first read if sniff is set.
+type flowConn struct {
+	net.Conn
+	f     *flow
+	sniff bool
+}
+
+func (c *flowConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.f.active()
+		if c.sniff {
+			c.sniff = false
+			c.f.proto.Store(sniffProto(b[:n]))
+
+			// tls record header: type(1) 0x16: handshake, version(2), length(2)
+			if n > 5 && b[0] == 0x16 {
+				c.f.sni.Store(parseSNI(b[5:n]))
+			}
+		}
+	}
+	return n, err
+}
+
+func (c *flowConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.f.active()
+	}
+	return n, err
+}
+
+// WriteTo copies to w after the first read, from the underlying conn directly if the idle timeout
+// is disabled, so relaying between tcp conns is done in the kernel. The activity is then only
+// updated when the copy ends.
+func (c *flowConn) WriteTo(w io.Writer) (int64, error) {
+	if conf.IdleTimeout > 0 {
+		return io.Copy(writerOnly{w}, readerOnly{c})
+	}
+
+	if fc, ok := w.(*flowConn); ok {
+		w = fc.Conn
+	}
+
+	defer c.f.active()
+	return copyFirst(w, c, c.Conn)
+}
+
+// ReadFrom copies from r to the underlying conn directly if the idle timeout is disabled.
+func (c *flowConn) ReadFrom(r io.Reader) (int64, error) {
+	if conf.IdleTimeout > 0 {
+		return io.Copy(writerOnly{c}, readerOnly{r})
+	}
+
+	c.f.active()
+	defer c.f.active()
+	return io.Copy(c.Conn, r)
+}
+
+// readerOnly and writerOnly hide ReaderFrom and WriterTo, so io.Copy uses a buffer
+type readerOnly struct{ io.Reader }
+type writerOnly struct{ io.Writer }
+
+// reapIdleFlows closes the flows idle for more than timeout, checks every minute
+func reapIdleFlows(timeout time.Duration) {
+	for {
+		time.Sleep(time.Minute)
+
+		var idles []*flow
+		flows.Lock()
+		for _, f := range flows.m {
+			if f.idle() > timeout {
+				idles = append(idles, f)
+			}
+		}
+		flows.Unlock()
+
+		for _, f := range idles {
+			logf("reap idle flow %s <-> %s, idle: %s", f.src, f.dst, f.idle())
+			f.c.Close()
+			f.rc.Close()
+			atomic.AddInt64(&flows.reaped, 1)
+		}
+	}
+}
+
+// handleFlows serves the relay stats: /stats/flows?n=10, with the n longest-lived flows
+func handleFlows(w http.ResponseWriter, r *http.Request) {
+	n, err := strconv.Atoi(r.URL.Query().Get("n"))
+	if err != nil {
+		n = 10
+	}
+
+	type flowInfo struct {
+		Src      string `json:"src"`
+		Dst      string `json:"dst"`
+		Duration string `json:"duration"`
+		Idle     string `json:"idle"`
+		Proto    string `json:"proto"`
+
+		start time.Time
+	}
+
+	var list []flowInfo
+	flows.Lock()
+	for _, f := range flows.m {
+		list = append(list, flowInfo{
+			Src:      f.src,
+			Dst:      f.dst,
+			Duration: time.Since(f.start).String(),
+			Idle:     f.idle().String(),
+			Proto:    f.protocol(),
+			start:    f.start,
+		})
+	}
+	active := len(flows.m)
+	flows.Unlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].start.Before(list[j].start) })
+	if len(list) > n {
+		list = list[:n]
+	}
+
+	writeJSON(w, struct {
+		Active  int        `json:"active"`
+		Reaped  int64      `json:"reaped"`
+		Longest []flowInfo `json:"longest"`
+	}{active, atomic.LoadInt64(&flows.reaped), list})
+}
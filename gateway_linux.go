@@ -0,0 +1,37 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"net"
+	"os"
+	"strings"
+)
+
+// defaultGateway returns the ipv4 default gateway from /proc/net/route, nil if not found.
+func defaultGateway() net.IP {
+	f, err := os.Open("/proc/net/route")
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	// Iface Destination Gateway Flags ...
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || fields[1] != "00000000" {
+			continue
+		}
+
+		b, err := hex.DecodeString(fields[2])
+		if err != nil || len(b) != net.IPv4len {
+			continue
+		}
+
+		// little endian
+		return net.IPv4(b[3], b[2], b[1], b[0])
+	}
+
+	return nil
+}
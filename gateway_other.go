@@ -0,0 +1,35 @@
+// +build !linux
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"os/exec"
+	"strings"
+)
+
+// defaultGateway returns the ipv4 default gateway from the output of "route -n get default"
+// on darwin and the bsds, nil if not found.
+func defaultGateway() net.IP {
+	out, err := exec.Command("route", "-n", "get", "default").Output()
+	if err != nil {
+		return nil
+	}
+
+	//    route to: default
+	// destination: default
+	//     gateway: 192.168.1.1
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == "gateway:" {
+			if ip := net.ParseIP(fields[1]).To4(); ip != nil {
+				return ip
+			}
+		}
+	}
+
+	return nil
+}
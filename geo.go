@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// geoList is a hot-swappable destination list, downloaded from remote urls
+// and updated periodically, used as geoip(cidr) and geosite(domain) rules.
+type geoList struct {
+	name     string
+	ipURLs   []string
+	siteURLs []string
+	verify   bool
+	interval int // update interval(hours)
+
+	target *ruleTarget  // target of the matched destinations
+	data   atomic.Value // *geoData
+}
+
+// geoData holds a snapshot of the downloaded lists
+type geoData struct {
+	domains map[string]bool
+	cidrs   []*net.IPNet
+}
+
+// newGeoList returns a geoList according to the rule config
+func newGeoList(r *RuleConf, target *ruleTarget) *geoList {
+	l := &geoList{
+		name:     r.name,
+		ipURLs:   r.GeoIPURL,
+		siteURLs: r.GeoSiteURL,
+		verify:   r.GeoVerify,
+		interval: r.GeoUpdate,
+		target:   target,
+	}
+
+	l.data.Store(&geoData{domains: make(map[string]bool)})
+	return l
+}
+
+// run updates the lists every interval hours, dial via d.
+func (l *geoList) run(d Dialer, interval int) {
+	client := &http.Client{
+		Timeout: 5 * time.Minute,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return d.Dial(network, addr)
+			},
+		},
+	}
+
+	if interval <= 0 {
+		interval = 24
+	}
+
+	// retry with backoff until the first successful update, e.g. the wan is not up yet at startup
+	bo := &backoff{min: 5 * time.Second, max: 10 * time.Minute, cur: 5 * time.Second}
+	loaded := false
+
+	for {
+		if err := l.update(client); err != nil {
+			logf("proxy-geo %s update error: %s", l.name, err)
+		} else {
+			loaded = true
+		}
+
+		if !loaded {
+			wait := bo.next()
+			logf("proxy-geo %s is pending, retry in %s", l.name, wait)
+			time.Sleep(wait)
+			continue
+		}
+
+		time.Sleep(time.Duration(interval) * time.Hour)
+	}
+}
+
+// update downloads all the lists, the current data will only be replaced when all lists are ready.
+func (l *geoList) update(client *http.Client) error {
+	data := &geoData{domains: make(map[string]bool)}
+
+	for _, u := range l.ipURLs {
+		b, err := l.fetch(client, u)
+		if err != nil {
+			return err
+		}
+
+		data.cidrs = append(data.cidrs, geoCIDRs(b)...)
+	}
+
+	for _, u := range l.siteURLs {
+		b, err := l.fetch(client, u)
+		if err != nil {
+			return err
+		}
+
+		for _, line := range geoLines(b) {
+			data.domains[strings.ToLower(line)] = true
+		}
+	}
+
+	l.data.Store(data)
+	logf("proxy-geo %s updated, %d cidrs, %d domains", l.name, len(data.cidrs), len(data.domains))
+
+	return nil
+}
+
+// fetch downloads url and verifies it with the sha256 checksum file "url.sha256sum".
+func (l *geoList) fetch(client *http.Client, url string) ([]byte, error) {
+	b, err := httpGet(client, url)
+	if err != nil {
+		return nil, err
+	}
+
+	if !l.verify {
+		return b, nil
+	}
+
+	sum, err := httpGet(client, url+".sha256sum")
+	if err != nil {
+		return nil, errors.New("get checksum of " + url + " error: " + err.Error())
+	}
+
+	fields := strings.Fields(string(sum))
+	if len(fields) == 0 {
+		return nil, errors.New("empty checksum file for " + url)
+	}
+
+	hash := sha256.Sum256(b)
+	if !strings.EqualFold(fields[0], hex.EncodeToString(hash[:])) {
+		return nil, errors.New("checksum mismatch for " + url)
+	}
+
+	return b, nil
+}
+
+// matchIP reports whether ip is in the geoip list
+func (l *geoList) matchIP(ip net.IP) bool {
+	for _, cidr := range l.data.Load().(*geoData).cidrs {
+		if cidr.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchDomain reports whether domain or its parent domain is in the geosite list
+func (l *geoList) matchDomain(domain string) bool {
+	domains := l.data.Load().(*geoData).domains
+	if len(domains) == 0 {
+		return false
+	}
+
+	domainParts := strings.Split(strings.ToLower(domain), ".")
+	length := len(domainParts)
+	for i := length - 2; i >= 0; i-- {
+		if domains[strings.Join(domainParts[i:length], ".")] {
+			return true
+		}
+	}
+
+	return false
+}
+
+func httpGet(client *http.Client, url string) ([]byte, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("get " + url + " error: " + resp.Status)
+	}
+
+	return ioutil.ReadAll(resp.Body)
+}
+
+// geoCIDRs returns the ips and cidrs in the list b, an ip is a /32 or /128 cidr
+func geoCIDRs(b []byte) []*net.IPNet {
+	var cidrs []*net.IPNet
+	for _, line := range geoLines(b) {
+		if !strings.Contains(line, "/") {
+			if ip := net.ParseIP(line); ip != nil {
+				if ip.To4() != nil {
+					line += "/32"
+				} else {
+					line += "/128"
+				}
+			}
+		}
+
+		if _, cidr, err := net.ParseCIDR(line); err == nil {
+			cidrs = append(cidrs, cidr)
+		}
+	}
+	return cidrs
+}
+
+// geoLines returns the first field of the non-empty lines in b,
+// comments start with '#' or ';' are ignored, e.g.: "1.1.1.0/24 ; SBL123"
+func geoLines(b []byte) []string {
+	var lines []string
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexAny(line, "#;"); i >= 0 {
+			line = line[:i]
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		lines = append(lines, fields[0])
+	}
+	return lines
+}
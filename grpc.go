@@ -0,0 +1,368 @@
+// grpc transport compatible with the "gun" transport of v2ray:
+// the stream is carried in the Hunk messages of a bidirectional streaming call
+//
+//	service GunService { rpc Tun (stream Hunk) returns (stream Hunk); }
+//	message Hunk { bytes data = 1; }
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// GRPC is a grpc transport, it carries the stream of the next forwarder in a chain:
+//
+//	grpc://cdn.example.com:443/ServiceName?host=origin.example.com,vmess://UUID@origin.example.com:443
+//
+// For domain fronting, serverName sets the tls server name and host the :authority, see WS.
+// keepalive=SECONDS sets the interval of the http2 pings on the idle connection, 15 by default, 0 disables it.
+type GRPC struct {
+	*Forwarder
+
+	url       string // https://host/ServiceName/Tun
+	host      string // :authority
+	transport *http2.Transport
+}
+
+// NewGRPC returns a grpc transport, the streams to the same server share one http2 connection.
+func NewGRPC(addr, path, rawQuery string, cDialer Dialer) (*GRPC, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+		addr = net.JoinHostPort(host, "443")
+	}
+
+	service := strings.Trim(path, "/")
+	if service == "" {
+		service = "GunService"
+	}
+
+	p, _ := url.ParseQuery(rawQuery)
+
+	s := &GRPC{
+		Forwarder: NewForwarder(addr, cDialer),
+		url:       "https://" + addr + "/" + service + "/Tun",
+		host:      host,
+	}
+
+	if v := p.Get("host"); v != "" {
+		s.host = v
+	}
+
+	tlsConfig, err := tlsClientConfig(s.host, p)
+	if err != nil {
+		return nil, errors.New("proxy-grpc: " + err.Error())
+	}
+	tlsConfig.NextProtos = []string{"h2"}
+
+	// h2c: grpc without tls, e.g. behind a local tls terminating proxy
+	h2c := p.Get("h2c") == "true"
+	if h2c {
+		s.url = "http://" + addr + "/" + service + "/Tun"
+	}
+
+	// ping the idle connection, it's closed if the ping is not acked, the new streams dial a new one
+	keepAlive, err := parseKeepAlive(p, defaultKeepAlive)
+	if err != nil {
+		return nil, errors.New("proxy-grpc: " + err.Error())
+	}
+
+	s.transport = &http2.Transport{
+		AllowHTTP:       h2c,
+		ReadIdleTimeout: keepAlive,
+		PingTimeout:     keepAlive,
+		DialTLS: func(network, _ string, _ *tls.Config) (net.Conn, error) {
+			rc, err := s.cDialer.Dial("tcp", s.addr)
+			if err != nil {
+				logf("dial to %s error: %s", s.addr, err)
+				return nil, err
+			}
+
+			if c, ok := rc.(*net.TCPConn); ok {
+				c.SetKeepAlive(true)
+			}
+
+			if h2c {
+				return rc, nil
+			}
+
+			tc := tls.Client(rc, tlsConfig)
+			if err := tc.Handshake(); err != nil {
+				rc.Close()
+				logf("proxy-grpc tls handshake with %s error: %s", s.addr, err)
+				return nil, err
+			}
+
+			return tc, nil
+		},
+	}
+
+	return s, nil
+}
+
+// Dial opens a grpc stream to the server, addr is decided by the next forwarder and ignored.
+func (s *GRPC) Dial(network, addr string) (net.Conn, error) {
+	pr, pw := io.Pipe()
+	req, err := http.NewRequest("POST", s.url, pr)
+	if err != nil {
+		return nil, err
+	}
+
+	// the stream is aborted by cancel on close or when a deadline is exceeded
+	ctx, cancel := context.WithCancel(context.Background())
+	req = req.WithContext(ctx)
+
+	req.Host = s.host
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Te", "trailers")
+	req.Header.Set("User-Agent", "grpc-go/1.36.0")
+
+	c := &grpcConn{pw: pw, ready: make(chan struct{}), raddr: s.addr, cancel: cancel}
+	c.abort = func() {
+		pw.CloseWithError(errGRPCTimeout)
+		cancel()
+	}
+
+	// the response headers may not be sent until the server has data,
+	// so the conn is returned without waiting for them.
+	go func() {
+		defer close(c.ready)
+
+		resp, err := s.transport.RoundTrip(req)
+		if err != nil {
+			logf("proxy-grpc stream to %s error: %s", s.url, err)
+			c.err = err
+			pr.CloseWithError(err)
+			return
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			c.err = newError(ErrProtocol, "proxy-grpc: unexpected response from "+s.url+": "+resp.Status)
+			pr.CloseWithError(c.err)
+			return
+		}
+
+		c.body = resp.Body
+		c.r = bufio.NewReader(resp.Body)
+	}()
+
+	logf("proxy-grpc connect to %s via %s", addr, s.url)
+	return c, nil
+}
+
+// DialUDP connects to the given address via the proxy.
+func (s *GRPC) DialUDP(network, addr string) (net.PacketConn, net.Addr, error) {
+	return nil, nil, newError(ErrUDPNotSupported, "proxy-grpc: udp not supported")
+}
+
+var errGRPCTimeout = &grpcTimeoutError{}
+
+type grpcTimeoutError struct{}
+
+func (e *grpcTimeoutError) Error() string   { return "proxy-grpc: i/o timeout" }
+func (e *grpcTimeoutError) Timeout() bool   { return true }
+func (e *grpcTimeoutError) Temporary() bool { return true }
+
+// grpcConn is a grpc stream
+type grpcConn struct {
+	streamDeadline
+
+	pw     *io.PipeWriter
+	raddr  string
+	cancel context.CancelFunc // cancels the request
+
+	ready chan struct{} // closed when the response is received
+	err   error
+	body  io.ReadCloser
+	r     *bufio.Reader
+	left  int // unread data of the current hunk
+
+	closeOnce sync.Once
+}
+
+func (c *grpcConn) Read(b []byte) (int, error) {
+	n, err := c.read(b)
+	if err != nil && c.timedOut() {
+		err = errGRPCTimeout
+	}
+	return n, err
+}
+
+func (c *grpcConn) read(b []byte) (int, error) {
+	<-c.ready
+	if c.err != nil {
+		return 0, c.err
+	}
+
+	for c.left == 0 {
+		n, err := c.readHunk()
+		if err != nil {
+			return 0, err
+		}
+		c.left = n
+	}
+
+	if len(b) > c.left {
+		b = b[:c.left]
+	}
+
+	n, err := c.r.Read(b)
+	c.left -= n
+	return n, err
+}
+
+// readHunk reads the headers of the next message, returns the length of its data:
+// Compressed(1) Length(4) Tag(1) DataLength(varint) Data
+func (c *grpcConn) readHunk() (int, error) {
+	var h [5]byte
+	if _, err := io.ReadFull(c.r, h[:]); err != nil {
+		return 0, err
+	}
+
+	if h[0] != 0 {
+		return 0, newError(ErrProtocol, "proxy-grpc: compressed messages not supported")
+	}
+
+	msgLen := int(binary.BigEndian.Uint32(h[1:]))
+	if msgLen == 0 {
+		return 0, nil
+	}
+
+	tag, err := c.r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+
+	if tag != 0x0a { // field 1, length-delimited
+		return 0, newError(ErrProtocol, "proxy-grpc: unexpected field in message")
+	}
+
+	n, err := binary.ReadUvarint(c.r)
+	if err != nil {
+		return 0, err
+	}
+
+	if int(n) != msgLen-1-uvarintLen(n) {
+		return 0, newError(ErrProtocol, "proxy-grpc: invalid message length")
+	}
+
+	return int(n), nil
+}
+
+func uvarintLen(n uint64) int {
+	var b [binary.MaxVarintLen64]byte
+	return binary.PutUvarint(b[:], n)
+}
+
+func (c *grpcConn) Write(b []byte) (int, error) {
+	var vb [binary.MaxVarintLen64]byte
+	vn := binary.PutUvarint(vb[:], uint64(len(b)))
+
+	buf := make([]byte, 5, 5+1+vn+len(b))
+	binary.BigEndian.PutUint32(buf[1:], uint32(1+vn+len(b)))
+	buf = append(buf, 0x0a)
+	buf = append(buf, vb[:vn]...)
+	buf = append(buf, b...)
+
+	if _, err := c.pw.Write(buf); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Close closes the request body and cancels the request, so the round trip returns
+// and the response body is closed even if the server never responds.
+func (c *grpcConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.pw.Close()
+		c.cancel()
+		c.stopTimers()
+		go func() {
+			<-c.ready
+			if c.body != nil {
+				c.body.Close()
+			}
+		}()
+	})
+	return nil
+}
+
+// streamDeadline is the deadlines of a stream over http2. A stream can not be resumed
+// after a read or write is interrupted, so the whole stream is aborted when a deadline is exceeded.
+type streamDeadline struct {
+	abort func()
+
+	mu      sync.Mutex
+	rt, wt  *time.Timer // the read and write deadline timers
+	expired int32
+}
+
+// expire aborts the stream when a deadline is exceeded
+func (d *streamDeadline) expire() {
+	atomic.StoreInt32(&d.expired, 1)
+	d.abort()
+}
+
+// timedOut reports whether the stream is aborted by a deadline
+func (d *streamDeadline) timedOut() bool {
+	return atomic.LoadInt32(&d.expired) == 1
+}
+
+// setTimer resets the deadline timer *tp to t, a zero t means no deadline
+func (d *streamDeadline) setTimer(tp **time.Timer, t time.Time) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if *tp != nil {
+		(*tp).Stop()
+		*tp = nil
+	}
+
+	if t.IsZero() {
+		return nil
+	}
+
+	if dur := time.Until(t); dur > 0 {
+		*tp = time.AfterFunc(dur, d.expire)
+	} else {
+		d.expire()
+	}
+	return nil
+}
+
+func (d *streamDeadline) stopTimers() {
+	d.setTimer(&d.rt, time.Time{})
+	d.setTimer(&d.wt, time.Time{})
+}
+
+func (d *streamDeadline) SetDeadline(t time.Time) error {
+	d.SetReadDeadline(t)
+	return d.SetWriteDeadline(t)
+}
+
+func (d *streamDeadline) SetReadDeadline(t time.Time) error  { return d.setTimer(&d.rt, t) }
+func (d *streamDeadline) SetWriteDeadline(t time.Time) error { return d.setTimer(&d.wt, t) }
+
+// grpcAddr is the address of a grpc stream
+type grpcAddr string
+
+func (a grpcAddr) Network() string { return "grpc" }
+func (a grpcAddr) String() string  { return string(a) }
+
+func (c *grpcConn) LocalAddr() net.Addr  { return grpcAddr("") }
+func (c *grpcConn) RemoteAddr() net.Addr { return grpcAddr(c.raddr) }
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// peerInterval is the interval to pull the forwarder states from the peer
+const peerInterval = 10 * time.Second
+
+// peerState is the state of a forwarder checked by an instance
+type peerState struct {
+	Addr    string `json:"addr"`
+	Enabled bool   `json:"enabled"`
+}
+
+func init() {
+	apiMux.HandleFunc("/forwarders/states", handleStates)
+}
+
+// handleStates lists the states of the forwarders which have passed a check here,
+// the ones learned from the peer are not listed, so the states don't bounce between the pair.
+func handleStates(w http.ResponseWriter, r *http.Request) {
+	list := []peerState{}
+
+	rrDialers.Lock()
+	for _, rr := range rrDialers.list {
+		for k, d := range rr.dialers {
+			if !rr.pending(k) {
+				list = append(list, peerState{Addr: d.Addr(), Enabled: atomic.LoadUint32(&rr.status[k]) == 1})
+			}
+		}
+	}
+	rrDialers.Unlock()
+
+	writeJSON(w, list)
+}
+
+// pullPeerStates pulls the forwarder states from the api of the peer periodically,
+// and applies them to the pending forwarders here.
+func pullPeerStates(peer string) {
+	if strings.HasPrefix(peer, ":") {
+		peer = "127.0.0.1" + peer
+	}
+
+	client := &http.Client{Timeout: peerInterval}
+	failed := false
+	for {
+		states, err := getPeerStates(client, "http://"+peer+"/forwarders/states")
+		if err != nil {
+			if !failed {
+				logf("ha-peer: get states from %s error: %s", peer, err)
+			}
+			failed = true
+		} else {
+			if failed {
+				logf("ha-peer: got states from %s again", peer)
+			}
+			failed = false
+			applyPeerStates(states)
+		}
+
+		time.Sleep(peerInterval)
+	}
+}
+
+func getPeerStates(client *http.Client, url string) ([]peerState, error) {
+	b, err := httpGet(client, url)
+	if err != nil {
+		return nil, err
+	}
+
+	var states []peerState
+	err = json.Unmarshal(b, &states)
+	return states, err
+}
+
+// applyPeerStates sets the states of the pending forwarders to the ones from the peer
+func applyPeerStates(states []peerState) {
+	m := make(map[string]uint32, len(states))
+	for _, s := range states {
+		v := uint32(2)
+		if s.Enabled {
+			v = 1
+		}
+
+		// a forwarder in several groups is enabled if it works in any of them
+		if old, ok := m[s.Addr]; !ok || old == 2 {
+			m[s.Addr] = v
+		}
+	}
+
+	rrDialers.Lock()
+	for _, rr := range rrDialers.list {
+		for k, d := range rr.dialers {
+			v, ok := m[d.Addr()]
+			if !ok {
+				continue
+			}
+			atomic.StoreUint32(&rr.peer[k], v)
+
+			enabled := v == 1
+			if rr.pending(k) && (atomic.LoadUint32(&rr.status[k]) == 1) != enabled {
+				rr.setStatus(k, enabled)
+				state := "DISABLED"
+				if enabled {
+					state = "ENABLED"
+				}
+				logf("ha-peer: %s set to %s by the peer", d.Addr(), state)
+			}
+		}
+	}
+	rrDialers.Unlock()
+}
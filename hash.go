@@ -0,0 +1,125 @@
+package main
+
+import (
+	"hash/fnv"
+	"net"
+	"sync/atomic"
+)
+
+// hashDialer is the hashing strategy, a destination(dh) or a client(sh) always uses the same
+// dialer while it's enabled, so the sites which dislike the ip changes in a session keep working.
+// The hash is over all the dialers, so only the keys of a disabled dialer move to the others.
+type hashDialer struct {
+	*rrDialer
+	src   bool  // sh: hash the client ip, the destination if unknown
+	table []int // indexes of all the dialers repeated by the weights
+}
+
+// newHashDialer returns a new dh dialer, or a sh dialer if src is true
+func newHashDialer(dialers []Dialer, s *StrategyConfig, src bool) Dialer {
+	h := &hashDialer{rrDialer: newRRDialer(dialers, s), src: src}
+
+	all := make([]int, len(dialers))
+	for k := range all {
+		all[k] = k
+	}
+	h.table = weightedSlots(all, h.weight)
+
+	return h
+}
+
+func (h *hashDialer) Dial(network, addr string) (net.Conn, error) {
+	return h.DialFrom(network, addr, "", nil)
+}
+
+// DialVia dials addr with the via chain
+func (h *hashDialer) DialVia(network, addr, via string) (net.Conn, error) {
+	return h.DialFrom(network, addr, via, nil)
+}
+
+// DialFrom dials addr with the via chain for the client src
+func (h *hashDialer) DialFrom(network, addr, via string, src net.IP) (net.Conn, error) {
+	d := h.pick(addr, src)
+	c, err := dialVia(d, network, addr, via)
+	return h.dialed(network, addr, via, d, c, err)
+}
+
+func (h *hashDialer) DialUDP(network, addr string) (pc net.PacketConn, writeTo net.Addr, err error) {
+	return h.DialUDPFrom(network, addr, nil)
+}
+
+// DialUDPFrom connects to addr for the client src
+func (h *hashDialer) DialUDPFrom(network, addr string, src net.IP) (net.PacketConn, net.Addr, error) {
+	return dialUDPTracked(h.pick(addr, src), network, addr)
+}
+
+// NextDialer returns the dialer of dstAddr, the client is unknown here.
+func (h *hashDialer) NextDialer(dstAddr string) Dialer {
+	return h.pick(dstAddr, nil)
+}
+
+// pick returns the learned dialer of dstAddr, or the dialer of the hash of the key,
+// which is the client ip of sh, or the host of dstAddr.
+func (h *hashDialer) pick(dstAddr string, src net.IP) Dialer {
+	if d := h.learnedDialer(dstAddr); d != nil {
+		return d
+	}
+
+	key := dstHost(dstAddr)
+	if h.src && src != nil {
+		key = normalizeIP(src).String()
+	}
+
+	f := fnv.New32a()
+	f.Write([]byte(key))
+	sum := f.Sum32()
+
+	idx := h.table[sum%uint32(len(h.table))]
+	if !h.usable(idx) {
+		slots := h.slots.Load().([]int)
+		if len(slots) == 0 {
+			logf("NO AVAILABLE PROXY FOUND! please check your network or proxy server settings.")
+			return h.dialers[idx]
+		}
+		idx = slots[sum%uint32(len(slots))]
+	}
+
+	atomic.StoreUint32(&h.idx, uint32(idx))
+	return h.dialers[idx]
+}
+
+// srcDialer is a dialer which passes the client ip of a request on to the sh strategy,
+// so it's carried per connection through the rules and the wrappers like the via chain.
+type srcDialer interface {
+	DialFrom(network, addr, via string, src net.IP) (net.Conn, error)
+	DialUDPFrom(network, addr string, src net.IP) (net.PacketConn, net.Addr, error)
+}
+
+// dialFrom dials addr via d with the via chain for the client src, as dialVia if d does not pass it on.
+func dialFrom(d Dialer, network, addr, via string, src net.IP) (net.Conn, error) {
+	if sd, ok := d.(srcDialer); ok && src != nil {
+		return sd.DialFrom(network, addr, via, src)
+	}
+	return dialVia(d, network, addr, via)
+}
+
+// dialUDPFrom connects to addr via d for the client src, as DialUDP if d does not pass it on.
+func dialUDPFrom(d Dialer, network, addr string, src net.IP) (net.PacketConn, net.Addr, error) {
+	if sd, ok := d.(srcDialer); ok && src != nil {
+		return sd.DialUDPFrom(network, addr, src)
+	}
+	return d.DialUDP(network, addr)
+}
+
+// srcIP returns the ip of the client address addr, nil if it's not an ip
+func srcIP(addr net.Addr) net.IP {
+	if addr == nil {
+		return nil
+	}
+
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
@@ -6,6 +6,7 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"crypto/tls"
 	"encoding/base64"
 	"errors"
 	"fmt"
@@ -15,6 +16,8 @@ import (
 	"net/url"
 	"strings"
 	"time"
+
+	utls "github.com/refraction-networking/utls"
 )
 
 // HTTP struct
@@ -24,8 +27,13 @@ type HTTP struct {
 
 	user     string
 	password string
-	xff      bool // X-Forwarded-For
-	xsi      bool // X-Server-IP
+	auth     Authenticator // server side authentication
+	xff      bool          // X-Forwarded-For
+	xsi      bool          // X-Server-IP
+	wpad     bool          // serve the pac file at /wpad.dat and /proxy.pac
+
+	tlsConfig *tls.Config // as client, connect to the proxy over tls(https)
+	tlsFP     *utls.ClientHelloID
 
 	selfip string
 }
@@ -54,12 +62,49 @@ func NewHTTP(addr, user, pass, rawQuery string, cDialer Dialer, sDialer Dialer)
 		}
 	}
 
+	s.wpad = p.Get("wpad") == "true"
+
+	if sDialer != nil {
+		auth, err := NewAuthenticator(user, pass, rawQuery)
+		if err != nil {
+			return nil, err
+		}
+		s.auth = auth
+	}
+
+	return s, nil
+}
+
+// NewHTTPS returns a http proxy client which connects to the proxy server over tls,
+// with skipverify=true in rawQuery, the server certificate will not be verified,
+// with fingerprint=chrome, the client hello emulates chrome, see utls.go.
+func NewHTTPS(addr, user, pass, rawQuery string, cDialer Dialer) (*HTTP, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+		addr = net.JoinHostPort(addr, "443")
+	}
+
+	s, err := NewHTTP(addr, user, pass, "", cDialer, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	p, _ := url.ParseQuery(rawQuery)
+	if s.tlsConfig, err = tlsClientConfig(host, p); err != nil {
+		return nil, errors.New("proxy-https: " + err.Error())
+	}
+
+	if s.tlsFP, err = parseFingerprint(p.Get("fingerprint")); err != nil {
+		return nil, errors.New("proxy-https: " + err.Error())
+	}
+
 	return s, nil
 }
 
 // ListenAndServe .
 func (s *HTTP) ListenAndServe() {
-	l, err := net.Listen("tcp", s.addr)
+	l, err := listen("tcp", s.addr)
 	if err != nil {
 		logf("failed to listen on %s: %v", s.addr, err)
 		return
@@ -68,14 +113,27 @@ func (s *HTTP) ListenAndServe() {
 
 	logf("listening TCP on %s", s.addr)
 
+	b := budgetOf(s.addr)
 	for {
 		c, err := l.Accept()
 		if err != nil {
+			if isClosed(err) {
+				return
+			}
 			logf("failed to accept: %v", err)
 			continue
 		}
 
-		go s.Serve(c)
+		if !b.acquireConn() {
+			logf("proxy-http %s rejected, too many connections on %s", c.RemoteAddr(), s.addr)
+			c.Close()
+			continue
+		}
+
+		go func() {
+			defer b.releaseConn()
+			s.Serve(b.limit(c))
+		}()
 	}
 }
 
@@ -94,19 +152,53 @@ func (s *HTTP) Serve(c net.Conn) {
 		return
 	}
 
-	if method == "CONNECT" {
-		s.servHTTPS(method, requestURI, proto, c)
-		return
-	}
-
 	reqHeader, err := reqTP.ReadMIMEHeader()
 	if err != nil {
 		logf("read header error:%s", err)
 		return
 	}
+
+	// the pac file is fetched as a normal request without the proxy credentials
+	if s.wpad && method == "GET" && (requestURI == "/wpad.dat" || requestURI == "/proxy.pac") {
+		s.servePAC(c, proto)
+		return
+	}
+
+	if s.auth != nil && !s.checkAuth(reqHeader.Get("Proxy-Authorization")) {
+		fmt.Fprintf(c, "%s 407 Proxy Authentication Required\r\nProxy-Authenticate: Basic realm=\"glider\"\r\n\r\n", proto)
+		logf("proxy-http %s authentication failed", c.RemoteAddr())
+		addResult(resultAuthFail)
+		return
+	}
+
+	via := reqHeader.Get(viaHeader)
+
+	if method == "CONNECT" {
+		if !checkVia(via) {
+			fmt.Fprintf(c, "%s 508 Loop Detected\r\n\r\n", proto)
+			logf("proxy-https %s <-> %s, forward loop detected, via: %s", c.RemoteAddr(), requestURI, via)
+			return
+		}
+
+		// the client may send data(e.g. tls client hello) right after the request, which are in reqR
+		s.servHTTPS(method, requestURI, proto, via, conn{reqR, c})
+		return
+	}
+
+	// Upgrade: websocket, pass through after the handshake
+	upgrade := ""
+	if headerHasToken(reqHeader, "Connection", "upgrade") {
+		upgrade = reqHeader.Get("Upgrade")
+	}
+
 	cleanHeaders(reqHeader)
-	// tell the remote server not to keep alive
-	reqHeader.Set("Connection", "close")
+	if upgrade != "" {
+		reqHeader.Set("Connection", "Upgrade")
+		reqHeader.Set("Upgrade", upgrade)
+	} else {
+		// tell the remote server not to keep alive
+		reqHeader.Set("Connection", "close")
+	}
 
 	// X-Forwarded-For
 	if s.xff {
@@ -129,8 +221,27 @@ func (s *HTTP) Serve(c net.Conn) {
 		tgt += ":80"
 	}
 
-	rc, err := s.sDialer.Dial("tcp", tgt)
+	if !checkVia(via) {
+		fmt.Fprintf(c, "%s 508 Loop Detected\r\n\r\n", proto)
+		logf("proxy-http %s <-> %s, forward loop detected, via: %s", c.RemoteAddr(), tgt, via)
+		return
+	}
+
+	// the rule dialer rewrites the address to connect, and the Host for the deprecated names
+	if rd, ok := s.sDialer.(*RuleDialer); ok {
+		if host := reqHeader.Get("Host"); host != "" {
+			reqHeader.Set("Host", rd.rewriteHost(tgt, host))
+		}
+	}
+
+	rc, err := dialFrom(s.sDialer, "tcp", tgt, via, srcIP(c.RemoteAddr()))
 	if err != nil {
+		addResult(resultOfDial(err))
+		if resp, ok := staticResponseOf(err); ok {
+			resp.write(c, proto)
+			logf("proxy-http %s <-> %s, %s", c.RemoteAddr(), tgt, resp)
+			return
+		}
 		fmt.Fprintf(c, "%s 502 ERROR\r\n\r\n", proto)
 		logf("failed to dial: %v", err)
 		return
@@ -170,8 +281,13 @@ func (s *HTTP) Serve(c net.Conn) {
 		return
 	}
 
-	respHeader.Set("Proxy-Connection", "close")
-	respHeader.Set("Connection", "close")
+	// 101 Switching Protocols, relay the raw data in both directions from now on
+	if upgrade != "" && code == "101" {
+		logf("proxy-http %s <-> %s, upgrade to %s", c.RemoteAddr(), tgt, upgrade)
+	} else {
+		respHeader.Set("Proxy-Connection", "close")
+		respHeader.Set("Connection", "close")
+	}
 
 	if s.xsi {
 		respHeader.Set("X-Server-IP", rc.RemoteAddr().(*net.TCPAddr).IP.String())
@@ -184,13 +300,21 @@ func (s *HTTP) Serve(c net.Conn) {
 	logf("proxy-http %s <-> %s", c.RemoteAddr(), tgt)
 	c.Write(respBuf.Bytes())
 
-	io.Copy(c, respR)
+	n, _ := io.Copy(c, respR)
+	addTraffic(tgt, "", int64(reqBuf.Len()), int64(respBuf.Len())+n)
 
 }
 
-func (s *HTTP) servHTTPS(method, requestURI, proto string, c net.Conn) {
-	rc, err := s.sDialer.Dial("tcp", requestURI)
+func (s *HTTP) servHTTPS(method, requestURI, proto, via string, c net.Conn) {
+	rc, err := dialFrom(s.sDialer, "tcp", requestURI, via, srcIP(c.RemoteAddr()))
 	if err != nil {
+		addResult(resultOfDial(err))
+		// the browsers don't show the response of CONNECT, but the status tells it's blocked
+		if resp, ok := staticResponseOf(err); ok {
+			resp.write(c, proto)
+			logf("proxy-https %s <-> %s, %s", c.RemoteAddr(), requestURI, resp)
+			return
+		}
 		c.Write([]byte(proto))
 		c.Write([]byte(" 502 ERROR\r\n\r\n"))
 		logf("failed to dial: %v", err)
@@ -201,7 +325,7 @@ func (s *HTTP) servHTTPS(method, requestURI, proto string, c net.Conn) {
 
 	logf("proxy-https %s <-> %s", c.RemoteAddr(), requestURI)
 
-	_, _, err = relay(c, rc)
+	err = relayStats(c, rc, requestURI)
 	if err != nil {
 		if err, ok := err.(net.Error); ok && err.Timeout() {
 			return // ignore i/o timeout
@@ -210,8 +334,47 @@ func (s *HTTP) servHTTPS(method, requestURI, proto string, c net.Conn) {
 	}
 }
 
+// servePAC serves the proxy auto-config file which points to this listener
+func (s *HTTP) servePAC(c net.Conn, proto string) {
+	pac := "function FindProxyForURL(url, host) {\n" +
+		"  if (isPlainHostName(host) || shExpMatch(host, \"*.local\")) return \"DIRECT\";\n" +
+		"  return \"PROXY " + c.LocalAddr().String() + "; DIRECT\";\n}\n"
+
+	fmt.Fprintf(c, "%s 200 OK\r\nContent-Type: application/x-ns-proxy-autoconfig\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s",
+		proto, len(pac), pac)
+
+	logf("proxy-http %s pac file served", c.RemoteAddr())
+}
+
+// checkAuth checks the "Proxy-Authorization: Basic xxx" header value
+func (s *HTTP) checkAuth(auth string) bool {
+	const prefix = "Basic "
+	if !strings.HasPrefix(auth, prefix) {
+		return false
+	}
+
+	b, err := base64.StdEncoding.DecodeString(auth[len(prefix):])
+	if err != nil {
+		return false
+	}
+
+	userPass := string(b)
+	i := strings.IndexByte(userPass, ':')
+	if i < 0 {
+		return false
+	}
+
+	return s.auth.Auth(userPass[:i], userPass[i+1:])
+}
+
 // Dial connects to the address addr on the network net via the proxy.
 func (s *HTTP) Dial(network, addr string) (net.Conn, error) {
+	return s.DialVia(network, addr, "")
+}
+
+// DialVia connects to the address addr via the proxy, and passes the via chain on.
+func (s *HTTP) DialVia(network, addr, via string) (net.Conn, error) {
+	start := time.Now()
 	rc, err := s.cDialer.Dial(network, s.addr)
 	if err != nil {
 		logf("dial to %s error: %s", s.addr, err)
@@ -222,34 +385,76 @@ func (s *HTTP) Dial(network, addr string) (net.Conn, error) {
 		c.SetKeepAlive(true)
 	}
 
-	rc.Write([]byte("CONNECT " + addr + " HTTP/1.0\r\n"))
-	rc.Write([]byte("Proxy-Connection: close\r\n"))
+	if s.tlsConfig != nil {
+		tc, err := tlsClient(rc, s.tlsConfig, s.tlsFP)
+		if err != nil {
+			rc.Close()
+			logf("proxy-https tls handshake with %s error: %s", s.addr, err)
+			return nil, err
+		}
+		rc = tc
+	}
+
+	var req bytes.Buffer
+	req.WriteString("CONNECT " + addr + " HTTP/1.0\r\n")
+	req.WriteString("Host: " + addr + "\r\n")
+	req.WriteString("Proxy-Connection: close\r\n")
 
-	if s.user != "" && s.password != "" {
+	if conf.LoopDetect {
+		req.WriteString(viaHeader + ": " + nextVia(via) + "\r\n")
+	}
+
+	if s.user != "" {
 		auth := s.user + ":" + s.password
-		rc.Write([]byte("Proxy-Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(auth)) + "\r\n"))
+		req.WriteString("Proxy-Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(auth)) + "\r\n")
 	}
 
 	//header ended
-	rc.Write([]byte("\r\n"))
+	req.WriteString("\r\n")
+
+	if _, err := rc.Write(req.Bytes()); err != nil {
+		rc.Close()
+		return nil, err
+	}
 
 	respR := bufio.NewReader(rc)
 	respTP := textproto.NewReader(respR)
 	_, code, _, ok := parseFirstLine(respTP)
 	if ok && code == "200" {
-		return rc, err
-	} else if code == "407" {
+		// skip the response headers, and keep the data after them in respR
+		if _, err := respTP.ReadMIMEHeader(); err != nil {
+			rc.Close()
+			return nil, err
+		}
+
+		logf("proxy-http connect to %s via %s, handshake: %s", addr, s.addr, time.Since(start))
+		return newTTFBConn(conn{respR, rc}, start, getLatencyStats("http", s.addr)), nil
+	}
+
+	rc.Close()
+
+	if code == "407" {
 		logf("proxy-http authencation needed by proxy %s", s.addr)
+	} else if code == "508" {
+		logf("proxy-http forward loop detected by proxy %s", s.addr)
 	} else if code == "405" {
 		logf("proxy-http 'CONNECT' method not allowed by proxy %s", s.addr)
 	}
 
-	return nil, errors.New("proxy-http cound not connect remote address: " + addr + ". error code: " + code)
+	msg := "proxy-http cound not connect remote address: " + addr + ". error code: " + code
+	switch code {
+	case "407":
+		return nil, newError(ErrAuth, msg)
+	case "502", "503", "504":
+		return nil, newError(ErrUnreachable, msg)
+	}
+
+	return nil, newError(ErrRejected, msg)
 }
 
 // DialUDP connects to the given address via the proxy.
 func (s *HTTP) DialUDP(network, addr string) (pc net.PacketConn, writeTo net.Addr, err error) {
-	return nil, nil, errors.New("http client does not support udp")
+	return nil, nil, newError(ErrUDPNotSupported, "http client does not support udp")
 }
 
 // parseFirstLine parses "GET /foo HTTP/1.1" OR "HTTP/1.1 200 OK" into its three parts.
@@ -270,6 +475,18 @@ func parseFirstLine(tp *textproto.Reader) (r1, r2, r3 string, ok bool) {
 	return line[:s1], line[s1+1 : s2], line[s2+1:], true
 }
 
+// headerHasToken reports whether the comma-separated header key contains token(case-insensitive)
+func headerHasToken(header textproto.MIMEHeader, key, token string) bool {
+	for _, v := range header[textproto.CanonicalMIMEHeaderKey(key)] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func cleanHeaders(header textproto.MIMEHeader) {
 	header.Del("Proxy-Connection")
 	header.Del("Connection")
@@ -280,6 +497,7 @@ func cleanHeaders(header textproto.MIMEHeader) {
 	header.Del("Trailers")
 	header.Del("Transfer-Encoding")
 	header.Del("Upgrade")
+	header.Del(viaHeader)
 }
 
 func writeFirstLine(s1, s2, s3 string, buf *bytes.Buffer) {
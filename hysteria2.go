@@ -0,0 +1,665 @@
+// hysteria2 client, tcp and udp:
+// https://v2.hysteria.network/docs/developers/Protocol/
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/bits"
+	mrand "math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+const (
+	hy2StatusAuthOK  = 233   // status of the successful auth request
+	hy2TCPRequest    = 0x401 // frame type of the tcp requests
+	hy2MaxMessage    = 2048  // max length of the message in the tcp response
+	hy2MaxPadding    = 4096  // max length of the padding in the tcp response
+	hy2SalamanderLen = 8     // salt length of the salamander obfuscation
+)
+
+// Hysteria2 is a hysteria2 client:
+//
+//	forward: hysteria2://password@host:443?obfs=salamander&obfs-password=PASS&down=100
+//
+// The tcp connections are quic streams, and the udp packets are quic datagrams if the server allows.
+// down=MBPS is the download bandwidth, the server sends at this rate(brutal), the server decides
+// (bbr) if not set; the upload uses the congestion control of quic-go. The tls options are the same
+// as the tls forwarder, the alpn is always h3.
+type Hysteria2 struct {
+	*Forwarder
+
+	auth       string
+	rx         uint64 // download bandwidth, bytes per second
+	obfs       []byte // salamander password
+	tlsConfig  *tls.Config
+	quicConfig *quic.Config
+
+	mu   sync.Mutex
+	conn *hy2Conn // shared by the streams and udp sessions
+}
+
+// NewHysteria2 returns a hysteria2 client, user:pass is sent as the password "user:pass".
+func NewHysteria2(addr, user, pass, rawQuery string, cDialer Dialer) (*Hysteria2, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+		addr = net.JoinHostPort(host, "443")
+	}
+
+	p, _ := url.ParseQuery(rawQuery)
+
+	s := &Hysteria2{
+		Forwarder:  NewForwarder(addr, cDialer),
+		auth:       user,
+		quicConfig: newQUICConfig(false, defaultKeepAlive),
+	}
+	s.quicConfig.EnableDatagrams = true
+
+	if pass != "" {
+		s.auth += ":" + pass
+	}
+
+	if s.tlsConfig, err = tlsClientConfig(host, p); err != nil {
+		return nil, errors.New("proxy-hysteria2: " + err.Error())
+	}
+	s.tlsConfig.NextProtos = []string{"h3"}
+
+	if v := p.Get("down"); v != "" {
+		mbps, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			return nil, errors.New("proxy-hysteria2: invalid down '" + v + "', the bandwidth in mbps")
+		}
+		s.rx = mbps * 1000000 / 8
+	}
+
+	switch p.Get("obfs") {
+	case "":
+	case "salamander":
+		if len(p.Get("obfs-password")) < 4 {
+			return nil, errors.New("proxy-hysteria2: obfs-password of salamander must be at least 4 bytes")
+		}
+		s.obfs = []byte(p.Get("obfs-password"))
+	default:
+		return nil, errors.New("proxy-hysteria2: obfs '" + p.Get("obfs") + "' not supported, available: salamander")
+	}
+
+	// the salt of salamander is in every packet
+	extra := 0
+	if s.obfs != nil {
+		extra = hy2SalamanderLen
+	}
+	if err := setQUICMTU(s.quicConfig, p, extra); err != nil {
+		return nil, errors.New("proxy-hysteria2: " + err.Error())
+	}
+
+	return s, nil
+}
+
+// getConn returns the authenticated quic connection to the server, reconnects if closed
+func (s *Hysteria2) getConn() (*hy2Conn, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn != nil {
+		select {
+		case <-s.conn.Context().Done():
+			s.conn = nil
+		default:
+			return s.conn, nil
+		}
+	}
+
+	pc, writeTo, err := s.cDialer.DialUDP("udp", s.addr)
+	if err != nil {
+		logf("dialudp to %s error: %s", s.addr, err)
+		return nil, err
+	}
+
+	if s.obfs != nil {
+		pc = &salamanderConn{PacketConn: pc, psk: s.obfs}
+	}
+
+	var qc *quic.Conn
+	rt := &http3.Transport{
+		TLSClientConfig: s.tlsConfig,
+		QUICConfig:      s.quicConfig,
+		Dial: func(ctx context.Context, _ string, tlsCfg *tls.Config, cfg *quic.Config) (*quic.Conn, error) {
+			var err error
+			qc, err = quic.DialEarly(ctx, pc, writeTo, tlsCfg, cfg)
+			return qc, err
+		},
+	}
+
+	req, _ := http.NewRequest(http.MethodPost, "https://hysteria/auth", nil)
+	req.Header.Set("Hysteria-Auth", s.auth)
+	req.Header.Set("Hysteria-CC-RX", strconv.FormatUint(s.rx, 10))
+	req.Header.Set("Hysteria-Padding", hy2Padding(256, 2048))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	resp, err := rt.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		rt.Close()
+		pc.Close()
+		logf("proxy-hysteria2 handshake with %s error: %s", s.addr, err)
+		return nil, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != hy2StatusAuthOK {
+		rt.Close()
+		pc.Close()
+		return nil, newError(ErrAuth, "proxy-hysteria2: authentication failed, status "+strconv.Itoa(resp.StatusCode))
+	}
+
+	logf("proxy-hysteria2 connected to %s, udp: %s, server rx: %s", s.addr,
+		resp.Header.Get("Hysteria-UDP"), resp.Header.Get("Hysteria-CC-RX"))
+
+	conn := &hy2Conn{
+		Conn:     qc,
+		rt:       rt,
+		udp:      resp.Header.Get("Hysteria-UDP") == "true",
+		sessions: make(map[uint32]*hy2PacketConn),
+	}
+
+	if conn.udp {
+		go conn.receive()
+	}
+
+	// the packet conn is not owned by quic-go
+	go func() {
+		<-conn.Context().Done()
+		rt.Close()
+		pc.Close()
+	}()
+
+	s.conn = conn
+	return conn, nil
+}
+
+// Dial connects to the address addr on the network net via the proxy.
+func (s *Hysteria2) Dial(network, addr string) (net.Conn, error) {
+	start := time.Now()
+
+	// retry once with a new connection, the old one may be timed out
+	for i := 0; ; i++ {
+		conn, err := s.getConn()
+		if err != nil {
+			return nil, err
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		st, err := conn.OpenStreamSync(ctx)
+		cancel()
+
+		if err != nil {
+			logf("proxy-hysteria2 open stream to %s error: %s", s.addr, err)
+			conn.CloseWithError(0, "")
+			if i > 0 {
+				return nil, err
+			}
+			continue
+		}
+
+		c := &quicConn{Stream: st, conn: conn.Conn}
+		if err := hy2Connect(c, addr); err != nil {
+			c.Close()
+			return nil, err
+		}
+
+		logf("proxy-hysteria2 connect to %s via %s, handshake: %s", addr, s.addr, time.Since(start))
+		return newTTFBConn(c, start, getLatencyStats("hysteria2", s.addr)), nil
+	}
+}
+
+// hy2Connect sends the tcp request and reads the response:
+// request: ID(varint) AddrLen(varint) Addr PaddingLen(varint) Padding
+// response: Status(1) MsgLen(varint) Msg PaddingLen(varint) Padding
+func hy2Connect(c net.Conn, addr string) error {
+	padding := hy2Padding(64, 512)
+
+	b := appendVarint(nil, hy2TCPRequest)
+	b = appendVarint(b, uint64(len(addr)))
+	b = append(b, addr...)
+	b = appendVarint(b, uint64(len(padding)))
+	b = append(b, padding...)
+
+	if _, err := c.Write(b); err != nil {
+		return err
+	}
+
+	var status [1]byte
+	if _, err := io.ReadFull(c, status[:]); err != nil {
+		return err
+	}
+
+	n, err := readVarint(c)
+	if err != nil {
+		return err
+	}
+	if n > hy2MaxMessage {
+		return newError(ErrProtocol, "proxy-hysteria2: message too long: "+strconv.FormatUint(n, 10))
+	}
+
+	msg := make([]byte, n)
+	if _, err := io.ReadFull(c, msg); err != nil {
+		return err
+	}
+
+	if n, err = readVarint(c); err != nil {
+		return err
+	}
+	if n > hy2MaxPadding {
+		return newError(ErrProtocol, "proxy-hysteria2: padding too long: "+strconv.FormatUint(n, 10))
+	}
+
+	if _, err := io.CopyN(ioutil.Discard, c, int64(n)); err != nil {
+		return err
+	}
+
+	if status[0] != 0 {
+		return newError(ErrUnreachable, "proxy-hysteria2: connect to "+addr+" error: "+string(msg))
+	}
+
+	return nil
+}
+
+// DialUDP connects to the given address via the proxy.
+func (s *Hysteria2) DialUDP(network, addr string) (net.PacketConn, net.Addr, error) {
+	conn, err := s.getConn()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !conn.udp {
+		return nil, nil, newError(ErrUDPNotSupported, "proxy-hysteria2: udp not enabled by "+s.addr)
+	}
+
+	return conn.newSession(addr), conn.RemoteAddr(), nil
+}
+
+// hy2Conn is an authenticated quic connection to the server
+type hy2Conn struct {
+	*quic.Conn
+	rt  *http3.Transport
+	udp bool // the server allows udp
+
+	mu       sync.Mutex
+	sessions map[uint32]*hy2PacketConn
+	nextID   uint32
+}
+
+func (c *hy2Conn) newSession(tgt string) *hy2PacketConn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.nextID++
+	pc := &hy2PacketConn{
+		udpSession: newUDPSession(),
+		conn:       c,
+		id:         c.nextID,
+		tgt:        tgt,
+	}
+	c.sessions[pc.id] = pc
+
+	return pc
+}
+
+// receive dispatches the datagrams to the udp sessions until the connection is closed
+func (c *hy2Conn) receive() {
+	for {
+		b, err := c.ReceiveDatagram(context.Background())
+		if err != nil {
+			c.mu.Lock()
+			for _, pc := range c.sessions {
+				pc.Close()
+			}
+			c.mu.Unlock()
+			return
+		}
+
+		m, err := parseHy2UDPMsg(b)
+		if err != nil {
+			logf("proxy-hysteria2 %s", err)
+			continue
+		}
+
+		c.mu.Lock()
+		pc := c.sessions[m.sid]
+		c.mu.Unlock()
+
+		if pc != nil {
+			pc.deliver(m)
+		}
+	}
+}
+
+// hy2HeaderLen returns the header length of the udp message in a datagram:
+// SessionID(4) PacketID(2) FragID(1) FragCount(1) AddrLen(varint) Addr Payload
+func hy2HeaderLen(m *udpMsg) int {
+	return 8 + varintLen(uint64(len(m.addr))) + len(m.addr)
+}
+
+func hy2Marshal(m *udpMsg) []byte {
+	b := make([]byte, 8, hy2HeaderLen(m)+len(m.data))
+	binary.BigEndian.PutUint32(b, m.sid)
+	binary.BigEndian.PutUint16(b[4:], m.pktID)
+	b[6], b[7] = m.fragID, m.fragCount
+	b = appendVarint(b, uint64(len(m.addr)))
+	b = append(b, m.addr...)
+	return append(b, m.data...)
+}
+
+func parseHy2UDPMsg(b []byte) (udpMsg, error) {
+	var m udpMsg
+	if len(b) < 9 {
+		return m, errors.New("udp message too short")
+	}
+
+	m.sid = binary.BigEndian.Uint32(b)
+	m.pktID = binary.BigEndian.Uint16(b[4:])
+	m.fragID, m.fragCount = b[6], b[7]
+
+	r := &byteReader{b: b[8:]}
+	n, err := readVarint(r)
+	if err != nil || n > uint64(len(r.b)) {
+		return m, errors.New("invalid address in udp message")
+	}
+
+	m.addr, m.data = string(r.b[:n]), r.b[n:]
+	if m.fragCount == 0 || m.fragID >= m.fragCount {
+		return m, errors.New("invalid fragment in udp message")
+	}
+
+	return m, nil
+}
+
+// hy2PacketConn is a udp session, all the packets are sent to tgt
+type hy2PacketConn struct {
+	*udpSession
+	conn *hy2Conn
+	id   uint32
+	tgt  string
+
+	pktID uint16 // guarded by mu
+}
+
+// WriteTo writes a packet to the target of the session, addr is ignored.
+// The packet is fragmented if it's larger than the max datagram size.
+func (pc *hy2PacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if pc.isClosed() {
+		return 0, errUDPSessionClosed
+	}
+
+	pc.mu.Lock()
+	pc.pktID++
+	m := udpMsg{sid: pc.id, pktID: pc.pktID, fragCount: 1, addr: pc.tgt, data: b}
+	pc.mu.Unlock()
+
+	err := pc.conn.SendDatagram(hy2Marshal(&m))
+
+	var tooLarge *quic.DatagramTooLargeError
+	if !errors.As(err, &tooLarge) {
+		if err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+
+	size := int(tooLarge.MaxDatagramPayloadSize) - hy2HeaderLen(&m)
+	if size <= 0 || (len(b)+size-1)/size > 255 {
+		return 0, err
+	}
+
+	m.fragCount = uint8((len(b) + size - 1) / size)
+	for i := 0; i < int(m.fragCount); i++ {
+		m.fragID, m.data = uint8(i), b[i*size:]
+		if len(m.data) > size {
+			m.data = m.data[:size]
+		}
+		if err := pc.conn.SendDatagram(hy2Marshal(&m)); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(b), nil
+}
+
+// Close closes the session, the server side is closed when idle.
+func (pc *hy2PacketConn) Close() error {
+	pc.close(func() {
+		pc.conn.mu.Lock()
+		delete(pc.conn.sessions, pc.id)
+		pc.conn.mu.Unlock()
+	})
+	return nil
+}
+
+func (pc *hy2PacketConn) LocalAddr() net.Addr { return pc.conn.LocalAddr() }
+
+// hy2Padding returns a random string with length in [min, max)
+func hy2Padding(min, max int) string {
+	const chars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+	b := make([]byte, min+mrand.Intn(max-min))
+	for i := range b {
+		b[i] = chars[mrand.Intn(len(chars))]
+	}
+	return string(b)
+}
+
+// appendVarint appends v as a quic variable-length integer(RFC 9000 16), v must be less than 2^62.
+func appendVarint(b []byte, v uint64) []byte {
+	switch n := varintLen(v); n {
+	case 1:
+		return append(b, byte(v))
+	case 2:
+		return append(b, byte(v>>8)|0x40, byte(v))
+	case 4:
+		return append(b, byte(v>>24)|0x80, byte(v>>16), byte(v>>8), byte(v))
+	default:
+		var buf [8]byte
+		binary.BigEndian.PutUint64(buf[:], v)
+		buf[0] |= 0xc0
+		return append(b, buf[:]...)
+	}
+}
+
+func varintLen(v uint64) int {
+	switch {
+	case v < 1<<6:
+		return 1
+	case v < 1<<14:
+		return 2
+	case v < 1<<30:
+		return 4
+	}
+	return 8
+}
+
+// readVarint reads a quic variable-length integer
+func readVarint(r io.Reader) (uint64, error) {
+	var b [8]byte
+	if _, err := io.ReadFull(r, b[:1]); err != nil {
+		return 0, err
+	}
+
+	n := 1 << (b[0] >> 6)
+	b[0] &= 0x3f
+	if _, err := io.ReadFull(r, b[1:n]); err != nil {
+		return 0, err
+	}
+
+	var v uint64
+	for _, c := range b[:n] {
+		v = v<<8 | uint64(c)
+	}
+	return v, nil
+}
+
+// byteReader reads from b
+type byteReader struct{ b []byte }
+
+func (r *byteReader) Read(p []byte) (int, error) {
+	if len(r.b) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.b)
+	r.b = r.b[n:]
+	return n, nil
+}
+
+// salamanderConn is the salamander obfuscation of the quic packets:
+// Salt(8) Payload, the payload is xored with blake2b-256(psk + salt).
+type salamanderConn struct {
+	net.PacketConn
+	psk []byte
+
+	rmu  sync.Mutex
+	rbuf [2048]byte
+}
+
+func (c *salamanderConn) key(salt []byte) [32]byte {
+	return blake2b256(append(append([]byte{}, c.psk...), salt...))
+}
+
+func (c *salamanderConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(c.rbuf[:])
+		if err != nil {
+			return 0, addr, err
+		}
+
+		if n <= hy2SalamanderLen {
+			continue
+		}
+
+		key := c.key(c.rbuf[:hy2SalamanderLen])
+		payload := c.rbuf[hy2SalamanderLen:n]
+		for i := range payload {
+			payload[i] ^= key[i%len(key)]
+		}
+
+		return copy(b, payload), addr, nil
+	}
+}
+
+func (c *salamanderConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	buf := make([]byte, hy2SalamanderLen+len(b))
+	if _, err := rand.Read(buf[:hy2SalamanderLen]); err != nil {
+		return 0, err
+	}
+
+	key := c.key(buf[:hy2SalamanderLen])
+	for i, v := range b {
+		buf[hy2SalamanderLen+i] = v ^ key[i%len(key)]
+	}
+
+	if _, err := c.PacketConn.WriteTo(buf, addr); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// blake2b-256 without key, for the salamander keys.
+// https://www.rfc-editor.org/rfc/rfc7693
+var blake2bIV = [8]uint64{
+	0x6a09e667f3bcc908, 0xbb67ae8584caa73b, 0x3c6ef372fe94f82b, 0xa54ff53a5f1d36f1,
+	0x510e527fade682d1, 0x9b05688c2b3e6c1f, 0x1f83d9abfb41bd6b, 0x5be0cd19137e2179,
+}
+
+var blake2bSigma = [10][16]int{
+	{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15},
+	{14, 10, 4, 8, 9, 15, 13, 6, 1, 12, 0, 2, 11, 7, 5, 3},
+	{11, 8, 12, 0, 5, 2, 15, 13, 10, 14, 3, 6, 7, 1, 9, 4},
+	{7, 9, 3, 1, 13, 12, 11, 14, 2, 6, 5, 10, 4, 0, 15, 8},
+	{9, 0, 5, 7, 2, 4, 10, 15, 14, 1, 11, 12, 6, 8, 3, 13},
+	{2, 12, 6, 10, 0, 11, 8, 3, 4, 13, 7, 5, 15, 14, 1, 9},
+	{12, 5, 1, 15, 14, 13, 4, 10, 0, 7, 6, 3, 9, 2, 8, 11},
+	{13, 11, 7, 14, 12, 1, 3, 9, 5, 0, 15, 4, 8, 6, 2, 10},
+	{6, 15, 14, 9, 11, 3, 0, 8, 12, 2, 13, 7, 1, 4, 10, 5},
+	{10, 2, 8, 4, 7, 6, 1, 5, 15, 11, 9, 14, 3, 12, 13, 0},
+}
+
+func blake2bCompress(h *[8]uint64, block []byte, t uint64, last bool) {
+	var m [16]uint64
+	for i := range m {
+		m[i] = binary.LittleEndian.Uint64(block[i*8:])
+	}
+
+	var v [16]uint64
+	copy(v[:8], h[:])
+	copy(v[8:], blake2bIV[:])
+	v[12] ^= t
+	if last {
+		v[14] = ^v[14]
+	}
+
+	g := func(a, b, c, d int, x, y uint64) {
+		v[a] += v[b] + x
+		v[d] = bits.RotateLeft64(v[d]^v[a], -32)
+		v[c] += v[d]
+		v[b] = bits.RotateLeft64(v[b]^v[c], -24)
+		v[a] += v[b] + y
+		v[d] = bits.RotateLeft64(v[d]^v[a], -16)
+		v[c] += v[d]
+		v[b] = bits.RotateLeft64(v[b]^v[c], -63)
+	}
+
+	for r := 0; r < 12; r++ {
+		s := &blake2bSigma[r%10]
+		g(0, 4, 8, 12, m[s[0]], m[s[1]])
+		g(1, 5, 9, 13, m[s[2]], m[s[3]])
+		g(2, 6, 10, 14, m[s[4]], m[s[5]])
+		g(3, 7, 11, 15, m[s[6]], m[s[7]])
+		g(0, 5, 10, 15, m[s[8]], m[s[9]])
+		g(1, 6, 11, 12, m[s[10]], m[s[11]])
+		g(2, 7, 8, 13, m[s[12]], m[s[13]])
+		g(3, 4, 9, 14, m[s[14]], m[s[15]])
+	}
+
+	for i := range h {
+		h[i] ^= v[i] ^ v[i+8]
+	}
+}
+
+func blake2b256(b []byte) [32]byte {
+	h := blake2bIV
+	h[0] ^= 0x01010000 ^ 32
+
+	var t uint64
+	for len(b) > 128 {
+		t += 128
+		blake2bCompress(&h, b[:128], t, false)
+		b = b[128:]
+	}
+
+	var block [128]byte
+	copy(block[:], b)
+	blake2bCompress(&h, block[:], t+uint64(len(b)), true)
+
+	var out [32]byte
+	for i := 0; i < 4; i++ {
+		binary.LittleEndian.PutUint64(out[i*8:], h[i])
+	}
+	return out
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net"
+	"testing"
+)
+
+// generated with golang.org/x/crypto/blake2b.Sum256 of the bytes 0, 1, ..., n-1
+func TestBLAKE2b256(t *testing.T) {
+	tests := []struct {
+		n    int
+		want string
+	}{
+		{0, "0e5751c026e543b2e8ab2eb06099daa1d1e5df47778f7787faab45cdf12fe3a8"},
+		{3, "3d8c3d594928271f44aad7a04b177154806867bcf918e1549c0bc16f9da2b09b"},
+		{128, "c3582f71ebb2be66fa5dd750f80baae97554f3b015663c8be377cfcb2488c1d1"},
+		{129, "f7f3c46ba2564ff4c4c162da1f5b605f9f1c4aa6a20652a9f9a337c1a2f5b9c9"},
+		{255, "1d0850ee9bca0abc9601e9deabe1418fedec2fb6ac4150bd5302d2430f9be943"},
+	}
+
+	for _, tt := range tests {
+		b := make([]byte, tt.n)
+		for i := range b {
+			b[i] = byte(i)
+		}
+		if got := blake2b256(b); hex.EncodeToString(got[:]) != tt.want {
+			t.Errorf("blake2b256(%d bytes) = %x, want %s", tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestSalamander(t *testing.T) {
+	a, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	b, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	psk := []byte("glider-salamander")
+	sa, sb := &salamanderConn{PacketConn: a, psk: psk}, &salamanderConn{PacketConn: b, psk: psk}
+
+	// blake2b.Sum256(psk + salt 00 01 ... 07)
+	if key := sa.key([]byte{0, 1, 2, 3, 4, 5, 6, 7}); hex.EncodeToString(key[:]) != "05b4d4a8634dd153c8c5d71af87c922b986b8ccadbfb639abe745c6471a02a59" {
+		t.Errorf("key = %x", key)
+	}
+
+	payload := bytes.Repeat([]byte("hysteria2"), 10)
+	if _, err := sa.WriteTo(payload, b.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 2048)
+	n, _, err := sb.ReadFrom(buf)
+	if err != nil || !bytes.Equal(buf[:n], payload) {
+		t.Fatalf("read %q, %v", buf[:n], err)
+	}
+
+	// on the wire: salt(8) and the xored payload
+	sa.WriteTo(payload, b.LocalAddr())
+	n, _, err = b.ReadFrom(buf)
+	if err != nil || n != hy2SalamanderLen+len(payload) || bytes.Contains(buf[:n], []byte("hysteria2")) {
+		t.Fatalf("raw packet %x, %v", buf[:n], err)
+	}
+}
+
+func TestHy2UDPMsg(t *testing.T) {
+	m := udpMsg{sid: 7, pktID: 0x1234, fragID: 1, fragCount: 2, addr: "example.com:53", data: []byte("payload")}
+	b := hy2Marshal(&m)
+	if len(b) != hy2HeaderLen(&m)+len(m.data) {
+		t.Fatalf("marshal length = %d, want %d", len(b), hy2HeaderLen(&m)+len(m.data))
+	}
+
+	got, err := parseHy2UDPMsg(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.sid != m.sid || got.pktID != m.pktID || got.fragID != 1 || got.fragCount != 2 ||
+		got.addr != m.addr || string(got.data) != "payload" {
+		t.Fatalf("parse = %+v", got)
+	}
+
+	if _, err := parseHy2UDPMsg(b[:10]); err == nil {
+		t.Error("truncated address is accepted")
+	}
+
+	// the fragments out of order, and an older packet dropped by a newer one
+	var f udpFrags
+	first := udpMsg{pktID: 1, fragID: 0, fragCount: 2, data: []byte("stale")}
+	if _, ok := f.add(first); ok {
+		t.Fatal("incomplete packet returned")
+	}
+	f.add(udpMsg{pktID: 2, fragID: 1, fragCount: 2, data: []byte("world")})
+	m, ok := f.add(udpMsg{pktID: 2, fragID: 0, fragCount: 2, data: []byte("hello ")})
+	if !ok || string(m.data) != "hello world" {
+		t.Fatalf("reassembled %q, %v", m.data, ok)
+	}
+}
+
+func TestVarint(t *testing.T) {
+	tests := []struct {
+		v    uint64
+		want string
+	}{
+		// RFC 9000 A.1
+		{37, "25"},
+		{15293, "7bbd"},
+		{494878333, "9d7f3e7d"},
+		{151288809941952652, "c2197c5eff14e88c"},
+		{hy2TCPRequest, "4401"},
+	}
+
+	for _, tt := range tests {
+		b := appendVarint(nil, tt.v)
+		if hex.EncodeToString(b) != tt.want {
+			t.Errorf("appendVarint(%d) = %x, want %s", tt.v, b, tt.want)
+		}
+		if v, err := readVarint(bytes.NewReader(b)); err != nil || v != tt.v {
+			t.Errorf("readVarint(%x) = %d, %v", b, v, err)
+		}
+	}
+}
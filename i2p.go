@@ -0,0 +1,209 @@
+// i2p streams via the SAMv3 bridge: https://geti2p.net/en/docs/api/samv3
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// I2P connects to the i2p destinations(.i2p, .b32.i2p) via the SAM bridge of an i2p router:
+// i2p://127.0.0.1:7656, the port of the destination is ignored.
+type I2P struct {
+	*Forwarder
+
+	mu      sync.Mutex
+	session string // id of the stream session, empty if not created
+}
+
+// NewI2P returns an i2p forwarder
+func NewI2P(addr string, cDialer Dialer) (*I2P, error) {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "7656")
+	}
+
+	return &I2P{Forwarder: NewForwarder(addr, cDialer)}, nil
+}
+
+// samConn is a connection to the sam bridge
+type samConn struct {
+	conn
+}
+
+// dialSAM connects to the sam bridge and says hello
+func (s *I2P) dialSAM() (*samConn, error) {
+	rc, err := s.cDialer.Dial("tcp", s.addr)
+	if err != nil {
+		logf("dial to %s error: %s", s.addr, err)
+		return nil, err
+	}
+
+	c := &samConn{newConn(rc)}
+	if _, err := c.command("HELLO VERSION MIN=3.0 MAX=3.3"); err != nil {
+		rc.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// command sends cmd and returns the values of the reply, e.g.:
+// HELLO VERSION MIN=3.0 MAX=3.3 -> HELLO REPLY RESULT=OK VERSION=3.3
+func (c *samConn) command(cmd string) (map[string]string, error) {
+	if _, err := c.Write([]byte(cmd + "\n")); err != nil {
+		return nil, err
+	}
+
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	line = strings.TrimSpace(line)
+	reply := samParse(line)
+	switch reply["RESULT"] {
+	case "OK":
+		return reply, nil
+	case "CANT_REACH_PEER", "TIMEOUT", "PEER_NOT_FOUND":
+		return nil, newError(ErrUnreachable, "proxy-i2p: "+cmd+": "+line)
+	case "KEY_NOT_FOUND", "INVALID_KEY":
+		return nil, newError(ErrInvalidAddr, "proxy-i2p: "+cmd+": "+line)
+	}
+
+	return nil, newError(ErrProtocol, "proxy-i2p: "+cmd+": "+line)
+}
+
+// samParse parses the KEY=VALUE pairs of a reply line, the values may be quoted
+func samParse(line string) map[string]string {
+	m := make(map[string]string)
+	for len(line) > 0 {
+		i := strings.IndexByte(line, '=')
+		sp := strings.IndexByte(line, ' ')
+		if i < 0 || (sp >= 0 && sp < i) {
+			// a word without value, e.g. "HELLO REPLY"
+			if sp < 0 {
+				break
+			}
+			line = line[sp+1:]
+			continue
+		}
+
+		k, v := line[:i], line[i+1:]
+		if strings.HasPrefix(v, "\"") {
+			end := strings.IndexByte(v[1:], '"')
+			if end < 0 {
+				m[k] = v[1:]
+				break
+			}
+			m[k], line = v[1:end+1], strings.TrimLeft(v[end+2:], " ")
+			continue
+		}
+
+		if sp = strings.IndexByte(v, ' '); sp < 0 {
+			m[k] = v
+			break
+		}
+		m[k], line = v[:sp], v[sp+1:]
+	}
+
+	return m
+}
+
+// getSession returns the id of the stream session, creates it if needed.
+// The session lives as long as its control connection.
+func (s *I2P) getSession() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.session != "" {
+		return s.session, nil
+	}
+
+	c, err := s.dialSAM()
+	if err != nil {
+		return "", err
+	}
+
+	var b [8]byte
+	rand.Read(b[:])
+	id := "glider-" + hex.EncodeToString(b[:])
+
+	// the tunnels may take a while to be built
+	c.SetDeadline(time.Now().Add(2 * time.Minute))
+	if _, err := c.command("SESSION CREATE STYLE=STREAM ID=" + id + " DESTINATION=TRANSIENT SIGNATURE_TYPE=EdDSA_SHA512_Ed25519"); err != nil {
+		c.Close()
+		return "", err
+	}
+	c.SetDeadline(time.Time{})
+
+	logf("proxy-i2p session %s created via %s", id, s.addr)
+	s.session = id
+
+	go func() {
+		defer c.Close()
+		for {
+			line, err := c.r.ReadString('\n')
+			if err != nil {
+				break
+			}
+			if strings.HasPrefix(line, "PING") {
+				c.Write([]byte("PONG" + strings.TrimPrefix(line, "PING")))
+			}
+		}
+
+		logf("proxy-i2p session %s closed", id)
+		s.mu.Lock()
+		if s.session == id {
+			s.session = ""
+		}
+		s.mu.Unlock()
+	}()
+
+	return id, nil
+}
+
+// Dial connects to the i2p destination addr via the sam bridge.
+func (s *I2P) Dial(network, addr string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if !strings.HasSuffix(strings.ToLower(host), ".i2p") {
+		return nil, newError(ErrInvalidAddr, "proxy-i2p: not an i2p destination: "+host)
+	}
+
+	id, err := s.getSession()
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	c, err := s.dialSAM()
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := c.command("NAMING LOOKUP NAME=" + host)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	if _, err := c.command("STREAM CONNECT ID=" + id + " DESTINATION=" + reply["VALUE"] + " SILENT=false"); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	logf("proxy-i2p connect to %s via %s, handshake: %s", addr, s.addr, time.Since(start))
+	return newTTFBConn(c.conn, start, getLatencyStats("i2p", s.addr)), nil
+}
+
+// DialUDP connects to the given address via the proxy.
+func (s *I2P) DialUDP(network, addr string) (net.PacketConn, net.Addr, error) {
+	return nil, nil, newError(ErrUDPNotSupported, "proxy-i2p: udp not supported")
+}
@@ -0,0 +1,206 @@
+// icmp tunnel transport, for the networks which allow ping but nothing else.
+// the data is carried in the payload of icmp echo requests and replies(see ptun.go),
+// raw sockets are required(root or CAP_NET_RAW) on both sides.
+//
+// client: icmptunnel://SERVER_IP?rate=20&psk=KEY, at most 20 packets per second
+// server: icmptunnel://0.0.0.0?rate=200&psk=KEY, it's recommended to disable the kernel echo replies:
+// sysctl -w net.ipv4.icmp_echo_ignore_all=1
+// the sessions are opened only with the same pre-shared key(psk) on both sides.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// icmp payload magics, to tell the tunnel packets from the normal pings and the kernel echo replies
+var (
+	icmpTunnelReqMagic  = []byte("GLQ1")
+	icmpTunnelRespMagic = []byte("GLR1")
+)
+
+// icmpTunnelMTU is the max ptun packet size in an icmp payload
+const icmpTunnelMTU = 1200
+
+// ICMPTunnel struct
+type ICMPTunnel struct {
+	*Forwarder
+	sDialer Dialer
+
+	rate int // packets per second
+	psk  []byte
+}
+
+// NewICMPTunnel returns an icmp tunnel proxy.
+func NewICMPTunnel(addr, rawQuery string, cDialer Dialer, sDialer Dialer) (*ICMPTunnel, error) {
+	s := &ICMPTunnel{
+		Forwarder: NewForwarder(addr, cDialer),
+		sDialer:   sDialer,
+		rate:      20,
+	}
+
+	if sDialer != nil {
+		s.rate = 200
+	}
+
+	p, _ := url.ParseQuery(rawQuery)
+	if s.psk = []byte(p.Get("psk")); len(s.psk) == 0 {
+		return nil, errors.New("proxy-icmptunnel: psk must be specified")
+	}
+
+	if v := p.Get("rate"); v != "" {
+		rate, err := strconv.Atoi(v)
+		if err != nil || rate <= 0 {
+			return nil, errors.New("proxy-icmptunnel: invalid rate '" + v + "'")
+		}
+		s.rate = rate
+	}
+
+	return s, nil
+}
+
+// ListenAndServe serves icmp tunnel requests.
+func (s *ICMPTunnel) ListenAndServe() {
+	c, err := listenPacket("ip4:icmp", s.addr)
+	if err != nil {
+		logf("proxy-icmptunnel failed to listen on %s: %v", s.addr, err)
+		return
+	}
+	defer c.Close()
+
+	logf("proxy-icmptunnel listening ICMP on %s", s.addr)
+
+	srv := newPtunServer(s.sDialer, s.psk)
+	limiter := newRateLimiter(s.rate)
+
+	for {
+		buf := make([]byte, 1500)
+		n, raddr, err := c.ReadFrom(buf)
+		if err != nil {
+			if isClosed(err) {
+				return
+			}
+			logf("proxy-icmptunnel read error: %v", err)
+			continue
+		}
+
+		// type(1) 8: echo request, code(1), checksum(2), id(2), seq(2), payload
+		msg := buf[:n]
+		if len(msg) < 8+len(icmpTunnelReqMagic) || msg[0] != 8 || !bytes.HasPrefix(msg[8:], icmpTunnelReqMagic) {
+			continue
+		}
+
+		// drop the packets over the rate limit, the client will retransmit
+		if !limiter.allow() {
+			continue
+		}
+
+		go func() {
+			resp := srv.handle(msg[8+len(icmpTunnelReqMagic):], icmpTunnelMTU-ptunHeaderLen)
+			if resp != nil {
+				c.WriteTo(icmpEcho(0, msg[4:8], icmpTunnelRespMagic, resp), raddr)
+			}
+		}()
+	}
+}
+
+// Dial connects to the address addr on the network net via the icmp tunnel.
+func (s *ICMPTunnel) Dial(network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp6", "tcp4":
+	default:
+		return nil, errors.New("proxy-icmptunnel: no support for connection type " + network)
+	}
+
+	raddr, err := net.ResolveIPAddr("ip4", s.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	pc, err := net.ListenPacket("ip4:icmp", "0.0.0.0")
+	if err != nil {
+		logf("proxy-icmptunnel listen icmp error: %s", err)
+		return nil, err
+	}
+
+	ex := &icmpTunnelExchanger{PacketConn: pc, raddr: raddr, id: uint16(rand.Uint32())}
+
+	c, err := dialPtun(ex, s.psk, icmpTunnelMTU-ptunHeaderLen, time.Second/time.Duration(s.rate), addr, pc.LocalAddr(), raddr)
+	if err != nil {
+		logf("proxy-icmptunnel connect to %s via %s error: %s", addr, s.addr, err)
+		return nil, err
+	}
+
+	logf("proxy-icmptunnel connect to %s via %s", addr, s.addr)
+	return c, nil
+}
+
+// DialUDP connects to the given address via the proxy.
+func (s *ICMPTunnel) DialUDP(network, addr string) (net.PacketConn, net.Addr, error) {
+	return nil, nil, newError(ErrUDPNotSupported, "icmptunnel client does not support udp")
+}
+
+// icmpEcho returns an icmp echo message of type typ, idSeq is the id(2) and seq(2)
+func icmpEcho(typ byte, idSeq []byte, magic, payload []byte) []byte {
+	msg := make([]byte, 8, 8+len(magic)+len(payload))
+	msg[0] = typ
+	copy(msg[4:8], idSeq)
+	msg = append(msg, magic...)
+	msg = append(msg, payload...)
+	binary.BigEndian.PutUint16(msg[2:], icmpChecksum(msg))
+	return msg
+}
+
+// icmpTunnelExchanger exchanges ptun packets in icmp echo requests and replies
+type icmpTunnelExchanger struct {
+	net.PacketConn
+	raddr *net.IPAddr
+	id    uint16
+	seq   uint16
+}
+
+func (e *icmpTunnelExchanger) exchange(req []byte) ([]byte, error) {
+	e.seq++
+	idSeq := []byte{byte(e.id >> 8), byte(e.id), byte(e.seq >> 8), byte(e.seq)}
+
+	if _, err := e.WriteTo(icmpEcho(8, idSeq, icmpTunnelReqMagic, req), e.raddr); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 1500)
+	e.SetReadDeadline(time.Now().Add(3 * time.Second))
+	for {
+		n, from, err := e.ReadFrom(buf)
+		if err != nil {
+			return nil, err
+		}
+
+		// type(1) 0: echo reply
+		msg := buf[:n]
+		if len(msg) < 8+len(icmpTunnelRespMagic) || msg[0] != 0 || !bytes.Equal(msg[4:6], idSeq[:2]) {
+			continue
+		}
+
+		if ip, ok := from.(*net.IPAddr); !ok || !ip.IP.Equal(e.raddr.IP) {
+			continue
+		}
+
+		if !bytes.HasPrefix(msg[8:], icmpTunnelRespMagic) {
+			continue
+		}
+
+		resp := msg[8+len(icmpTunnelRespMagic):]
+		if !ptunMatch(req, resp) {
+			continue
+		}
+
+		return append([]byte(nil), resp...), nil
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+
+	"gopkg.in/yaml.v2"
+)
+
+// importer converts the config of another proxy to the structured(yaml) config of glider,
+// the routing targets(clash proxy groups, v2ray outbounds and balancers) become rules.
+type importer struct {
+	y     yamlConf
+	rules map[string]*yamlRule
+	order []string // rule names in the order of the first use
+
+	skipped map[string]int // unsupported items by kind
+	warns   []string
+}
+
+// importConf converts the Clash(yaml) or v2ray(json) config file, returns the config
+// and the warnings about the items not converted.
+func importConf(file string) ([]byte, []string, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	im := &importer{rules: make(map[string]*yamlRule), skipped: make(map[string]int)}
+	if bytes.HasPrefix(bytes.TrimSpace(b), []byte("{")) {
+		err = im.v2ray(b)
+	} else {
+		err = im.clash(b)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, name := range im.order {
+		if r := im.rules[name]; len(r.Domain)+len(r.IP)+len(r.CIDR) > 0 {
+			im.y.Rules = append(im.y.Rules, *r)
+		}
+	}
+
+	if err := im.y.validate(); err != nil {
+		return nil, nil, err
+	}
+
+	var kinds []string
+	for kind := range im.skipped {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		im.warn("%d %s skipped, not supported", im.skipped[kind], kind)
+	}
+
+	out, err := yaml.Marshal(&im.y)
+	return out, im.warns, err
+}
+
+// warn adds a warning once, the groups are converted for every use
+func (im *importer) warn(format string, v ...interface{}) {
+	w := fmt.Sprintf(format, v...)
+	for _, old := range im.warns {
+		if old == w {
+			return
+		}
+	}
+	im.warns = append(im.warns, w)
+}
+
+// rule returns the rule of the target name, created with forward and strategy when first used
+func (im *importer) rule(name string, forward []string, strategy yamlStrategy) *yamlRule {
+	r, ok := im.rules[name]
+	if !ok {
+		r = &yamlRule{Name: name, Forward: forward, Strategy: strategy}
+		im.rules[name] = r
+		im.order = append(im.order, name)
+	}
+	return r
+}
+
+// addDest adds an ip, cidr or domain destination to r
+func addDest(r *yamlRule, dest string) {
+	if ip := net.ParseIP(dest); ip != nil {
+		r.IP = append(r.IP, ip.String())
+	} else if _, _, err := net.ParseCIDR(dest); err == nil {
+		r.CIDR = append(r.CIDR, dest)
+	} else {
+		r.Domain = append(r.Domain, dest)
+	}
+}
+
+// proxyURL returns the forwarder url SCHEME://[USER[:PASS]@]HOST:PORT[/PATH][?QUERY]
+func proxyURL(scheme, user, pass, host, port, path string, q url.Values) string {
+	u := &url.URL{Scheme: scheme, Host: net.JoinHostPort(host, port), Path: path, RawQuery: q.Encode()}
+	switch {
+	case pass != "":
+		u.User = url.UserPassword(user, pass)
+	case user != "":
+		u.User = url.User(user)
+	}
+	return u.String()
+}
+
+// tlsQuery returns the query of the tls options of forwarders
+func tlsQuery(serverName string, skipVerify bool) url.Values {
+	q := url.Values{}
+	if serverName != "" {
+		q.Set("serverName", serverName)
+	}
+	if skipVerify {
+		q.Set("skipverify", "true")
+	}
+	return q
+}
+
+// checkWebSite returns HOST[:PORT] of the http check url, empty if it's not http
+func checkWebSite(checkURL string) string {
+	u, err := url.Parse(checkURL)
+	if err != nil || u.Scheme != "http" {
+		return ""
+	}
+	return u.Host
+}
+
+// listenAddr returns the listen address of port, on loopback unless lan is true
+func listenAddr(scheme string, port int, lan bool) string {
+	host := "127.0.0.1"
+	if lan {
+		host = ""
+	}
+	return scheme + "://" + net.JoinHostPort(host, strconv.Itoa(port))
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// defaultKeepAlive is the keepalive interval of the multiplexed transports(mux, grpc, naive and quic),
+// shorter than the idle timeouts of most NATs, so the idle sessions are not dropped silently.
+const defaultKeepAlive = 15 * time.Second
+
+// keepAliveMisses is the number of intervals without any frame from the peer, after which
+// a session is closed as dead, the new streams are opened in a new session then.
+const keepAliveMisses = 4
+
+// parseKeepAlive returns the keepalive interval of keepalive=SECONDS in p, def if not set, 0 disables it
+func parseKeepAlive(p url.Values, def time.Duration) (time.Duration, error) {
+	v := p.Get("keepalive")
+	if v == "" {
+		return def, nil
+	}
+
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, errors.New("invalid keepalive " + v)
+	}
+	return time.Duration(n) * time.Second, nil
+}
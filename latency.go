@@ -0,0 +1,138 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// latencyStats is the outbound latency stats of a forwarder, lock-free
+type latencyStats struct {
+	proto     string
+	addr      string
+	count     int64 // atomic
+	handshake int64 // moving average of handshake duration, atomic
+	ttfb      int64 // moving average of time to first byte, atomic
+}
+
+// latencyMap stores the latency stats of forwarders, proto+addr -> *latencyStats
+var latencyMap sync.Map
+
+func init() {
+	apiMux.HandleFunc("/stats/latency", handleLatency)
+}
+
+// getLatencyStats returns the latency stats of forwarder addr with protocol proto
+func getLatencyStats(proto, addr string) *latencyStats {
+	key := proto + "://" + addr
+	v, ok := latencyMap.Load(key)
+	if !ok {
+		v, _ = latencyMap.LoadOrStore(key, &latencyStats{proto: proto, addr: addr})
+	}
+	return v.(*latencyStats)
+}
+
+// ewma returns the exponentially weighted moving average
+func ewma(avg, d time.Duration) time.Duration {
+	if avg == 0 {
+		return d
+	}
+	return (avg*7 + d) / 8
+}
+
+// addEWMA updates the moving average stored in avg with d atomically
+func addEWMA(avg *int64, d time.Duration) {
+	for {
+		old := atomic.LoadInt64(avg)
+		if atomic.CompareAndSwapInt64(avg, old, int64(ewma(time.Duration(old), d))) {
+			return
+		}
+	}
+}
+
+// addHandshake records a handshake duration
+func (s *latencyStats) addHandshake(d time.Duration) {
+	atomic.AddInt64(&s.count, 1)
+	addEWMA(&s.handshake, d)
+}
+
+// addTTFB records a time to first byte
+func (s *latencyStats) addTTFB(d time.Duration) {
+	addEWMA(&s.ttfb, d)
+}
+
+// Handshake returns the average handshake duration
+func (s *latencyStats) Handshake() time.Duration {
+	return time.Duration(atomic.LoadInt64(&s.handshake))
+}
+
+// TTFB returns the average time to first byte
+func (s *latencyStats) TTFB() time.Duration {
+	return time.Duration(atomic.LoadInt64(&s.ttfb))
+}
+
+// ttfbConn records the time to first byte since the connection established
+type ttfbConn struct {
+	net.Conn
+	start time.Time
+	once  sync.Once
+	stats *latencyStats
+}
+
+// newTTFBConn records the handshake duration since start and returns a conn to record ttfb
+func newTTFBConn(c net.Conn, start time.Time, stats *latencyStats) net.Conn {
+	stats.addHandshake(time.Since(start))
+	return &ttfbConn{Conn: c, start: time.Now(), stats: stats}
+}
+
+func (c *ttfbConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.once.Do(func() {
+			ttfb := time.Since(c.start)
+			c.stats.addTTFB(ttfb)
+			logf("proxy-%s %s first byte received: %s", c.stats.proto, c.stats.addr, ttfb)
+		})
+	}
+	return n, err
+}
+
+// WriteTo records the first byte, then copies from the underlying conn to w,
+// so the ReaderFrom/WriterTo of the conns are used.
+func (c *ttfbConn) WriteTo(w io.Writer) (int64, error) {
+	return copyFirst(w, c, c.Conn)
+}
+
+// ReadFrom copies from r to the underlying conn, so the ReaderFrom of it is used.
+func (c *ttfbConn) ReadFrom(r io.Reader) (int64, error) {
+	return io.Copy(c.Conn, r)
+}
+
+// handleLatency serves the latency stats of forwarders: /stats/latency
+func handleLatency(w http.ResponseWriter, r *http.Request) {
+	type latency struct {
+		Proto     string `json:"proto"`
+		Addr      string `json:"addr"`
+		Count     int64  `json:"count"`
+		Handshake string `json:"handshake"`
+		TTFB      string `json:"ttfb"`
+	}
+
+	var stats []latency
+	latencyMap.Range(func(key, value interface{}) bool {
+		s := value.(*latencyStats)
+		stats = append(stats, latency{
+			Proto:     s.proto,
+			Addr:      s.addr,
+			Count:     atomic.LoadInt64(&s.count),
+			Handshake: s.Handshake().String(),
+			TTFB:      s.TTFB().String(),
+		})
+		return true
+	})
+
+	writeJSON(w, stats)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// listenFwds caches the dialers of the listener forwarders by the forwarders and strategy,
+// so the ports of a port range share one strategy dialer and its checks.
+var listenFwds struct {
+	sync.Mutex
+	dialers map[string]Dialer
+}
+
+// listenForwards returns the forwarder chains of a listener: forward=CHAIN, repeatable,
+// the ',' and '&' in a chain are escaped as %2C and %26.
+func listenForwards(rawQuery string) []string {
+	p, _ := url.ParseQuery(rawQuery)
+	return p["forward"]
+}
+
+// listenDialer returns the dialer of a listener with its own forwarders(forward=CHAIN) and
+// strategy(strategy=rr|ha|lha|dh|sh, rr by default), the connections of the listener bypass the rules
+// and the global forwarders. sDialer is returned if the listener has no forwarders.
+func listenDialer(rawQuery string, sDialer Dialer) (Dialer, error) {
+	p, _ := url.ParseQuery(rawQuery)
+	forward := p["forward"]
+	if len(forward) == 0 {
+		return sDialer, nil
+	}
+
+	s := conf.StrategyConfig
+	s.Strategy, s.Schedule = "rr", nil
+	if v := p.Get("strategy"); v != "" {
+		switch v {
+		case "rr", "ha", "lha", "dh", "sh":
+		default:
+			return nil, errors.New("listen: unknown strategy '" + v + "', available: rr ha lha dh sh")
+		}
+		s.Strategy = v
+	}
+
+	key := s.Strategy + " " + strings.Join(forward, " ")
+
+	listenFwds.Lock()
+	defer listenFwds.Unlock()
+
+	if d, ok := listenFwds.dialers[key]; ok {
+		return d, nil
+	}
+
+	forward, err := expandGroups(forward)
+	if err != nil {
+		return nil, err
+	}
+
+	dDialer := NewDirect(0, conf.Mark, conf.Interface, conf.SourceIP)
+	fwdrs, err := chainDialers(forward, dDialer)
+	if err != nil {
+		return nil, err
+	}
+	for _, fwdr := range fwdrs {
+		go checkExitIP(fwdr)
+	}
+
+	d := newAcctDialer(NewStrategyDialer(fwdrs, &s), "listen")
+	if listenFwds.dialers == nil {
+		listenFwds.dialers = make(map[string]Dialer)
+	}
+	listenFwds.dialers[key] = d
+
+	return d, nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// listenAddrs stores all the local listening addresses of glider,
+// used to detect proxy loops like forwarding to ourselves.
+var listenAddrs struct {
+	sync.RWMutex
+	addrs []*net.TCPAddr
+}
+
+// addListenAddr registers a local listening address.
+func addListenAddr(addr string) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return
+	}
+
+	tcpAddr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(host, port))
+	if err != nil {
+		return
+	}
+
+	listenAddrs.Lock()
+	listenAddrs.addrs = append(listenAddrs.addrs, tcpAddr)
+	listenAddrs.Unlock()
+}
+
+// isListenAddr reports whether addr points back to one of glider's own listeners.
+// Only ip literals and localhost are checked, the listen addresses are resolved once when added,
+// so no dns lookup is done before dialing, the hostnames are checked by isLoopConn once connected.
+func isListenAddr(addr string) bool {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		if !strings.EqualFold(host, "localhost") {
+			return false
+		}
+		ip = net.IPv4(127, 0, 0, 1)
+	}
+
+	listenAddrs.RLock()
+	defer listenAddrs.RUnlock()
+
+	for _, l := range listenAddrs.addrs {
+		if port != strconv.Itoa(l.Port) {
+			continue
+		}
+
+		if l.IP == nil || l.IP.IsUnspecified() {
+			if isLocalIP(ip) {
+				return true
+			}
+		} else if l.IP.Equal(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isLoopConn reports whether c dialed to the hostname addr is connected to one of glider's own
+// listeners, e.g. a name resolved to a local address. The ip literals are checked before dialing.
+func isLoopConn(addr string, c net.Conn) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) != nil || c.RemoteAddr() == nil {
+		return false
+	}
+	return isListenAddr(c.RemoteAddr().String())
+}
+
+// isLocalIP reports whether ip is a loopback address or an address of the local interfaces.
+func isLocalIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsUnspecified() {
+		return true
+	}
+
+	for _, addr := range interfaceAddrs() {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// viaHeader is the http header used to carry the chain of glider instance ids
+// a request has passed through, so a chain routing back into itself can be detected.
+const viaHeader = "X-Glider-Via"
+
+// instanceID identifies this glider instance in the via chain
+var instanceID string
+
+func init() {
+	b := make([]byte, 8)
+	rand.Read(b)
+	instanceID = hex.EncodeToString(b)
+}
+
+// checkVia checks the via chain received from another glider instance,
+// returns false if this instance is already in the chain.
+func checkVia(via string) bool {
+	if !conf.LoopDetect || via == "" {
+		return true
+	}
+
+	for _, id := range strings.Split(via, ",") {
+		if strings.TrimSpace(id) == instanceID {
+			return false
+		}
+	}
+
+	return true
+}
+
+// nextVia returns the via chain to send to the next hop, via is the chain received with the request.
+func nextVia(via string) string {
+	if via == "" {
+		return instanceID
+	}
+	return via + "," + instanceID
+}
+
+// viaDialer is a dialer which passes the via chain received with a request on to the next hop,
+// so it's carried per connection through the rules and strategies to the http forwarders.
+type viaDialer interface {
+	DialVia(network, addr, via string) (net.Conn, error)
+}
+
+// dialVia dials addr via d with the via chain, as Dial if d does not pass it on.
+func dialVia(d Dialer, network, addr, via string) (net.Conn, error) {
+	if vd, ok := d.(viaDialer); ok {
+		return vd.DialVia(network, addr, via)
+	}
+	return d.Dial(network, addr)
+}
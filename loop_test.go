@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"testing"
+)
+
+func TestIsLoopConn(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	addListenAddr(l.Addr().String())
+
+	port := l.Addr().(*net.TCPAddr).Port
+	other := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: port}
+
+	tests := []struct {
+		name   string
+		addr   string
+		remote net.Addr
+		want   bool
+	}{
+		{"hostname resolved to the listener", "proxy.example.com:" + strconv.Itoa(port), l.Addr(), true},
+		{"hostname resolved elsewhere", "proxy.example.com:" + strconv.Itoa(port), other, false},
+		{"ip literal checked before dialing", l.Addr().String(), l.Addr(), false},
+	}
+
+	for _, tt := range tests {
+		c := &addrConn{remote: tt.remote}
+		if got := isLoopConn(tt.addr, c); got != tt.want {
+			t.Errorf("%s: isLoopConn = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -4,8 +4,8 @@ import (
 	"log"
 	"os"
 	"os/signal"
-	"strings"
 	"syscall"
+	"time"
 )
 
 // VERSION .
@@ -13,26 +13,61 @@ const VERSION = "0.5.0"
 
 func dialerFromConf() Dialer {
 	// global forwarders in xx.conf
-	var fwdrs []Dialer
-	for _, chain := range conf.Forward {
-		var fwdr Dialer
-		var err error
-		for _, url := range strings.Split(chain, ",") {
-			fwdr, err = DialerFromURL(url, fwdr)
-			if err != nil {
-				log.Fatal(err)
-			}
+	dDialer := NewDirect(0, conf.Mark, conf.Interface, conf.SourceIP)
+
+	fwdrs, err := chainDialers(conf.Forward, dDialer)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, fwdr := range fwdrs {
+		go checkExitIP(fwdr)
+	}
+
+	if len(fwdrs) == 0 {
+		fwdrs = append(fwdrs, dDialer)
+	}
+
+	sDialer := NewStrategyDialer(fwdrs, &conf.StrategyConfig)
+	sDialer = newBTDialer(sDialer, conf.BitTorrent, dDialer)
+	if conf.ABForward != "" {
+		ab, err := newABDialer(sDialer, conf.ABForward)
+		if err != nil {
+			log.Fatal(err)
 		}
-		fwdrs = append(fwdrs, fwdr)
+		return ab
 	}
 
-	return NewStrategyDialer(conf.Strategy, fwdrs, conf.CheckWebSite, conf.CheckDuration)
+	return sDialer
 }
 
 func main() {
 
 	confInit()
+	logf("starting with %d listeners, %d forwarders, %d rules", len(conf.Listen), len(conf.Forward), len(conf.rules))
+
+	if conf.MaxMem > 0 {
+		startMemLimit(conf.MaxMem)
+	}
+
+	if conf.AcctSock != "" {
+		startAcct(conf.AcctSock)
+	}
+
+	if conf.AutoRoute && !conf.Check {
+		initAutoRoute()
+	}
+
 	sDialer := NewRuleDialer(conf.rules, dialerFromConf())
+	routeDialer = sDialer
+
+	if conf.Check {
+		failed := checkExpects(sDialer)
+		stopSSPlugins()
+		if failed > 0 {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
 
 	for _, listen := range conf.Listen {
 		local, err := ServerFromURL(listen, sDialer)
@@ -40,7 +75,14 @@ func main() {
 			log.Fatal(err)
 		}
 
-		go local.ListenAndServe()
+		go serve(local, listen)
+	}
+
+	if port := autoRoutePort(conf.Listen); conf.AutoRoute && port != "" {
+		if err := setupRedirRules(port); err != nil {
+			cleanAutoRoute()
+			log.Fatal(err)
+		}
 	}
 
 	ipsetM, err := NewIPSetManager(conf.IPSet, conf.rules)
@@ -49,6 +91,7 @@ func main() {
 	}
 
 	if conf.DNS != "" {
+		addListenAddr(conf.DNS)
 		dns, err := NewDNS(conf.DNS, conf.DNSServer[0], sDialer, false)
 		if err != nil {
 			log.Fatal(err)
@@ -69,10 +112,37 @@ func main() {
 			dns.AddAnswerHandler(ipsetM.AddDomainIP)
 		}
 
-		go dns.ListenAndServe()
+		go serve(dns, conf.DNS)
+	}
+
+	if conf.IdleTimeout > 0 {
+		go reapIdleFlows(time.Duration(conf.IdleTimeout) * time.Second)
+	}
+
+	if conf.API != "" {
+		addListenAddr(conf.API)
+		go apiListenAndServe(conf.API)
+	}
+
+	if tokenBackend != nil {
+		addListenAddr(conf.TokenListen)
+		go tokenListenAndServe(conf.TokenListen)
+	}
+
+	if conf.HAPeer != "" {
+		go pullPeerStates(conf.HAPeer)
 	}
 
+	if conf.NetWatch {
+		go watchAddrs()
+	}
+
+	watchDumpSignal()
+
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
 	<-sigCh
+
+	stopSSPlugins()
+	cleanAutoRoute()
 }
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// multicast/broadcast udp policy, used by transparent (tproxy) listeners
+const (
+	mcastDrop    = "drop"    // drop the packets silently
+	mcastLocal   = "local"   // deliver to the local network directly, never forward
+	mcastForward = "forward" // treat as normal udp traffic and forward via forwarders
+)
+
+// isMcastOrBcast reports whether ip is a multicast, limited broadcast
+// or directed broadcast address of one of the local networks.
+// NOTE: SSDP(239.255.255.250) and mDNS(224.0.0.251) are multicast addresses.
+func isMcastOrBcast(ip net.IP) bool {
+	if ip.IsMulticast() || ip.Equal(net.IPv4bcast) {
+		return true
+	}
+
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return false
+	}
+
+	for _, addr := range interfaceAddrs() {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || ipnet.IP.To4() == nil || len(ipnet.Mask) != net.IPv4len {
+			continue
+		}
+
+		bcast := make(net.IP, net.IPv4len)
+		for i := range bcast {
+			bcast[i] = ipnet.IP.To4()[i] | ^ipnet.Mask[i]
+		}
+
+		if ip4.Equal(bcast) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// mcastDialer returns the dialer to use for the multicast/broadcast destination
+// according to policy: sDialer of the listener, or Direct. nil means the packet should be dropped.
+func mcastDialer(policy string, sDialer Dialer) Dialer {
+	switch policy {
+	case mcastForward:
+		return sDialer
+	case mcastLocal:
+		return Direct
+	}
+
+	return nil
+}
+
+// validateMCastPolicy checks the multicast/broadcast policy
+func validateMCastPolicy(policy string) error {
+	switch policy {
+	case "", mcastDrop, mcastLocal, mcastForward:
+		return nil
+	}
+	return errors.New("mcastpolicy: unknown policy '" + policy + "', available: drop local forward")
+}
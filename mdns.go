@@ -0,0 +1,399 @@
+// advertise the listeners on the local network with mDNS/DNS-SD:
+// https://tools.ietf.org/html/rfc6762, https://tools.ietf.org/html/rfc6763
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	mdnsAddr      = "224.0.0.251:5353"
+	mdnsTTL       = 120
+	mdnsLegacyTTL = 10 // the ttl of the legacy unicast responses
+
+	dnsTypePTR = 12
+	dnsTypeTXT = 16
+	dnsTypeSRV = 33
+	dnsTypeANY = 255
+
+	dnsClassIN         = 1
+	dnsClassCacheFlush = 0x8000 // the unique records replace the cached ones
+	dnsClassQU         = 0x8000 // the question wants a unicast response
+)
+
+// mdnsService is an advertised listener
+type mdnsService struct {
+	instance string // instance name, e.g. glider
+	service  string // service type, e.g. _socks._tcp
+	port     int
+}
+
+// mdnsResponder answers the queries for the advertised services, only one per process
+type mdnsResponder struct {
+	mu       sync.Mutex
+	services []*mdnsService
+	wpad     bool   // answer wpad.local
+	host     string // host name without .local
+}
+
+var (
+	mdns     = &mdnsResponder{}
+	mdnsOnce sync.Once
+)
+
+// advertiseMDNS advertises the listener on addr if the mdns param is in rawQuery:
+// socks5://:1080?mdns=glider, with wpad=true, wpad.local is also answered for the
+// http listeners on port 80 so the browsers can find the pac file(/wpad.dat).
+func advertiseMDNS(addr, scheme, rawQuery string) {
+	p, _ := url.ParseQuery(rawQuery)
+	name := p.Get("mdns")
+	if name == "" {
+		return
+	}
+
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		logf("mdns: invalid listen address %s: %s", addr, err)
+		return
+	}
+	portNum, _ := strconv.Atoi(port)
+
+	var types []string
+	switch scheme {
+	case "socks5", "socks4", "socks4a":
+		types = []string{"_socks._tcp"}
+	case "http":
+		types = []string{"_http-proxy._tcp"}
+	case "mixed":
+		types = []string{"_socks._tcp", "_http-proxy._tcp"}
+	default:
+		logf("mdns: schema '%s' can not be advertised, available: mixed http socks5 socks4", scheme)
+		return
+	}
+
+	mdns.mu.Lock()
+	for _, t := range types {
+		mdns.services = append(mdns.services, &mdnsService{instance: name, service: t, port: portNum})
+	}
+	if p.Get("wpad") == "true" {
+		mdns.wpad = true
+	}
+	mdns.mu.Unlock()
+
+	mdnsOnce.Do(func() { go mdns.run() })
+}
+
+// run answers the queries, the services are announced twice at start
+func (m *mdnsResponder) run() {
+	m.host, _ = os.Hostname()
+	if i := strings.IndexByte(m.host, '.'); i > 0 {
+		m.host = m.host[:i]
+	}
+	if m.host == "" {
+		m.host = "glider"
+	}
+
+	group, _ := net.ResolveUDPAddr("udp4", mdnsAddr)
+	c, err := net.ListenMulticastUDP("udp4", nil, group)
+	if err != nil {
+		logf("mdns: failed to listen on %s: %s", mdnsAddr, err)
+		return
+	}
+	defer c.Close()
+
+	logf("mdns: responder listening on %s as %s.local", mdnsAddr, m.host)
+
+	go func() {
+		for i := 0; i < 2; i++ {
+			// the announcements leave on the interface of the route to the group
+			local, _ := localIPTo(mdnsAddr)
+			if msg := m.announce(local); msg != nil {
+				c.WriteToUDP(msg, group)
+			}
+			time.Sleep(time.Second)
+		}
+	}()
+
+	buf := make([]byte, 9000)
+	for {
+		n, src, err := c.ReadFromUDP(buf)
+		if err != nil {
+			logf("mdns: read error: %s", err)
+			return
+		}
+
+		// legacy unicast queries from other ports than 5353 are answered directly
+		legacy := src.Port != group.Port
+		resp, unicast := m.answer(buf[:n], src.IP, legacy)
+		if resp == nil {
+			continue
+		}
+
+		dst := group
+		if unicast || legacy {
+			dst = src
+		}
+		c.WriteToUDP(resp, dst)
+	}
+}
+
+// mdnsRR is a resource record to be answered
+type mdnsRR struct {
+	name  string
+	typ   uint16
+	class uint16
+	rdata []byte
+}
+
+// records returns the records answering the question from src, and the additional records
+func (m *mdnsResponder) records(qname string, qtype uint16, src net.IP) (answers, extra []mdnsRR) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	host := m.host + ".local"
+	qname = strings.ToLower(qname)
+
+	if qname == "_services._dns-sd._udp.local" && (qtype == dnsTypePTR || qtype == dnsTypeANY) {
+		seen := make(map[string]bool)
+		for _, s := range m.services {
+			if !seen[s.service] {
+				seen[s.service] = true
+				answers = append(answers, mdnsRR{qname, dnsTypePTR, dnsClassIN, dnsName(s.service + ".local")})
+			}
+		}
+		return
+	}
+
+	for _, s := range m.services {
+		fqdn := s.instance + "." + s.service + ".local"
+		srv := make([]byte, 6, 6+len(host)+2)
+		binary.BigEndian.PutUint16(srv[4:], uint16(s.port))
+		srv = append(srv, dnsName(host)...)
+
+		txt := mdnsRR{fqdn, dnsTypeTXT, dnsClassIN | dnsClassCacheFlush, []byte{0}}
+		srvRR := mdnsRR{fqdn, dnsTypeSRV, dnsClassIN | dnsClassCacheFlush, srv}
+
+		switch {
+		case qname == strings.ToLower(s.service+".local") && (qtype == dnsTypePTR || qtype == dnsTypeANY):
+			answers = append(answers, mdnsRR{qname, dnsTypePTR, dnsClassIN, dnsName(fqdn)})
+			extra = append(extra, srvRR, txt)
+		case qname == strings.ToLower(fqdn) && qtype == dnsTypeSRV:
+			answers = append(answers, srvRR)
+		case qname == strings.ToLower(fqdn) && qtype == dnsTypeTXT:
+			answers = append(answers, txt)
+		case qname == strings.ToLower(fqdn) && qtype == dnsTypeANY:
+			answers = append(answers, srvRR, txt)
+		default:
+			continue
+		}
+	}
+
+	if len(answers) > 0 {
+		extra = append(extra, mdnsHostRecords(host, src)...)
+		return
+	}
+
+	if (qname == strings.ToLower(host) || (m.wpad && qname == "wpad.local")) &&
+		(qtype == DNSQTypeA || qtype == dnsTypeANY) {
+		answers = mdnsHostRecords(qname, src)
+	}
+
+	return
+}
+
+// mdnsHostRecords returns the A records of the ipv4 addresses with name on the interface
+// which src is on, so the hosts are not told the addresses they can not reach.
+func mdnsHostRecords(name string, src net.IP) []mdnsRR {
+	ifaces, err := net.Interfaces()
+	if err != nil || src == nil {
+		return nil
+	}
+
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+
+		var rrs []mdnsRR
+		var on bool
+		for _, addr := range addrs {
+			ipnet, ok := addr.(*net.IPNet)
+			if !ok || ipnet.IP.IsLoopback() || ipnet.IP.To4() == nil {
+				continue
+			}
+			if ipnet.Contains(src) {
+				on = true
+			}
+			rrs = append(rrs, mdnsRR{name, DNSQTypeA, dnsClassIN | dnsClassCacheFlush, ipnet.IP.To4()})
+		}
+
+		if on {
+			return rrs
+		}
+	}
+
+	return nil
+}
+
+// answer returns the response of the query msg from src, nil if nothing to answer.
+// A legacy unicast response echoes the id and the questions, with a short ttl and
+// without the cache flush bit(RFC 6762 section 6.7).
+func (m *mdnsResponder) answer(msg []byte, src net.IP, legacy bool) ([]byte, bool) {
+	if len(msg) < DNSHeaderLen || msg[2]&0x80 != 0 { // responses
+		return nil, false
+	}
+
+	var answers, extra []mdnsRR
+	var unicast bool
+
+	off := DNSHeaderLen
+	for i := 0; i < int(binary.BigEndian.Uint16(msg[4:])); i++ {
+		name, next, err := readDNSName(msg, off)
+		if err != nil || len(msg) < next+4 {
+			return nil, false
+		}
+
+		qtype := binary.BigEndian.Uint16(msg[next:])
+		qclass := binary.BigEndian.Uint16(msg[next+2:])
+		off = next + 4
+
+		a, e := m.records(name, qtype, src)
+		if len(a) > 0 && qclass&dnsClassQU != 0 {
+			unicast = true
+		}
+		answers, extra = append(answers, a...), append(extra, e...)
+	}
+
+	if len(answers) == 0 {
+		return nil, false
+	}
+
+	resp := make([]byte, DNSHeaderLen)
+	resp[2] = 0x84 // QR, AA
+	binary.BigEndian.PutUint16(resp[6:], uint16(len(answers)))
+	binary.BigEndian.PutUint16(resp[10:], uint16(len(extra)))
+
+	// the id must be zero in multicast responses, and be echoed for the legacy unicast queries,
+	// the questions are copied at the same offset so the compression pointers stay valid.
+	ttl := uint32(mdnsTTL)
+	if legacy {
+		copy(resp, msg[:2])
+		copy(resp[4:6], msg[4:6])
+		resp = append(resp, msg[DNSHeaderLen:off]...)
+		ttl = mdnsLegacyTTL
+	}
+
+	for _, rr := range append(answers, extra...) {
+		if legacy {
+			rr.class &^= dnsClassCacheFlush
+		}
+		resp = appendRR(resp, rr, ttl)
+	}
+
+	return resp, unicast
+}
+
+// announce returns an unsolicited response of all the services, the host records of local's interface
+func (m *mdnsResponder) announce(local net.IP) []byte {
+	m.mu.Lock()
+	services := m.services
+	m.mu.Unlock()
+
+	var answers []mdnsRR
+	for _, s := range services {
+		a, e := m.records(s.service+".local", dnsTypePTR, local)
+		answers = append(answers, a...)
+		answers = append(answers, e...)
+	}
+
+	if len(answers) == 0 {
+		return nil
+	}
+
+	msg := make([]byte, DNSHeaderLen)
+	msg[2] = 0x84
+	binary.BigEndian.PutUint16(msg[6:], uint16(len(answers)))
+	for _, rr := range answers {
+		msg = appendRR(msg, rr, mdnsTTL)
+	}
+	return msg
+}
+
+func appendRR(b []byte, rr mdnsRR, ttl uint32) []byte {
+	b = append(b, dnsName(rr.name)...)
+
+	var h [10]byte
+	binary.BigEndian.PutUint16(h[0:], rr.typ)
+	binary.BigEndian.PutUint16(h[2:], rr.class)
+	binary.BigEndian.PutUint32(h[4:], ttl)
+	binary.BigEndian.PutUint16(h[8:], uint16(len(rr.rdata)))
+	b = append(b, h[:]...)
+
+	return append(b, rr.rdata...)
+}
+
+// dnsName encodes name in labels, the instance names may contain dots
+// so only the last 3 or 2 labels are split(instance._service._proto.local).
+func dnsName(name string) []byte {
+	var labels []string
+	if i := strings.Index(name, "._"); i > 0 && !strings.HasPrefix(name, "_") {
+		labels = append([]string{name[:i]}, strings.Split(name[i+1:], ".")...)
+	} else {
+		labels = strings.Split(name, ".")
+	}
+
+	var b []byte
+	for _, l := range labels {
+		if len(l) > 63 {
+			l = l[:63]
+		}
+		b = append(b, byte(len(l)))
+		b = append(b, l...)
+	}
+	return append(b, 0)
+}
+
+// readDNSName reads the name at off, returns the name and the offset after it
+func readDNSName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	next := -1
+	for jumps := 0; ; {
+		if off >= len(msg) {
+			return "", 0, errors.New("dns name out of range")
+		}
+
+		l := int(msg[off])
+		switch {
+		case l == 0:
+			if next < 0 {
+				next = off + 1
+			}
+			return strings.Join(labels, "."), next, nil
+		case l>>6 == 3: // compression pointer
+			if off+1 >= len(msg) || jumps > 10 {
+				return "", 0, errors.New("invalid dns name pointer")
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+			jumps++
+		default:
+			if off+1+l > len(msg) {
+				return "", 0, errors.New("dns label out of range")
+			}
+			labels = append(labels, string(msg[off+1:off+1+l]))
+			off += 1 + l
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// the approximate memory of a relayed tcp connection: the copy buffers and goroutine stacks of both
+// directions and a bufio reader, and of a udp session: the packet buffers and goroutine stacks.
+const (
+	connMem = 2*(32<<10) + 2*(8<<10) + 4<<10
+	udpMem  = 2*udpBufSize + 2*(8<<10)
+
+	memSampleInterval = time.Second
+)
+
+// mem is the global memory ceiling(-maxmem) shared by all the listeners
+var mem struct {
+	max      int64 // bytes, 0 means unlimited
+	used     int64 // atomic, accounted by the connections and udp sessions
+	heap     int64 // atomic, the sampled heap in use
+	shed     int64 // atomic, the connections and udp sessions rejected
+	shedding int32 // atomic, 1 when shedding, to log the state changes only
+}
+
+func init() {
+	apiMux.HandleFunc("/stats/memory", handleMemory)
+}
+
+// startMemLimit sets the memory ceiling in MB, and samples the heap in use periodically
+func startMemLimit(mb int) {
+	mem.max = int64(mb) << 20
+
+	go func() {
+		var ms runtime.MemStats
+		for {
+			runtime.ReadMemStats(&ms)
+			atomic.StoreInt64(&mem.heap, int64(ms.HeapInuse))
+			time.Sleep(memSampleInterval)
+		}
+	}()
+}
+
+// memAcquire accounts n bytes for a new connection or udp session, reports whether it's allowed:
+// the new ones are shed when the accounted usage or the heap reaches 90% of the ceiling,
+// so the existing ones keep working instead of the process being killed.
+func memAcquire(n int64) bool {
+	used := atomic.AddInt64(&mem.used, n)
+	if mem.max == 0 {
+		return true
+	}
+
+	limit := mem.max / 10 * 9
+	if used > limit || atomic.LoadInt64(&mem.heap) > limit {
+		atomic.AddInt64(&mem.used, -n)
+		atomic.AddInt64(&mem.shed, 1)
+		if atomic.CompareAndSwapInt32(&mem.shedding, 0, 1) {
+			logf("memory near the ceiling %d MB(accounted %d MB, heap %d MB), shedding new connections",
+				mem.max>>20, used>>20, atomic.LoadInt64(&mem.heap)>>20)
+		}
+		return false
+	}
+
+	if atomic.CompareAndSwapInt32(&mem.shedding, 1, 0) {
+		logf("memory below the ceiling %d MB again, accepting new connections", mem.max>>20)
+	}
+	return true
+}
+
+// memRelease releases n bytes accounted by memAcquire
+func memRelease(n int64) {
+	atomic.AddInt64(&mem.used, -n)
+}
+
+// handleMemory serves the memory accounting: /stats/memory
+func handleMemory(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, struct {
+		Max  int64 `json:"max,omitempty"`
+		Used int64 `json:"used"`
+		Heap int64 `json:"heap,omitempty"`
+		Shed int64 `json:"shed"`
+	}{
+		Max:  mem.max,
+		Used: atomic.LoadInt64(&mem.used),
+		Heap: atomic.LoadInt64(&mem.heap),
+		Shed: atomic.LoadInt64(&mem.shed),
+	})
+}
@@ -24,6 +24,7 @@ type MixedProxy struct {
 	addr   string
 	http   *HTTP
 	socks5 *SOCKS5
+	socks4 *SOCKS4
 }
 
 // NewMixedProxy returns a mixed proxy.
@@ -33,8 +34,21 @@ func NewMixedProxy(addr, user, pass, rawQuery string, sDialer Dialer) (*MixedPro
 		addr:    addr,
 	}
 
-	p.http, _ = NewHTTP(addr, user, pass, rawQuery, nil, sDialer)
-	p.socks5, _ = NewSOCKS5(addr, user, pass, nil, sDialer)
+	var err error
+	p.http, err = NewHTTP(addr, user, pass, rawQuery, nil, sDialer)
+	if err != nil {
+		return nil, err
+	}
+
+	p.socks5, err = NewSOCKS5(addr, user, pass, rawQuery, nil, sDialer)
+	if err != nil {
+		return nil, err
+	}
+
+	p.socks4, err = NewSOCKS4(addr, user, pass, rawQuery, true, nil, sDialer)
+	if err != nil {
+		return nil, err
+	}
 
 	return p, nil
 }
@@ -44,7 +58,7 @@ func (p *MixedProxy) ListenAndServe() {
 
 	go p.socks5.ListenAndServeUDP()
 
-	l, err := net.Listen("tcp", p.addr)
+	l, err := listen("tcp", p.addr)
 	if err != nil {
 		logf("proxy-mixed failed to listen on %s: %v", p.addr, err)
 		return
@@ -52,14 +66,27 @@ func (p *MixedProxy) ListenAndServe() {
 
 	logf("proxy-mixed listening TCP on %s", p.addr)
 
+	b := budgetOf(p.addr)
 	for {
 		c, err := l.Accept()
 		if err != nil {
+			if isClosed(err) {
+				return
+			}
 			logf("proxy-mixed failed to accept: %v", err)
 			continue
 		}
 
-		go p.Serve(c)
+		if !b.acquireConn() {
+			logf("proxy-mixed %s rejected, too many connections on %s", c.RemoteAddr(), p.addr)
+			c.Close()
+			continue
+		}
+
+		go func() {
+			defer b.releaseConn()
+			p.Serve(b.limit(c))
+		}()
 	}
 }
 
@@ -85,6 +112,12 @@ func (p *MixedProxy) Serve(conn net.Conn) {
 			p.socks5.ServeTCP(c)
 			return
 		}
+
+		// socks4(a), client send socksversion: 4 as the first byte
+		if head[0] == socks4Version {
+			p.socks4.ServeTCP(c)
+			return
+		}
 	}
 
 	if p.http != nil {
@@ -0,0 +1,582 @@
+// mtproto proxy for telegram clients, the obfuscated transport and the fake-tls of mtprotoproxy:
+// https://core.telegram.org/mtproto/mtproto-transports#transport-obfuscation
+
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	mrand "math/rand"
+	"net"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	mtInitLen = 64 // the obfuscated init packet: random(8) key(32) iv(16) tag(4) dc(2) random(2)
+	mtTagPos  = 56
+	mtDCPos   = 60
+
+	mtReplays      = 1 << 16          // the recent init packets and client randoms remembered
+	mtTimeSkewPast = 20 * time.Minute // the fake-tls timestamps accepted
+	mtTimeSkewNext = 10 * time.Minute
+)
+
+var (
+	mtTagAbridged     = []byte{0xef, 0xef, 0xef, 0xef}
+	mtTagIntermediate = []byte{0xee, 0xee, 0xee, 0xee}
+	mtTagPadded       = []byte{0xdd, 0xdd, 0xdd, 0xdd}
+)
+
+// the addresses of the telegram datacenters 1-5, the media ones(negative dc) are the same
+var (
+	mtDCv4 = []string{"149.154.175.50", "149.154.167.51", "149.154.175.100", "149.154.167.91", "149.154.171.5"}
+	mtDCv6 = []string{"2001:b28:f23d:f001::a", "2001:67c:4e8:f002::a", "2001:b28:f23d:f003::a", "2001:67c:4e8:f004::a", "2001:b28:f23f:f005::a"}
+)
+
+var (
+	errMTAuth   = newError(ErrAuth, "proxy-mtproto: no secret matches the handshake")
+	errMTReplay = newError(ErrAuth, "proxy-mtproto: replayed handshake")
+)
+
+// MTProto is a mtproto proxy server for telegram clients, listen only:
+//
+//	listen: mtproto://:443?secret=ee0123456789abcdef0123456789abcdef7777772e6578616d706c652e636f6d
+//
+// secret is 16 bytes in hex, "dd" + 16 bytes for the random padding, or "ee" + 16 bytes + the hex of
+// a domain for fake-tls, it can be set multiple times. The fake-tls clients look like https to the domain,
+// the others with a tls client hello are relayed to the domain. The requests are relayed to the
+// telegram datacenters via the forwarders, ipv6=true to connect them over ipv6.
+type MTProto struct {
+	*Forwarder
+	sDialer Dialer
+
+	secrets []*mtSecret
+	fakeTLS bool // any fake-tls secret
+	ipv6    bool
+	tarpit  bool // tar-pit the connections with malformed handshakes
+
+	replays mtReplayCache
+}
+
+// mtSecret is a secret of the clients
+type mtSecret struct {
+	key    []byte
+	domain string // the domain of fake-tls, empty if not
+}
+
+// NewMTProto returns a mtproto proxy server.
+func NewMTProto(addr, rawQuery string, sDialer Dialer) (*MTProto, error) {
+	p, _ := url.ParseQuery(rawQuery)
+
+	s := &MTProto{
+		Forwarder: NewForwarder(addr, nil),
+		sDialer:   sDialer,
+		ipv6:      p.Get("ipv6") == "true",
+		tarpit:    p.Get("tarpit") == "true",
+	}
+
+	for _, v := range p["secret"] {
+		secret, err := parseMTSecret(v)
+		if err != nil {
+			return nil, err
+		}
+		s.secrets = append(s.secrets, secret)
+		s.fakeTLS = s.fakeTLS || secret.domain != ""
+	}
+
+	if len(s.secrets) == 0 {
+		return nil, errors.New("proxy-mtproto: secret must be set, e.g. mtproto://:443?secret=ee" + hex.EncodeToString(make([]byte, 16)) + hex.EncodeToString([]byte("www.example.com")))
+	}
+
+	return s, nil
+}
+
+// parseMTSecret parses a secret in hex, or in base64 as some clients share the fake-tls ones
+func parseMTSecret(s string) (*mtSecret, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		if b, err = base64.RawURLEncoding.DecodeString(s); err != nil {
+			return nil, errors.New("proxy-mtproto: invalid secret '" + s + "', should be in hex")
+		}
+	}
+
+	switch {
+	case len(b) == 16:
+		return &mtSecret{key: b}, nil
+	case len(b) == 17 && b[0] == 0xdd:
+		return &mtSecret{key: b[1:]}, nil
+	case len(b) > 17 && b[0] == 0xee:
+		return &mtSecret{key: b[1:17], domain: string(b[17:])}, nil
+	}
+
+	return nil, errors.New("proxy-mtproto: invalid secret '" + s + "', format: 16 bytes, dd + 16 bytes or ee + 16 bytes + domain, in hex")
+}
+
+// ListenAndServe serves mtproto requests.
+func (s *MTProto) ListenAndServe() {
+	l, err := listen("tcp", s.addr)
+	if err != nil {
+		logf("proxy-mtproto failed to listen on %s: %v", s.addr, err)
+		return
+	}
+
+	logf("proxy-mtproto listening TCP on %s", s.addr)
+
+	b := budgetOf(s.addr)
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if isClosed(err) {
+				return
+			}
+			logf("proxy-mtproto failed to accept: %v", err)
+			continue
+		}
+
+		if !b.acquireConn() {
+			logf("proxy-mtproto %s rejected, too many connections on %s", c.RemoteAddr(), s.addr)
+			c.Close()
+			continue
+		}
+
+		go func() {
+			defer b.releaseConn()
+			s.ServeTCP(b.limit(c))
+		}()
+	}
+}
+
+// ServeTCP serves a mtproto connection.
+func (s *MTProto) ServeTCP(c net.Conn) {
+	defer c.Close()
+
+	if c, ok := c.(*net.TCPConn); ok {
+		c.SetKeepAlive(true)
+	}
+
+	// never respond to the invalid handshakes, see defendProbe
+	c.SetReadDeadline(time.Now().Add(handshakeTimeout()))
+
+	cc := newConn(c)
+	var rw net.Conn = cc
+	secrets := s.plainSecrets()
+
+	if head, err := cc.Peek(3); err == nil && s.fakeTLS && bytes.Equal(head, []byte{0x16, 0x03, 0x01}) {
+		hello, err := readTLSRecord(cc)
+		if err != nil {
+			defendProbe(c, err, s.tarpit)
+			return
+		}
+
+		secret, err := s.verifyClientHello(hello)
+		if err != nil {
+			logf("proxy-mtproto fake-tls handshake from %s error: %v", c.RemoteAddr(), err)
+			s.serveMask(cc, hello)
+			return
+		}
+
+		if _, err := c.Write(mtServerHello(secret.key, hello)); err != nil {
+			return
+		}
+
+		rw, secrets = &mtFakeTLSConn{Conn: cc}, []*mtSecret{secret}
+	}
+
+	oc, tag, dc, err := s.handshake(rw, secrets)
+	if err != nil {
+		logf("proxy-mtproto handshake from %s error: %v", c.RemoteAddr(), err)
+		defendProbe(c, err, s.tarpit)
+		return
+	}
+	c.SetReadDeadline(time.Time{})
+
+	tgt, err := s.dcAddr(dc)
+	if err != nil {
+		logf("proxy-mtproto %s: %v", c.RemoteAddr(), err)
+		return
+	}
+
+	rc, err := s.sDialer.Dial("tcp", tgt)
+	if err != nil {
+		logf("proxy-mtproto failed to connect to dc %d(%s): %v", dc, tgt, err)
+		return
+	}
+	defer rc.Close()
+
+	dcc, err := mtDCHandshake(rc, tag)
+	if err != nil {
+		logf("proxy-mtproto handshake with dc %d(%s) error: %v", dc, tgt, err)
+		return
+	}
+
+	logf("proxy-mtproto %s <-> dc %d(%s)", c.RemoteAddr(), dc, tgt)
+
+	if err := relayStats(oc, dcc, tgt); err != nil {
+		if err, ok := err.(net.Error); ok && err.Timeout() {
+			return // ignore i/o timeout
+		}
+		logf("proxy-mtproto relay error: %v", err)
+	}
+}
+
+// plainSecrets returns the secrets of the clients without fake-tls
+func (s *MTProto) plainSecrets() []*mtSecret {
+	var secrets []*mtSecret
+	for _, secret := range s.secrets {
+		if secret.domain == "" {
+			secrets = append(secrets, secret)
+		}
+	}
+	return secrets
+}
+
+// handshake reads the obfuscated init packet from c, returns the conn decrypting the reads and
+// encrypting the writes, the protocol tag and the dc requested.
+func (s *MTProto) handshake(c net.Conn, secrets []*mtSecret) (net.Conn, []byte, int, error) {
+	pkt := make([]byte, mtInitLen)
+	if _, err := io.ReadFull(c, pkt); err != nil {
+		return nil, nil, 0, err
+	}
+
+	// the key and iv of the writes are those of the reads reversed
+	rev := make([]byte, 48)
+	for i := range rev {
+		rev[i] = pkt[8+47-i]
+	}
+
+	for _, secret := range secrets {
+		dec, err := mtStream(mtKey(pkt[8:40], secret.key), pkt[40:56])
+		if err != nil {
+			return nil, nil, 0, err
+		}
+
+		plain := make([]byte, mtInitLen)
+		dec.XORKeyStream(plain, pkt)
+
+		tag := plain[mtTagPos:mtDCPos]
+		if !bytes.Equal(tag, mtTagAbridged) && !bytes.Equal(tag, mtTagIntermediate) && !bytes.Equal(tag, mtTagPadded) {
+			continue
+		}
+
+		if s.replays.seen(pkt[8:56]) {
+			return nil, nil, 0, errMTReplay
+		}
+
+		enc, err := mtStream(mtKey(rev[:32], secret.key), rev[32:])
+		if err != nil {
+			return nil, nil, 0, err
+		}
+
+		dc := int(int16(binary.LittleEndian.Uint16(plain[mtDCPos:])))
+		return &mtObfsConn{Conn: c, dec: dec, enc: enc}, tag, dc, nil
+	}
+
+	return nil, nil, 0, errMTAuth
+}
+
+// dcAddr returns the address of dc
+func (s *MTProto) dcAddr(dc int) (string, error) {
+	i := dc
+	if i < 0 {
+		i = -i
+	}
+	if i < 1 || i > len(mtDCv4) {
+		return "", errors.New("unknown dc " + strconv.Itoa(dc))
+	}
+
+	if s.ipv6 {
+		return net.JoinHostPort(mtDCv6[i-1], "443"), nil
+	}
+	return net.JoinHostPort(mtDCv4[i-1], "443"), nil
+}
+
+// verifyClientHello verifies the client random of a fake-tls client hello record:
+// hmac-sha256(secret, record with zero random) xor (zero(28) timestamp(4, little endian))
+func (s *MTProto) verifyClientHello(rec []byte) (*mtSecret, error) {
+	// record header(5), handshake type(1) 0x01: client hello, length(3), version(2), random(32)
+	if rec[0] != 0x16 || len(rec) < 43 || rec[5] != 0x01 {
+		return nil, errors.New("not a client hello")
+	}
+	random := rec[11:43]
+
+	zeroed := append([]byte(nil), rec...)
+	copy(zeroed[11:43], make([]byte, 32))
+
+	sni := parseSNI(rec[5:])
+	for _, secret := range s.secrets {
+		if secret.domain == "" || secret.domain != sni {
+			continue
+		}
+
+		mac := hmac.New(sha256.New, secret.key)
+		mac.Write(zeroed)
+		sum := mac.Sum(nil)
+		for i := range sum {
+			sum[i] ^= random[i]
+		}
+
+		if !bytes.Equal(sum[:28], make([]byte, 28)) {
+			continue
+		}
+
+		ts := time.Unix(int64(binary.LittleEndian.Uint32(sum[28:])), 0)
+		if d := time.Since(ts); d > mtTimeSkewPast || d < -mtTimeSkewNext {
+			return nil, errors.New("client time skewed: " + ts.String())
+		}
+
+		if s.replays.seen(random) {
+			return nil, errMTReplay
+		}
+		return secret, nil
+	}
+
+	return nil, errMTAuth
+}
+
+// serveMask relays a tls client not authenticated to the domain of the fake-tls secret,
+// so it sees the real server.
+func (s *MTProto) serveMask(c net.Conn, hello []byte) {
+	var domain string
+	sni := parseSNI(hello[5:])
+	for _, secret := range s.secrets {
+		if secret.domain != "" && (domain == "" || secret.domain == sni) {
+			domain = secret.domain
+		}
+	}
+
+	rc, err := net.Dial("tcp", net.JoinHostPort(domain, "443"))
+	if err != nil {
+		logf("proxy-mtproto failed to connect to %s: %v", domain, err)
+		return
+	}
+	defer rc.Close()
+
+	c.SetReadDeadline(time.Time{})
+	if _, err := rc.Write(hello); err != nil {
+		return
+	}
+	relay(c, rc)
+}
+
+// mtServerHello returns the fake server hello, change cipher spec and application data records,
+// the server random is hmac-sha256(secret, client random + the records with zero random).
+func mtServerHello(secret, clientHello []byte) []byte {
+	var sid []byte
+	if n := int(clientHello[43]); len(clientHello) >= 44+n {
+		sid = clientHello[44 : 44+n]
+	}
+
+	// version(2) random(32) session id, cipher suite TLS_AES_128_GCM_SHA256, compression method
+	hello := []byte{0x03, 0x03}
+	hello = append(hello, make([]byte, 32)...)
+	hello = append(hello, byte(len(sid)))
+	hello = append(hello, sid...)
+	hello = append(hello, 0x13, 0x01, 0x00)
+
+	// extensions: key_share of x25519 and supported_versions of tls 1.3
+	pub := make([]byte, 32)
+	rand.Read(pub)
+	hello = append(hello, 0x00, 0x2e, 0x00, 0x33, 0x00, 0x24, 0x00, 0x1d, 0x00, 0x20)
+	hello = append(hello, pub...)
+	hello = append(hello, 0x00, 0x2b, 0x00, 0x02, 0x03, 0x04)
+
+	msg := []byte{0x02, 0, byte(len(hello) >> 8), byte(len(hello))}
+	msg = append(msg, hello...)
+
+	b := []byte{0x16, 0x03, 0x03, byte(len(msg) >> 8), byte(len(msg))}
+	b = append(b, msg...)
+	b = append(b, 0x14, 0x03, 0x03, 0x00, 0x01, 0x01)
+
+	// the encrypted certificate and the rest, random as they are not parsed by the clients
+	cert := make([]byte, 1024+mrand.Intn(3072))
+	rand.Read(cert)
+	b = append(b, 0x17, 0x03, 0x03, byte(len(cert)>>8), byte(len(cert)))
+	b = append(b, cert...)
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(clientHello[11:43])
+	mac.Write(b)
+	copy(b[11:43], mac.Sum(nil))
+
+	return b
+}
+
+// mtDCHandshake sends an obfuscated init packet with tag to the dc, the key is not hashed with a secret.
+func mtDCHandshake(rc net.Conn, tag []byte) (net.Conn, error) {
+	pkt := make([]byte, mtInitLen)
+	for {
+		rand.Read(pkt)
+		if mtValidInit(pkt) {
+			break
+		}
+	}
+	copy(pkt[mtTagPos:], tag)
+
+	enc, err := mtStream(pkt[8:40], pkt[40:56])
+	if err != nil {
+		return nil, err
+	}
+
+	rev := make([]byte, 48)
+	for i := range rev {
+		rev[i] = pkt[8+47-i]
+	}
+	dec, err := mtStream(rev[:32], rev[32:])
+	if err != nil {
+		return nil, err
+	}
+
+	// only the tag and after are sent encrypted
+	b := make([]byte, mtInitLen)
+	enc.XORKeyStream(b, pkt)
+	copy(b, pkt[:mtTagPos])
+
+	if _, err := rc.Write(b); err != nil {
+		return nil, err
+	}
+
+	return &mtObfsConn{Conn: rc, dec: dec, enc: enc}, nil
+}
+
+// mtValidInit reports whether the random init packet can not be taken as another protocol by the dc
+func mtValidInit(b []byte) bool {
+	if b[0] == 0xef || bytes.Equal(b[4:8], []byte{0, 0, 0, 0}) {
+		return false
+	}
+
+	for _, s := range []string{"HEAD", "POST", "GET ", "OPTI", "PUT ", "\xee\xee\xee\xee", "\xdd\xdd\xdd\xdd", "\x16\x03\x01\x02"} {
+		if string(b[:4]) == s {
+			return false
+		}
+	}
+	return true
+}
+
+// mtKey returns the key of the clients: sha256(key + secret)
+func mtKey(key, secret []byte) []byte {
+	h := sha256.New()
+	h.Write(key)
+	h.Write(secret)
+	return h.Sum(nil)
+}
+
+func mtStream(key, iv []byte) (cipher.Stream, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewCTR(block, iv), nil
+}
+
+// mtObfsConn decrypts the reads and encrypts the writes with aes-256-ctr
+type mtObfsConn struct {
+	net.Conn
+	dec, enc cipher.Stream
+}
+
+func (c *mtObfsConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.dec.XORKeyStream(b[:n], b[:n])
+	return n, err
+}
+
+func (c *mtObfsConn) Write(b []byte) (int, error) {
+	buf := make([]byte, len(b))
+	c.enc.XORKeyStream(buf, b)
+	return c.Conn.Write(buf)
+}
+
+// mtFakeTLSConn carries the obfuscated stream in tls application data records,
+// the change cipher spec records from the client are skipped.
+type mtFakeTLSConn struct {
+	net.Conn
+	rbuf []byte
+}
+
+func (c *mtFakeTLSConn) Read(b []byte) (int, error) {
+	for len(c.rbuf) == 0 {
+		rec, err := readTLSRecord(c.Conn)
+		if err != nil {
+			return 0, err
+		}
+
+		switch rec[0] {
+		case 0x14: // change cipher spec
+		case 0x17:
+			c.rbuf = rec[5:]
+		case 0x15:
+			return 0, io.EOF
+		default:
+			return 0, errors.New("proxy-mtproto: unexpected tls record type " + strconv.Itoa(int(rec[0])))
+		}
+	}
+
+	n := copy(b, c.rbuf)
+	c.rbuf = c.rbuf[n:]
+	return n, nil
+}
+
+func (c *mtFakeTLSConn) Write(b []byte) (int, error) {
+	var n int
+	for len(b) > 0 {
+		data := b
+		if len(data) > 16384 {
+			data = data[:16384]
+		}
+
+		rec := make([]byte, 5+len(data))
+		rec[0], rec[1], rec[2] = 0x17, 0x03, 0x03
+		binary.BigEndian.PutUint16(rec[3:], uint16(len(data)))
+		copy(rec[5:], data)
+
+		if _, err := c.Conn.Write(rec); err != nil {
+			return n, err
+		}
+
+		n += len(data)
+		b = b[len(data):]
+	}
+
+	return n, nil
+}
+
+// mtReplayCache remembers the recent handshakes, the oldest are forgotten when full
+type mtReplayCache struct {
+	mu   sync.Mutex
+	m    map[string]bool
+	ring []string
+	next int
+}
+
+// seen reports whether k is seen, and remembers it
+func (r *mtReplayCache) seen(k []byte) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.m == nil {
+		r.m, r.ring = make(map[string]bool), make([]string, mtReplays)
+	}
+
+	key := string(k)
+	if r.m[key] {
+		return true
+	}
+
+	delete(r.m, r.ring[r.next])
+	r.ring[r.next] = key
+	r.next = (r.next + 1) % len(r.ring)
+	r.m[key] = true
+	return false
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseMTSecret(t *testing.T) {
+	key := "0123456789abcdef0123456789abcdef"
+	tests := []struct {
+		secret string
+		domain string
+		ok     bool
+	}{
+		{key, "", true},
+		{"dd" + key, "", true},
+		{"ee" + key + hex.EncodeToString([]byte("example.com")), "example.com", true},
+		{key[:30], "", false},
+		{"ff" + key, "", false},
+	}
+
+	for _, tt := range tests {
+		s, err := parseMTSecret(tt.secret)
+		if (err == nil) != tt.ok || err == nil && (hex.EncodeToString(s.key) != key || s.domain != tt.domain) {
+			t.Errorf("parseMTSecret(%s) = %+v, %v", tt.secret, s, err)
+		}
+	}
+}
+
+// mtClientInit returns the init packet of a client and its streams, as the telegram clients do
+func mtClientInit(secret, tag []byte, dc int16) ([]byte, *mtObfsConn) {
+	pkt := make([]byte, mtInitLen)
+	for rand.Read(pkt); !mtValidInit(pkt); rand.Read(pkt) {
+	}
+	copy(pkt[mtTagPos:], tag)
+	binary.LittleEndian.PutUint16(pkt[mtDCPos:], uint16(dc))
+
+	rev := make([]byte, 48)
+	for i := range rev {
+		rev[i] = pkt[8+47-i]
+	}
+	enc, _ := mtStream(mtKey(pkt[8:40], secret), pkt[40:56])
+	dec, _ := mtStream(mtKey(rev[:32], secret), rev[32:])
+
+	b := make([]byte, mtInitLen)
+	enc.XORKeyStream(b, pkt)
+	copy(b, pkt[:mtTagPos])
+	return b, &mtObfsConn{dec: dec, enc: enc}
+}
+
+func TestMTProtoHandshake(t *testing.T) {
+	s, err := NewMTProto(":443", "secret=00000000000000000000000000000000&secret=dd0123456789abcdef0123456789abcdef", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	secret, _ := hex.DecodeString("0123456789abcdef0123456789abcdef")
+	pkt, client := mtClientInit(secret, mtTagPadded, -2)
+
+	c1, c2 := net.Pipe()
+	client.Conn = c1
+	go func() {
+		c1.Write(pkt)
+		client.Write([]byte("ping"))
+	}()
+
+	oc, tag, dc, err := s.handshake(c2, s.secrets)
+	if err != nil || !bytes.Equal(tag, mtTagPadded) || dc != -2 {
+		t.Fatalf("handshake = %x, %d, %v", tag, dc, err)
+	}
+	if addr, _ := s.dcAddr(dc); addr != "149.154.167.51:443" {
+		t.Fatalf("dc address %s", addr)
+	}
+
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(oc, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("server read %q, %v", buf, err)
+	}
+
+	go oc.Write([]byte("pong"))
+	if _, err := io.ReadFull(client, buf); err != nil || string(buf) != "pong" {
+		t.Fatalf("client read %q, %v", buf, err)
+	}
+
+	// the same init packet again
+	c3, c4 := net.Pipe()
+	go c3.Write(pkt)
+	if _, _, _, err := s.handshake(c4, s.secrets); err != errMTReplay {
+		t.Fatalf("replayed handshake: %v", err)
+	}
+}
+
+func TestMTProtoFakeTLS(t *testing.T) {
+	secret, _ := hex.DecodeString("0123456789abcdef0123456789abcdef")
+	s, err := NewMTProto(":443", "secret=ee"+hex.EncodeToString(secret)+hex.EncodeToString([]byte("example.com")), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// client hello with the server name, session id and a zero random
+	msg := append([]byte{0x01, 0x00, 0x00, 0x00, 0x03, 0x03}, make([]byte, 32)...)
+	msg = append(msg, 32)
+	msg = append(msg, bytes.Repeat([]byte{0x5a}, 32)...)
+	msg = append(msg, 0x00, 0x02, 0x13, 0x01, 0x01, 0x00)
+	ext := []byte{0x00, 0x00, 0x00, 0x10, 0x00, 0x0e, 0x00, 0x00, 0x0b}
+	ext = append(ext, "example.com"...)
+	msg = append(msg, 0x00, byte(len(ext)))
+	msg = append(msg, ext...)
+	msg[3] = byte(len(msg) - 4)
+	rec := append([]byte{0x16, 0x03, 0x01, 0x00, byte(len(msg))}, msg...)
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(rec)
+	random := mac.Sum(nil)
+	ts := make([]byte, 4)
+	binary.LittleEndian.PutUint32(ts, uint32(time.Now().Unix()))
+	for i := range ts {
+		random[28+i] ^= ts[i]
+	}
+	copy(rec[11:], random)
+
+	if _, err := s.verifyClientHello(rec); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.verifyClientHello(rec); err != errMTReplay {
+		t.Fatalf("replayed client hello: %v", err)
+	}
+
+	// the client verifies the server random
+	hello := mtServerHello(secret, rec)
+	if !bytes.Equal(hello[44:76], rec[44:76]) {
+		t.Fatal("session id not echoed")
+	}
+
+	zeroed := append([]byte(nil), hello...)
+	copy(zeroed[11:43], make([]byte, 32))
+	mac = hmac.New(sha256.New, secret)
+	mac.Write(random)
+	mac.Write(zeroed)
+	if !bytes.Equal(mac.Sum(nil), hello[11:43]) {
+		t.Fatal("server random not verified")
+	}
+
+	// modified after signed
+	rec[50] ^= 1
+	if _, err := s.verifyClientHello(rec); err != errMTAuth {
+		t.Fatalf("modified client hello: %v", err)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+
+	"github.com/quic-go/quic-go"
+)
+
+// mtu=N on a forwarder is the mtu of the path to it, e.g. 1420 over wireguard, so the tunnels in
+// tunnels are not fragmented: the tcp sockets of the first hop of a chain are clamped to the mss
+// of N, and the quic transports(quic, hysteria2 and tuic) send the packets fitting in N.
+const (
+	minMTU = 576
+
+	tcp4Overhead = 40 // ipv4 and tcp headers
+	tcp6Overhead = 60 // ipv6 and tcp headers
+	quicOverhead = 48 // ipv6 and udp headers, the larger one of both families
+
+	// quic requires the datagrams of at least 1200 bytes
+	minQUICPacket = 1200
+)
+
+// parseMTU returns the mtu of mtu=N in p, 0 if not set
+func parseMTU(p url.Values) (int, error) {
+	v := p.Get("mtu")
+	if v == "" {
+		return 0, nil
+	}
+
+	mtu, err := strconv.Atoi(v)
+	if err != nil || mtu < minMTU || mtu > 65535 {
+		return 0, errors.New("invalid mtu '" + v + "'")
+	}
+	return mtu, nil
+}
+
+// tcpMSS returns the mss of the tcp sockets on network to fit in mtu
+func tcpMSS(network string, mtu int) int {
+	if network == "tcp6" {
+		return mtu - tcp6Overhead
+	}
+	return mtu - tcp4Overhead
+}
+
+// setQUICMTU limits the packets of c with the extra bytes of obfuscation to fit in the mtu=N of p,
+// the path mtu discovery is disabled so the packets never grow beyond it.
+func setQUICMTU(c *quic.Config, p url.Values, extra int) error {
+	mtu, err := parseMTU(p)
+	if err != nil || mtu == 0 {
+		return err
+	}
+
+	size := mtu - quicOverhead - extra
+	if size < minQUICPacket {
+		return errors.New("mtu " + strconv.Itoa(mtu) + " too small for quic, at least " + strconv.Itoa(minQUICPacket+quicOverhead+extra))
+	}
+
+	c.InitialPacketSize = uint16(size)
+	c.DisablePathMTUDiscovery = true
+	return nil
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/xtaci/smux"
+)
+
+// Mux is a smux stream multiplexer, many connections of the inner protocol or the next
+// forwarder share one physical connection:
+//
+//	listen:  mux://:8443,socks5://
+//	listen:  tls://:443?cert=/path/to/cert&key=/path/to/key,mux://,socks5://
+//	forward: mux://host:8443?maxstreams=16&idle=60,socks5://host:8443
+//
+// As client, a new session is dialed when all the sessions have maxstreams streams,
+// and the sessions without streams are kept for idle seconds to be reused, version=2 for smux v2.
+// Both sides ping every keepalive seconds(15 by default, 0 disables it), a session without any
+// frame for 4 intervals is closed, the new streams are opened in a new session.
+type Mux struct {
+	*Forwarder
+	sDialer Dialer
+
+	config     *smux.Config
+	maxStreams int
+	idle       time.Duration
+	serve      func(c net.Conn) // as server, serves the inner protocol
+
+	mu       sync.Mutex
+	sessions []*muxSession
+	reapOnce sync.Once
+}
+
+// muxSession is a client session
+type muxSession struct {
+	*smux.Session
+	idleSince time.Time // zero if the session has streams
+	pending   int       // stream slots reserved by getSession but not opened yet
+}
+
+func newMux(rawQuery string) (*Mux, error) {
+	p, _ := url.ParseQuery(rawQuery)
+
+	s := &Mux{
+		config:     smux.DefaultConfig(),
+		maxStreams: 8,
+		idle:       60 * time.Second,
+	}
+
+	if v := p.Get("version"); v != "" {
+		s.config.Version, _ = strconv.Atoi(v)
+	}
+
+	keepAlive, err := parseKeepAlive(p, defaultKeepAlive)
+	if err != nil {
+		return nil, errors.New("proxy-mux: " + err.Error())
+	}
+	if keepAlive == 0 {
+		s.config.KeepAliveDisabled = true
+	} else {
+		s.config.KeepAliveInterval = keepAlive
+		s.config.KeepAliveTimeout = keepAlive * keepAliveMisses
+	}
+
+	if err := smux.VerifyConfig(s.config); err != nil {
+		return nil, errors.New("proxy-mux: " + err.Error())
+	}
+
+	if v := p.Get("maxstreams"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return nil, errors.New("proxy-mux: invalid maxstreams " + v)
+		}
+		s.maxStreams = n
+	}
+
+	if v := p.Get("idle"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, errors.New("proxy-mux: invalid idle " + v)
+		}
+		s.idle = time.Duration(n) * time.Second
+	}
+
+	return s, nil
+}
+
+// NewMux returns a mux client
+func NewMux(addr, rawQuery string, cDialer Dialer) (*Mux, error) {
+	s, err := newMux(rawQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	s.Forwarder = NewForwarder(addr, cDialer)
+	return s, nil
+}
+
+// NewMuxServer returns a mux server which serves the inner protocol
+func NewMuxServer(addr, rawQuery, inner string, sDialer Dialer) (*Mux, error) {
+	if inner == "" {
+		return nil, errors.New("proxy-mux: inner protocol must be specified, e.g. mux://:8443,socks5://")
+	}
+
+	s, err := newMux(rawQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	s.Forwarder = NewForwarder(addr, nil)
+	s.sDialer = sDialer
+
+	if s.serve, err = innerServer(inner, sDialer); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// ListenAndServe serves the inner protocol over mux sessions.
+func (s *Mux) ListenAndServe() {
+	l, err := listen("tcp", s.addr)
+	if err != nil {
+		logf("proxy-mux failed to listen on %s: %v", s.addr, err)
+		return
+	}
+
+	logf("proxy-mux listening TCP on %s", s.addr)
+
+	b := budgetOf(s.addr)
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if isClosed(err) {
+				return
+			}
+			logf("proxy-mux failed to accept: %v", err)
+			continue
+		}
+
+		go s.ServeTCP(b.limit(c))
+	}
+}
+
+// ServeTCP serves the streams of a mux session on c, the streams are counted in the budget.
+func (s *Mux) ServeTCP(c net.Conn) {
+	defer c.Close()
+
+	if c, ok := c.(*net.TCPConn); ok {
+		c.SetKeepAlive(true)
+	}
+
+	sess, err := smux.Server(c, s.config)
+	if err != nil {
+		logf("proxy-mux session from %s error: %s", c.RemoteAddr(), err)
+		return
+	}
+	defer sess.Close()
+
+	logf("proxy-mux session from %s", c.RemoteAddr())
+
+	b := budgetOf(s.addr)
+	for {
+		st, err := sess.AcceptStream()
+		if err != nil {
+			logf("proxy-mux session from %s closed: %v", c.RemoteAddr(), err)
+			return
+		}
+
+		if !b.acquireConn() {
+			logf("proxy-mux %s rejected, too many connections on %s", c.RemoteAddr(), s.addr)
+			st.Close()
+			continue
+		}
+
+		go func() {
+			defer b.releaseConn()
+			s.serve(st)
+		}()
+	}
+}
+
+// getSession returns a session with less than maxStreams streams, dials a new one if none.
+// The lock is held across select-or-dial and a stream slot is reserved in the returned session,
+// so concurrent dials never exceed maxStreams, the caller must call release after opening the stream.
+func (s *Mux) getSession() (*muxSession, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sessions := s.sessions[:0]
+	var found *muxSession
+	for _, sess := range s.sessions {
+		if sess.IsClosed() {
+			continue
+		}
+		sessions = append(sessions, sess)
+
+		if found == nil && sess.NumStreams()+sess.pending < s.maxStreams {
+			found = sess
+		}
+	}
+	s.sessions = sessions
+
+	if found != nil {
+		found.pending++
+		found.idleSince = time.Time{}
+		return found, nil
+	}
+
+	rc, err := s.cDialer.Dial("tcp", s.addr)
+	if err != nil {
+		logf("dial to %s error: %s", s.addr, err)
+		return nil, err
+	}
+
+	if c, ok := rc.(*net.TCPConn); ok {
+		c.SetKeepAlive(true)
+	}
+
+	sess, err := smux.Client(rc, s.config)
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+
+	logf("proxy-mux new session to %s", s.addr)
+
+	found = &muxSession{Session: sess, pending: 1}
+	s.sessions = append(s.sessions, found)
+
+	s.reapOnce.Do(func() { go s.reap() })
+
+	return found, nil
+}
+
+// release releases the stream slot reserved by getSession
+func (s *Mux) release(sess *muxSession) {
+	s.mu.Lock()
+	sess.pending--
+	s.mu.Unlock()
+}
+
+// reap closes the sessions without streams for more than idle
+func (s *Mux) reap() {
+	interval := s.idle / 2
+	if interval < time.Second {
+		interval = time.Second
+	}
+
+	for range time.Tick(interval) {
+		now := time.Now()
+
+		s.mu.Lock()
+		for _, sess := range s.sessions {
+			if sess.NumStreams() > 0 || sess.pending > 0 {
+				sess.idleSince = time.Time{}
+				continue
+			}
+
+			if sess.idleSince.IsZero() {
+				sess.idleSince = now
+			}
+
+			if now.Sub(sess.idleSince) >= s.idle {
+				logf("proxy-mux session to %s closed, idle for %s", s.addr, now.Sub(sess.idleSince))
+				sess.Close()
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// Dial opens a stream to the mux server, addr is decided by the next forwarder and ignored.
+func (s *Mux) Dial(network, addr string) (net.Conn, error) {
+	// retry once with a new session, the old one may be broken
+	for i := 0; ; i++ {
+		sess, err := s.getSession()
+		if err != nil {
+			return nil, err
+		}
+
+		st, err := sess.OpenStream()
+		s.release(sess)
+		if err == nil {
+			return st, nil
+		}
+
+		logf("proxy-mux open stream to %s error: %s", s.addr, err)
+		sess.Close()
+		if i > 0 {
+			return nil, err
+		}
+	}
+}
+
+// DialUDP connects to the given address via the proxy.
+func (s *Mux) DialUDP(network, addr string) (net.PacketConn, net.Addr, error) {
+	return nil, nil, newError(ErrUDPNotSupported, "proxy-mux: udp not supported")
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestNaivePaddingHeader(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		h := naivePaddingHeader()
+		if len(h) < 16 || len(h) > 32 {
+			t.Fatalf("padding header length %d", len(h))
+		}
+		if strings.Trim(h[:16], "!#$()+<>?@[]^`{}") != "" || strings.Trim(h[16:], "~") != "" {
+			t.Fatalf("padding header %q", h)
+		}
+	}
+}
+
+func TestNaivePadding(t *testing.T) {
+	var payloads [][]byte
+	for i := 0; i < naiveFirstPaddings+3; i++ {
+		payloads = append(payloads, bytes.Repeat([]byte{byte('a' + i)}, 10+i))
+	}
+
+	pr, pw := io.Pipe()
+	w := &naiveConn{pw: pw, cancel: func() {}, body: ioutil.NopCloser(nil)}
+	go func() {
+		for _, p := range payloads {
+			w.Write(p)
+		}
+		pw.Close()
+	}()
+
+	raw, err := ioutil.ReadAll(pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the first frames are padded, then the data is raw
+	r := bytes.NewReader(raw)
+	for i, p := range payloads {
+		if i == naiveFirstPaddings {
+			rest, _ := ioutil.ReadAll(r)
+			if !bytes.Equal(rest, bytes.Join(payloads[i:], nil)) {
+				t.Fatalf("raw data after the padded frames: %q", rest)
+			}
+			break
+		}
+
+		var h [3]byte
+		io.ReadFull(r, h[:])
+		if n := binary.BigEndian.Uint16(h[:]); int(n) != len(p) {
+			t.Fatalf("frame %d payload length %d, want %d", i, n, len(p))
+		}
+
+		frame := make([]byte, len(p)+int(h[2]))
+		io.ReadFull(r, frame)
+		if !bytes.Equal(frame[:len(p)], p) || bytes.Count(frame[len(p):], []byte{0}) != int(h[2]) {
+			t.Fatalf("frame %d: %q", i, frame)
+		}
+	}
+
+	// read back with small buffers
+	c := &naiveConn{body: ioutil.NopCloser(bytes.NewReader(raw))}
+	var got []byte
+	buf := make([]byte, 7)
+	for {
+		n, err := c.Read(buf)
+		got = append(got, buf[:n]...)
+		if err != nil {
+			break
+		}
+	}
+
+	if want := bytes.Join(payloads, nil); !bytes.Equal(got, want) {
+		t.Fatalf("read %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// addrEvents broadcasts the interface address changes:
+// the channel is closed and replaced on each change.
+var addrEvents struct {
+	sync.Mutex
+	ch chan struct{}
+}
+
+func init() {
+	addrEvents.ch = make(chan struct{})
+}
+
+// addrChanged returns a channel which is closed on the next address change
+func addrChanged() <-chan struct{} {
+	addrEvents.Lock()
+	defer addrEvents.Unlock()
+	return addrEvents.ch
+}
+
+// notifyAddrChange wakes up all the waiters of addrChanged
+func notifyAddrChange() {
+	addrEvents.Lock()
+	close(addrEvents.ch)
+	addrEvents.ch = make(chan struct{})
+	addrEvents.Unlock()
+}
+
+// watchAddrs watches the interface addresses(netlink on linux, polling on others),
+// when changed(e.g. pppoe reconnected with a new wan ip), closes the relays on the
+// vanished addresses, rechecks the forwarders and rebinds the listeners failed before.
+func watchAddrs() {
+	wait, err := addrNotifier()
+	if err != nil {
+		logf("netwatch: %s, fallback to polling", err)
+		wait = func() { time.Sleep(10 * time.Second) }
+	}
+
+	last := localAddrs()
+	for {
+		wait()
+
+		// wait for the changes to settle, pppoe sets the address and routes in a row
+		time.Sleep(time.Second)
+
+		cur := localAddrs()
+		if strings.Join(cur, " ") == strings.Join(last, " ") {
+			continue
+		}
+
+		logf("netwatch: interface addresses changed: %v -> %v", last, cur)
+		last = cur
+
+		flushInterfaceAddrs()
+		closeStaleListeners(cur)
+		closeStaleFlows(cur)
+		recheckDialers()
+		notifyAddrChange()
+	}
+}
+
+// ifaceAddrs caches the interface addresses for the checks on every dial,
+// refreshed after ifaceAddrsTTL or at once when netwatch sees a change.
+var ifaceAddrs struct {
+	sync.Mutex
+	addrs  []net.Addr
+	expire time.Time
+}
+
+const ifaceAddrsTTL = 30 * time.Second
+
+// interfaceAddrs returns the cached addresses of all the interfaces
+func interfaceAddrs() []net.Addr {
+	ifaceAddrs.Lock()
+	defer ifaceAddrs.Unlock()
+
+	if time.Now().After(ifaceAddrs.expire) {
+		addrs, err := net.InterfaceAddrs()
+		if err != nil {
+			logf("get interface addresses error: %s", err)
+		}
+		ifaceAddrs.addrs, ifaceAddrs.expire = addrs, time.Now().Add(ifaceAddrsTTL)
+	}
+
+	return ifaceAddrs.addrs
+}
+
+// flushInterfaceAddrs drops the cached interface addresses
+func flushInterfaceAddrs() {
+	ifaceAddrs.Lock()
+	ifaceAddrs.expire = time.Time{}
+	ifaceAddrs.Unlock()
+}
+
+// localAddrs returns the sorted ip addresses of all the interfaces
+func localAddrs() []string {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		logf("netwatch: get interface addresses error: %s", err)
+		return nil
+	}
+
+	var ips []string
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok {
+			ips = append(ips, n.IP.String())
+		}
+	}
+	sort.Strings(ips)
+
+	return ips
+}
+
+// closeStaleFlows closes the relays whose outbound sockets are bound to an address not in addrs,
+// they will never get a response after the address is gone.
+func closeStaleFlows(addrs []string) {
+	valid := make(map[string]bool, len(addrs))
+	for _, a := range addrs {
+		valid[a] = true
+	}
+
+	var stales []*flow
+	flows.Lock()
+	for _, f := range flows.m {
+		a, ok := f.rc.LocalAddr().(*net.TCPAddr)
+		if !ok || a.IP.IsUnspecified() || a.IP.IsLoopback() {
+			continue
+		}
+
+		if !valid[a.IP.String()] {
+			stales = append(stales, f)
+		}
+	}
+	flows.Unlock()
+
+	for _, f := range stales {
+		logf("netwatch: close stale flow %s <-> %s, local address %s is gone", f.src, f.dst, f.rc.LocalAddr())
+		f.c.Close()
+		f.rc.Close()
+	}
+}
+
+// recheckDialers wakes up the health checks of all the forwarders
+func recheckDialers() {
+	rrDialers.Lock()
+	defer rrDialers.Unlock()
+
+	for _, rr := range rrDialers.list {
+		rr.recheck()
+	}
+}
+
+// listeners tracks the sockets listening on specific addresses, so the ones on a vanished address
+// are closed, then their servers return and are run again by serve after the next change.
+var listeners struct {
+	sync.Mutex
+	m map[io.Closer]net.IP
+}
+
+// trackListener tracks c listening on a, the wildcard and loopback addresses are never gone.
+func trackListener(c io.Closer, a net.Addr) {
+	var ip net.IP
+	switch a := a.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	case *net.IPAddr:
+		ip = a.IP
+	}
+
+	if ip == nil || ip.IsUnspecified() || ip.IsLoopback() {
+		return
+	}
+
+	listeners.Lock()
+	if listeners.m == nil {
+		listeners.m = make(map[io.Closer]net.IP)
+	}
+	listeners.m[c] = ip
+	listeners.Unlock()
+}
+
+// listen announces on the local network address, the listener is tracked by netwatch.
+func listen(network, addr string) (net.Listener, error) {
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	trackListener(l, l.Addr())
+	return l, nil
+}
+
+// listenPacket announces on the local network address, the conn is tracked by netwatch.
+func listenPacket(network, addr string) (net.PacketConn, error) {
+	c, err := net.ListenPacket(network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	trackListener(c, c.LocalAddr())
+	return c, nil
+}
+
+// isClosed reports whether err is returned by a closed listener or conn
+func isClosed(err error) bool {
+	return strings.Contains(err.Error(), "use of closed network connection")
+}
+
+// closeStaleListeners closes the listeners on an address not in addrs
+func closeStaleListeners(addrs []string) {
+	valid := make(map[string]bool, len(addrs))
+	for _, a := range addrs {
+		valid[a] = true
+	}
+
+	listeners.Lock()
+	defer listeners.Unlock()
+
+	for c, ip := range listeners.m {
+		if !valid[ip.String()] {
+			logf("netwatch: close listener on %s, the address is gone", ip)
+			c.Close()
+			delete(listeners.m, c)
+		}
+	}
+}
+
+// serve runs the server, and with netwatch enabled, runs it again after the addresses
+// changed if it returned, e.g. failed to listen on an address which is not assigned yet,
+// or its listener was closed as the address was gone.
+func serve(s Server, addr string) {
+	for {
+		s.ListenAndServe()
+		if !conf.NetWatch {
+			return
+		}
+
+		<-addrChanged()
+		logf("netwatch: rebinding listener %s", addr)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"syscall"
+	"time"
+)
+
+// rtnetlink multicast groups
+// https://github.com/torvalds/linux/blob/master/include/uapi/linux/rtnetlink.h
+const (
+	rtmgrpLink       = 0x1
+	rtmgrpIPv4IfAddr = 0x10
+	rtmgrpIPv6IfAddr = 0x100
+)
+
+// addrNotifier returns a function which blocks until a link or address event is received from netlink
+func addrNotifier() (func(), error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return nil, err
+	}
+
+	lsa := &syscall.SockaddrNetlink{
+		Family: syscall.AF_NETLINK,
+		Groups: rtmgrpLink | rtmgrpIPv4IfAddr | rtmgrpIPv6IfAddr,
+	}
+
+	if err = syscall.Bind(fd, lsa); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+
+	buf := make([]byte, 8192)
+	return func() {
+		// the messages are not parsed, the addresses are compared by the caller
+		if _, _, err := syscall.Recvfrom(fd, buf, 0); err != nil {
+			logf("netwatch: read netlink error: %s", err)
+			time.Sleep(10 * time.Second)
+		}
+	}, nil
+}
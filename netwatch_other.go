@@ -0,0 +1,10 @@
+// +build !linux
+
+package main
+
+import "time"
+
+// addrNotifier returns a function which waits for the next polling of the addresses
+func addrNotifier() (func(), error) {
+	return func() { time.Sleep(10 * time.Second) }, nil
+}
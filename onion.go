@@ -0,0 +1,207 @@
+// publish listeners as onion services via the tor control port:
+// https://spec.torproject.org/control-spec/commands.html#add_onion
+
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// onionService is a listener published as an onion service
+type onionService struct {
+	listen  string // the local listener
+	control string // tor control port
+	pass    string // control port password, cookie authentication is used if empty
+	keyFile string // the private key is loaded from or saved to keyFile to keep the onion address
+	port    string // virtual port of the onion service, the listening port by default
+}
+
+// publishOnion publishes the listener on addr as an onion service if the onion param is in rawQuery:
+// socks5://:1080?onion=127.0.0.1:9051&onionkey=/var/lib/glider/onion.key&onionport=1080&onionpass=PASS
+// authed reports whether the listener requires authentication, an open listener is warned.
+func publishOnion(addr, rawQuery string, authed bool) {
+	p, _ := url.ParseQuery(rawQuery)
+	if p.Get("onion") == "" {
+		return
+	}
+
+	if !authed {
+		logf("onion: WARNING: %s has no authentication, anyone who knows the onion address can use it", addr)
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		logf("onion: invalid listen address %s: %s", addr, err)
+		return
+	}
+
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "127.0.0.1"
+	}
+
+	s := &onionService{
+		listen:  net.JoinHostPort(host, port),
+		control: p.Get("onion"),
+		pass:    p.Get("onionpass"),
+		keyFile: p.Get("onionkey"),
+		port:    port,
+	}
+
+	if v := p.Get("onionport"); v != "" {
+		s.port = v
+	}
+
+	go s.run()
+}
+
+// run keeps the onion service published, the service is removed by tor
+// when the control connection is closed, so it's reconnected on errors.
+func (s *onionService) run() {
+	for {
+		if err := s.publish(); err != nil {
+			logf("onion: publish %s via %s error: %s, retry in 30s", s.listen, s.control, err)
+		}
+		time.Sleep(30 * time.Second)
+	}
+}
+
+// publish adds the onion service and blocks until the control connection is closed
+func (s *onionService) publish() error {
+	c, err := net.Dial("tcp", s.control)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	r := bufio.NewReader(c)
+	if err := s.authenticate(c, r); err != nil {
+		return err
+	}
+
+	key := "NEW:ED25519-V3"
+	if s.keyFile != "" {
+		if b, err := ioutil.ReadFile(s.keyFile); err == nil {
+			key = strings.TrimSpace(string(b))
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	reply, err := torControl(c, r, "ADD_ONION "+key+" Port="+s.port+","+s.listen)
+	if err != nil {
+		return err
+	}
+
+	if pk := reply["PrivateKey"]; pk != "" && s.keyFile != "" {
+		if err := ioutil.WriteFile(s.keyFile, []byte(pk+"\n"), 0600); err != nil {
+			logf("onion: save private key to %s error: %s", s.keyFile, err)
+		}
+	}
+
+	logf("onion: %s published as %s.onion:%s", s.listen, reply["ServiceID"], s.port)
+
+	// the asynchronous events are not subscribed, so it only returns when closed
+	_, err = r.ReadString('\n')
+	return err
+}
+
+// authenticate authenticates to the control port with the password or the cookie file
+func (s *onionService) authenticate(c net.Conn, r *bufio.Reader) error {
+	info, err := torControl(c, r, "PROTOCOLINFO 1")
+	if err != nil {
+		return err
+	}
+
+	// METHODS=COOKIE,SAFECOOKIE, the tokens are matched exactly
+	methods := make(map[string]bool)
+	for _, m := range strings.Split(info["METHODS"], ",") {
+		methods[m] = true
+	}
+
+	switch {
+	case s.pass != "":
+		_, err = torControl(c, r, "AUTHENTICATE "+strconv.Quote(s.pass))
+	case methods["NULL"]:
+		_, err = torControl(c, r, "AUTHENTICATE")
+	case methods["COOKIE"]:
+		cookie, rerr := ioutil.ReadFile(info["COOKIEFILE"])
+		if rerr != nil {
+			return errors.New("read cookie file error: " + rerr.Error())
+		}
+		_, err = torControl(c, r, "AUTHENTICATE "+hex.EncodeToString(cookie))
+	default:
+		return errors.New("unsupported control port auth methods " + info["METHODS"] + ", set onionpass")
+	}
+
+	return err
+}
+
+// torControl sends cmd and returns the KEY=VALUE pairs of the reply lines:
+// 250-ServiceID=xxx, 250-PrivateKey=yyy, 250 OK
+func torControl(c net.Conn, r *bufio.Reader, cmd string) (map[string]string, error) {
+	if _, err := c.Write([]byte(cmd + "\r\n")); err != nil {
+		return nil, err
+	}
+
+	reply := make(map[string]string)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+
+		line = strings.TrimRight(line, "\r\n")
+		if len(line) < 4 {
+			return nil, errors.New("invalid control reply: " + line)
+		}
+
+		if line[:3] != "250" {
+			return nil, errors.New(strings.Fields(cmd)[0] + ": " + line)
+		}
+
+		// key=value pairs in the line, e.g. "250-AUTH METHODS=COOKIE,SAFECOOKIE COOKIEFILE="/run/tor/control.authcookie""
+		for _, kv := range splitControlLine(line[4:]) {
+			if i := strings.IndexByte(kv, '='); i > 0 {
+				v := kv[i+1:]
+				if uv, err := strconv.Unquote(v); err == nil {
+					v = uv
+				}
+				reply[kv[:i]] = v
+			}
+		}
+
+		if line[3] == ' ' {
+			return reply, nil
+		}
+	}
+}
+
+// splitControlLine splits line by spaces outside the quotes
+func splitControlLine(line string) []string {
+	var fields []string
+	var quoted bool
+	start := 0
+	for i := 0; i < len(line); i++ {
+		switch line[i] {
+		case '\\':
+			i++
+		case '"':
+			quoted = !quoted
+		case ' ':
+			if !quoted {
+				fields = append(fields, line[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(fields, line[start:])
+}
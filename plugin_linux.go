@@ -0,0 +1,8 @@
+package main
+
+import "syscall"
+
+// pluginSysProcAttr kills the plugin processes when glider exits, even if it's killed
+func pluginSysProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Pdeathsig: syscall.SIGKILL}
+}
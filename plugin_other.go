@@ -0,0 +1,8 @@
+// +build !linux
+
+package main
+
+import "syscall"
+
+// pluginSysProcAttr returns nil, the plugin processes are killed by stopSSPlugins on exit
+func pluginSysProcAttr() *syscall.SysProcAttr { return nil }
@@ -0,0 +1,449 @@
+// request port mappings for the listeners from the router behind consumer NAT:
+// NAT-PMP: https://tools.ietf.org/html/rfc6886
+// UPnP IGD: http://upnp.org/specs/gw/UPnP-gw-WANIPConnection-v1-Service.pdf
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	portmapLease   = 3600 // seconds
+	natpmpPort     = 5351
+	ssdpAddr       = "239.255.255.250:1900"
+	upnpIGDService = "urn:schemas-upnp-org:device:InternetGatewayDevice:1"
+)
+
+// portMapper requests a port mapping from the router
+type portMapper interface {
+	// mapPort maps the external port to the internal port, returns the external port and the lease
+	mapPort(network string, internal, external, lease int) (int, int, error)
+	String() string
+}
+
+// portMapping keeps the port mappings of a listener refreshed
+type portMapping struct {
+	method   string   // auto, upnp, natpmp
+	networks []string // tcp, udp
+	port     int      // the listening port
+	external int      // the requested external port, the listening port by default
+}
+
+// startPortMap requests the port mappings of the listener on addr if the portmap param is in rawQuery:
+// socks5://user:pass@:1080?portmap=auto&portmapport=11080, the udp port is also mapped for the listeners with udp.
+// authed reports whether the listener requires authentication, an open proxy is never mapped to the internet.
+func startPortMap(addr, scheme, rawQuery string, authed bool) {
+	p, _ := url.ParseQuery(rawQuery)
+	method := p.Get("portmap")
+	if method == "" {
+		return
+	}
+
+	if !authed {
+		switch scheme {
+		case "mixed", "http", "socks4", "socks4a", "socks5":
+			logf("portmap: refused to map %s, an open %s proxy would be reachable from the internet, set the user or auth", addr, scheme)
+			return
+		}
+		logf("portmap: WARNING: %s has no authentication and will be reachable from the internet", addr)
+	}
+
+	switch method {
+	case "auto", "upnp", "natpmp":
+	default:
+		logf("portmap: unknown method '%s', available: auto upnp natpmp", method)
+		return
+	}
+
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		logf("portmap: invalid listen address %s: %s", addr, err)
+		return
+	}
+
+	m := &portMapping{method: method, networks: portmapNetworks(scheme)}
+	m.port, _ = strconv.Atoi(port)
+	m.external = m.port
+
+	if v := p.Get("portmapport"); v != "" {
+		if m.external, err = strconv.Atoi(v); err != nil {
+			logf("portmap: invalid portmapport %s", v)
+			return
+		}
+	}
+
+	go m.run()
+}
+
+// portmapNetworks returns the networks served by the listeners of scheme
+func portmapNetworks(scheme string) []string {
+	switch scheme {
+	case "quic", "udptun", "dnstunnel":
+		return []string{"udp"}
+	case "mixed", "socks5", "ss":
+		return []string{"tcp", "udp"}
+	}
+	return []string{"tcp"}
+}
+
+// run maps the ports and refreshes them at the half of the lease, the mappings
+// are left to expire on exit.
+func (m *portMapping) run() {
+	for {
+		lease, err := m.refresh()
+		if err != nil {
+			logf("portmap: map port %d error: %s, retry in 60s", m.port, err)
+			time.Sleep(time.Minute)
+			continue
+		}
+
+		if lease <= 0 || lease > portmapLease {
+			lease = portmapLease
+		}
+		time.Sleep(time.Duration(lease) * time.Second / 2)
+	}
+}
+
+// refresh maps all the networks, returns the shortest lease
+func (m *portMapping) refresh() (int, error) {
+	mapper, err := newPortMapper(m.method)
+	if err != nil {
+		return 0, err
+	}
+
+	lease := portmapLease
+	for _, network := range m.networks {
+		external, l, err := mapper.mapPort(network, m.port, m.external, portmapLease)
+		if err != nil {
+			return 0, err
+		}
+
+		if l > 0 && l < lease {
+			lease = l
+		}
+
+		logf("portmap: %s port %d mapped to %d via %s, lease %ds", network, m.port, external, mapper, l)
+	}
+
+	return lease, nil
+}
+
+// newPortMapper discovers the router, NAT-PMP is tried first in auto mode
+func newPortMapper(method string) (portMapper, error) {
+	gw, err := routerAddr()
+	if err != nil && method != "upnp" {
+		return nil, err
+	}
+
+	if method == "natpmp" {
+		return &natpmp{gateway: gw}, nil
+	}
+
+	if method == "auto" {
+		n := &natpmp{gateway: gw}
+		if _, err := n.externalAddr(); err == nil {
+			return n, nil
+		}
+	}
+
+	return discoverUPnP()
+}
+
+// routerAddr returns the default gateway from the routing table
+func routerAddr() (net.IP, error) {
+	if gw := defaultGateway(); gw != nil {
+		return gw, nil
+	}
+	return nil, errors.New("no ipv4 default gateway found")
+}
+
+// localIPTo returns the local ip used to reach addr, no packets are sent
+func localIPTo(addr string) (net.IP, error) {
+	c, err := net.Dial("udp4", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	return c.LocalAddr().(*net.UDPAddr).IP, nil
+}
+
+// natpmp is a NAT-PMP client
+type natpmp struct {
+	gateway net.IP
+}
+
+func (n *natpmp) String() string { return "natpmp://" + n.gateway.String() }
+
+// request sends req to the gateway and returns the response of op,
+// retries with the doubled timeout from 250ms as the RFC suggests.
+func (n *natpmp) request(req []byte, size int) ([]byte, error) {
+	c, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: n.gateway, Port: natpmpPort})
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	buf := make([]byte, 16)
+	timeout := 250 * time.Millisecond
+	for i := 0; i < 4; i++ {
+		if _, err := c.Write(req); err != nil {
+			return nil, err
+		}
+
+		c.SetReadDeadline(time.Now().Add(timeout))
+		m, err := c.Read(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				timeout *= 2
+				continue
+			}
+			return nil, err
+		}
+
+		if m < size || buf[0] != 0 || buf[1] != req[1]|0x80 {
+			return nil, errors.New("natpmp: invalid response")
+		}
+
+		if code := binary.BigEndian.Uint16(buf[2:]); code != 0 {
+			return nil, errors.New("natpmp: result code " + strconv.Itoa(int(code)))
+		}
+
+		return buf[:m], nil
+	}
+
+	return nil, errors.New("natpmp: no response from " + n.gateway.String())
+}
+
+// externalAddr requests the external address, used to probe the gateway
+func (n *natpmp) externalAddr() (net.IP, error) {
+	resp, err := n.request([]byte{0, 0}, 12)
+	if err != nil {
+		return nil, err
+	}
+	return net.IP(resp[8:12]), nil
+}
+
+func (n *natpmp) mapPort(network string, internal, external, lease int) (int, int, error) {
+	// Version(1) OP(1) Reserved(2) InternalPort(2) ExternalPort(2) Lifetime(4)
+	req := make([]byte, 12)
+	req[1] = 2 // tcp
+	if network == "udp" {
+		req[1] = 1
+	}
+	binary.BigEndian.PutUint16(req[4:], uint16(internal))
+	binary.BigEndian.PutUint16(req[6:], uint16(external))
+	binary.BigEndian.PutUint32(req[8:], uint32(lease))
+
+	// Version(1) OP(1) ResultCode(2) Epoch(4) InternalPort(2) ExternalPort(2) Lifetime(4)
+	resp, err := n.request(req, 16)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return int(binary.BigEndian.Uint16(resp[10:])), int(binary.BigEndian.Uint32(resp[12:])), nil
+}
+
+// upnp is a UPnP IGD client
+type upnp struct {
+	control string // control url of the WANIPConnection or WANPPPConnection service
+	service string // service type
+	localIP net.IP // the internal client of the mappings
+}
+
+func (u *upnp) String() string { return u.control }
+
+// upnpDevice is the device description, only the services are used
+type upnpDevice struct {
+	Services []struct {
+		ServiceType string `xml:"serviceType"`
+		ControlURL  string `xml:"controlURL"`
+	} `xml:"serviceList>service"`
+	Devices []upnpDevice `xml:"deviceList>device"`
+}
+
+// discoverUPnP finds the gateway by ssdp and gets its control url from the description
+func discoverUPnP() (*upnp, error) {
+	c, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	dst, _ := net.ResolveUDPAddr("udp4", ssdpAddr)
+	req := "M-SEARCH * HTTP/1.1\r\nHOST: " + ssdpAddr + "\r\nST: " + upnpIGDService +
+		"\r\nMAN: \"ssdp:discover\"\r\nMX: 2\r\n\r\n"
+	if _, err := c.WriteTo([]byte(req), dst); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 2048)
+	c.SetReadDeadline(time.Now().Add(3 * time.Second))
+	for {
+		n, _, err := c.ReadFrom(buf)
+		if err != nil {
+			return nil, errors.New("upnp: no gateway found: " + err.Error())
+		}
+
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf[:n])), nil)
+		if err != nil {
+			continue
+		}
+
+		if loc := resp.Header.Get("Location"); loc != "" {
+			if u, err := newUPnP(loc); err == nil {
+				return u, nil
+			}
+		}
+	}
+}
+
+// newUPnP returns a upnp client with the device description at location
+func newUPnP(location string) (*upnp, error) {
+	base, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get(location)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var root struct {
+		URLBase string     `xml:"URLBase"`
+		Device  upnpDevice `xml:"device"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&root); err != nil {
+		return nil, err
+	}
+
+	if root.URLBase != "" {
+		if b, err := url.Parse(root.URLBase); err == nil {
+			base = b
+		}
+	}
+
+	u := &upnp{}
+	devices := []upnpDevice{root.Device}
+	for len(devices) > 0 && u.control == "" {
+		d := devices[0]
+		devices = append(devices[1:], d.Devices...)
+		for _, s := range d.Services {
+			if strings.Contains(s.ServiceType, ":WANIPConnection:") || strings.Contains(s.ServiceType, ":WANPPPConnection:") {
+				ref, err := url.Parse(s.ControlURL)
+				if err != nil {
+					continue
+				}
+				u.control, u.service = base.ResolveReference(ref).String(), s.ServiceType
+				break
+			}
+		}
+	}
+
+	if u.control == "" {
+		return nil, errors.New("upnp: no wan connection service in " + location)
+	}
+
+	host := base.Host
+	if base.Port() == "" {
+		host = net.JoinHostPort(host, "80")
+	}
+
+	if u.localIP, err = localIPTo(host); err != nil {
+		return nil, err
+	}
+
+	return u, nil
+}
+
+// soap calls action of the service with the arguments in order
+func (u *upnp) soap(action string, args ...string) error {
+	var body bytes.Buffer
+	body.WriteString(`<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>`)
+	body.WriteString(`<u:` + action + ` xmlns:u="` + u.service + `">`)
+	for i := 0; i+1 < len(args); i += 2 {
+		body.WriteString("<" + args[i] + ">")
+		xml.EscapeText(&body, []byte(args[i+1]))
+		body.WriteString("</" + args[i] + ">")
+	}
+	body.WriteString(`</u:` + action + `></s:Body></s:Envelope>`)
+
+	req, err := http.NewRequest("POST", u.control, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", `"`+u.service+`#`+action+`"`)
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(resp.Body)
+		var fault struct {
+			Code string `xml:"Body>Fault>detail>UPnPError>errorCode"`
+			Desc string `xml:"Body>Fault>detail>UPnPError>errorDescription"`
+		}
+		xml.Unmarshal(b, &fault)
+		return &upnpError{code: fault.Code, desc: fault.Desc, status: resp.Status}
+	}
+
+	return nil
+}
+
+// upnpError is the error of a soap action
+type upnpError struct {
+	code, desc, status string
+}
+
+func (e *upnpError) Error() string {
+	return "upnp: " + e.status + ", error " + e.code + " " + e.desc
+}
+
+func (u *upnp) mapPort(network string, internal, external, lease int) (int, int, error) {
+	args := func(lease int) []string {
+		return []string{
+			"NewRemoteHost", "",
+			"NewExternalPort", strconv.Itoa(external),
+			"NewProtocol", strings.ToUpper(network),
+			"NewInternalPort", strconv.Itoa(internal),
+			"NewInternalClient", u.localIP.String(),
+			"NewEnabled", "1",
+			"NewPortMappingDescription", "glider",
+			"NewLeaseDuration", strconv.Itoa(lease),
+		}
+	}
+
+	err := u.soap("AddPortMapping", args(lease)...)
+
+	// 725: OnlyPermanentLeasesSupported, the mapping is kept until the router reboots
+	if ue, ok := err.(*upnpError); ok && ue.code == "725" {
+		lease = 0
+		err = u.soap("AddPortMapping", args(lease)...)
+	}
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return external, lease, nil
+}
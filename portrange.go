@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// portRange splits the listen url s with a port range, e.g. socks5://:20000-20100?maxconns=100,
+// into head, tail and the range, s == head + "FROM-TO" + tail.
+func portRange(s string) (head, tail string, from, to int, ok bool) {
+	i := strings.Index(s, "://")
+	if i < 0 {
+		return
+	}
+	i += 3
+
+	// authority: [USER:PASS@]HOST:PORT[=TARGET]
+	end := len(s)
+	if j := strings.IndexAny(s[i:], "/?#"); j >= 0 {
+		end = i + j
+	}
+	if j := strings.LastIndexByte(s[i:end], '@'); j >= 0 {
+		i += j + 1
+	}
+	if j := strings.IndexByte(s[i:end], '='); j >= 0 {
+		end = i + j
+	}
+
+	j := strings.LastIndexByte(s[i:end], ':')
+	if j < 0 {
+		return
+	}
+	i += j + 1
+
+	ports := strings.SplitN(s[i:end], "-", 2)
+	if len(ports) != 2 {
+		return
+	}
+
+	var err1, err2 error
+	from, err1 = strconv.Atoi(ports[0])
+	to, err2 = strconv.Atoi(ports[1])
+	if err1 != nil || err2 != nil {
+		return
+	}
+
+	return s[:i], s[end:], from, to, true
+}
+
+// rangeServer listens on a range of ports as one logical listener:
+// a server per port, all of them share the same budget(maxconns, maxudp, maxbw).
+type rangeServer struct {
+	addr    string
+	servers []Server
+}
+
+// newRangeServer returns the servers of the listen url s with a port range
+func newRangeServer(s string, sDialer Dialer) (Server, error) {
+	head, tail, from, to, _ := portRange(s)
+	if from < 1 || to > 65535 || from > to {
+		return nil, errors.New("invalid port range " + strconv.Itoa(from) + "-" + strconv.Itoa(to) + " in " + s)
+	}
+
+	u, err := url.Parse(head + strconv.Itoa(from) + tail)
+	if err != nil {
+		return nil, err
+	}
+
+	host, _, err := net.SplitHostPort(strings.Split(u.Host, "=")[0])
+	if err != nil {
+		return nil, err
+	}
+
+	rs := &rangeServer{addr: net.JoinHostPort(host, strconv.Itoa(from)+"-"+strconv.Itoa(to))}
+
+	b, err := newBudget(rs.addr, u.RawQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	for port := from; port <= to; port++ {
+		srv, err := ServerFromURL(head+strconv.Itoa(port)+tail, sDialer)
+		if err != nil {
+			return nil, err
+		}
+
+		// replace the budget of each port with the shared one
+		setBudget(net.JoinHostPort(host, strconv.Itoa(port)), b)
+		rs.servers = append(rs.servers, srv)
+	}
+
+	logf("listen on %s, %d ports", rs.addr, len(rs.servers))
+
+	return rs, nil
+}
+
+// ListenAndServe serves on all the ports, returns when the first one returned.
+func (rs *rangeServer) ListenAndServe() {
+	for _, s := range rs.servers[1:] {
+		go s.ListenAndServe()
+	}
+	rs.servers[0].ListenAndServe()
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// probeDirect checks whether the direct path really works:
+// the default gateway must be reachable(icmp, or tcp as a fallback),
+// and the captive portal url must not be intercepted.
+func probeDirect() error {
+	if gw := defaultGateway(); gw != nil {
+		if err := probeGateway(gw); err != nil {
+			return errors.New("gateway " + gw.String() + " unreachable: " + err.Error())
+		}
+	}
+
+	if conf.CaptiveURL != "" {
+		if err := checkCaptive(conf.CaptiveURL); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// probeGateway sends an icmp echo request to gw, falls back to a tcp probe
+// when raw sockets are not permitted.
+func probeGateway(gw net.IP) error {
+	c, err := net.DialTimeout("ip4:icmp", gw.String(), 2*time.Second)
+	if err != nil {
+		return probeTCP(gw)
+	}
+	defer c.Close()
+
+	// type(1) 8: echo request, code(1), checksum(2), id(2), seq(2)
+	msg := []byte{8, 0, 0, 0, 0, 0, 0, 1}
+	binary.BigEndian.PutUint16(msg[4:], uint16(os.Getpid()))
+	binary.BigEndian.PutUint16(msg[2:], icmpChecksum(msg))
+
+	c.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := c.Write(msg); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 1500)
+	for {
+		n, err := c.Read(buf)
+		if err != nil {
+			return err
+		}
+
+		// skip the ip header if any
+		b := buf[:n]
+		if len(b) >= 20 && b[0]>>4 == 4 {
+			b = b[int(b[0]&0x0f)*4:]
+		}
+
+		// type 0: echo reply
+		if len(b) >= 8 && b[0] == 0 {
+			return nil
+		}
+	}
+}
+
+// probeTCP connects to port 80 of ip, "connection refused" also means reachable.
+func probeTCP(ip net.IP) error {
+	c, err := net.DialTimeout("tcp", net.JoinHostPort(ip.String(), "80"), 2*time.Second)
+	if err == nil {
+		c.Close()
+		return nil
+	}
+
+	if opErr, ok := err.(*net.OpError); ok {
+		if sysErr, ok := opErr.Err.(*os.SyscallError); ok && sysErr.Err == syscall.ECONNREFUSED {
+			return nil
+		}
+	}
+
+	return err
+}
+
+// icmpChecksum returns the internet checksum of b
+func icmpChecksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+
+	sum = sum>>16 + sum&0xffff
+	sum += sum >> 16
+	return ^uint16(sum)
+}
+
+// checkCaptive requests url directly, the response must be "204 No Content",
+// otherwise the local network is captive(e.g. hotel or airport wifi login page).
+func checkCaptive(url string) error {
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		return errors.New("captive portal detected, " + url + " responds: " + resp.Status)
+	}
+
+	return nil
+}
+
+// probeUDP checks the udp relay of forwarder d with a dns query(A record of host) to the dns server,
+// the tcp checks can not find the servers whose udp relay is broken.
+func probeUDP(d Dialer, server, host string) error {
+	pc, writeTo, err := d.DialUDP("udp", server)
+	if err != nil {
+		return err
+	}
+	defer pc.Close()
+
+	id := uint16(time.Now().UnixNano())
+	msg := make([]byte, DNSHeaderLen, DNSHeaderLen+len(host)+6)
+	binary.BigEndian.PutUint16(msg, id)
+	msg[2] = 0x01 // RD
+	msg[5] = 1    // qdcount
+	for _, label := range strings.Split(strings.Trim(host, "."), ".") {
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0, 0, DNSQTypeA, 0, 1)
+
+	if _, err := pc.WriteTo(msg, writeTo); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 1024)
+	pc.SetReadDeadline(time.Now().Add(3 * time.Second))
+	for {
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+
+		if n >= DNSHeaderLen && binary.BigEndian.Uint16(buf) == id {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,68 @@
+// Package proxy holds the error kinds of glider, so the embedders can tell
+// the authentication failures from the network failures:
+//
+//	if proxy.ErrorKind(err) == proxy.ErrAuth { ... }
+//	if errors.Is(err, proxy.ErrUnreachable) { ... }
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net"
+)
+
+// Kinds of the proxy errors, use ErrorKind to get the kind of an error
+var (
+	ErrAuth            = errors.New("authentication failed")
+	ErrUnreachable     = errors.New("destination unreachable") // the forwarder works but the destination is unreachable via it
+	ErrUDPNotSupported = errors.New("udp not supported")
+	ErrUnknownSchema   = errors.New("unknown schema")
+	ErrInvalidAddr     = errors.New("invalid address")
+	ErrProtocol        = errors.New("protocol error") // unexpected or malformed messages from the peer
+	ErrRejected        = errors.New("rejected")
+	ErrNetwork         = errors.New("network error")
+)
+
+// Error is a proxy error with its kind
+type Error struct {
+	Kind error // one of the Err* kinds
+	Msg  string
+	Err  error // the underlying error, may be nil
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return e.Msg + ": " + e.Err.Error()
+	}
+	return e.Msg
+}
+
+// Is reports whether target is the kind of e, for errors.Is
+func (e *Error) Is(target error) bool { return target == e.Kind }
+
+// Unwrap returns the underlying error, for errors.Unwrap
+func (e *Error) Unwrap() error { return e.Err }
+
+// ErrorKind returns the kind of err, also if it's wrapped by fmt.Errorf("...: %w", err),
+// the i/o errors are ErrNetwork, nil if unknown.
+func ErrorKind(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Kind
+	}
+
+	var ne net.Error
+	if errors.As(err, &ne) {
+		return ErrNetwork
+	}
+
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return ErrNetwork
+	}
+
+	return nil
+}
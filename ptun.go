@@ -0,0 +1,553 @@
+// ptun is a simple reliable stream over request/response packet transports
+// where only the client can send packets, e.g. dns queries or icmp echo requests.
+// it's stop-and-wait: the client has at most one outstanding request and retransmits
+// it on timeout, the server caches the last response of each session for the retransmission.
+//
+// request and response packet:
+// +-----+-----+-------+---------+
+// | SID | SEQ | FLAGS | PAYLOAD |
+// +-----+-----+-------+---------+
+// |  4  |  2  |   1   | Variable|
+// +-----+-----+-------+---------+
+// the response echoes SID and SEQ of the request.
+//
+// the payload of a SYN request is authenticated with the pre-shared key, so the server
+// is not an open relay: ADDR | TIME(8) | HMAC-SHA256(PSK, SID SEQ FLAGS ADDR TIME)[:16]
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+const ptunHeaderLen = 7
+
+// ptun flags
+const (
+	ptunSYN = 1 // open a session, payload: socks address of the target, time and mac
+	ptunFIN = 2 // close the session
+	ptunERR = 4 // unknown session or dial error, response only
+)
+
+// ptunBufSize is the max buffered bytes of each direction
+const ptunBufSize = 64 << 10
+
+// the time and mac of a SYN request, the requests older than ptunMaxSkew are rejected
+const (
+	ptunTimeLen = 8
+	ptunMACLen  = 16
+	ptunMaxSkew = 2 * time.Minute
+)
+
+// ptunMAC returns the mac of a SYN request, hdr is the request header, addr and ts the payload before the mac
+func ptunMAC(psk, hdr, addrTime []byte) []byte {
+	h := hmac.New(sha256.New, psk)
+	h.Write(hdr[:ptunHeaderLen])
+	h.Write(addrTime)
+	return h.Sum(nil)[:ptunMACLen]
+}
+
+// ptunSYNPayload returns the authenticated payload of the SYN request with hdr to tgt
+func ptunSYNPayload(psk, hdr []byte, tgt Addr) []byte {
+	b := make([]byte, len(tgt)+ptunTimeLen, len(tgt)+ptunTimeLen+ptunMACLen)
+	copy(b, tgt)
+	binary.BigEndian.PutUint64(b[len(tgt):], uint64(time.Now().Unix()))
+	return append(b, ptunMAC(psk, hdr, b)...)
+}
+
+// ptunVerifySYN verifies the SYN request req and returns the target, nil if invalid
+func ptunVerifySYN(psk, req []byte) Addr {
+	payload := req[ptunHeaderLen:]
+	tgt := SplitAddr(payload)
+	if tgt == nil || len(payload) != len(tgt)+ptunTimeLen+ptunMACLen {
+		return nil
+	}
+
+	addrTime := payload[:len(tgt)+ptunTimeLen]
+	if !hmac.Equal(payload[len(addrTime):], ptunMAC(psk, req, addrTime)) {
+		return nil
+	}
+
+	ts := time.Unix(int64(binary.BigEndian.Uint64(payload[len(tgt):])), 0)
+	if d := time.Since(ts); d > ptunMaxSkew || d < -ptunMaxSkew {
+		return nil
+	}
+
+	return tgt
+}
+
+var errPtunTimeout = &ptunTimeoutError{}
+
+type ptunTimeoutError struct{}
+
+func (e *ptunTimeoutError) Error() string   { return "ptun: i/o timeout" }
+func (e *ptunTimeoutError) Timeout() bool   { return true }
+func (e *ptunTimeoutError) Temporary() bool { return true }
+
+// ptunExchanger sends a request packet and returns the matched response packet(see ptunMatch)
+type ptunExchanger interface {
+	exchange(req []byte) ([]byte, error)
+	Close() error
+}
+
+// ptunMatch reports whether resp is the response of req
+func ptunMatch(req, resp []byte) bool {
+	return len(resp) >= ptunHeaderLen && bytes.Equal(req[:6], resp[:6])
+}
+
+// ptunBuf is a bounded buffer with deadline
+type ptunBuf struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	buf      bytes.Buffer
+	closed   bool
+	deadline time.Time
+	timer    *time.Timer
+	ready    chan struct{} // signaled on write and close
+}
+
+func newPtunBuf() *ptunBuf {
+	b := &ptunBuf{ready: make(chan struct{}, 1)}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+// timeout reports whether the deadline exceeded, must be called with b.mu held
+func (b *ptunBuf) timeout() bool {
+	return !b.deadline.IsZero() && !time.Now().Before(b.deadline)
+}
+
+func (b *ptunBuf) signal() {
+	select {
+	case b.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (b *ptunBuf) Write(p []byte) (int, error) {
+	return b.write(p, true)
+}
+
+// put writes p to the buffer, ignores the deadline which is set for the reader.
+func (b *ptunBuf) put(p []byte) (int, error) {
+	return b.write(p, false)
+}
+
+func (b *ptunBuf) write(p []byte, deadline bool) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for b.buf.Len() >= ptunBufSize && !b.closed {
+		if deadline && b.timeout() {
+			return 0, errPtunTimeout
+		}
+		b.cond.Wait()
+	}
+
+	if b.closed {
+		return 0, io.ErrClosedPipe
+	}
+
+	b.buf.Write(p)
+	b.cond.Broadcast()
+	b.signal()
+
+	return len(p), nil
+}
+
+func (b *ptunBuf) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for b.buf.Len() == 0 && !b.closed {
+		if b.timeout() {
+			return 0, errPtunTimeout
+		}
+		b.cond.Wait()
+	}
+
+	if b.buf.Len() == 0 {
+		return 0, io.EOF
+	}
+
+	n, _ := b.buf.Read(p)
+	b.cond.Broadcast()
+	return n, nil
+}
+
+// take returns at most n bytes without blocking, waits for wait if there's no data.
+// eof is true when the buffer is closed and drained.
+func (b *ptunBuf) take(n int, wait time.Duration) (p []byte, eof bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.buf.Len() == 0 && !b.closed && wait > 0 {
+		t := time.AfterFunc(wait, func() {
+			b.mu.Lock()
+			b.cond.Broadcast()
+			b.mu.Unlock()
+		})
+		b.cond.Wait()
+		t.Stop()
+	}
+
+	p = append([]byte(nil), b.buf.Next(n)...)
+	b.cond.Broadcast()
+
+	return p, b.closed && b.buf.Len() == 0
+}
+
+// setDeadline sets the deadline of the blocking Read and Write
+func (b *ptunBuf) setDeadline(t time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.deadline = t
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+
+	if !t.IsZero() {
+		b.timer = time.AfterFunc(time.Until(t), func() {
+			b.mu.Lock()
+			b.cond.Broadcast()
+			b.mu.Unlock()
+		})
+	}
+
+	b.cond.Broadcast()
+}
+
+func (b *ptunBuf) Close() error {
+	b.mu.Lock()
+	b.closed = true
+	b.cond.Broadcast()
+	b.mu.Unlock()
+
+	b.signal()
+	return nil
+}
+
+// ptunConn is the client side stream of a ptun session
+type ptunConn struct {
+	ex       ptunExchanger
+	sid      uint32
+	seq      uint16
+	mtu      int           // max payload size of a request
+	interval time.Duration // min interval between requests, to avoid flooding
+
+	up, down *ptunBuf
+
+	laddr, raddr net.Addr
+}
+
+// dialPtun opens a session to target via the exchanger ex, the SYN request is authenticated with psk
+func dialPtun(ex ptunExchanger, psk []byte, mtu int, interval time.Duration, target string, laddr, raddr net.Addr) (net.Conn, error) {
+	tgt := ParseAddr(target)
+	if tgt == nil {
+		ex.Close()
+		return nil, newError(ErrInvalidAddr, "ptun: unable to parse address: "+target)
+	}
+
+	c := &ptunConn{
+		ex:       ex,
+		sid:      rand.Uint32(),
+		mtu:      mtu,
+		interval: interval,
+		up:       newPtunBuf(),
+		down:     newPtunBuf(),
+		laddr:    laddr,
+		raddr:    raddr,
+	}
+
+	hdr := make([]byte, ptunHeaderLen)
+	binary.BigEndian.PutUint32(hdr, c.sid)
+	binary.BigEndian.PutUint16(hdr[4:], c.seq)
+	hdr[6] = ptunSYN
+	syn := ptunSYNPayload(psk, hdr, tgt)
+
+	if len(syn) > mtu {
+		ex.Close()
+		return nil, newError(ErrInvalidAddr, "ptun: address too long for the tunnel: "+target)
+	}
+
+	if _, _, err := c.roundTrip(ptunSYN, syn); err != nil {
+		ex.Close()
+		return nil, err
+	}
+
+	go c.loop()
+	return c, nil
+}
+
+// roundTrip sends a request and returns the flags and payload of the response, retransmits on error
+func (c *ptunConn) roundTrip(flags byte, payload []byte) (byte, []byte, error) {
+	req := make([]byte, ptunHeaderLen+len(payload))
+	binary.BigEndian.PutUint32(req, c.sid)
+	binary.BigEndian.PutUint16(req[4:], c.seq)
+	req[6] = flags
+	copy(req[ptunHeaderLen:], payload)
+
+	var err error
+	for i := 0; i < 5; i++ {
+		var resp []byte
+		resp, err = c.ex.exchange(req)
+		if err != nil {
+			continue
+		}
+
+		c.seq++
+		if resp[6]&ptunERR != 0 {
+			return resp[6], nil, newError(ErrRejected, "ptun: session rejected by server")
+		}
+
+		return resp[6], resp[ptunHeaderLen:], nil
+	}
+
+	return 0, nil, err
+}
+
+// loop sends the buffered data and polls the server for data until the session ends
+func (c *ptunConn) loop() {
+	defer c.ex.Close()
+	defer c.down.Close()
+
+	const minIdle, maxIdle = 50 * time.Millisecond, time.Second
+	idle := minIdle
+
+	for {
+		payload, eof := c.up.take(c.mtu, 0)
+		if eof {
+			c.roundTrip(ptunFIN, nil)
+			return
+		}
+
+		flags, data, err := c.roundTrip(0, payload)
+		if err != nil {
+			logf("proxy-ptun session %08x error: %s", c.sid, err)
+			return
+		}
+
+		if len(data) > 0 {
+			if _, err := c.down.put(data); err != nil {
+				c.roundTrip(ptunFIN, nil)
+				return
+			}
+		}
+
+		if flags&ptunFIN != 0 {
+			return
+		}
+
+		time.Sleep(c.interval)
+
+		// back off polling when idle
+		if len(payload) > 0 || len(data) > 0 {
+			idle = minIdle
+			continue
+		}
+
+		select {
+		case <-c.up.ready:
+		case <-time.After(idle):
+		}
+
+		if idle *= 2; idle > maxIdle {
+			idle = maxIdle
+		}
+	}
+}
+
+func (c *ptunConn) Read(b []byte) (int, error)  { return c.down.Read(b) }
+func (c *ptunConn) Write(b []byte) (int, error) { return c.up.Write(b) }
+
+func (c *ptunConn) Close() error {
+	c.up.Close()
+	c.down.Close()
+	return nil
+}
+
+func (c *ptunConn) LocalAddr() net.Addr  { return c.laddr }
+func (c *ptunConn) RemoteAddr() net.Addr { return c.raddr }
+
+func (c *ptunConn) SetDeadline(t time.Time) error {
+	c.up.setDeadline(t)
+	c.down.setDeadline(t)
+	return nil
+}
+
+func (c *ptunConn) SetReadDeadline(t time.Time) error {
+	c.down.setDeadline(t)
+	return nil
+}
+
+func (c *ptunConn) SetWriteDeadline(t time.Time) error {
+	c.up.setDeadline(t)
+	return nil
+}
+
+// ptunServer is the server side of ptun sessions
+type ptunServer struct {
+	sDialer  Dialer
+	psk      []byte   // authenticates the SYN requests
+	sessions sync.Map // sid -> *ptunSession
+}
+
+// ptunSession is a server side session
+type ptunSession struct {
+	mu   sync.Mutex
+	rc   net.Conn
+	down *ptunBuf // data from rc
+
+	seq  uint16
+	resp []byte // the last response, for retransmission
+	last time.Time
+}
+
+func newPtunServer(sDialer Dialer, psk []byte) *ptunServer {
+	s := &ptunServer{sDialer: sDialer, psk: psk}
+	go s.reap()
+	return s
+}
+
+// handle handles the request packet req, returns the response with at most mtu bytes payload,
+// nil means the request should be dropped.
+func (s *ptunServer) handle(req []byte, mtu int) []byte {
+	if len(req) < ptunHeaderLen {
+		return nil
+	}
+
+	sid := binary.BigEndian.Uint32(req)
+	seq := binary.BigEndian.Uint16(req[4:])
+	flags, payload := req[6], req[ptunHeaderLen:]
+
+	resp := func(flags byte, data []byte) []byte {
+		b := make([]byte, ptunHeaderLen+len(data))
+		copy(b, req[:6])
+		b[6] = flags
+		copy(b[ptunHeaderLen:], data)
+		return b
+	}
+
+	if flags&ptunSYN != 0 {
+		// verified before a session is stored, so the invalid requests can not take a sid
+		tgt := ptunVerifySYN(s.psk, req)
+		if tgt == nil {
+			logf("proxy-ptun session %08x rejected, invalid SYN request", sid)
+			return nil
+		}
+
+		v, loaded := s.sessions.LoadOrStore(sid, &ptunSession{seq: seq, last: time.Now()})
+		sess := v.(*ptunSession)
+		if loaded {
+			sess.mu.Lock()
+			defer sess.mu.Unlock()
+			if sess.seq == seq && sess.resp != nil {
+				return sess.resp
+			}
+			return nil
+		}
+
+		sess.mu.Lock()
+		defer sess.mu.Unlock()
+
+		rc, err := s.sDialer.Dial("tcp", tgt.String())
+		if err != nil {
+			logf("proxy-ptun session %08x failed to connect to target %s: %v", sid, tgt, err)
+			s.sessions.Delete(sid)
+			return resp(ptunERR, nil)
+		}
+
+		logf("proxy-ptun session %08x <-> %s", sid, tgt)
+
+		sess.rc, sess.down = rc, newPtunBuf()
+		go func() {
+			io.Copy(sess.down, rc)
+			sess.down.Close()
+		}()
+
+		sess.resp = resp(0, nil)
+		return sess.resp
+	}
+
+	v, ok := s.sessions.Load(sid)
+	if !ok {
+		return resp(ptunERR, nil)
+	}
+
+	sess := v.(*ptunSession)
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+
+	// failed to open
+	if sess.rc == nil {
+		return resp(ptunERR, nil)
+	}
+
+	switch seq {
+	case sess.seq: // retransmission
+		return sess.resp
+	case sess.seq + 1:
+	default: // stale
+		return nil
+	}
+
+	sess.seq, sess.last = seq, time.Now()
+
+	if len(payload) > 0 {
+		if _, err := sess.rc.Write(payload); err != nil {
+			flags |= ptunFIN
+		}
+	}
+
+	if flags&ptunFIN != 0 {
+		s.close(sess)
+		sess.resp = resp(ptunFIN, nil)
+		return sess.resp
+	}
+
+	data, eof := sess.down.take(mtu, 100*time.Millisecond)
+	if eof {
+		s.close(sess)
+		sess.resp = resp(ptunFIN, data)
+		return sess.resp
+	}
+
+	sess.resp = resp(0, data)
+	return sess.resp
+}
+
+// close closes the session, it stays in the map until reaped for the retransmitted requests.
+func (s *ptunServer) close(sess *ptunSession) {
+	if sess.rc != nil {
+		sess.rc.Close()
+		sess.down.Close()
+	}
+}
+
+// reap removes the sessions idle for more than 2 minutes
+func (s *ptunServer) reap() {
+	for {
+		time.Sleep(30 * time.Second)
+
+		s.sessions.Range(func(key, value interface{}) bool {
+			sess := value.(*ptunSession)
+			sess.mu.Lock()
+			if time.Since(sess.last) > 2*time.Minute {
+				s.close(sess)
+				s.sessions.Delete(key)
+			}
+			sess.mu.Unlock()
+			return true
+		})
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// QUIC is a quic transport, every tcp connection is carried in a stream:
+//
+//	listen:  quic://:443?cert=/path/to/cert&key=/path/to/key,socks5://
+//	listen:  quic://:443?cert=/path/to/cert&key=/path/to/key,tcptun://127.0.0.1:22
+//	forward: quic://host:443?serverName=example.com,socks5://host:443
+//
+// As client, the streams share one quic connection. 0-RTT resumption is off by default,
+// 0rtt=true enables it on both sides, the 0-RTT data may be replayed by an attacker.
+// keepalive=SECONDS sets the keepalive interval, 15 by default, 0 disables it.
+// mtu=N limits the packets to fit in the mtu of the path, e.g. over wireguard.
+type QUIC struct {
+	*Forwarder
+	sDialer Dialer
+
+	tlsConfig  *tls.Config
+	quicConfig *quic.Config
+	early      bool             // as client, dial with 0-RTT
+	serve      func(c net.Conn) // as server, serves the inner protocol
+
+	mu   sync.Mutex
+	conn *quic.Conn // as client, shared by the streams
+}
+
+// newQUICConfig returns the quic config, the connection is closed after keepAliveMisses keepalive
+// intervals without any packet from the peer, or 60 seconds if the keepalive is disabled.
+func newQUICConfig(early bool, keepAlive time.Duration) *quic.Config {
+	idle := 60 * time.Second
+	if keepAlive > 0 {
+		idle = keepAlive * keepAliveMisses
+	}
+
+	return &quic.Config{
+		HandshakeIdleTimeout: 10 * time.Second,
+		MaxIdleTimeout:       idle,
+		KeepAlivePeriod:      keepAlive,
+		Allow0RTT:            early,
+	}
+}
+
+// quicALPN returns the alpn of the quic tls, quic requires one
+func quicALPN(p url.Values) []string {
+	if alpn := p["alpn"]; len(alpn) > 0 {
+		return alpn
+	}
+	return []string{"h3"}
+}
+
+// NewQUIC returns a quic transport client
+func NewQUIC(addr, rawQuery string, cDialer Dialer) (*QUIC, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+		addr = net.JoinHostPort(host, "443")
+	}
+
+	p, _ := url.ParseQuery(rawQuery)
+
+	keepAlive, err := parseKeepAlive(p, defaultKeepAlive)
+	if err != nil {
+		return nil, errors.New("proxy-quic: " + err.Error())
+	}
+
+	s := &QUIC{
+		Forwarder:  NewForwarder(addr, cDialer),
+		quicConfig: newQUICConfig(p.Get("0rtt") == "true", keepAlive),
+		early:      p.Get("0rtt") == "true",
+	}
+
+	if err := setQUICMTU(s.quicConfig, p, 0); err != nil {
+		return nil, errors.New("proxy-quic: " + err.Error())
+	}
+
+	s.tlsConfig = &tls.Config{
+		ServerName:         host,
+		NextProtos:         quicALPN(p),
+		InsecureSkipVerify: p.Get("skipverify") == "true",
+		ClientSessionCache: tls.NewLRUClientSessionCache(16),
+	}
+
+	if v := p.Get("serverName"); v != "" {
+		s.tlsConfig.ServerName = v
+	}
+
+	if ca := p.Get("ca"); ca != "" {
+		if s.tlsConfig.RootCAs, err = loadCertPool(ca); err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// NewQUICServer returns a quic transport server which serves the inner protocol
+func NewQUICServer(addr, rawQuery, inner string, sDialer Dialer) (*QUIC, error) {
+	if inner == "" {
+		return nil, errors.New("proxy-quic: inner protocol must be specified, e.g. quic://:443?cert=x&key=y,socks5://")
+	}
+
+	p, _ := url.ParseQuery(rawQuery)
+
+	tlsConfig, err := tlsServerConfig(p)
+	if err != nil {
+		return nil, errors.New("proxy-quic: " + err.Error())
+	}
+	tlsConfig.NextProtos = quicALPN(p)
+
+	keepAlive, err := parseKeepAlive(p, defaultKeepAlive)
+	if err != nil {
+		return nil, errors.New("proxy-quic: " + err.Error())
+	}
+
+	s := &QUIC{
+		Forwarder:  NewForwarder(addr, nil),
+		sDialer:    sDialer,
+		tlsConfig:  tlsConfig,
+		quicConfig: newQUICConfig(p.Get("0rtt") == "true", keepAlive),
+	}
+
+	if s.serve, err = innerServer(inner, sDialer); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// ListenAndServe serves the inner protocol over quic.
+func (s *QUIC) ListenAndServe() {
+	l, err := quic.ListenAddrEarly(s.addr, s.tlsConfig, s.quicConfig)
+	if err != nil {
+		logf("proxy-quic failed to listen on %s: %v", s.addr, err)
+		return
+	}
+
+	logf("proxy-quic listening UDP on %s", s.addr)
+
+	b := budgetOf(s.addr)
+	for {
+		conn, err := l.Accept(context.Background())
+		if err != nil {
+			logf("proxy-quic failed to accept: %v", err)
+			return
+		}
+
+		go s.serveConn(conn, b)
+	}
+}
+
+// serveConn serves the streams of a quic connection
+func (s *QUIC) serveConn(conn *quic.Conn, b *budget) {
+	logf("proxy-quic connection from %s", conn.RemoteAddr())
+
+	for {
+		st, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			logf("proxy-quic connection from %s closed: %v", conn.RemoteAddr(), err)
+			return
+		}
+
+		c := &quicConn{Stream: st, conn: conn}
+		if !b.acquireConn() {
+			logf("proxy-quic %s rejected, too many connections on %s", conn.RemoteAddr(), s.addr)
+			c.Close()
+			continue
+		}
+
+		go func() {
+			defer b.releaseConn()
+			s.serve(b.limit(c))
+		}()
+	}
+}
+
+// getConn returns the quic connection to the server, reconnects if closed
+func (s *QUIC) getConn() (*quic.Conn, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn != nil {
+		select {
+		case <-s.conn.Context().Done():
+			s.conn = nil
+		default:
+			return s.conn, nil
+		}
+	}
+
+	pc, writeTo, err := s.cDialer.DialUDP("udp", s.addr)
+	if err != nil {
+		logf("dialudp to %s error: %s", s.addr, err)
+		return nil, err
+	}
+
+	var conn *quic.Conn
+	if s.early {
+		conn, err = quic.DialEarly(context.Background(), pc, writeTo, s.tlsConfig, s.quicConfig)
+	} else {
+		conn, err = quic.Dial(context.Background(), pc, writeTo, s.tlsConfig, s.quicConfig)
+	}
+
+	if err != nil {
+		pc.Close()
+		logf("proxy-quic handshake with %s error: %s", s.addr, err)
+		return nil, err
+	}
+
+	// the packet conn is not owned by quic-go
+	go func() {
+		<-conn.Context().Done()
+		pc.Close()
+	}()
+
+	s.conn = conn
+	return conn, nil
+}
+
+// Dial opens a stream to the quic server, addr is decided by the next forwarder and ignored.
+func (s *QUIC) Dial(network, addr string) (net.Conn, error) {
+	// retry once with a new connection, the old one may be timed out
+	for i := 0; ; i++ {
+		conn, err := s.getConn()
+		if err != nil {
+			return nil, err
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		st, err := conn.OpenStreamSync(ctx)
+		cancel()
+
+		if err == nil {
+			return &quicConn{Stream: st, conn: conn}, nil
+		}
+
+		logf("proxy-quic open stream to %s error: %s", s.addr, err)
+		conn.CloseWithError(0, "")
+		if i > 0 {
+			return nil, err
+		}
+	}
+}
+
+// DialUDP connects to the given address via the proxy.
+func (s *QUIC) DialUDP(network, addr string) (net.PacketConn, net.Addr, error) {
+	return nil, nil, newError(ErrUDPNotSupported, "proxy-quic: udp not supported")
+}
+
+// quicConn is a quic stream
+type quicConn struct {
+	*quic.Stream
+	conn *quic.Conn
+}
+
+// Close closes both directions of the stream
+func (c *quicConn) Close() error {
+	c.Stream.CancelRead(0)
+	return c.Stream.Close()
+}
+
+func (c *quicConn) LocalAddr() net.Addr  { return c.conn.LocalAddr() }
+func (c *quicConn) RemoteAddr() net.Addr { return c.conn.RemoteAddr() }
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// udpMsg is a udp packet or a fragment of it, relayed over quic by hysteria2 and tuic
+type udpMsg struct {
+	sid       uint32 // session id of hysteria2, association id of tuic
+	pktID     uint16
+	fragID    uint8
+	fragCount uint8
+	addr      string
+	data      []byte
+}
+
+// udpFrags reassembles the fragments of the latest packet, the older ones are dropped.
+type udpFrags struct {
+	pktID uint16
+	frags [][]byte
+	count int
+	size  int
+	addr  string // address in the first fragment, tuic omits it in the others
+}
+
+func (f *udpFrags) add(m udpMsg) (udpMsg, bool) {
+	if m.fragCount == 1 {
+		return m, true
+	}
+
+	if m.pktID != f.pktID || len(f.frags) != int(m.fragCount) {
+		f.pktID, f.frags, f.count, f.size = m.pktID, make([][]byte, m.fragCount), 0, 0
+	}
+
+	if f.frags[m.fragID] == nil {
+		f.frags[m.fragID] = m.data
+		f.count++
+		f.size += len(m.data)
+		if m.fragID == 0 {
+			f.addr = m.addr
+		}
+	}
+
+	if f.count < len(f.frags) {
+		return m, false
+	}
+
+	data := make([]byte, 0, f.size)
+	for _, frag := range f.frags {
+		data = append(data, frag...)
+	}
+	f.frags = nil
+
+	m.fragID, m.fragCount, m.addr, m.data = 0, 1, f.addr, data
+	return m, true
+}
+
+var errUDPSessionClosed = errors.New("use of closed network connection")
+
+var errUDPSessionTimeout = &udpTimeoutError{}
+
+type udpTimeoutError struct{}
+
+func (e *udpTimeoutError) Error() string   { return "i/o timeout" }
+func (e *udpTimeoutError) Timeout() bool   { return true }
+func (e *udpTimeoutError) Temporary() bool { return true }
+
+// udpSession is the receiving side of a udp session over quic, the packets are delivered
+// by the receive loop of the connection.
+type udpSession struct {
+	in        chan udpMsg
+	frags     udpFrags // guarded by mu
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	mu sync.Mutex
+	rd time.Time
+}
+
+func newUDPSession() *udpSession {
+	return &udpSession{in: make(chan udpMsg, 64), closed: make(chan struct{})}
+}
+
+// deliver queues the packet when all the fragments are received
+func (s *udpSession) deliver(m udpMsg) {
+	s.mu.Lock()
+	m, ok := s.frags.add(m)
+	s.mu.Unlock()
+
+	if ok {
+		select {
+		case s.in <- m:
+		default: // drop when the reader is slow, as udp
+		}
+	}
+}
+
+// ReadFrom reads a packet, addr is the sender in the message
+func (s *udpSession) ReadFrom(b []byte) (int, net.Addr, error) {
+	s.mu.Lock()
+	rd := s.rd
+	s.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if !rd.IsZero() {
+		d := time.Until(rd)
+		if d <= 0 {
+			return 0, nil, errUDPSessionTimeout
+		}
+		t := time.NewTimer(d)
+		defer t.Stop()
+		timeout = t.C
+	}
+
+	select {
+	case m := <-s.in:
+		raddr, err := net.ResolveUDPAddr("udp", m.addr)
+		return copy(b, m.data), raddr, err
+	case <-s.closed:
+		return 0, nil, errUDPSessionClosed
+	case <-timeout:
+		return 0, nil, errUDPSessionTimeout
+	}
+}
+
+func (s *udpSession) isClosed() bool {
+	select {
+	case <-s.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// close closes the session once, then runs cleanup in a new goroutine,
+// as the receive loop may hold the lock of the connection when closing all the sessions.
+func (s *udpSession) close(cleanup func()) {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		go cleanup()
+	})
+}
+
+func (s *udpSession) SetDeadline(t time.Time) error {
+	return s.SetReadDeadline(t)
+}
+
+func (s *udpSession) SetReadDeadline(t time.Time) error {
+	s.mu.Lock()
+	s.rd = t
+	s.mu.Unlock()
+	return nil
+}
+
+// SetWriteDeadline does nothing, the datagrams are sent without blocking
+func (s *udpSession) SetWriteDeadline(t time.Time) error { return nil }
@@ -35,7 +35,7 @@ func NewRedirProxy(addr string, sDialer Dialer) (*RedirProxy, error) {
 
 // ListenAndServe .
 func (s *RedirProxy) ListenAndServe() {
-	l, err := net.Listen("tcp", s.addr)
+	l, err := listen("tcp", s.addr)
 	if err != nil {
 		logf("proxy-redir failed to listen on %s: %v", s.addr, err)
 		return
@@ -43,36 +43,61 @@ func (s *RedirProxy) ListenAndServe() {
 
 	logf("proxy-redir listening TCP on %s", s.addr)
 
+	b := budgetOf(s.addr)
 	for {
 		c, err := l.Accept()
 		if err != nil {
+			if isClosed(err) {
+				return
+			}
 			logf("proxy-redir failed to accept: %v", err)
 			continue
 		}
 
+		if !b.acquireConn() {
+			logf("proxy-redir %s rejected, too many connections on %s", c.RemoteAddr(), s.addr)
+			c.Close()
+			continue
+		}
+
 		go func() {
+			defer b.releaseConn()
 			defer c.Close()
 
 			if c, ok := c.(*net.TCPConn); ok {
 				c.SetKeepAlive(true)
 			}
 
-			tgt, err := getOrigDst(c, false)
+			// the connections redirected by ip6tables have an ipv6 local address
+			ipv6 := false
+			if la, ok := c.LocalAddr().(*net.TCPAddr); ok {
+				ipv6 = la.IP.To4() == nil
+			}
+
+			tgt, err := getOrigDst(c, ipv6)
 			if err != nil {
 				logf("proxy-redir failed to get target address: %v", err)
 				return
 			}
 
-			rc, err := s.sDialer.Dial("tcp", tgt.String())
+			// connected to the listener directly, not redirected, it would connect to itself
+			if tgt.String() == c.LocalAddr().String() {
+				logf("proxy-redir %s connected to %s directly, not redirected", c.RemoteAddr(), tgt)
+				return
+			}
+
+			rc, err := dialFrom(s.sDialer, "tcp", tgt.String(), "", srcIP(c.RemoteAddr()))
 			if err != nil {
 				logf("proxy-redir failed to connect to target: %v", err)
+				addResult(resultOfDial(err))
 				return
 			}
 			defer rc.Close()
 
 			logf("proxy-redir %s <-> %s", c.RemoteAddr(), tgt)
 
-			_, _, err = relay(c, rc)
+			// limit the bandwidth after getting the original destination, which needs the *net.TCPConn
+			err = relayStats(b.limit(c), rc, tgt.String())
 			if err != nil {
 				if err, ok := err.(net.Error); ok && err.Timeout() {
 					return // ignore i/o timeout
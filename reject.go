@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// reject proxy, rejects all requests
+type reject struct{}
+
+// Reject proxy
+var Reject = &reject{}
+
+var errReject = newError(ErrRejected, "rejected by rule")
+
+func (d *reject) Addr() string { return "REJECT" }
+
+func (d *reject) Dial(network, addr string) (net.Conn, error) {
+	logf("proxy-reject %s %s blocked", network, addr)
+	return nil, errReject
+}
+
+// DialUDP rejects the udp request
+func (d *reject) DialUDP(network, addr string) (net.PacketConn, net.Addr, error) {
+	logf("proxy-reject %s %s blocked", network, addr)
+	return nil, nil, errReject
+}
+
+func (d *reject) NextDialer(dstAddr string) Dialer { return d }
+
+// noQUICDialer rejects udp requests to port 443(QUIC/HTTP3),
+// so browsers will fall back to tcp.
+type noQUICDialer struct {
+	Dialer
+}
+
+// DialUDP rejects the udp request to port 443
+func (d *noQUICDialer) DialUDP(network, addr string) (net.PacketConn, net.Addr, error) {
+	return d.DialUDPFrom(network, addr, nil)
+}
+
+// DialUDPFrom rejects the udp request to port 443, for the client src
+func (d *noQUICDialer) DialUDPFrom(network, addr string, src net.IP) (net.PacketConn, net.Addr, error) {
+	if _, port, err := net.SplitHostPort(addr); err == nil && port == "443" {
+		logf("proxy-reject quic %s %s blocked", network, addr)
+		return nil, nil, errReject
+	}
+
+	return dialUDPFrom(d.Dialer, network, addr, src)
+}
+
+// NextDialer returns the dialer of the wrapped dialer, so rule routing is unchanged.
+func (d *noQUICDialer) NextDialer(dstAddr string) Dialer { return d.Dialer.NextDialer(dstAddr) }
+
+// DialVia dials with the via chain via the wrapped dialer
+func (d *noQUICDialer) DialVia(network, addr, via string) (net.Conn, error) {
+	return dialVia(d.Dialer, network, addr, via)
+}
+
+// DialFrom dials with the via chain for the client src via the wrapped dialer
+func (d *noQUICDialer) DialFrom(network, addr, via string, src net.IP) (net.Conn, error) {
+	return dialFrom(d.Dialer, network, addr, via, src)
+}
+
+// staticDialer rejects all requests of a rule with a static http response, which is
+// sent by the http listener instead of "502 ERROR", e.g. a redirect or a block page.
+type staticDialer struct {
+	rule     string
+	location string // redirect url
+	page     []byte // block page
+}
+
+// newStaticDialer returns the static response dialer of the rule,
+// the redirect url or the block page may have the placeholders {host} and {rule}.
+func newStaticDialer(r *RuleConf) (*staticDialer, error) {
+	d := &staticDialer{rule: r.name, location: r.Redirect}
+	if r.BlockPage != "" {
+		page, err := ioutil.ReadFile(r.BlockPage)
+		if err != nil {
+			return nil, err
+		}
+		d.page = page
+	}
+	return d, nil
+}
+
+func (d *staticDialer) Addr() string {
+	if d.location != "" {
+		return "REDIRECT"
+	}
+	return "BLOCKPAGE"
+}
+
+func (d *staticDialer) Dial(network, addr string) (net.Conn, error) {
+	logf("proxy-static %s %s blocked", network, addr)
+	return nil, wrapError(ErrRejected, "rejected by rule", &staticResponse{d, addr})
+}
+
+// DialUDP rejects the udp request, there's no response for it
+func (d *staticDialer) DialUDP(network, addr string) (net.PacketConn, net.Addr, error) {
+	logf("proxy-static %s %s blocked", network, addr)
+	return nil, nil, errReject
+}
+
+func (d *staticDialer) NextDialer(dstAddr string) Dialer { return d }
+
+// staticResponse is the error of the static dialer, with the response for the destination
+type staticResponse struct {
+	d    *staticDialer
+	addr string
+}
+
+func (r *staticResponse) Error() string {
+	return "static response " + strconv.Itoa(r.code()) + " by rule " + r.d.rule
+}
+
+func (r *staticResponse) code() int {
+	if r.d.location != "" {
+		return 302
+	}
+	return 403
+}
+
+// write writes the response to w, proto is the protocol of the request, e.g. "HTTP/1.1"
+func (r *staticResponse) write(w io.Writer, proto string) {
+	host := r.addr
+	if h, _, err := net.SplitHostPort(r.addr); err == nil {
+		host = h
+	}
+
+	var page string
+	var buf bytes.Buffer
+	if r.d.location != "" {
+		location := strings.NewReplacer("{host}", url.QueryEscape(host), "{rule}", url.QueryEscape(r.d.rule)).Replace(r.d.location)
+		fmt.Fprintf(&buf, "%s 302 Found\r\nLocation: %s\r\n", proto, location)
+	} else {
+		page = strings.NewReplacer("{host}", html.EscapeString(host), "{rule}", html.EscapeString(r.d.rule)).Replace(string(r.d.page))
+		fmt.Fprintf(&buf, "%s 403 Forbidden\r\nContent-Type: text/html; charset=utf-8\r\n", proto)
+	}
+	fmt.Fprintf(&buf, "Content-Length: %d\r\nCache-Control: no-store\r\nConnection: close\r\nProxy-Connection: close\r\n\r\n", len(page))
+	buf.WriteString(page)
+
+	w.Write(buf.Bytes())
+}
+
+// staticResponseOf returns the static response of a dial error if any
+func staticResponseOf(err error) (*staticResponse, bool) {
+	var resp *staticResponse
+	return resp, errors.As(err, &resp)
+}
+
+// validateStatic checks the static response options of a rule
+func validateStatic(redirect, blockPage string) error {
+	if redirect != "" && blockPage != "" {
+		return errors.New("redirect and blockpage can not be used together")
+	}
+
+	if redirect != "" {
+		u, err := url.Parse(redirect)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.New("invalid redirect url '" + redirect + "'")
+		}
+	}
+
+	if blockPage != "" {
+		if _, err := os.Stat(blockPage); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"syscall"
+)
+
+// results of the tcp connections of the listeners, logged when the relays end and counted
+// by /stats/results, so the spikes of an error class can be alerted on.
+const (
+	resultOK             = "ok"
+	resultAuthFail       = "auth-fail"   // the client failed the authentication of the listener, or glider failed at the forwarder
+	resultRuleReject     = "rule-reject" // rejected by a rule, the bittorrent policy or the loop detection
+	resultUpstreamReject = "upstream-reject"
+	resultUnreachable    = "unreachable" // the forwarder works but the destination is unreachable via it
+	resultDialTimeout    = "dial-timeout"
+	resultDialError      = "dial-error"
+	resultUpstreamReset  = "upstream-reset"
+	resultClientReset    = "client-reset"
+	resultRelayError     = "relay-error"
+)
+
+// resultCounts are the counters of the results, the keys are fixed so they are updated without locks
+var resultCounts = map[string]*int64{}
+
+func init() {
+	for _, r := range []string{resultOK, resultAuthFail, resultRuleReject, resultUpstreamReject, resultUnreachable,
+		resultDialTimeout, resultDialError, resultUpstreamReset, resultClientReset, resultRelayError} {
+		resultCounts[r] = new(int64)
+	}
+
+	apiMux.HandleFunc("/stats/results", handleResults)
+}
+
+// addResult counts a connection with result r
+func addResult(r string) {
+	atomic.AddInt64(resultCounts[r], 1)
+}
+
+// resultOfDial returns the result of a connection failed to dial with err
+func resultOfDial(err error) string {
+	if _, ok := staticResponseOf(err); ok || errors.Is(err, errReject) || errors.Is(err, errBitTorrent) || errors.Is(err, errLoop) {
+		return resultRuleReject
+	}
+
+	switch ErrorKind(err) {
+	case ErrAuth:
+		return resultAuthFail
+	case ErrRejected:
+		return resultUpstreamReject
+	case ErrUnreachable:
+		return resultUnreachable
+	}
+
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return resultDialTimeout
+	}
+	return resultDialError
+}
+
+// resultOfRelay returns the result of a connection relayed between the client c and the upstream
+// with err. The timeouts are the wake-ups at the end of the relays, not errors.
+func resultOfRelay(c net.Conn, err error) string {
+	if err == nil || errors.Is(err, io.EOF) {
+		return resultOK
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return resultOK
+	}
+
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) {
+		// the errors of the sockets have their remote addresses
+		var oe *net.OpError
+		if errors.As(err, &oe) && oe.Addr != nil && c.RemoteAddr() != nil && oe.Addr.String() == c.RemoteAddr().String() {
+			return resultClientReset
+		}
+		return resultUpstreamReset
+	}
+	return resultRelayError
+}
+
+// handleResults serves the connection counts by result: /stats/results
+func handleResults(w http.ResponseWriter, r *http.Request) {
+	counts := make(map[string]int64, len(resultCounts))
+	for k, v := range resultCounts {
+		counts[k] = atomic.LoadInt64(v)
+	}
+	writeJSON(w, counts)
+}
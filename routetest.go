@@ -0,0 +1,183 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// maxTestDialTimeout is the max timeout(seconds) of the test dials
+const maxTestDialTimeout = 30
+
+// routeDialer is the rule dialer of the listeners, for testing the routes on the api
+var routeDialer *RuleDialer
+
+func init() {
+	apiMux.HandleFunc("/test/resolve", apiLocal(handleTestResolve))
+	apiMux.HandleFunc("/test/dial", apiLocal(handleTestDial))
+}
+
+// routeResult is the route of a destination, and the result of the test dial if any
+type routeResult struct {
+	Addr      string   `json:"addr"`
+	Rule      string   `json:"rule"`            // rule name, "global" if no rule matches
+	Match     string   `json:"match,omitempty"` // how the rule matches, e.g. "domain=example.com"
+	Forwarder string   `json:"forwarder"`       // the forwarder picked now, e.g. by rr
+	Chain     []string `json:"chain"`           // hops from the first to the forwarder
+
+	Dial *dialResult `json:"dial,omitempty"`
+}
+
+type dialResult struct {
+	OK       bool   `json:"ok"`
+	Error    string `json:"error,omitempty"`
+	Kind     string `json:"kind,omitempty"` // error kind, e.g. "destination unreachable"
+	Result   string `json:"result"`         // ok or the result code of the failure, see results.go
+	Duration int64  `json:"duration"`       // milliseconds
+	Local    string `json:"local,omitempty"`
+	Remote   string `json:"remote,omitempty"`
+}
+
+// resolveRoute returns the route of addr, d is the forwarder chain picked
+func resolveRoute(addr string) (*routeResult, Dialer) {
+	t, by := routeDialer.match(addr)
+	d := pickForwarder(t.dialer, addr)
+
+	r := &routeResult{Addr: addr, Rule: t.name, Match: by, Forwarder: d.Addr()}
+
+	// the hops of a chain are linked by NextDialer, the direct dialer ends the chain
+	for hop, i := d, 0; i < 16; i++ {
+		r.Chain = append([]string{hop.Addr()}, r.Chain...)
+		next := hop.NextDialer(addr)
+		if next == hop {
+			break
+		}
+		hop = next
+	}
+
+	return r, d
+}
+
+// pickForwarder returns the forwarder chain d picks for addr now, d is a strategy dialer
+// or a forwarder chain, maybe wrapped by the accounting, bittorrent or quic blocking dialers.
+func pickForwarder(d Dialer, addr string) Dialer {
+	for {
+		switch v := d.(type) {
+		case *acctDialer:
+			d = v.Dialer
+		case *btDialer:
+			d = v.Dialer
+		case *noQUICDialer:
+			d = v.Dialer
+		case *abDialer:
+			d = v.Dialer
+		case *rrDialer, *haDialer, *lhaDialer, *hashDialer, *schedDialer:
+			return d.NextDialer(addr)
+		default:
+			return d
+		}
+	}
+}
+
+// routeAddr returns the addr parameter of the request, writes the error if invalid
+func routeAddr(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if routeDialer == nil {
+		http.Error(w, "rule dialer not ready", http.StatusServiceUnavailable)
+		return "", false
+	}
+
+	addr := r.URL.Query().Get("addr")
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		http.Error(w, "invalid addr '"+addr+"', format: HOST:PORT", http.StatusBadRequest)
+		return "", false
+	}
+
+	return addr, true
+}
+
+// handleTestResolve serves the rule and the forwarder of a destination: /test/resolve?addr=example.com:443
+func handleTestResolve(w http.ResponseWriter, r *http.Request) {
+	addr, ok := routeAddr(w, r)
+	if !ok {
+		return
+	}
+
+	route, _ := resolveRoute(addr)
+	writeJSON(w, route)
+}
+
+// handleTestDial dials a destination(tcp) via the forwarder it's routed to, and reports the timing:
+// /test/dial?addr=example.com:443&timeout=10, only from loopback unless -apiremote.
+func handleTestDial(w http.ResponseWriter, r *http.Request) {
+	addr, ok := routeAddr(w, r)
+	if !ok {
+		return
+	}
+
+	timeout := 10 * time.Second
+	if v := r.URL.Query().Get("timeout"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > maxTestDialTimeout {
+			http.Error(w, "invalid timeout '"+v+"', 1-"+strconv.Itoa(maxTestDialTimeout)+" seconds", http.StatusBadRequest)
+			return
+		}
+		timeout = time.Duration(n) * time.Second
+	}
+
+	route, d := resolveRoute(addr)
+	route.Dial = testDial(d, addr, timeout)
+
+	logf("api: test dial %s via %s: %t, %dms", addr, route.Forwarder, route.Dial.OK, route.Dial.Duration)
+	writeJSON(w, route)
+}
+
+// testDial dials addr with d, the dialers have no timeout, so a late connection is closed when done.
+func testDial(d Dialer, addr string, timeout time.Duration) *dialResult {
+	type dialed struct {
+		c   net.Conn
+		err error
+	}
+
+	ch := make(chan dialed, 1)
+	start := time.Now()
+	go func() {
+		c, err := d.Dial("tcp", addr)
+		ch <- dialed{c, err}
+	}()
+
+	res := &dialResult{}
+	select {
+	case r := <-ch:
+		res.Duration = time.Since(start).Nanoseconds() / int64(time.Millisecond)
+		if r.err != nil {
+			res.Error = r.err.Error()
+			if kind := ErrorKind(r.err); kind != nil {
+				res.Kind = kind.Error()
+			}
+			res.Result = resultOfDial(r.err)
+			return res
+		}
+
+		res.OK, res.Result = true, resultOK
+		if a := r.c.LocalAddr(); a != nil {
+			res.Local = a.String()
+		}
+		if a := r.c.RemoteAddr(); a != nil {
+			res.Remote = a.String()
+		}
+		r.c.Close()
+
+	case <-time.After(timeout):
+		res.Duration = int64(timeout / time.Millisecond)
+		res.Error = "timeout after " + timeout.String()
+		res.Result = resultDialTimeout
+		go func() {
+			if r := <-ch; r.c != nil {
+				r.c.Close()
+			}
+		}()
+	}
+
+	return res
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"log"
 	"net"
 	"strings"
@@ -10,76 +11,156 @@ import (
 // RuleDialer struct
 type RuleDialer struct {
 	gDialer Dialer
+	global  *ruleTarget
 
 	domainMap sync.Map
+	tldMap    sync.Map // top level domains, matches all the names under them
 	ipMap     sync.Map
 	cidrMap   sync.Map
+
+	geoLists []*geoList
+
+	rewrites map[string]string // domain -> HOST[:PORT] to connect instead
+}
+
+// ruleTarget is the dialer of the destinations matched by a rule
+type ruleTarget struct {
+	name   string // rule name, "global" for the global forwarders
+	dialer Dialer
 }
 
 // NewRuleDialer returns a new rule dialer
 func NewRuleDialer(rules []*RuleConf, gDialer Dialer) *RuleDialer {
-	rd := &RuleDialer{gDialer: gDialer}
+	rd := &RuleDialer{gDialer: newAcctDialer(gDialer, "global"), rewrites: make(map[string]string)}
+	rd.global = &ruleTarget{name: "global", dialer: rd.gDialer}
 
 	for _, r := range rules {
-		var fwdrs []Dialer
-		for _, chain := range r.Forward {
-			var fwdr Dialer
-			var err error
-			for _, url := range strings.Split(chain, ",") {
-				fwdr, err = DialerFromURL(url, fwdr)
-				if err != nil {
-					log.Fatal(err)
-				}
+		var sDialer Dialer
+
+		// the destinations are blocked with a static response, the forwarders are never used,
+		// so they are not built and checked
+		if r.Redirect != "" || r.BlockPage != "" {
+			static, err := newStaticDialer(r)
+			if err != nil {
+				log.Fatal(r.name + ": " + err.Error())
 			}
-			fwdrs = append(fwdrs, fwdr)
+			sDialer = static
+		} else {
+			sDialer = ruleForwarders(r)
 		}
-
-		sDialer := NewStrategyDialer(r.Strategy, fwdrs, r.CheckWebSite, r.CheckDuration)
+		sDialer = newAcctDialer(sDialer, r.name)
+		t := &ruleTarget{name: r.name, dialer: sDialer}
 
 		for _, domain := range r.Domain {
-			rd.domainMap.Store(strings.ToLower(domain), sDialer)
+			rd.domainMap.Store(strings.ToLower(domain), t)
+		}
+
+		// the rewritten domains are matched by the rule too
+		rewrites, err := parseRewrites(r.Rewrite)
+		if err != nil {
+			log.Fatal(r.name + ": " + err.Error())
+		}
+		for domain, to := range rewrites {
+			rd.rewrites[domain] = to
+			rd.domainMap.Store(domain, t)
+		}
+
+		for _, tld := range r.TLD {
+			rd.tldMap.Store(strings.ToLower(strings.Trim(tld, ".")), t)
 		}
 
 		for _, ip := range r.IP {
-			rd.ipMap.Store(ip, sDialer)
+			if pip := net.ParseIP(ip); pip != nil {
+				ip = normalizeIP(pip).String()
+			}
+			rd.ipMap.Store(ip, t)
 		}
 
 		for _, s := range r.CIDR {
 			if _, cidr, err := net.ParseCIDR(s); err == nil {
-				rd.cidrMap.Store(cidr, sDialer)
+				rd.cidrMap.Store(cidr, t)
 			}
 		}
 
+		if len(r.GeoIPURL) > 0 || len(r.GeoSiteURL) > 0 {
+			l := newGeoList(r, t)
+			rd.geoLists = append(rd.geoLists, l)
+		}
+
+	}
+
+	// start the updates after geoLists is built, they read it while loading
+	for _, l := range rd.geoLists {
+		go l.run(rd, l.interval)
 	}
 
 	return rd
 }
 
+// ruleForwarders returns the strategy dialer of the forwarders of the rule r
+func ruleForwarders(r *RuleConf) Dialer {
+	dDialer := NewDirect(r.DSCP, r.Mark, conf.Interface, conf.SourceIP)
+
+	forward, err := expandGroups(r.Forward)
+	if err != nil {
+		log.Fatal(r.name + ": " + err.Error())
+	}
+
+	fwdrs, err := chainDialers(forward, dDialer)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, fwdr := range fwdrs {
+		go checkExitIP(fwdr)
+	}
+
+	if len(fwdrs) == 0 {
+		fwdrs = append(fwdrs, dDialer)
+	}
+
+	sDialer := NewStrategyDialer(fwdrs, &r.StrategyConfig)
+	if r.BlockQUIC {
+		sDialer = &noQUICDialer{sDialer}
+	}
+	return newBTDialer(sDialer, r.BitTorrent, dDialer)
+}
+
 // Addr returns RuleDialer's address, always be "RULES"
 func (rd *RuleDialer) Addr() string { return "RULE DIALER, DEFAULT: " + rd.gDialer.Addr() }
 
 // NextDialer return next dialer according to rule
 func (rd *RuleDialer) NextDialer(dstAddr string) Dialer {
+	t, _ := rd.match(dstAddr)
+	return t.dialer
+}
+
+// match returns the target of the rule matching dstAddr and how it's matched, e.g. "cidr=10.0.0.0/8",
+// the global target and "" if no rule matches.
+func (rd *RuleDialer) match(dstAddr string) (*ruleTarget, string) {
 	host, _, err := net.SplitHostPort(dstAddr)
 	if err != nil {
 		// TODO: check here
 		// logf("proxy-rule SplitHostPort ERROR: %s", err)
-		return rd.gDialer
+		return rd.global, ""
 	}
 
 	// find ip
 	if ip := net.ParseIP(host); ip != nil {
+		ip = normalizeIP(ip)
+		host = ip.String()
+
 		// check ip
-		if dialer, ok := rd.ipMap.Load(ip.String()); ok {
-			return dialer.(Dialer)
+		if t, ok := rd.ipMap.Load(ip.String()); ok {
+			return t.(*ruleTarget), "ip=" + host
 		}
 
-		var ret Dialer
+		var ret *ruleTarget
+		var by string
 		// check cidr
 		rd.cidrMap.Range(func(key, value interface{}) bool {
 			cidr := key.(*net.IPNet)
 			if cidr.Contains(ip) {
-				ret = value.(Dialer)
+				ret, by = value.(*ruleTarget), "cidr="+cidr.String()
 				return false
 			}
 
@@ -87,7 +168,14 @@ func (rd *RuleDialer) NextDialer(dstAddr string) Dialer {
 		})
 
 		if ret != nil {
-			return ret
+			return ret, by
+		}
+
+		// check geoip
+		for _, l := range rd.geoLists {
+			if l.matchIP(ip) {
+				return l.target, "geoip=" + l.name
+			}
 		}
 
 	}
@@ -98,26 +186,132 @@ func (rd *RuleDialer) NextDialer(dstAddr string) Dialer {
 		domain := strings.Join(domainParts[i:length], ".")
 
 		// find in domainMap
-		if dialer, ok := rd.domainMap.Load(domain); ok {
-			return dialer.(Dialer)
+		if t, ok := rd.domainMap.Load(domain); ok {
+			return t.(*ruleTarget), "domain=" + domain
+		}
+	}
+
+	// find in tldMap
+	tld := strings.ToLower(domainParts[length-1])
+	if t, ok := rd.tldMap.Load(tld); ok {
+		return t.(*ruleTarget), "tld=" + tld
+	}
+
+	// check geosite
+	for _, l := range rd.geoLists {
+		if l.matchDomain(host) {
+			return l.target, "geosite=" + l.name
 		}
 	}
 
-	return rd.gDialer
+	return rd.global, ""
 }
 
 // Dial dials to targer addr and return a conn
 func (rd *RuleDialer) Dial(network, addr string) (net.Conn, error) {
-	return rd.NextDialer(addr).Dial(network, addr)
+	return rd.NextDialer(addr).Dial(network, rd.rewrite(addr))
+}
+
+// DialVia dials to target addr with the via chain
+func (rd *RuleDialer) DialVia(network, addr, via string) (net.Conn, error) {
+	return dialVia(rd.NextDialer(addr), network, rd.rewrite(addr), via)
+}
+
+// DialFrom dials to target addr with the via chain for the client src
+func (rd *RuleDialer) DialFrom(network, addr, via string, src net.IP) (net.Conn, error) {
+	return dialFrom(rd.NextDialer(addr), network, rd.rewrite(addr), via, src)
 }
 
 // DialUDP connects to the given address via the proxy
 func (rd *RuleDialer) DialUDP(network, addr string) (pc net.PacketConn, writeTo net.Addr, err error) {
-	return rd.NextDialer(addr).DialUDP(network, addr)
+	return rd.NextDialer(addr).DialUDP(network, rd.rewrite(addr))
+}
+
+// DialUDPFrom connects to the given address via the proxy for the client src
+func (rd *RuleDialer) DialUDPFrom(network, addr string, src net.IP) (net.PacketConn, net.Addr, error) {
+	return dialUDPFrom(rd.NextDialer(addr), network, rd.rewrite(addr), src)
+}
+
+// rewrite returns the address to connect for dstAddr by the rewrite rules, dstAddr if none matches.
+// A rewrite matches the domain and all its subdomains, the longest one wins, the port of dstAddr
+// is kept if the rewrite has none. The client hello of tls is not changed, as it's covered by
+// the handshake, so the server still sees the original SNI, see rewriteHost for the http requests.
+func (rd *RuleDialer) rewrite(dstAddr string) string {
+	to, domain := rd.matchRewrite(dstAddr)
+	if domain == "" {
+		return dstAddr
+	}
+
+	logf("rule rewrite %s to %s, based on rule: rewrite=%s", dstAddr, to, domain)
+	return to
+}
+
+// matchRewrite returns the address to connect for dstAddr and the domain of the matched rewrite
+func (rd *RuleDialer) matchRewrite(dstAddr string) (string, string) {
+	if len(rd.rewrites) == 0 {
+		return dstAddr, ""
+	}
+
+	host, port, err := net.SplitHostPort(dstAddr)
+	if err != nil || net.ParseIP(host) != nil {
+		return dstAddr, ""
+	}
+
+	for h := strings.ToLower(strings.TrimSuffix(host, ".")); ; {
+		if to, ok := rd.rewrites[h]; ok {
+			if _, _, err := net.SplitHostPort(to); err != nil {
+				to = net.JoinHostPort(to, port)
+			}
+			return to, h
+		}
+
+		i := strings.IndexByte(h, '.')
+		if i < 0 {
+			return dstAddr, ""
+		}
+		h = h[i+1:]
+	}
+}
+
+// rewriteHost returns the Host header of a plain http request to dstAddr, rewritten to the domain
+// of the matched rewrite, e.g. to redirect a deprecated name. host is kept if the rewrite connects
+// to an ip address, as the server behind it(e.g. a cdn front for domain fronting) routes by host.
+func (rd *RuleDialer) rewriteHost(dstAddr, host string) string {
+	to, domain := rd.matchRewrite(dstAddr)
+	if domain == "" {
+		return host
+	}
+
+	h, port, _ := net.SplitHostPort(to)
+	if net.ParseIP(h) != nil {
+		return host
+	}
+
+	if port == "80" {
+		return h
+	}
+	return to
+}
+
+// parseRewrites parses the rewrite entries "DOMAIN=HOST[:PORT]" to domain -> HOST[:PORT]
+func parseRewrites(list []string) (map[string]string, error) {
+	m := make(map[string]string)
+	for _, r := range list {
+		d := strings.SplitN(r, "=", 2)
+		if len(d) != 2 || d[0] == "" || d[1] == "" || strings.Contains(d[1], "=") {
+			return nil, errors.New("invalid rewrite '" + r + "', format: DOMAIN=HOST[:PORT]")
+		}
+		m[strings.ToLower(strings.Trim(strings.TrimPrefix(d[0], "*."), "."))] = d[1]
+	}
+	return m, nil
 }
 
 // AddDomainIP used to update ipMap rules according to domainMap rule
 func (rd *RuleDialer) AddDomainIP(domain, ip string) error {
+	if pip := net.ParseIP(ip); pip != nil {
+		ip = normalizeIP(pip).String()
+	}
+
 	if ip != "" {
 		domainParts := strings.Split(domain, ".")
 		length := len(domainParts)
@@ -125,12 +319,25 @@ func (rd *RuleDialer) AddDomainIP(domain, ip string) error {
 			pDomain := strings.ToLower(strings.Join(domainParts[i:length], "."))
 
 			// find in domainMap
-			if dialer, ok := rd.domainMap.Load(pDomain); ok {
-				rd.ipMap.Store(ip, dialer)
+			if t, ok := rd.domainMap.Load(pDomain); ok {
+				rd.ipMap.Store(ip, t)
 				logf("rule add ip=%s, based on rule: domain=%s & domain/ip: %s/%s\n", ip, pDomain, domain, ip)
 			}
 		}
 
+		tld := strings.ToLower(domainParts[length-1])
+		if t, ok := rd.tldMap.Load(tld); ok {
+			rd.ipMap.Store(ip, t)
+			logf("rule add ip=%s, based on rule: tld=%s & domain/ip: %s/%s\n", ip, tld, domain, ip)
+		}
+
+		for _, l := range rd.geoLists {
+			if l.matchDomain(domain) {
+				rd.ipMap.Store(ip, l.target)
+				logf("rule add ip=%s, based on geosite list %s & domain/ip: %s/%s\n", ip, l.name, domain, ip)
+			}
+		}
+
 	}
 	return nil
 }
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// schedule actions, or the number(from 1) of the forwarder to use as the primary of ha
+const (
+	schedRR   = "rr"   // switch to round robin
+	schedHA   = "ha"   // switch to high availability
+	schedNext = "next" // switch the primary of ha to the next enabled forwarder
+)
+
+// schedEntry is an entry of the schedule: "HH:MM ACTION", in local time
+type schedEntry struct {
+	min    int // minutes of the day
+	action string
+	idx    int // index of the forwarder, -1 if the action is not a number
+}
+
+// parseSchedule parses the entries "HH:MM ACTION", e.g. "01:00 rr", "07:00 ha", "03:30 next", "12:00 2"
+func parseSchedule(schedule []string) ([]schedEntry, error) {
+	var entries []schedEntry
+	for _, s := range schedule {
+		fields := strings.Fields(s)
+		if len(fields) != 2 {
+			return nil, errors.New("schedule: invalid entry '" + s + "', format: HH:MM rr|ha|next|N")
+		}
+
+		t, err := time.Parse("15:04", fields[0])
+		if err != nil {
+			return nil, errors.New("schedule: invalid time '" + fields[0] + "', format: HH:MM")
+		}
+
+		e := schedEntry{min: t.Hour()*60 + t.Minute(), action: fields[1], idx: -1}
+		switch e.action {
+		case schedRR, schedHA, schedNext:
+		default:
+			n, err := strconv.Atoi(e.action)
+			if err != nil || n < 1 {
+				return nil, errors.New("schedule: invalid action '" + e.action + "', available: rr ha next N(the forwarder number from 1)")
+			}
+			e.idx = n - 1
+		}
+
+		entries = append(entries, e)
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].min < entries[j].min })
+	return entries, nil
+}
+
+// at returns the latest time of the entry not after now
+func (e *schedEntry) at(now time.Time) time.Time {
+	t := time.Date(now.Year(), now.Month(), now.Day(), e.min/60, e.min%60, 0, 0, now.Location())
+	if t.After(now) {
+		t = time.Date(now.Year(), now.Month(), now.Day()-1, e.min/60, e.min%60, 0, 0, now.Location())
+	}
+	return t
+}
+
+// schedDialer switches the strategy or the primary forwarder of ha at the times of the schedule,
+// e.g. for the providers throttling the long-lived sessions from one exit.
+// The established connections are kept, the learned destinations are forgotten when switched.
+type schedDialer struct {
+	*haDialer
+	ha      uint32 // 1: high availability, 0: round robin, atomic
+	entries []schedEntry
+}
+
+// newSchedDialer returns a strategy dialer switched by the schedule, s.Schedule must be valid.
+func newSchedDialer(dialers []Dialer, s *StrategyConfig) *schedDialer {
+	sd := &schedDialer{haDialer: &haDialer{rrDialer: newRRDialer(dialers, s)}}
+	sd.entries, _ = parseSchedule(s.Schedule)
+
+	if s.Strategy == schedHA {
+		sd.ha = 1
+	}
+
+	sd.restore(time.Now())
+	go sd.run()
+
+	return sd
+}
+
+func (sd *schedDialer) isHA() bool {
+	return atomic.LoadUint32(&sd.ha) == 1
+}
+
+func (sd *schedDialer) Dial(network, addr string) (net.Conn, error) {
+	return sd.DialVia(network, addr, "")
+}
+
+// DialVia dials addr with the via chain
+func (sd *schedDialer) DialVia(network, addr, via string) (net.Conn, error) {
+	if sd.isHA() {
+		return sd.haDialer.DialVia(network, addr, via)
+	}
+	return sd.rrDialer.DialVia(network, addr, via)
+}
+
+func (sd *schedDialer) DialUDP(network, addr string) (pc net.PacketConn, writeTo net.Addr, err error) {
+	if sd.isHA() {
+		return sd.haDialer.DialUDP(network, addr)
+	}
+	return sd.rrDialer.DialUDP(network, addr)
+}
+
+func (sd *schedDialer) NextDialer(dstAddr string) Dialer {
+	if sd.isHA() {
+		return sd.haDialer.NextDialer(dstAddr)
+	}
+	return sd.rrDialer.NextDialer(dstAddr)
+}
+
+// run applies the entries when their times come, checks the clock every 30 seconds,
+// so a clock jump(e.g. synced by ntp after boot on routers without rtc) is noticed.
+func (sd *schedDialer) run() {
+	last := time.Now()
+	for range time.Tick(30 * time.Second) {
+		now := time.Now()
+
+		if now.Before(last) || now.Sub(last) > 5*time.Minute {
+			logf("schedule: clock changed from %s to %s, restore the scheduled state", last.Format(time.Stamp), now.Format(time.Stamp))
+			sd.restore(now)
+		} else {
+			for i := range sd.entries {
+				if e := &sd.entries[i]; e.at(now).After(last) {
+					sd.apply(e)
+				}
+			}
+		}
+
+		last = now
+	}
+}
+
+// restore applies the latest strategy and the latest primary forwarder of the schedule before now,
+// the "next" entries are events and not restored.
+func (sd *schedDialer) restore(now time.Time) {
+	var mode, primary *schedEntry
+	for i := range sd.entries {
+		e := &sd.entries[i]
+		switch {
+		case e.action == schedNext:
+		case e.idx < 0:
+			if mode == nil || e.at(now).After(mode.at(now)) {
+				mode = e
+			}
+		default:
+			if primary == nil || e.at(now).After(primary.at(now)) {
+				primary = e
+			}
+		}
+	}
+
+	if mode != nil {
+		sd.apply(mode)
+	}
+	if primary != nil {
+		sd.apply(primary)
+	}
+}
+
+// apply applies the action of e
+func (sd *schedDialer) apply(e *schedEntry) {
+	switch e.action {
+	case schedRR:
+		atomic.StoreUint32(&sd.ha, 0)
+	case schedHA:
+		atomic.StoreUint32(&sd.ha, 1)
+	case schedNext:
+		avail := sd.avail.Load().([]int)
+		if len(avail) == 0 {
+			logf("schedule: no available forwarder to switch to")
+			return
+		}
+
+		// avail is in the order of the forwarders, find the first one after the current
+		i := sort.SearchInts(avail, sd.current()+1)
+		if i == len(avail) {
+			i = 0
+		}
+		atomic.StoreUint32(&sd.idx, uint32(avail[i]))
+		atomic.StoreUint32(&sd.pref, uint32(avail[i]))
+	default:
+		if e.idx >= len(sd.dialers) {
+			logf("schedule: forwarder %d not found, only %d forwarders", e.idx+1, len(sd.dialers))
+			return
+		}
+		atomic.StoreUint32(&sd.idx, uint32(e.idx))
+		atomic.StoreUint32(&sd.pref, uint32(e.idx))
+	}
+
+	sd.dstMap.Range(func(k, v interface{}) bool {
+		sd.dstMap.Delete(k)
+		return true
+	})
+
+	mode := schedRR
+	if sd.isHA() {
+		mode = schedHA
+	}
+	logf("schedule: %02d:%02d %s, now in %s mode, primary: %s", e.min/60, e.min%60, e.action, mode, sd.dialers[sd.current()].Addr())
+}
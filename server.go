@@ -19,12 +19,27 @@ func ServerFromURL(s string, sDialer Dialer) (Server, error) {
 		s = "mixed://" + s
 	}
 
+	// port range, e.g. socks5://:20000-20100
+	if _, _, _, _, ok := portRange(s); ok {
+		return newRangeServer(s, sDialer)
+	}
+
+	// transport listeners wrap an inner protocol, e.g. tls://:443?cert=x&key=y,socks5://
+	var inner string
+	if i := strings.IndexByte(s, ','); i > 0 {
+		s, inner = s[:i], s[i+1:]
+	}
+
 	u, err := url.Parse(s)
 	if err != nil {
 		logf("parse err: %s", err)
 		return nil, err
 	}
 
+	if inner != "" && u.Scheme != "tls" && u.Scheme != "quic" && u.Scheme != "mux" && u.Scheme != "shadowtls" {
+		return nil, errors.New("schema '" + u.Scheme + "' can not wrap an inner protocol")
+	}
+
 	addr := u.Host
 	var user, pass string
 	if u.User != nil {
@@ -36,17 +51,68 @@ func ServerFromURL(s string, sDialer Dialer) (Server, error) {
 		sDialer = Direct
 	}
 
+	// the forwarders of the listener: forward=CHAIN&strategy=rr
+	if sDialer, err = listenDialer(u.RawQuery, sDialer); err != nil {
+		return nil, err
+	}
+
+	// register the local listening address for loop detection
+	listenAddr := strings.Split(addr, "=")[0]
+	addListenAddr(listenAddr)
+
+	// per-listener resource budget: maxconns, maxudp, maxbw
+	b, err := newBudget(listenAddr, u.RawQuery)
+	if err != nil {
+		return nil, err
+	}
+	setBudget(listenAddr, b)
+
+	// publish as an onion service: onion=127.0.0.1:9051
+	authed := listenerAuthed(u.Scheme, user, u.RawQuery, inner)
+	publishOnion(listenAddr, u.RawQuery, authed)
+
+	// map the port on the router: portmap=auto, upnp or natpmp
+	startPortMap(listenAddr, u.Scheme, u.RawQuery, authed)
+
+	// advertise on the local network: mdns=NAME
+	advertiseMDNS(listenAddr, u.Scheme, u.RawQuery)
+
 	switch u.Scheme {
 	case "mixed":
 		return NewMixedProxy(addr, user, pass, u.RawQuery, sDialer)
 	case "http":
 		return NewHTTP(addr, user, pass, u.RawQuery, nil, sDialer)
 	case "socks5":
-		return NewSOCKS5(addr, user, pass, nil, sDialer)
+		return NewSOCKS5(addr, user, pass, u.RawQuery, nil, sDialer)
+	case "socks4", "socks4a":
+		return NewSOCKS4(addr, user, pass, u.RawQuery, true, nil, sDialer)
 	case "ss":
-		return NewSS(addr, user, pass, nil, sDialer)
+		if isSS2022(user) {
+			return nil, errors.New("ss 2022 methods are only supported in forwarders")
+		}
+		return NewSS(addr, user, pass, u.RawQuery, nil, sDialer)
+	case "trojan":
+		return NewTrojan(addr, user, u.RawQuery, nil, sDialer)
+	case "tls":
+		return NewTLSServer(addr, u.RawQuery, inner, sDialer)
+	case "quic":
+		return NewQUICServer(addr, u.RawQuery, inner, sDialer)
+	case "mux":
+		return NewMuxServer(addr, u.RawQuery, inner, sDialer)
+	case "shadowtls":
+		return NewShadowTLSServer(addr, user, u.RawQuery, inner, sDialer)
+	case "mtproto":
+		return NewMTProto(addr, u.RawQuery, sDialer)
+	case "dnstunnel":
+		return NewDNSTunnel(addr, u.RawQuery, nil, sDialer)
+	case "icmptunnel":
+		return NewICMPTunnel(addr, u.RawQuery, nil, sDialer)
+	case "sni":
+		return NewSNIRouter(addr, u.RawQuery, sDialer)
 	case "redir":
 		return NewRedirProxy(addr, sDialer)
+	case "tun":
+		return NewTun(addr, u.RawQuery, sDialer)
 	case "tcptun":
 		d := strings.Split(addr, "=")
 		return NewTCPTun(d[0], d[1], sDialer)
@@ -61,5 +127,5 @@ func ServerFromURL(s string, sDialer Dialer) (Server, error) {
 		return NewUoTTun(d[0], d[1], sDialer)
 	}
 
-	return nil, errors.New("unknown schema '" + u.Scheme + "'")
+	return nil, newError(ErrUnknownSchema, "unknown schema '"+u.Scheme+"'")
 }
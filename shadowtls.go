@@ -0,0 +1,614 @@
+// shadow-tls v3, a transport borrowing the tls handshake of a real server:
+// https://github.com/ihciah/shadow-tls/blob/master/docs/protocol-v3-en.md
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"io"
+	"net"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+const (
+	stlsHandshake       = 0x16
+	stlsApplicationData = 0x17
+	stlsAlert           = 0x15
+
+	stlsTagLen   = 4                    // truncated hmac-sha1 in the session id and the frames
+	stlsMaxData  = 16384                // max length of the data of a frame written
+	stlsHelloTag = 39 + 32 - stlsTagLen // offset of the tag in the session id of the client hello
+)
+
+var (
+	errSTLSAuth  = newError(ErrAuth, "proxy-shadowtls: the handshake is not authenticated, not a shadow-tls v3 server or the handshake server has no tls 1.3")
+	errSTLSFrame = newError(ErrProtocol, "proxy-shadowtls: frame not authenticated")
+)
+
+// ShadowTLS is a shadow-tls v3 transport, it wraps the inner protocol of a listener
+// or the next forwarder in a chain:
+//
+//	listen:  shadowtls://pass@:443?handshake=www.example.com:443,ss://AEAD_CHACHA20_POLY1305:pass@
+//	forward: shadowtls://pass@host:443?serverName=www.example.com,ss://AEAD_CHACHA20_POLY1305:pass@host:443
+//
+// The client does a real tls handshake with the handshake server relayed by the server,
+// the session id of the client hello and the frames of the server are signed with the password,
+// then the data follows in the application data frames with the hmac of the password.
+// The clients not authenticated are relayed to the handshake server, which must support tls 1.3.
+// The client hello is emulated with uTLS, the fingerprint is chrome by default.
+type ShadowTLS struct {
+	*Forwarder
+	password []byte
+
+	tlsConfig *tls.Config         // as client, the tls config of the handshake server
+	tlsFP     *utls.ClientHelloID // as client, the client hello fingerprint
+	alpn      []string
+
+	handshake string           // as server, the address of the handshake server
+	serve     func(c net.Conn) // as server, serves the inner protocol
+}
+
+// NewShadowTLS returns a shadow-tls transport client
+func NewShadowTLS(addr, pass, rawQuery string, cDialer Dialer) (*ShadowTLS, error) {
+	if pass == "" {
+		return nil, errors.New("proxy-shadowtls: password must be set, e.g. shadowtls://pass@host:443?serverName=www.example.com")
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+		addr = net.JoinHostPort(host, "443")
+	}
+
+	p, _ := url.ParseQuery(rawQuery)
+	if p.Get("serverName") == "" {
+		return nil, errors.New("proxy-shadowtls: serverName must be set to the name of the handshake server")
+	}
+
+	s := &ShadowTLS{Forwarder: NewForwarder(addr, cDialer), password: []byte(pass)}
+	if s.tlsConfig, err = tlsClientConfig(host, p); err != nil {
+		return nil, errors.New("proxy-shadowtls: " + err.Error())
+	}
+
+	// the conn is not used after the handshake, so the alpn of browsers is fine
+	s.alpn = p["alpn"]
+	if len(s.alpn) == 0 {
+		s.alpn = []string{"h2", "http/1.1"}
+	}
+
+	fp := p.Get("fingerprint")
+	if fp == "" {
+		fp = "chrome"
+	}
+	if s.tlsFP, err = parseFingerprint(fp); err != nil {
+		return nil, errors.New("proxy-shadowtls: " + err.Error())
+	}
+	if s.tlsFP == nil {
+		return nil, errors.New("proxy-shadowtls: fingerprint=go is not supported, the session id is set with uTLS")
+	}
+
+	return s, nil
+}
+
+// NewShadowTLSServer returns a shadow-tls transport server which serves the inner protocol
+func NewShadowTLSServer(addr, pass, rawQuery, inner string, sDialer Dialer) (*ShadowTLS, error) {
+	if inner == "" {
+		return nil, errors.New("proxy-shadowtls: inner protocol must be specified, e.g. shadowtls://pass@:443?handshake=www.example.com:443,ss://AEAD_CHACHA20_POLY1305:pass@")
+	}
+	if pass == "" {
+		return nil, errors.New("proxy-shadowtls: password must be set, e.g. shadowtls://pass@:443?handshake=www.example.com:443")
+	}
+
+	p, _ := url.ParseQuery(rawQuery)
+
+	s := &ShadowTLS{Forwarder: NewForwarder(addr, nil), password: []byte(pass), handshake: p.Get("handshake")}
+	if s.handshake == "" {
+		return nil, errors.New("proxy-shadowtls: handshake must be set to the address of a tls 1.3 server, e.g. handshake=www.example.com:443")
+	}
+	if _, _, err := net.SplitHostPort(s.handshake); err != nil {
+		s.handshake = net.JoinHostPort(s.handshake, "443")
+	}
+
+	var err error
+	if s.serve, err = innerServer(inner, sDialer); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// ListenAndServe serves the inner protocol over shadow-tls.
+func (s *ShadowTLS) ListenAndServe() {
+	l, err := listen("tcp", s.addr)
+	if err != nil {
+		logf("proxy-shadowtls failed to listen on %s: %v", s.addr, err)
+		return
+	}
+
+	logf("proxy-shadowtls listening TCP on %s, handshake server: %s", s.addr, s.handshake)
+
+	b := budgetOf(s.addr)
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if isClosed(err) {
+				return
+			}
+			logf("proxy-shadowtls failed to accept: %v", err)
+			continue
+		}
+
+		if !b.acquireConn() {
+			logf("proxy-shadowtls %s rejected, too many connections on %s", c.RemoteAddr(), s.addr)
+			c.Close()
+			continue
+		}
+
+		go func() {
+			defer b.releaseConn()
+			s.ServeTCP(b.limit(c))
+		}()
+	}
+}
+
+// ServeTCP serves a shadow-tls connection.
+func (s *ShadowTLS) ServeTCP(c net.Conn) {
+	defer c.Close()
+
+	if c, ok := c.(*net.TCPConn); ok {
+		c.SetKeepAlive(true)
+	}
+
+	c.SetDeadline(time.Now().Add(handshakeTimeout()))
+	hello, err := readTLSRecord(c)
+	if err != nil {
+		logf("proxy-shadowtls failed to read the client hello from %s: %v", c.RemoteAddr(), err)
+		return
+	}
+
+	hs, err := net.Dial("tcp", s.handshake)
+	if err != nil {
+		logf("proxy-shadowtls failed to connect to the handshake server %s: %v", s.handshake, err)
+		return
+	}
+	defer hs.Close()
+
+	if _, err := hs.Write(hello); err != nil {
+		return
+	}
+
+	// the others see the handshake server only
+	if !s.verifyHello(hello) {
+		c.SetDeadline(time.Time{})
+		logf("proxy-shadowtls %s not authenticated, relayed to %s", c.RemoteAddr(), s.handshake)
+		relay(c, hs)
+		return
+	}
+
+	random := make(chan []byte, 1)
+	done := make(chan struct{})
+	var switched int32
+
+	go func() {
+		defer close(done)
+		err := s.relayHandshake(c, hs, random)
+		if atomic.LoadInt32(&switched) == 0 {
+			if err != nil && err != io.EOF {
+				logf("proxy-shadowtls relay from the handshake server %s error: %v", s.handshake, err)
+			}
+			c.Close()
+		}
+	}()
+
+	// forward the frames of the client to the handshake server, until the first data frame
+	var rh *stlsHMAC
+	var sr, rec []byte
+	for {
+		if rec, err = readTLSRecord(c); err != nil {
+			return
+		}
+
+		if rec[0] == stlsApplicationData {
+			if rh == nil {
+				select {
+				case sr = <-random:
+				case <-done:
+					return
+				}
+
+				// not tls 1.3, the client can not be authenticated, so it's the handshake server for the client
+				if sr == nil {
+					c.SetDeadline(time.Time{})
+					if _, err := hs.Write(rec); err == nil {
+						io.Copy(hs, c)
+					}
+					return
+				}
+				rh = newSTLSHMAC(s.password, sr, []byte("C"))
+			}
+
+			if len(rec) >= 5+stlsTagLen && rh.verify(rec[5+stlsTagLen:], rec[5:5+stlsTagLen]) {
+				break
+			}
+		}
+
+		if _, err := hs.Write(rec); err != nil {
+			return
+		}
+	}
+
+	// the frames of the handshake server in flight are dropped by the client
+	atomic.StoreInt32(&switched, 1)
+	hs.Close()
+	<-done
+	c.SetDeadline(time.Time{})
+
+	s.serve(&stlsConn{Conn: c, rh: rh, wh: newSTLSHMAC(s.password, sr, []byte("S")), rbuf: rec[5+stlsTagLen:]})
+}
+
+// relayHandshake relays the frames of the handshake server to the client, the application data frames
+// after the server hello are xored and signed. The server random is sent to random,
+// nil if the handshake server does not negotiate tls 1.3.
+func (s *ShadowTLS) relayHandshake(c, hs net.Conn, random chan<- []byte) error {
+	var h *stlsHMAC
+	var key []byte
+	sent := false
+
+	for {
+		rec, err := readTLSRecord(hs)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case !sent && rec[0] == stlsHandshake:
+			sr, tls13 := parseServerHello(rec[5:])
+			if sr == nil {
+				break
+			}
+
+			sent = true
+			if !tls13 {
+				logf("proxy-shadowtls handshake server %s does not negotiate tls 1.3, relayed only", s.handshake)
+				random <- nil
+				break
+			}
+
+			h, key = newSTLSHMAC(s.password, sr), stlsKey(s.password, sr)
+			random <- sr
+
+		case h != nil && rec[0] == stlsApplicationData:
+			data := rec[5:]
+			stlsXOR(data, key)
+
+			frame := make([]byte, 5+stlsTagLen+len(data))
+			copy(frame, rec[:3])
+			binary.BigEndian.PutUint16(frame[3:], uint16(stlsTagLen+len(data)))
+			copy(frame[5:], h.tag(data))
+			copy(frame[5+stlsTagLen:], data)
+			rec = frame
+		}
+
+		if _, err := c.Write(rec); err != nil {
+			return err
+		}
+	}
+}
+
+// verifyHello verifies the tag in the session id of the client hello record
+func (s *ShadowTLS) verifyHello(rec []byte) bool {
+	msg := rec[5:]
+	if rec[0] != stlsHandshake || len(msg) < stlsHelloTag+stlsTagLen || msg[0] != 0x01 || msg[38] != 32 {
+		return false
+	}
+	return hmac.Equal(stlsHelloSign(s.password, msg), msg[stlsHelloTag:stlsHelloTag+stlsTagLen])
+}
+
+// Dial connects to the shadow-tls server, addr is decided by the next forwarder and ignored.
+func (s *ShadowTLS) Dial(network, addr string) (net.Conn, error) {
+	rc, err := s.cDialer.Dial("tcp", s.addr)
+	if err != nil {
+		logf("dial to %s error: %s", s.addr, err)
+		return nil, err
+	}
+
+	if c, ok := rc.(*net.TCPConn); ok {
+		c.SetKeepAlive(true)
+	}
+
+	c, err := s.clientHandshake(rc)
+	if err != nil {
+		rc.Close()
+		logf("proxy-shadowtls handshake with %s error: %s", s.addr, err)
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// DialUDP connects to the given address via the proxy.
+func (s *ShadowTLS) DialUDP(network, addr string) (net.PacketConn, net.Addr, error) {
+	return nil, nil, newError(ErrUDPNotSupported, "proxy-shadowtls: udp not supported")
+}
+
+// clientHandshake does the tls handshake with the handshake server via the server,
+// the conn of the tls handshake is dropped, then the data is sent in the frames of rc.
+func (s *ShadowTLS) clientHandshake(rc net.Conn) (net.Conn, error) {
+	hc := &stlsHandshakeConn{Conn: rc, password: s.password}
+	uc, err := newUConn(hc, s.tlsConfig, *s.tlsFP, s.alpn)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := uc.BuildHandshakeState(); err != nil {
+		return nil, err
+	}
+
+	// session id: 28 random bytes and the tag of the client hello, in which the tag is zero
+	hello := uc.HandshakeState.Hello
+	if len(hello.Raw) < stlsHelloTag+stlsTagLen || hello.Raw[38] != 32 {
+		return nil, errors.New("proxy-shadowtls: no 32 bytes session id in the client hello of the fingerprint")
+	}
+	rand.Read(hello.Raw[39:stlsHelloTag])
+	copy(hello.Raw[stlsHelloTag:], stlsHelloSign(s.password, hello.Raw))
+	hello.SessionId = append([]byte(nil), hello.Raw[39:stlsHelloTag+stlsTagLen]...)
+
+	if err := uc.Handshake(); err != nil {
+		return nil, err
+	}
+
+	// tls 1.2 has no application data frames in the handshake, nothing is verified
+	if !hc.verified {
+		return nil, errSTLSAuth
+	}
+
+	return &stlsConn{
+		Conn: rc,
+		rh:   newSTLSHMAC(s.password, hc.random, []byte("S")),
+		wh:   newSTLSHMAC(s.password, hc.random, []byte("C")),
+		drop: hc.h,
+	}, nil
+}
+
+// stlsHandshakeConn is the conn of the tls handshake of a client, it verifies the application data
+// frames from the server and restores them for the tls stack. Read returns at most a record,
+// so the tls stack does not read past the handshake.
+type stlsHandshakeConn struct {
+	net.Conn
+	password []byte
+
+	random   []byte    // server random
+	h        *stlsHMAC // hmac of the frames of the handshake server
+	key      []byte
+	verified bool
+	rbuf     []byte
+}
+
+func (c *stlsHandshakeConn) Read(b []byte) (int, error) {
+	if len(c.rbuf) == 0 {
+		rec, err := readTLSRecord(c.Conn)
+		if err != nil {
+			return 0, err
+		}
+
+		switch {
+		case c.h == nil && rec[0] == stlsHandshake:
+			if sr, _ := parseServerHello(rec[5:]); sr != nil {
+				c.random, c.h, c.key = sr, newSTLSHMAC(c.password, sr), stlsKey(c.password, sr)
+			}
+
+		case c.h != nil && rec[0] == stlsApplicationData:
+			if len(rec) < 5+stlsTagLen || !c.h.verify(rec[5+stlsTagLen:], rec[5:5+stlsTagLen]) {
+				return 0, errSTLSAuth
+			}
+
+			// move the header over the tag
+			copy(rec[stlsTagLen:], rec[:5])
+			rec = rec[stlsTagLen:]
+			binary.BigEndian.PutUint16(rec[3:], uint16(len(rec)-5))
+			stlsXOR(rec[5:], c.key)
+			c.verified = true
+		}
+
+		c.rbuf = rec
+	}
+
+	n := copy(b, c.rbuf)
+	c.rbuf = c.rbuf[n:]
+	return n, nil
+}
+
+// stlsConn is a shadow-tls conn after the handshake, the data is in application data frames:
+// ContentType(1) 0x17, Version(2) 0x0303, Length(2), HMAC(4), Data
+type stlsConn struct {
+	net.Conn
+	rh   *stlsHMAC // verifies the frames read
+	wh   *stlsHMAC // signs the frames written
+	drop *stlsHMAC // as client, the frames of the handshake server still in flight are dropped
+	rbuf []byte
+
+	wmu sync.Mutex
+}
+
+func (c *stlsConn) Read(b []byte) (int, error) {
+	for len(c.rbuf) == 0 {
+		rec, err := readTLSRecord(c.Conn)
+		if err != nil {
+			return 0, err
+		}
+
+		switch rec[0] {
+		case stlsApplicationData:
+			if len(rec) < 5+stlsTagLen {
+				return 0, errSTLSFrame
+			}
+
+			data, tag := rec[5+stlsTagLen:], rec[5:5+stlsTagLen]
+			if c.rh.verify(data, tag) {
+				c.rbuf = data
+			} else if c.drop == nil || !c.drop.verify(data, tag) {
+				return 0, errSTLSFrame
+			}
+
+		case stlsAlert:
+			return 0, io.EOF
+
+		default:
+			return 0, errSTLSFrame
+		}
+	}
+
+	n := copy(b, c.rbuf)
+	c.rbuf = c.rbuf[n:]
+	return n, nil
+}
+
+func (c *stlsConn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	var n int
+	for len(b) > 0 {
+		data := b
+		if len(data) > stlsMaxData {
+			data = data[:stlsMaxData]
+		}
+
+		frame := make([]byte, 5+stlsTagLen+len(data))
+		frame[0], frame[1], frame[2] = stlsApplicationData, 0x03, 0x03
+		binary.BigEndian.PutUint16(frame[3:], uint16(stlsTagLen+len(data)))
+		copy(frame[5:], c.wh.tag(data))
+		copy(frame[5+stlsTagLen:], data)
+
+		if _, err := c.Conn.Write(frame); err != nil {
+			return n, err
+		}
+
+		n += len(data)
+		b = b[len(data):]
+	}
+
+	return n, nil
+}
+
+// parseServerHello returns the server random of the server hello message b,
+// and whether tls 1.3 is negotiated in the supported_versions extension.
+func parseServerHello(b []byte) ([]byte, bool) {
+	// handshake type(1) 0x02: server hello, length(3), version(2), random(32), session id
+	if len(b) < 39 || b[0] != 0x02 {
+		return nil, false
+	}
+	random := append([]byte(nil), b[6:38]...)
+
+	// cipher suite(2), compression method(1)
+	i := 39 + int(b[38]) + 3
+	if len(b) < i+2 {
+		return random, false
+	}
+
+	end := i + 2 + int(binary.BigEndian.Uint16(b[i:]))
+	i += 2
+	if end > len(b) {
+		end = len(b)
+	}
+
+	for i+4 <= end {
+		extType := binary.BigEndian.Uint16(b[i:])
+		extLen := int(binary.BigEndian.Uint16(b[i+2:]))
+		i += 4
+
+		// supported_versions
+		if extType == 43 {
+			return random, extLen == 2 && i+2 <= end && binary.BigEndian.Uint16(b[i:]) == tls.VersionTLS13
+		}
+		i += extLen
+	}
+
+	return random, false
+}
+
+// stlsHelloSign returns the tag of the client hello message, with the tag in the session id zeroed
+func stlsHelloSign(password, msg []byte) []byte {
+	b := append([]byte(nil), msg...)
+	copy(b[stlsHelloTag:stlsHelloTag+stlsTagLen], make([]byte, stlsTagLen))
+	return newSTLSHMAC(password, b).sum()
+}
+
+// stlsKey returns the key to xor the frames of the handshake server: sha256(password + server random)
+func stlsKey(password, random []byte) []byte {
+	h := sha256.New()
+	h.Write(password)
+	h.Write(random)
+	return h.Sum(nil)
+}
+
+func stlsXOR(b, key []byte) {
+	for i := range b {
+		b[i] ^= key[i%len(key)]
+	}
+}
+
+// stlsHMAC is a running hmac-sha1 keyed by the password, truncated to 4 bytes,
+// the frames are verified on a copy and the state is kept only if matched.
+type stlsHMAC struct {
+	inner hash.Hash
+	opad  [sha1.BlockSize]byte
+}
+
+func newSTLSHMAC(key []byte, data ...[]byte) *stlsHMAC {
+	if len(key) > sha1.BlockSize {
+		k := sha1.Sum(key)
+		key = k[:]
+	}
+
+	h := &stlsHMAC{inner: sha1.New()}
+	var ipad [sha1.BlockSize]byte
+	copy(ipad[:], key)
+	copy(h.opad[:], key)
+	for i := range ipad {
+		ipad[i] ^= 0x36
+		h.opad[i] ^= 0x5c
+	}
+
+	h.inner.Write(ipad[:])
+	for _, b := range data {
+		h.inner.Write(b)
+	}
+	return h
+}
+
+func (h *stlsHMAC) sum() []byte {
+	outer := sha1.New()
+	outer.Write(h.opad[:])
+	outer.Write(h.inner.Sum(nil))
+	return outer.Sum(nil)[:stlsTagLen]
+}
+
+// tag updates the hmac with data and returns the tag
+func (h *stlsHMAC) tag(data []byte) []byte {
+	h.inner.Write(data)
+	return h.sum()
+}
+
+// verify reports whether tag is the tag of data, the hmac is updated only if it is.
+func (h *stlsHMAC) verify(data, tag []byte) bool {
+	state, _ := h.inner.(encoding.BinaryMarshaler).MarshalBinary()
+	if !hmac.Equal(h.tag(data), tag) {
+		h.inner.(encoding.BinaryUnmarshaler).UnmarshalBinary(state)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/hex"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestSTLSHMAC(t *testing.T) {
+	password, random := []byte("password"), bytes.Repeat([]byte{0x42}, 32)
+
+	h := newSTLSHMAC(password, random, []byte("C"))
+	m := hmac.New(sha1.New, password)
+	m.Write(random)
+	m.Write([]byte("C"))
+
+	for _, data := range []string{"hello", "", "world"} {
+		m.Write([]byte(data))
+		if got, want := h.tag([]byte(data)), m.Sum(nil)[:stlsTagLen]; !bytes.Equal(got, want) {
+			t.Fatalf("tag(%q) = %x, want %x", data, got, want)
+		}
+	}
+
+	// a mismatch keeps the state
+	if h.verify([]byte("next"), []byte{0, 0, 0, 0}) {
+		t.Fatal("wrong tag verified")
+	}
+	m.Write([]byte("next"))
+	if !h.verify([]byte("next"), m.Sum(nil)[:stlsTagLen]) {
+		t.Fatal("tag not verified after a mismatch")
+	}
+}
+
+func TestSTLSHello(t *testing.T) {
+	// handshake header(4), version(2), random(32), session id(1+32), cipher suites...
+	msg := append([]byte{0x01, 0x00, 0x00, 0x49, 0x03, 0x03}, bytes.Repeat([]byte{0xaa}, 32)...)
+	msg = append(msg, 32)
+	msg = append(msg, bytes.Repeat([]byte{0xbb}, 32)...)
+	msg = append(msg, 0x00, 0x02, 0x13, 0x01, 0x01, 0x00)
+
+	copy(msg[stlsHelloTag:], stlsHelloSign([]byte("password"), msg))
+	rec := append([]byte{stlsHandshake, 0x03, 0x01, 0x00, byte(len(msg))}, msg...)
+
+	s := &ShadowTLS{password: []byte("password")}
+	if !s.verifyHello(rec) {
+		t.Fatal("signed client hello not verified")
+	}
+
+	rec[20] ^= 1
+	if s.verifyHello(rec) {
+		t.Fatal("modified client hello verified")
+	}
+	rec[20] ^= 1
+
+	s.password = []byte("wrong")
+	if s.verifyHello(rec) {
+		t.Fatal("client hello verified with a wrong password")
+	}
+}
+
+func TestParseServerHello(t *testing.T) {
+	// server hello with supported_versions: tls 1.3 and key_share
+	b, _ := hex.DecodeString("020000560303" +
+		"000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f" +
+		"00" + "1301" + "00" + "002e" + "002b00020304" + "00330024001d0020" +
+		"0000000000000000000000000000000000000000000000000000000000000000")
+
+	random, tls13 := parseServerHello(b)
+	if hex.EncodeToString(random) != "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f" || !tls13 {
+		t.Fatalf("parseServerHello = %x, %t", random, tls13)
+	}
+
+	// tls 1.2, no supported_versions
+	b, _ = hex.DecodeString("020000260303" +
+		"000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f" + "00" + "c02f" + "00")
+	if random, tls13 = parseServerHello(b); random == nil || tls13 {
+		t.Fatalf("parseServerHello of tls 1.2 = %x, %t", random, tls13)
+	}
+
+	if random, _ = parseServerHello([]byte{0x01, 0x00}); random != nil {
+		t.Fatal("not a server hello parsed")
+	}
+}
+
+func TestSTLSConn(t *testing.T) {
+	password, random := []byte("password"), bytes.Repeat([]byte{0x42}, 32)
+
+	c1, c2 := net.Pipe()
+	client := &stlsConn{
+		Conn: c1,
+		rh:   newSTLSHMAC(password, random, []byte("S")),
+		wh:   newSTLSHMAC(password, random, []byte("C")),
+		drop: newSTLSHMAC(password, random),
+	}
+	server := &stlsConn{
+		Conn: c2,
+		rh:   newSTLSHMAC(password, random, []byte("C")),
+		wh:   newSTLSHMAC(password, random, []byte("S")),
+	}
+
+	data := bytes.Repeat([]byte("0123456789"), 4000)
+	go func() {
+		// a frame of the handshake server in flight, dropped by the client
+		hs := newSTLSHMAC(password, random)
+		frame := append([]byte{stlsApplicationData, 0x03, 0x03, 0x00, 0x0a}, hs.tag([]byte("ticket"))...)
+		c2.Write(append(frame, "ticket"...))
+
+		server.Write(data)
+	}()
+
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(client, got); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("client read error: %v", err)
+	}
+
+	go func() {
+		client.Write([]byte("hello"))
+		c1.Close()
+	}()
+
+	buf := make([]byte, 16)
+	n, err := server.Read(buf)
+	if err != nil || string(buf[:n]) != "hello" {
+		t.Fatalf("server read %q, %v", buf[:n], err)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ssPlugin is a SIP003 plugin of a ss forwarder or listener, e.g. v2ray-plugin or kcptun,
+// it runs as a child process and relays the tcp traffic between SS_LOCAL and SS_REMOTE:
+//
+//	forwarder: ss -> SS_LOCAL(plugin, loopback) -> SS_REMOTE(the server)
+//	listener:  SS_REMOTE(plugin, the listen address) -> SS_LOCAL(ss, loopback)
+//
+// the udp traffic doesn't pass the plugin.
+type ssPlugin struct {
+	path   string
+	opts   string
+	remote string // SS_REMOTE_HOST:SS_REMOTE_PORT
+	local  string // SS_LOCAL_HOST:SS_LOCAL_PORT, a free port on loopback
+
+	mu      sync.Mutex
+	cmd     *exec.Cmd
+	stopped bool
+}
+
+// ssPlugins are the running plugins, stopped on exit
+var ssPlugins struct {
+	sync.Mutex
+	list []*ssPlugin
+}
+
+// newSSPlugin starts the plugin "PATH[;OPTIONS]" for remote, it's restarted when exited.
+func newSSPlugin(plugin, remote string) (*ssPlugin, error) {
+	p := &ssPlugin{path: plugin, remote: remote}
+	if i := strings.Index(plugin, ";"); i >= 0 {
+		p.path, p.opts = plugin[:i], plugin[i+1:]
+	}
+
+	if p.path == "" {
+		return nil, errors.New("empty plugin path")
+	}
+
+	if _, err := exec.LookPath(p.path); err != nil {
+		return nil, err
+	}
+
+	// the port is free now, the plugin binds it soon
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	p.local = l.Addr().String()
+	l.Close()
+
+	ssPlugins.Lock()
+	ssPlugins.list = append(ssPlugins.list, p)
+	ssPlugins.Unlock()
+
+	go p.run()
+	return p, nil
+}
+
+// env returns the environment variables of the plugin
+func (p *ssPlugin) env() ([]string, error) {
+	rhost, rport, err := net.SplitHostPort(p.remote)
+	if err != nil {
+		return nil, err
+	}
+	if rhost == "" {
+		rhost = "0.0.0.0"
+	}
+
+	lhost, lport, _ := net.SplitHostPort(p.local)
+	return append(os.Environ(),
+		"SS_REMOTE_HOST="+rhost,
+		"SS_REMOTE_PORT="+rport,
+		"SS_LOCAL_HOST="+lhost,
+		"SS_LOCAL_PORT="+lport,
+		"SS_PLUGIN_OPTIONS="+p.opts,
+	), nil
+}
+
+// run runs the plugin until stopped, restarts it with backoff when exited
+func (p *ssPlugin) run() {
+	env, err := p.env()
+	if err != nil {
+		logf("proxy-ss plugin %s error: %s", p.path, err)
+		return
+	}
+
+	bo := &backoff{min: time.Second, max: time.Minute, cur: time.Second}
+	for {
+		cmd := exec.Command(p.path)
+		cmd.Env = env
+		cmd.SysProcAttr = pluginSysProcAttr()
+
+		out, _ := cmd.StdoutPipe()
+		cmd.Stderr = cmd.Stdout
+
+		p.mu.Lock()
+		if p.stopped {
+			p.mu.Unlock()
+			return
+		}
+		err := cmd.Start()
+		if err == nil {
+			p.cmd = cmd
+		}
+		p.mu.Unlock()
+
+		if err == nil {
+			logf("proxy-ss plugin %s started, pid: %d, %s <-> %s", p.path, cmd.Process.Pid, p.local, p.remote)
+			start := time.Now()
+			p.log(out)
+			err = cmd.Wait()
+
+			// it worked for a while, restart it soon
+			if time.Since(start) > time.Minute {
+				bo.cur = bo.min
+			}
+		}
+
+		p.mu.Lock()
+		stopped := p.stopped
+		p.mu.Unlock()
+		if stopped {
+			return
+		}
+
+		wait := bo.next()
+		logf("proxy-ss plugin %s exited: %v, restart in %s", p.path, err, wait)
+		time.Sleep(wait)
+	}
+}
+
+// log logs the output of the plugin in verbose mode
+func (p *ssPlugin) log(r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		logf("proxy-ss plugin %s: %s", p.path, scanner.Text())
+	}
+}
+
+// stop kills the plugin and stops restarting it
+func (p *ssPlugin) stop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.stopped = true
+	if p.cmd != nil && p.cmd.Process != nil {
+		p.cmd.Process.Kill()
+	}
+}
+
+// stopSSPlugins kills all the plugins, called on exit
+func stopSSPlugins() {
+	ssPlugins.Lock()
+	defer ssPlugins.Unlock()
+
+	for _, p := range ssPlugins.list {
+		p.stop()
+	}
+}
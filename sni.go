@@ -0,0 +1,226 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// SNIRouter routes the tls connections by the server name in the client hello,
+// without terminating tls:
+//
+//	sni://:443?route=a.com=10.0.0.1:443&route=b.com=10.0.0.2:8443=socks5://10.0.0.9:1080&default=10.0.0.3:443
+//
+// a route matches the domain and all its subdomains, the longest one wins, a forwarder chain
+// after the backend is used for the route instead of the forwarders of the listener(escape '&' as %26).
+// with transparent=true, the names without a route are relayed to SNI:PORT(the listening port),
+// except ip literals, localhost and the private names, so it works as a transparent sni proxy.
+type SNIRouter struct {
+	*Forwarder
+	sDialer Dialer
+
+	routes      map[string]*sniRoute // domain -> route
+	def         string               // the default backend
+	transparent bool
+	port        string
+}
+
+// sniRoute is the backend of a domain and the dialer to it
+type sniRoute struct {
+	backend string
+	dialer  Dialer // nil for the forwarders of the listener
+}
+
+// NewSNIRouter returns a sni router.
+func NewSNIRouter(addr, rawQuery string, sDialer Dialer) (*SNIRouter, error) {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &SNIRouter{
+		Forwarder: NewForwarder(addr, nil),
+		sDialer:   sDialer,
+		routes:    make(map[string]*sniRoute),
+		port:      port,
+	}
+
+	p, _ := url.ParseQuery(rawQuery)
+	for _, r := range p["route"] {
+		d := strings.SplitN(r, "=", 3)
+		if len(d) < 2 || d[0] == "" || d[1] == "" {
+			return nil, errors.New("proxy-sni: invalid route '" + r + "', format: DOMAIN=HOST:PORT[=FORWARDER,FORWARDER...]")
+		}
+
+		route := &sniRoute{backend: d[1]}
+		if len(d) == 3 {
+			if route.dialer, err = chainDialer(d[2], Direct); err != nil {
+				return nil, errors.New("proxy-sni: invalid forwarder in route '" + r + "': " + err.Error())
+			}
+		}
+		s.routes[strings.ToLower(strings.TrimPrefix(d[0], "*."))] = route
+	}
+	s.def = p.Get("default")
+	s.transparent = p.Get("transparent") == "true"
+
+	return s, nil
+}
+
+// ListenAndServe .
+func (s *SNIRouter) ListenAndServe() {
+	l, err := listen("tcp", s.addr)
+	if err != nil {
+		logf("proxy-sni failed to listen on %s: %v", s.addr, err)
+		return
+	}
+
+	logf("proxy-sni listening TCP on %s", s.addr)
+
+	b := budgetOf(s.addr)
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if isClosed(err) {
+				return
+			}
+			logf("proxy-sni failed to accept: %v", err)
+			continue
+		}
+
+		if !b.acquireConn() {
+			logf("proxy-sni %s rejected, too many connections on %s", c.RemoteAddr(), s.addr)
+			c.Close()
+			continue
+		}
+
+		go func() {
+			defer b.releaseConn()
+			s.ServeTCP(b.limit(c))
+		}()
+	}
+}
+
+// ServeTCP serves a tls connection.
+func (s *SNIRouter) ServeTCP(nc net.Conn) {
+	defer nc.Close()
+
+	if c, ok := nc.(*net.TCPConn); ok {
+		c.SetKeepAlive(true)
+	}
+
+	// the client hello is kept in the buffer and relayed to the backend
+	c := newConnSize(nc, tlsRecordLen)
+
+	sni := peekSNI(c, handshakeTimeout())
+	tgt, d := s.backend(sni)
+	if tgt == "" {
+		logf("proxy-sni no backend for %s, server name: '%s'", c.RemoteAddr(), sni)
+		return
+	}
+
+	rc, err := d.Dial("tcp", tgt)
+	if err != nil {
+		logf("proxy-sni failed to connect to %s: %v", tgt, err)
+		addResult(resultOfDial(err))
+		return
+	}
+	defer rc.Close()
+
+	logf("proxy-sni %s <-> %s, server name: %s", c.RemoteAddr(), tgt, sni)
+
+	err = relayStats(c, rc, tgt)
+	if err != nil {
+		if err, ok := err.(net.Error); ok && err.Timeout() {
+			return // ignore i/o timeout
+		}
+		logf("proxy-sni relay error: %v", err)
+	}
+}
+
+// backend returns the backend address for the server name sni and the dialer to it
+func (s *SNIRouter) backend(sni string) (string, Dialer) {
+	sni = strings.ToLower(strings.TrimSuffix(sni, "."))
+	if sni == "" {
+		return s.def, s.sDialer
+	}
+
+	// a.b.com, b.com, com
+	for d := sni; d != ""; {
+		if r, ok := s.routes[d]; ok {
+			if r.dialer != nil {
+				return r.backend, r.dialer
+			}
+			return r.backend, s.sDialer
+		}
+
+		i := strings.IndexByte(d, '.')
+		if i < 0 {
+			break
+		}
+		d = d[i+1:]
+	}
+
+	if s.def != "" || !s.transparent {
+		return s.def, s.sDialer
+	}
+
+	if !isPublicName(sni) {
+		logf("proxy-sni server name '%s' is not a public name, rejected", sni)
+		return "", nil
+	}
+
+	return net.JoinHostPort(sni, s.port), s.sDialer
+}
+
+// privateSuffixes are the special-use and commonly used private domains
+var privateSuffixes = []string{"localhost", "local", "lan", "home", "internal", "intranet", "corp", "private", "home.arpa", "in-addr.arpa", "ip6.arpa"}
+
+// isPublicName reports whether the server name may be relayed to in transparent mode:
+// not an ip literal, a single label, a private name or a name resolved to a private address.
+func isPublicName(name string) bool {
+	if net.ParseIP(name) != nil || !strings.Contains(name, ".") {
+		return false
+	}
+
+	for _, suffix := range privateSuffixes {
+		if name == suffix || strings.HasSuffix(name, "."+suffix) {
+			return false
+		}
+	}
+
+	ips, err := net.LookupIP(name)
+	if err != nil {
+		return false
+	}
+
+	for _, ip := range ips {
+		if isPrivateIP(ip) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// privateNets are the loopback, private, link local and shared address ranges
+var privateNets = func() []*net.IPNet {
+	var nets []*net.IPNet
+	for _, s := range []string{"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16",
+		"172.16.0.0/12", "192.168.0.0/16", "::1/128", "fc00::/7", "fe80::/10"} {
+		_, n, _ := net.ParseCIDR(s)
+		nets = append(nets, n)
+	}
+	return nets
+}()
+
+// isPrivateIP reports whether ip is a loopback, private, link local or unspecified address
+func isPrivateIP(ip net.IP) bool {
+	ip = normalizeIP(ip)
+	for _, n := range privateNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return ip.IsUnspecified()
+}
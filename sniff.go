@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+// tlsRecordLen is the max length of a tls record: header(5) and 16K plaintext
+const tlsRecordLen = 5 + 16384
+
+// tlsMaxPayload is the max length of the payload of an encrypted tls record
+const tlsMaxPayload = 16384 + 2048
+
+var errTLSRecord = newError(ErrProtocol, "tls record too long")
+
+// peekSNI waits at most timeout for the tls client hello and returns the server name,
+// the client hello is kept in the buffer of c, which should be at least tlsRecordLen.
+func peekSNI(c conn, timeout time.Duration) string {
+	c.SetReadDeadline(time.Now().Add(timeout))
+	defer c.SetReadDeadline(time.Time{})
+
+	// tls record header: type(1) version(2) length(2), 0x16: handshake
+	head, err := c.Peek(5)
+	if err != nil || head[0] != 0x16 {
+		return ""
+	}
+
+	n := 5 + int(binary.BigEndian.Uint16(head[3:5]))
+	if n > tlsRecordLen {
+		return ""
+	}
+
+	b, err := c.Peek(n)
+	if err != nil {
+		return ""
+	}
+
+	return parseSNI(b[5:])
+}
+
+// parseSNI parses the server name from the tls handshake message b
+func parseSNI(b []byte) (sni string) {
+	parseClientHello(b, func(extType uint16, ext []byte) bool {
+		if extType != 0 {
+			return true
+		}
+
+		// server_name extension: list length(2), name type(1) 0x00: host_name, name length(2), name
+		if len(ext) < 5 || ext[2] != 0 {
+			return false
+		}
+
+		l := int(binary.BigEndian.Uint16(ext[3:]))
+		if len(ext) >= 5+l {
+			sni = string(ext[5 : 5+l])
+		}
+		return false
+	})
+
+	return
+}
+
+// parseClientHello parses the tls handshake message b and calls f with the extensions
+// until it returns false, returns the client version, 0 if b is not a client hello.
+func parseClientHello(b []byte, f func(extType uint16, ext []byte) bool) uint16 {
+	// handshake type(1) 0x01: client hello, length(3), version(2), random(32)
+	if len(b) < 38 || b[0] != 0x01 {
+		return 0
+	}
+	version := binary.BigEndian.Uint16(b[4:])
+	i := 38
+
+	// session id
+	if len(b) < i+1 {
+		return version
+	}
+	i += 1 + int(b[i])
+
+	// cipher suites
+	if len(b) < i+2 {
+		return version
+	}
+	i += 2 + int(binary.BigEndian.Uint16(b[i:]))
+
+	// compression methods
+	if len(b) < i+1 {
+		return version
+	}
+	i += 1 + int(b[i])
+
+	// extensions
+	if len(b) < i+2 {
+		return version
+	}
+	end := i + 2 + int(binary.BigEndian.Uint16(b[i:]))
+	i += 2
+	if end > len(b) {
+		end = len(b)
+	}
+
+	for i+4 <= end {
+		extType := binary.BigEndian.Uint16(b[i:])
+		extLen := int(binary.BigEndian.Uint16(b[i+2:]))
+		i += 4
+
+		if i+extLen > end || !f(extType, b[i:i+extLen]) {
+			break
+		}
+
+		i += extLen
+	}
+
+	return version
+}
+
+// tls versions in the client hello
+var tlsVersions = map[uint16]string{
+	0x0300: "ssl3.0",
+	0x0301: "tls1.0",
+	0x0302: "tls1.1",
+	0x0303: "tls1.2",
+	0x0304: "tls1.3",
+}
+
+// sniffProto returns the protocol of b, the first data sent by the client:
+// tls1.x, http, http2, ssh, bittorrent or unknown.
+func sniffProto(b []byte) string {
+	switch {
+	case len(b) == 0:
+		return "none"
+	case len(b) > 5 && b[0] == 0x16 && b[1] == 0x03:
+		return sniffTLSVersion(b)
+	case bytes.HasPrefix(b, []byte("PRI * HTTP/2.0")):
+		return "http2"
+	case bytes.HasPrefix(b, []byte("SSH-")):
+		return "ssh"
+	case isBitTorrent(b):
+		return "bittorrent"
+	}
+
+	for _, method := range httpMethods {
+		if len(b) > len(method) && bytes.HasPrefix(b, method) && b[len(method)] == ' ' {
+			return "http"
+		}
+	}
+
+	return "unknown"
+}
+
+// sniffTLSVersion returns the highest version offered in the tls record b,
+// "tls" if the client hello is not complete in b.
+func sniffTLSVersion(b []byte) string {
+	var max uint16
+	version := parseClientHello(b[5:], func(extType uint16, ext []byte) bool {
+		// supported_versions extension: length(1), versions(2 each)
+		if extType != 43 || len(ext) < 1 {
+			return true
+		}
+
+		for i := 1; i+1 < len(ext) && i < 1+int(ext[0]); i += 2 {
+			// skip the GREASE values, 0x?a?a
+			if v := binary.BigEndian.Uint16(ext[i:]); v&0x0f0f != 0x0a0a && v > max {
+				max = v
+			}
+		}
+		return false
+	})
+
+	if max == 0 {
+		if 5+int(binary.BigEndian.Uint16(b[3:5])) > len(b) {
+			return "tls"
+		}
+		max = version
+	}
+
+	if name, ok := tlsVersions[max]; ok {
+		return name
+	}
+	return "tls"
+}
+
+// readTLSRecord reads a tls record: ContentType(1) Version(2) Length(2) Payload
+func readTLSRecord(r io.Reader) ([]byte, error) {
+	var h [5]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return nil, err
+	}
+
+	n := int(binary.BigEndian.Uint16(h[3:]))
+	if n > tlsMaxPayload {
+		return nil, errTLSRecord
+	}
+
+	rec := make([]byte, 5+n)
+	copy(rec, h[:])
+	if _, err := io.ReadFull(r, rec[5:]); err != nil {
+		return nil, err
+	}
+
+	return rec, nil
+}
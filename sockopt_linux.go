@@ -0,0 +1,42 @@
+// +build linux
+
+package main
+
+import "syscall"
+
+// setSockOpts sets the dscp(tos) and fwmark of the socket fd, binds it to the interface iface,
+// and clamps the mss of the tcp socket to fit in mtu
+func setSockOpts(fd int, network string, dscp, mark int, iface string, mtu int) error {
+	if dscp > 0 {
+		var err error
+		switch network {
+		case "tcp6", "udp6":
+			err = syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, dscp<<2)
+		default:
+			err = syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_TOS, dscp<<2)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if mark > 0 {
+		if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_MARK, mark); err != nil {
+			return err
+		}
+	}
+
+	if iface != "" {
+		if err := syscall.BindToDevice(fd, iface); err != nil {
+			return err
+		}
+	}
+
+	if mtu > 0 {
+		if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_MAXSEG, tcpMSS(network, mtu)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,14 @@
+// +build !linux
+
+package main
+
+import "errors"
+
+// setSockOpts sets the dscp(tos) and fwmark of the socket fd, binds it to the interface iface,
+// and clamps the mss of the tcp socket to fit in mtu
+func setSockOpts(fd int, network string, dscp, mark int, iface string, mtu int) error {
+	if dscp > 0 || mark > 0 || iface != "" || mtu > 0 {
+		return errors.New("dscp, mark, interface and mtu not supported on this os")
+	}
+	return nil
+}
@@ -0,0 +1,281 @@
+// socks4: https://www.openssh.com/txt/socks4.protocol
+// socks4a: https://www.openssh.com/txt/socks4a.protocol
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+const socks4Version = 4
+
+// SOCKS4 request commands
+const (
+	socks4Connect = 1
+	socks4Bind    = 2
+)
+
+// SOCKS4 reply codes
+const (
+	socks4Granted  = 90
+	socks4Rejected = 91
+)
+
+// SOCKS4 struct
+type SOCKS4 struct {
+	*Forwarder
+	sDialer Dialer
+
+	user string        // USERID
+	auth Authenticator // server side authentication, the USERID is checked with an empty password
+	a    bool          // socks4a, send the domain names to the server instead of resolving them locally
+}
+
+// NewSOCKS4 returns a socks4(a) proxy.
+func NewSOCKS4(addr, user, pass, rawQuery string, socks4a bool, cDialer Dialer, sDialer Dialer) (*SOCKS4, error) {
+	s := &SOCKS4{
+		Forwarder: NewForwarder(addr, cDialer),
+		sDialer:   sDialer,
+		user:      user,
+		a:         socks4a,
+	}
+
+	if sDialer != nil {
+		// socks4 has no password field, so a listener with a password rejects all the socks4 requests,
+		// unless the user is a session token(see token.go) or the auth backend accepts empty passwords.
+		auth, err := NewAuthenticator(user, pass, rawQuery)
+		if err != nil {
+			return nil, err
+		}
+		s.auth = auth
+	}
+
+	return s, nil
+}
+
+// ListenAndServe serves socks4 requests.
+func (s *SOCKS4) ListenAndServe() {
+	l, err := listen("tcp", s.addr)
+	if err != nil {
+		logf("proxy-socks4 failed to listen on %s: %v", s.addr, err)
+		return
+	}
+
+	logf("proxy-socks4 listening TCP on %s", s.addr)
+
+	b := budgetOf(s.addr)
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if isClosed(err) {
+				return
+			}
+			logf("proxy-socks4 failed to accept: %v", err)
+			continue
+		}
+
+		if !b.acquireConn() {
+			logf("proxy-socks4 %s rejected, too many connections on %s", c.RemoteAddr(), s.addr)
+			c.Close()
+			continue
+		}
+
+		go func() {
+			defer b.releaseConn()
+			s.ServeTCP(b.limit(c))
+		}()
+	}
+}
+
+// ServeTCP serves a socks4(a) connection.
+func (s *SOCKS4) ServeTCP(nc net.Conn) {
+	defer nc.Close()
+
+	if c, ok := nc.(*net.TCPConn); ok {
+		c.SetKeepAlive(true)
+	}
+
+	// data sent by the client right after the request are kept in the buffer
+	c := newConn(nc)
+
+	tgt, err := s.handshake(c)
+	if err != nil {
+		logf("proxy-socks4 failed to get target address: %v", err)
+		return
+	}
+
+	rc, err := dialFrom(s.sDialer, "tcp", tgt, "", srcIP(c.RemoteAddr()))
+	if err != nil {
+		logf("proxy-socks4 failed to connect to target: %v", err)
+		addResult(resultOfDial(err))
+		c.Write([]byte{0, socks4Rejected, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer rc.Close()
+
+	if _, err := c.Write([]byte{0, socks4Granted, 0, 0, 0, 0, 0, 0}); err != nil {
+		return
+	}
+
+	logf("proxy-socks4 %s <-> %s", c.RemoteAddr(), tgt)
+
+	err = relayStats(c, rc, tgt)
+	if err != nil {
+		if err, ok := err.(net.Error); ok && err.Timeout() {
+			return // ignore i/o timeout
+		}
+		logf("proxy-socks4 relay error: %v", err)
+	}
+}
+
+// handshake reads the request and returns the target address
+func (s *SOCKS4) handshake(c conn) (string, error) {
+	// VN(1) CD(1) DSTPORT(2) DSTIP(4) USERID NULL [HOSTNAME NULL]
+	r := c.r
+	buf := make([]byte, 8)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", err
+	}
+
+	if buf[0] != socks4Version {
+		return "", newError(ErrProtocol, "unknown socks version "+strconv.Itoa(int(buf[0])))
+	}
+
+	if buf[1] != socks4Connect {
+		c.Write([]byte{0, socks4Rejected, 0, 0, 0, 0, 0, 0})
+		return "", newError(ErrProtocol, "command not supported: "+strconv.Itoa(int(buf[1])))
+	}
+
+	port := strconv.Itoa(int(buf[2])<<8 | int(buf[3]))
+	host := net.IP(buf[4:8]).String()
+
+	user, err := readNullString(r)
+	if err != nil {
+		return "", err
+	}
+
+	// socks4a: DSTIP 0.0.0.x(x != 0) means the hostname follows
+	if buf[4] == 0 && buf[5] == 0 && buf[6] == 0 && buf[7] != 0 {
+		if host, err = readNullString(r); err != nil {
+			return "", err
+		}
+	}
+
+	if s.auth != nil && !s.auth.Auth(user, "") {
+		c.Write([]byte{0, socks4Rejected, 0, 0, 0, 0, 0, 0})
+		return "", newError(ErrAuth, "authentication failed, user: "+user)
+	}
+
+	return net.JoinHostPort(host, port), nil
+}
+
+// readNullString reads a null-terminated string, at most 255 bytes
+func readNullString(r *bufio.Reader) (string, error) {
+	b, err := r.ReadSlice(0)
+	if err != nil {
+		return "", err
+	}
+
+	if len(b) > 256 {
+		return "", newError(ErrProtocol, "string too long")
+	}
+
+	return string(b[:len(b)-1]), nil
+}
+
+// Dial connects to the address addr on the network net via the SOCKS4 proxy.
+func (s *SOCKS4) Dial(network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4":
+	default:
+		return nil, errors.New("proxy-socks4: no support for connection type " + network)
+	}
+
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 1 || port > 0xffff {
+		return nil, newError(ErrInvalidAddr, "proxy-socks4: invalid port "+portStr)
+	}
+
+	// VN(1) CD(1) DSTPORT(2) DSTIP(4) USERID NULL [HOSTNAME NULL]
+	req := []byte{socks4Version, socks4Connect, byte(port >> 8), byte(port)}
+
+	ip := net.ParseIP(host)
+	if ip == nil && !s.a {
+		ips, err := net.LookupIP(host)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, i := range ips {
+			if i.To4() != nil {
+				ip = i
+				break
+			}
+		}
+
+		if ip == nil {
+			return nil, newError(ErrInvalidAddr, "proxy-socks4: no ipv4 address of "+host)
+		}
+	}
+
+	switch {
+	case ip == nil: // socks4a
+		req = append(req, 0, 0, 0, 1)
+		req = append(req, s.user...)
+		req = append(req, 0)
+		req = append(req, host...)
+		req = append(req, 0)
+	case ip.To4() != nil:
+		req = append(req, ip.To4()...)
+		req = append(req, s.user...)
+		req = append(req, 0)
+	default:
+		return nil, newError(ErrInvalidAddr, "proxy-socks4: no support for ipv6 address "+host)
+	}
+
+	start := time.Now()
+	c, err := s.cDialer.Dial(network, s.addr)
+	if err != nil {
+		logf("dial to %s error: %s", s.addr, err)
+		return nil, err
+	}
+
+	if c, ok := c.(*net.TCPConn); ok {
+		c.SetKeepAlive(true)
+	}
+
+	if _, err := c.Write(req); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	// VN(1) CD(1) DSTPORT(2) DSTIP(4)
+	resp := make([]byte, 8)
+	if _, err := io.ReadFull(c, resp); err != nil {
+		c.Close()
+		return nil, wrapError(ErrNetwork, "proxy: failed to read reply from SOCKS4 proxy at "+s.addr, err)
+	}
+
+	if resp[1] != socks4Granted {
+		c.Close()
+		return nil, newError(ErrRejected, "proxy: SOCKS4 proxy at "+s.addr+" rejected the request, code: "+strconv.Itoa(int(resp[1])))
+	}
+
+	logf("proxy-socks4 connect to %s via %s, handshake: %s", addr, s.addr, time.Since(start))
+	return newTTFBConn(c, start, getLatencyStats("socks4", s.addr)), nil
+}
+
+// DialUDP connects to the given address via the proxy.
+func (s *SOCKS4) DialUDP(network, addr string) (net.PacketConn, net.Addr, error) {
+	return nil, nil, newError(ErrUDPNotSupported, "socks4 client does not support udp")
+}
@@ -12,10 +12,13 @@
 package main
 
 import (
+	"bytes"
 	"errors"
 	"io"
 	"net"
+	"net/url"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -57,9 +60,14 @@ var socks5Errors = []error{
 	errors.New("TTL expired"),
 	errors.New("command not supported"),
 	errors.New("address type not supported"),
-	errors.New("socks5UDPAssociate"),
 }
 
+var (
+	// errSocks5UDPAssociate is returned by the handshake of an udp associate request
+	errSocks5UDPAssociate = errors.New("socks5UDPAssociate")
+	errSocks5Command      = newError(ErrProtocol, "proxy-socks5 command not supported")
+)
+
 // SOCKS5 struct
 type SOCKS5 struct {
 	*Forwarder
@@ -67,16 +75,59 @@ type SOCKS5 struct {
 
 	user     string
 	password string
+	auth     Authenticator  // server side authentication, see RFC 1929
+	udpFrag  int            // fragment the udp replies larger than udpFrag bytes, 0 means disabled
+	udpAddrs []*net.UDPAddr // the addresses of the udp relay in the udp associate replies, port 0: the listener's
+
+	// client ips with authenticated udp associations, ip -> count
+	assocMu sync.Mutex
+	assoc   map[string]int
 }
 
 // NewSOCKS5 returns a Proxy that makes SOCKSv5 connections to the given address
 // with an optional username and password. See RFC 1928.
-func NewSOCKS5(addr, user, pass string, cDialer Dialer, sDialer Dialer) (*SOCKS5, error) {
+func NewSOCKS5(addr, user, pass, rawQuery string, cDialer Dialer, sDialer Dialer) (*SOCKS5, error) {
 	s := &SOCKS5{
 		Forwarder: NewForwarder(addr, cDialer),
 		sDialer:   sDialer,
 		user:      user,
 		password:  pass,
+		assoc:     make(map[string]int),
+	}
+
+	if sDialer != nil {
+		auth, err := NewAuthenticator(user, pass, rawQuery)
+		if err != nil {
+			return nil, err
+		}
+		s.auth = auth
+	}
+
+	p, _ := url.ParseQuery(rawQuery)
+	if v := p.Get("udpfrag"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, errors.New("proxy-socks5: invalid udpfrag '" + v + "'")
+		}
+		s.udpFrag = n
+	}
+
+	// udpaddr=IP[:PORT], e.g. the public addresses behind nat, one for each family
+	for _, v := range p["udpaddr"] {
+		ua := &net.UDPAddr{IP: net.ParseIP(v)}
+		if ua.IP == nil {
+			host, port, err := net.SplitHostPort(v)
+			if err != nil {
+				return nil, errors.New("proxy-socks5: invalid udpaddr '" + v + "'")
+			}
+			if ua.IP = net.ParseIP(host); ua.IP == nil {
+				return nil, errors.New("proxy-socks5: invalid udpaddr '" + v + "', must be an ip")
+			}
+			if ua.Port, err = strconv.Atoi(port); err != nil || ua.Port < 1 || ua.Port > 65535 {
+				return nil, errors.New("proxy-socks5: invalid udpaddr port '" + port + "'")
+			}
+		}
+		s.udpAddrs = append(s.udpAddrs, ua)
 	}
 
 	return s, nil
@@ -90,7 +141,7 @@ func (s *SOCKS5) ListenAndServe() {
 
 // ListenAndServeTCP .
 func (s *SOCKS5) ListenAndServeTCP() {
-	l, err := net.Listen("tcp", s.addr)
+	l, err := listen("tcp", s.addr)
 	if err != nil {
 		logf("proxy-socks5 failed to listen on %s: %v", s.addr, err)
 		return
@@ -98,14 +149,27 @@ func (s *SOCKS5) ListenAndServeTCP() {
 
 	logf("proxy-socks5 listening TCP on %s", s.addr)
 
+	b := budgetOf(s.addr)
 	for {
 		c, err := l.Accept()
 		if err != nil {
+			if isClosed(err) {
+				return
+			}
 			logf("proxy-socks5 failed to accept: %v", err)
 			continue
 		}
 
-		go s.ServeTCP(c)
+		if !b.acquireConn() {
+			logf("proxy-socks5 %s rejected, too many connections on %s", c.RemoteAddr(), s.addr)
+			c.Close()
+			continue
+		}
+
+		go func() {
+			defer b.releaseConn()
+			s.ServeTCP(b.limit(c))
+		}()
 	}
 }
 
@@ -120,7 +184,11 @@ func (s *SOCKS5) ServeTCP(c net.Conn) {
 	tgt, err := s.handshake(c)
 	if err != nil {
 		// UDP: keep the connection until disconnect then free the UDP socket
-		if err == socks5Errors[9] {
+		if err == errSocks5UDPAssociate {
+			ip := hostOf(c.RemoteAddr())
+			s.addAssoc(ip)
+			defer s.delAssoc(ip)
+
 			buf := []byte{}
 			// block here
 			for {
@@ -134,19 +202,23 @@ func (s *SOCKS5) ServeTCP(c net.Conn) {
 		}
 
 		logf("proxy-socks5 failed to get target address: %v", err)
+		if ErrorKind(err) == ErrAuth {
+			addResult(resultAuthFail)
+		}
 		return
 	}
 
-	rc, err := s.sDialer.Dial("tcp", tgt.String())
+	rc, err := dialFrom(s.sDialer, "tcp", tgt.String(), "", srcIP(c.RemoteAddr()))
 	if err != nil {
 		logf("proxy-socks5 failed to connect to target: %v", err)
+		addResult(resultOfDial(err))
 		return
 	}
 	defer rc.Close()
 
 	logf("proxy-socks5 %s <-> %s", c.RemoteAddr(), tgt)
 
-	_, _, err = relay(c, rc)
+	err = relayStats(c, rc, tgt.String())
 	if err != nil {
 		if err, ok := err.(net.Error); ok && err.Timeout() {
 			return // ignore i/o timeout
@@ -157,50 +229,88 @@ func (s *SOCKS5) ServeTCP(c net.Conn) {
 
 // ListenAndServeUDP serves udp requests.
 func (s *SOCKS5) ListenAndServeUDP() {
-	lc, err := net.ListenPacket("udp", s.addr)
+	lc, err := listenPacket("udp", s.addr)
 	if err != nil {
 		logf("proxy-socks5-udp failed to listen on %s: %v", s.addr, err)
 		return
 	}
 	defer lc.Close()
 
+	b := budgetOf(s.addr)
+	lc = b.limitPacket(lc)
+
 	logf("proxy-socks5-udp listening UDP on %s", s.addr)
 
 	var nm sync.Map
 	buf := make([]byte, udpBufSize)
+	frags := newSocks5Frags()
 
 	for {
 		c := NewSocks5PktConn(lc, nil, nil, true, nil)
+		c.frags, c.fragSize = frags, s.udpFrag
 
 		n, raddr, err := c.ReadFrom(buf)
 		if err != nil {
+			if isClosed(err) {
+				return
+			}
 			logf("proxy-socks5-udp remote read error: %v", err)
 			continue
 		}
 
-		var pc *Socks5PktConn
-		v, ok := nm.Load(raddr.String())
+		// udp packets carry no credentials, only accept the clients with udp associations
+		if s.auth != nil && !s.hasAssoc(hostOf(raddr)) {
+			logf("proxy-socks5-udp %s has no authenticated udp association, dropped", raddr)
+			continue
+		}
+
+		key := udpKeyOf(raddr)
+
+		var sess *socks5UDPSession
+		v, ok := nm.Load(key)
 		if !ok && v == nil {
-			lpc, nextHop, err := s.sDialer.DialUDP("udp", c.tgtAddr.String())
+			if !b.acquireUDP() {
+				logf("proxy-socks5-udp %s rejected, too many udp sessions on %s", raddr, s.addr)
+				continue
+			}
+
+			lpc, nextHop, err := dialUDPFrom(s.sDialer, "udp", c.tgtAddr.String(), srcIP(raddr))
 			if err != nil {
+				b.releaseUDP()
 				logf("proxy-socks5-udp remote dial error: %v", err)
 				continue
 			}
 
-			pc = NewSocks5PktConn(lpc, nextHop, nil, false, nil)
-			nm.Store(raddr.String(), pc)
+			sess = &socks5UDPSession{pc: NewSocks5PktConn(lpc, nextHop, nil, false, nil), tgt: append(Addr{}, c.tgtAddr...)}
+			nm.Store(key, sess)
 
 			go func() {
-				timedCopy(c, raddr, pc, 2*time.Minute)
-				pc.Close()
-				nm.Delete(raddr.String())
+				relayUDPReplies(c, sess.pc, 2*time.Minute)
+				sess.pc.Close()
+				nm.Delete(key)
+				b.releaseUDP()
 			}()
 
 		} else {
-			pc = v.(*Socks5PktConn)
+			sess = v.(*socks5UDPSession)
 		}
 
-		_, err = pc.WriteTo(buf[:n], pc.writeAddr)
+		// the client may send to multiple peers in one session(e.g. STUN),
+		// a direct udp socket can write to any of them, the forwarders are bound to the first target.
+		writeTo := sess.pc.writeAddr
+		if !bytes.Equal(c.tgtAddr, sess.tgt) {
+			if _, ok := sess.pc.PacketConn.(*net.UDPConn); !ok {
+				logf("proxy-socks5-udp %s -> %s dropped, the session via forwarder is bound to %s", raddr, c.tgtAddr, sess.tgt)
+				continue
+			}
+
+			if writeTo, err = resolveUDPAddr(c.tgtAddr); err != nil {
+				logf("proxy-socks5-udp resolve %s error: %v", c.tgtAddr, err)
+				continue
+			}
+		}
+
+		_, err = sess.pc.WriteTo(buf[:n], writeTo)
 		if err != nil {
 			logf("proxy-socks5-udp remote write error: %v", err)
 			continue
@@ -211,6 +321,44 @@ func (s *SOCKS5) ListenAndServeUDP() {
 
 }
 
+// socks5UDPSession is the udp session of a client
+type socks5UDPSession struct {
+	pc  *Socks5PktConn
+	tgt Addr // the first target
+}
+
+// resolveUDPAddr returns the udp address of a, only domain names are resolved
+func resolveUDPAddr(a Addr) (*net.UDPAddr, error) {
+	if ua := a.UDPAddr(); ua != nil {
+		return ua, nil
+	}
+	return net.ResolveUDPAddr("udp", a.String())
+}
+
+// relayUDPReplies copies the replies from pc to the client via c with read timeout,
+// the DST.ADDR in the reply header is the peer which actually sent the datagram.
+func relayUDPReplies(c *Socks5PktConn, pc net.PacketConn, timeout time.Duration) error {
+	buf := make([]byte, udpBufSize)
+	for {
+		pc.SetReadDeadline(time.Now().Add(timeout))
+		n, from, err := pc.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+
+		src := c.tgtAddr
+		if ua, ok := from.(*net.UDPAddr); ok && addrFromUDP(ua) != nil {
+			src = addrFromUDP(ua)
+		} else if a := ParseAddr(from.String()); a != nil {
+			src = a
+		}
+
+		if _, err := c.writeTo(buf[:n], src); err != nil {
+			return err
+		}
+	}
+}
+
 // Dial connects to the address addr on the network net via the SOCKS5 proxy.
 func (s *SOCKS5) Dial(network, addr string) (net.Conn, error) {
 	switch network {
@@ -219,6 +367,7 @@ func (s *SOCKS5) Dial(network, addr string) (net.Conn, error) {
 		return nil, errors.New("proxy-socks5: no support for connection type " + network)
 	}
 
+	start := time.Now()
 	c, err := s.cDialer.Dial(network, s.addr)
 	if err != nil {
 		logf("dial to %s error: %s", s.addr, err)
@@ -234,7 +383,8 @@ func (s *SOCKS5) Dial(network, addr string) (net.Conn, error) {
 		return nil, err
 	}
 
-	return c, nil
+	logf("proxy-socks5 connect to %s via %s, handshake: %s", addr, s.addr, time.Since(start))
+	return newTTFBConn(c, start, getLatencyStats("socks5", s.addr)), nil
 }
 
 // DialUDP connects to the given address via the proxy.
@@ -270,7 +420,7 @@ func (s *SOCKS5) DialUDP(network, addr string) (pc net.PacketConn, writeTo net.A
 	rep := buf[1]
 	if rep != 0 {
 		logf("proxy-socks5 server reply: %d, not succeeded", rep)
-		return nil, nil, errors.New("server connect failed")
+		return nil, nil, newError(ErrRejected, "proxy-socks5 server reply "+strconv.Itoa(int(rep))+", udp associate failed")
 	}
 
 	uAddr, err := readAddr(c, buf)
@@ -278,9 +428,16 @@ func (s *SOCKS5) DialUDP(network, addr string) (pc net.PacketConn, writeTo net.A
 		return nil, nil, err
 	}
 
-	pc, nextHop, err := s.cDialer.DialUDP(network, uAddr.String())
+	// BND.ADDR 0.0.0.0 or :: means the same host as the server
+	uHost, uPort, _ := net.SplitHostPort(uAddr.String())
+	if ip := net.ParseIP(uHost); ip != nil && ip.IsUnspecified() {
+		host, _, _ := net.SplitHostPort(s.addr)
+		uHost = host
+	}
+
+	pc, nextHop, err := s.cDialer.DialUDP(network, net.JoinHostPort(uHost, uPort))
 	if err != nil {
-		logf("proxy-socks5 dialudp to %s error: %s", uAddr.String(), err)
+		logf("proxy-socks5 dialudp to %s error: %s", net.JoinHostPort(uHost, uPort), err)
 		return nil, nil, err
 	}
 
@@ -299,10 +456,10 @@ func (s *SOCKS5) connect(conn net.Conn, target string) error {
 
 	port, err := strconv.Atoi(portStr)
 	if err != nil {
-		return errors.New("proxy: failed to parse port number: " + portStr)
+		return newError(ErrInvalidAddr, "proxy: failed to parse port number: "+portStr)
 	}
 	if port < 1 || port > 0xffff {
-		return errors.New("proxy: port number out of range: " + portStr)
+		return newError(ErrInvalidAddr, "proxy: port number out of range: "+portStr)
 	}
 
 	// the size here is just an estimate
@@ -316,17 +473,17 @@ func (s *SOCKS5) connect(conn net.Conn, target string) error {
 	}
 
 	if _, err := conn.Write(buf); err != nil {
-		return errors.New("proxy: failed to write greeting to SOCKS5 proxy at " + s.addr + ": " + err.Error())
+		return wrapError(ErrNetwork, "proxy: failed to write greeting to SOCKS5 proxy at "+s.addr, err)
 	}
 
 	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
-		return errors.New("proxy: failed to read greeting from SOCKS5 proxy at " + s.addr + ": " + err.Error())
+		return wrapError(ErrNetwork, "proxy: failed to read greeting from SOCKS5 proxy at "+s.addr, err)
 	}
 	if buf[0] != 5 {
-		return errors.New("proxy: SOCKS5 proxy at " + s.addr + " has unexpected version " + strconv.Itoa(int(buf[0])))
+		return newError(ErrProtocol, "proxy: SOCKS5 proxy at "+s.addr+" has unexpected version "+strconv.Itoa(int(buf[0])))
 	}
 	if buf[1] == 0xff {
-		return errors.New("proxy: SOCKS5 proxy at " + s.addr + " requires authentication")
+		return newError(ErrAuth, "proxy: SOCKS5 proxy at "+s.addr+" requires authentication")
 	}
 
 	if buf[1] == socks5AuthPassword {
@@ -338,15 +495,15 @@ func (s *SOCKS5) connect(conn net.Conn, target string) error {
 		buf = append(buf, s.password...)
 
 		if _, err := conn.Write(buf); err != nil {
-			return errors.New("proxy: failed to write authentication request to SOCKS5 proxy at " + s.addr + ": " + err.Error())
+			return wrapError(ErrNetwork, "proxy: failed to write authentication request to SOCKS5 proxy at "+s.addr, err)
 		}
 
 		if _, err := io.ReadFull(conn, buf[:2]); err != nil {
-			return errors.New("proxy: failed to read authentication reply from SOCKS5 proxy at " + s.addr + ": " + err.Error())
+			return wrapError(ErrNetwork, "proxy: failed to read authentication reply from SOCKS5 proxy at "+s.addr, err)
 		}
 
 		if buf[1] != 0 {
-			return errors.New("proxy: SOCKS5 proxy at " + s.addr + " rejected username/password")
+			return newError(ErrAuth, "proxy: SOCKS5 proxy at "+s.addr+" rejected username/password")
 		}
 	}
 
@@ -363,7 +520,7 @@ func (s *SOCKS5) connect(conn net.Conn, target string) error {
 		buf = append(buf, ip...)
 	} else {
 		if len(host) > 255 {
-			return errors.New("proxy: destination hostname too long: " + host)
+			return newError(ErrInvalidAddr, "proxy: destination hostname too long: "+host)
 		}
 		buf = append(buf, socks5Domain)
 		buf = append(buf, byte(len(host)))
@@ -372,20 +529,35 @@ func (s *SOCKS5) connect(conn net.Conn, target string) error {
 	buf = append(buf, byte(port>>8), byte(port))
 
 	if _, err := conn.Write(buf); err != nil {
-		return errors.New("proxy: failed to write connect request to SOCKS5 proxy at " + s.addr + ": " + err.Error())
+		return wrapError(ErrNetwork, "proxy: failed to write connect request to SOCKS5 proxy at "+s.addr, err)
 	}
 
 	if _, err := io.ReadFull(conn, buf[:4]); err != nil {
-		return errors.New("proxy: failed to read connect reply from SOCKS5 proxy at " + s.addr + ": " + err.Error())
+		return wrapError(ErrNetwork, "proxy: failed to read connect reply from SOCKS5 proxy at "+s.addr, err)
 	}
 
 	failure := "unknown error"
 	if int(buf[1]) < len(socks5Errors) {
 		failure = socks5Errors[buf[1]].Error()
+	} else if m, ok := torReplies[buf[1]]; ok {
+		failure = m
 	}
 
 	if len(failure) > 0 {
-		return errors.New("proxy: SOCKS5 proxy at " + s.addr + " failed to connect: " + failure)
+		msg := "proxy: SOCKS5 proxy at " + s.addr + " failed to connect: " + failure
+		switch buf[1] {
+		case 2: // connection forbidden
+			return newError(ErrRejected, msg)
+		case 3, 4, 5: // network unreachable, host unreachable, connection refused
+			return newError(ErrUnreachable, msg)
+		case 0xf0, 0xf2, 0xf3, 0xf7:
+			return newError(ErrUnreachable, msg)
+		case 0xf4, 0xf5:
+			return newError(ErrAuth, msg)
+		case 0xf6:
+			return newError(ErrInvalidAddr, msg)
+		}
+		return newError(ErrProtocol, msg)
 	}
 
 	bytesToDiscard := 0
@@ -397,11 +569,11 @@ func (s *SOCKS5) connect(conn net.Conn, target string) error {
 	case socks5Domain:
 		_, err := io.ReadFull(conn, buf[:1])
 		if err != nil {
-			return errors.New("proxy: failed to read domain length from SOCKS5 proxy at " + s.addr + ": " + err.Error())
+			return wrapError(ErrNetwork, "proxy: failed to read domain length from SOCKS5 proxy at "+s.addr, err)
 		}
 		bytesToDiscard = int(buf[0])
 	default:
-		return errors.New("proxy: got unknown address type " + strconv.Itoa(int(buf[3])) + " from SOCKS5 proxy at " + s.addr)
+		return newError(ErrProtocol, "proxy: got unknown address type "+strconv.Itoa(int(buf[3]))+" from SOCKS5 proxy at "+s.addr)
 	}
 
 	if cap(buf) < bytesToDiscard {
@@ -410,12 +582,12 @@ func (s *SOCKS5) connect(conn net.Conn, target string) error {
 		buf = buf[:bytesToDiscard]
 	}
 	if _, err := io.ReadFull(conn, buf); err != nil {
-		return errors.New("proxy: failed to read address from SOCKS5 proxy at " + s.addr + ": " + err.Error())
+		return wrapError(ErrNetwork, "proxy: failed to read address from SOCKS5 proxy at "+s.addr, err)
 	}
 
 	// Also need to discard the port number
 	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
-		return errors.New("proxy: failed to read port from SOCKS5 proxy at " + s.addr + ": " + err.Error())
+		return wrapError(ErrNetwork, "proxy: failed to read port from SOCKS5 proxy at "+s.addr, err)
 	}
 
 	return nil
@@ -433,10 +605,15 @@ func (s *SOCKS5) handshake(rw io.ReadWriter) (Addr, error) {
 	if _, err := io.ReadFull(rw, buf[:nmethods]); err != nil {
 		return nil, err
 	}
-	// write VER METHOD
-	if _, err := rw.Write([]byte{5, 0}); err != nil {
+
+	if s.auth != nil {
+		if err := s.authenticate(rw, buf[:nmethods]); err != nil {
+			return nil, err
+		}
+	} else if _, err := rw.Write([]byte{5, socks5AuthNone}); err != nil { // write VER METHOD
 		return nil, err
 	}
+
 	// read VER CMD RSV ATYP DST.ADDR DST.PORT
 	if _, err := io.ReadFull(rw, buf[:3]); err != nil {
 		return nil, err
@@ -450,36 +627,182 @@ func (s *SOCKS5) handshake(rw io.ReadWriter) (Addr, error) {
 	case socks5Connect:
 		_, err = rw.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0}) // SOCKS v5, reply succeeded
 	case socks5UDPAssociate:
-		listenAddr := ParseAddr(rw.(net.Conn).LocalAddr().String())
-		_, err = rw.Write(append([]byte{5, 0, 0}, listenAddr...)) // SOCKS v5, reply succeeded
+		_, err = rw.Write(append([]byte{5, 0, 0}, s.udpReplyAddr(rw.(net.Conn))...)) // SOCKS v5, reply succeeded
 		if err != nil {
-			return nil, socks5Errors[7]
+			return nil, errSocks5Command
 		}
-		err = socks5Errors[9]
+		err = errSocks5UDPAssociate
 	default:
-		return nil, socks5Errors[7]
+		return nil, errSocks5Command
 	}
 
 	return addr, err // skip VER, CMD, RSV fields
 }
 
+// udpReplyAddr returns BND.ADDR and BND.PORT of the udp associate reply to the client of c, in the
+// family of the client: the udpaddr of the family, or the local address of c if none.
+// An ipv4 client of a dual-stack listener gets the ipv4 address instead of the mapped one, and
+// an unspecified address(the same host as the server, RFC 1928) is in the family of the client.
+func (s *SOCKS5) udpReplyAddr(c net.Conn) Addr {
+	local, ok1 := c.LocalAddr().(*net.TCPAddr)
+	remote, ok2 := c.RemoteAddr().(*net.TCPAddr)
+	if !ok1 || !ok2 {
+		return ParseAddr(c.LocalAddr().String())
+	}
+
+	v4 := remote.IP.To4() != nil
+	ua := &net.UDPAddr{IP: local.IP, Port: local.Port}
+
+	for _, a := range s.udpAddrs {
+		if (a.IP.To4() != nil) == v4 {
+			ua.IP = a.IP
+			if a.Port != 0 {
+				ua.Port = a.Port
+			}
+			break
+		}
+	}
+
+	if ua.IP.IsUnspecified() {
+		ua.IP = net.IPv6unspecified
+		if v4 {
+			ua.IP = net.IPv4zero
+		}
+	}
+
+	return addrFromUDP(ua)
+}
+
+// authenticate selects the username/password method and performs the sub-negotiation, see RFC 1929.
+func (s *SOCKS5) authenticate(rw io.ReadWriter, methods []byte) error {
+	var supported bool
+	for _, m := range methods {
+		if m == socks5AuthPassword {
+			supported = true
+			break
+		}
+	}
+
+	if !supported {
+		rw.Write([]byte{5, 0xff}) // no acceptable methods
+		return newError(ErrAuth, "proxy-socks5 client does not support username/password authentication")
+	}
+
+	if _, err := rw.Write([]byte{5, socks5AuthPassword}); err != nil {
+		return err
+	}
+
+	// read VER ULEN UNAME PLEN PASSWD
+	buf := make([]byte, 256)
+	if _, err := io.ReadFull(rw, buf[:2]); err != nil {
+		return err
+	}
+	if buf[0] != 1 {
+		return newError(ErrProtocol, "proxy-socks5 unknown auth version "+strconv.Itoa(int(buf[0])))
+	}
+
+	ulen := int(buf[1])
+	if _, err := io.ReadFull(rw, buf[:ulen+1]); err != nil {
+		return err
+	}
+	user := string(buf[:ulen])
+
+	plen := int(buf[ulen])
+	if _, err := io.ReadFull(rw, buf[:plen]); err != nil {
+		return err
+	}
+	pass := string(buf[:plen])
+
+	// write VER STATUS, 0: success
+	if !s.auth.Auth(user, pass) {
+		rw.Write([]byte{1, 1})
+		return newError(ErrAuth, "proxy-socks5 authentication failed, user: "+user)
+	}
+
+	_, err := rw.Write([]byte{1, 0})
+	return err
+}
+
+func (s *SOCKS5) addAssoc(ip string) {
+	s.assocMu.Lock()
+	s.assoc[ip]++
+	s.assocMu.Unlock()
+}
+
+func (s *SOCKS5) delAssoc(ip string) {
+	s.assocMu.Lock()
+	if s.assoc[ip]--; s.assoc[ip] <= 0 {
+		delete(s.assoc, ip)
+	}
+	s.assocMu.Unlock()
+}
+
+func (s *SOCKS5) hasAssoc(ip string) bool {
+	s.assocMu.Lock()
+	defer s.assocMu.Unlock()
+	return s.assoc[ip] > 0
+}
+
 // String serializes SOCKS address a to string form.
+// it's called on every dial and udp packet, so the string is built with only one allocation.
 func (a Addr) String() string {
-	var host, port string
+	var buf [MaxAddrLen + 8]byte
+	b := buf[:0]
+
+	var p []byte // the port
 
 	switch ATYP(a[0]) { // address type
 	case socks5Domain:
-		host = string(a[2 : 2+int(a[1])])
-		port = strconv.Itoa((int(a[2+int(a[1])]) << 8) | int(a[2+int(a[1])+1]))
+		b = append(b, a[2:2+int(a[1])]...)
+		p = a[2+int(a[1]):]
 	case socks5IP4:
-		host = net.IP(a[1 : 1+net.IPv4len]).String()
-		port = strconv.Itoa((int(a[1+net.IPv4len]) << 8) | int(a[1+net.IPv4len+1]))
+		for i, v := range a[1 : 1+net.IPv4len] {
+			if i > 0 {
+				b = append(b, '.')
+			}
+			b = strconv.AppendInt(b, int64(v), 10)
+		}
+		p = a[1+net.IPv4len:]
 	case socks5IP6:
-		host = net.IP(a[1 : 1+net.IPv6len]).String()
-		port = strconv.Itoa((int(a[1+net.IPv6len]) << 8) | int(a[1+net.IPv6len+1]))
+		ip := normalizeIP(net.IP(a[1 : 1+net.IPv6len]))
+		if ip.To4() == nil {
+			b = append(b, '[')
+			b = append(b, ip.String()...)
+			b = append(b, ']')
+		} else {
+			b = append(b, ip.String()...)
+		}
+		p = a[1+net.IPv6len:]
+	}
+
+	b = append(b, ':')
+	b = strconv.AppendInt(b, int64(p[0])<<8|int64(p[1]), 10)
+
+	return string(b)
+}
+
+// UDPAddr returns the udp address of a without resolving, nil if a is a domain name.
+func (a Addr) UDPAddr() *net.UDPAddr {
+	switch ATYP(a[0]) {
+	case socks5IP4:
+		return &net.UDPAddr{IP: net.IP(a[1 : 1+net.IPv4len]), Port: int(a[1+net.IPv4len])<<8 | int(a[1+net.IPv4len+1])}
+	case socks5IP6:
+		return &net.UDPAddr{IP: net.IP(a[1 : 1+net.IPv6len]), Port: int(a[1+net.IPv6len])<<8 | int(a[1+net.IPv6len+1])}
+	}
+	return nil
+}
+
+// addrFromUDP returns the SOCKS address of a without the string form
+func addrFromUDP(a *net.UDPAddr) Addr {
+	if ip4 := a.IP.To4(); ip4 != nil {
+		return append(append([]byte{socks5IP4}, ip4...), byte(a.Port>>8), byte(a.Port))
+	}
+
+	if ip6 := a.IP.To16(); ip6 != nil {
+		return append(append([]byte{socks5IP6}, ip6...), byte(a.Port>>8), byte(a.Port))
 	}
 
-	return net.JoinHostPort(host, port)
+	return nil
 }
 
 // UoT udp over tcp
@@ -561,7 +884,14 @@ func ParseAddr(s string) Addr {
 	if err != nil {
 		return nil
 	}
+
+	// the zone of link-local ipv6 addresses can not be encoded, e.g. fe80::1%eth0
+	if i := strings.LastIndexByte(host, '%'); i > 0 && net.ParseIP(host[:i]) != nil {
+		host = host[:i]
+	}
+
 	if ip := net.ParseIP(host); ip != nil {
+		// ipv4-mapped ipv6 addresses are encoded as ipv4
 		if ip4 := ip.To4(); ip4 != nil {
 			addr = make([]byte, 1+net.IPv4len+2)
 			addr[0] = socks5IP4
@@ -601,6 +931,9 @@ type Socks5PktConn struct {
 	tgtHeader bool
 
 	ctrlConn net.Conn // tcp control conn
+
+	frags    *socks5Frags // reassembly queues of the fragmented datagrams
+	fragSize int          // fragment the datagrams larger than fragSize on write, 0 means disabled
 }
 
 // NewSocks5PktConn returns a Socks5PktConn
@@ -635,20 +968,46 @@ func (pc *Socks5PktConn) ReadFrom(b []byte) (int, net.Addr, error) {
 		return pc.PacketConn.ReadFrom(b)
 	}
 
-	buf := make([]byte, len(b))
-	n, raddr, err := pc.PacketConn.ReadFrom(buf)
-	if err != nil {
-		return n, raddr, err
+	// room for the header, so the payload is not truncated with ipv6 or domain addresses
+	buf := make([]byte, 3+MaxAddrLen+len(b))
+
+	if pc.frags == nil {
+		pc.frags = newSocks5Frags()
 	}
 
-	// https://tools.ietf.org/html/rfc1928#section-7
-	// +----+------+------+----------+----------+----------+
-	// |RSV | FRAG | ATYP | DST.ADDR | DST.PORT |   DATA   |
-	// +----+------+------+----------+----------+----------+
-	// | 2  |  1   |  1   | Variable |    2     | Variable |
-	// +----+------+------+----------+----------+----------+
-	tgtAddr := SplitAddr(buf[3:])
-	copy(b, buf[3+len(tgtAddr):])
+	var tgtAddr Addr
+	var raddr net.Addr
+	var n int
+	for {
+		var data []byte
+		var err error
+		n, raddr, err = pc.PacketConn.ReadFrom(buf)
+		if err != nil {
+			return n, raddr, err
+		}
+
+		// https://tools.ietf.org/html/rfc1928#section-7
+		// +----+------+------+----------+----------+----------+
+		// |RSV | FRAG | ATYP | DST.ADDR | DST.PORT |   DATA   |
+		// +----+------+------+----------+----------+----------+
+		// | 2  |  1   |  1   | Variable |    2     | Variable |
+		// +----+------+------+----------+----------+----------+
+		if n < 3 {
+			return 0, raddr, newError(ErrProtocol, "proxy-socks5 udp packet too short")
+		}
+
+		tgtAddr = SplitAddr(buf[3:n])
+		if tgtAddr == nil {
+			return 0, raddr, newError(ErrInvalidAddr, "proxy-socks5 udp packet with invalid address")
+		}
+
+		// wait for the rest fragments of the datagram
+		tgtAddr, data = pc.frags.add(raddr.String(), buf[2], tgtAddr, buf[3+len(tgtAddr):n])
+		if data != nil {
+			n = copy(b, data)
+			break
+		}
+	}
 
 	//test
 	if pc.writeAddr == nil {
@@ -659,7 +1018,14 @@ func (pc *Socks5PktConn) ReadFrom(b []byte) (int, net.Addr, error) {
 		pc.tgtAddr = tgtAddr
 	}
 
-	return n - len(tgtAddr) - 3, raddr, err
+	// dialer side: return the peer which sent the datagram, instead of the proxy server
+	if pc.ctrlConn != nil && ATYP(tgtAddr[0]) != socks5Domain {
+		if addr, err := net.ResolveUDPAddr("udp", tgtAddr.String()); err == nil {
+			raddr = addr
+		}
+	}
+
+	return n, raddr, nil
 }
 
 // WriteTo overrides the original function from net.PacketConn
@@ -668,7 +1034,33 @@ func (pc *Socks5PktConn) WriteTo(b []byte, addr net.Addr) (int, error) {
 		return pc.PacketConn.WriteTo(b, addr)
 	}
 
-	buf := append([]byte{0, 0, 0}, pc.tgtAddr...)
+	return pc.writeTo(b, pc.tgtAddr)
+}
+
+// writeTo writes b to writeAddr with tgtAddr in the header
+func (pc *Socks5PktConn) writeTo(b []byte, tgtAddr Addr) (int, error) {
+	// fragment the oversized datagram, at most 127 fragments
+	hdrLen := 3 + len(tgtAddr)
+	size := pc.fragSize - hdrLen
+	if pc.fragSize > 0 && hdrLen+len(b) > pc.fragSize && size > 0 && (len(b)+size-1)/size <= 0x7f {
+		for pos, i := byte(1), 0; i < len(b); pos, i = pos+1, i+size {
+			end := i + size
+			frag := pos
+			if end >= len(b) {
+				end = len(b)
+				frag |= 0x80 // end of the fragment sequence
+			}
+
+			buf := append([]byte{0, 0, frag}, tgtAddr...)
+			buf = append(buf, b[i:end]...)
+			if _, err := pc.PacketConn.WriteTo(buf, pc.writeAddr); err != nil {
+				return i, err
+			}
+		}
+		return len(b), nil
+	}
+
+	buf := append([]byte{0, 0, 0}, tgtAddr...)
 	buf = append(buf, b[:]...)
 	return pc.PacketConn.WriteTo(buf, pc.writeAddr)
 }
@@ -681,3 +1073,73 @@ func (pc *Socks5PktConn) Close() error {
 
 	return pc.PacketConn.Close()
 }
+
+// socks5FragTimeout is the reassembly timeout of the fragmented datagrams
+const socks5FragTimeout = 5 * time.Second
+
+// socks5Frags reassembles the fragmented udp datagrams, see RFC 1928 section 7
+type socks5Frags struct {
+	mu     sync.Mutex
+	queues map[string]*socks5FragQueue // source addr -> queue
+}
+
+// socks5FragQueue is the reassembly queue of a source
+type socks5FragQueue struct {
+	start   time.Time
+	last    byte // position of the last fragment
+	tgtAddr Addr
+	data    []byte
+}
+
+func newSocks5Frags() *socks5Frags {
+	return &socks5Frags{queues: make(map[string]*socks5FragQueue)}
+}
+
+// add adds a datagram from src, returns the target address and data when a whole datagram is available.
+// a standalone datagram(frag 0) abandons the queue, so does a fragment out of order.
+func (f *socks5Frags) add(src string, frag byte, tgtAddr Addr, data []byte) (Addr, []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if frag == 0 {
+		delete(f.queues, src)
+		return tgtAddr, data
+	}
+
+	pos := frag & 0x7f
+	q := f.queues[src]
+	if q == nil || pos != q.last+1 || time.Since(q.start) > socks5FragTimeout {
+		delete(f.queues, src)
+		if pos != 1 {
+			return nil, nil // the beginning of the datagram is lost
+		}
+
+		f.expire()
+		q = &socks5FragQueue{start: time.Now(), tgtAddr: append(Addr(nil), tgtAddr...)}
+		f.queues[src] = q
+	}
+
+	q.last = pos
+	q.data = append(q.data, data...)
+
+	if len(q.data) > udpBufSize {
+		delete(f.queues, src)
+		return nil, nil
+	}
+
+	if frag&0x80 == 0 {
+		return nil, nil
+	}
+
+	delete(f.queues, src)
+	return q.tgtAddr, q.data
+}
+
+// expire removes the timed out queues
+func (f *socks5Frags) expire() {
+	for src, q := range f.queues {
+		if time.Since(q.start) > socks5FragTimeout {
+			delete(f.queues, src)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+// addrConn is a net.Conn with the given local and remote addresses
+type addrConn struct {
+	net.Conn
+	local, remote net.Addr
+}
+
+func (c *addrConn) LocalAddr() net.Addr  { return c.local }
+func (c *addrConn) RemoteAddr() net.Addr { return c.remote }
+
+func TestSOCKS5UDPReplyAddr(t *testing.T) {
+	tcp := func(s string) *net.TCPAddr {
+		a, err := net.ResolveTCPAddr("tcp", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return a
+	}
+	udp := func(ip string, port int) *net.UDPAddr {
+		return &net.UDPAddr{IP: net.ParseIP(ip), Port: port}
+	}
+	v4relay, v6relay := udp("203.0.113.1", 0), udp("2001:db8::2", 5353)
+
+	tests := []struct {
+		name          string
+		local, remote string
+		udpAddrs      []*net.UDPAddr
+		want          string
+	}{
+		{"v4-only", "192.0.2.1:1080", "198.51.100.7:40000", nil, "192.0.2.1:1080"},
+		{"v6-only", "[2001:db8::1]:1080", "[2001:db8::7]:40000", nil, "[2001:db8::1]:1080"},
+		{"dual-stack v4 client", "[::ffff:192.0.2.1]:1080", "[::ffff:198.51.100.7]:40000", nil, "192.0.2.1:1080"},
+		{"dual-stack v6 client", "[2001:db8::1]:1080", "[2001:db8::7]:40000", nil, "[2001:db8::1]:1080"},
+		{"unspecified v4 client", "0.0.0.0:1080", "198.51.100.7:40000", nil, "0.0.0.0:1080"},
+		{"unspecified v6 client", "[::]:1080", "[2001:db8::7]:40000", nil, "[::]:1080"},
+		{"unspecified mapped client", "[::]:1080", "[::ffff:198.51.100.7]:40000", nil, "0.0.0.0:1080"},
+		{"udpaddr v4 client", "[::ffff:192.0.2.1]:1080", "[::ffff:198.51.100.7]:40000", []*net.UDPAddr{v6relay, v4relay}, "203.0.113.1:1080"},
+		{"udpaddr v6 client", "[2001:db8::1]:1080", "[2001:db8::7]:40000", []*net.UDPAddr{v4relay, v6relay}, "[2001:db8::2]:5353"},
+		{"udpaddr no family", "[2001:db8::1]:1080", "[2001:db8::7]:40000", []*net.UDPAddr{v4relay}, "[2001:db8::1]:1080"},
+	}
+
+	for _, tt := range tests {
+		s := &SOCKS5{udpAddrs: tt.udpAddrs}
+		c := &addrConn{local: tcp(tt.local), remote: tcp(tt.remote)}
+		if got := s.udpReplyAddr(c).String(); got != tt.want {
+			t.Errorf("%s: udpReplyAddr = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
@@ -2,8 +2,8 @@ package main
 
 import (
 	"errors"
-	"log"
 	"net"
+	"net/url"
 	"strings"
 	"sync"
 	"time"
@@ -19,14 +19,32 @@ type SS struct {
 	sDialer Dialer
 
 	core.Cipher
+
+	tarpit bool // tar-pit the connections with malformed handshakes
+
+	plugin *ssPlugin // SIP003 plugin of the tcp traffic, see sip003.go
+}
+
+// ssMethods maps the method names used by other shadowsocks implementations(e.g. ss-libev)
+// to the AEAD cipher names, so the same urls work on both sides.
+var ssMethods = map[string]string{
+	"AES-128-GCM":            "AEAD_AES_128_GCM",
+	"AES-192-GCM":            "AEAD_AES_192_GCM",
+	"AES-256-GCM":            "AEAD_AES_256_GCM",
+	"CHACHA20-IETF-POLY1305": "AEAD_CHACHA20_POLY1305",
 }
 
 // NewSS returns a shadowsocks proxy.
-func NewSS(addr, method, pass string, cDialer Dialer, sDialer Dialer) (*SS, error) {
+func NewSS(addr, method, pass, rawQuery string, cDialer Dialer, sDialer Dialer) (*SS, error) {
+	if m, ok := ssMethods[strings.ToUpper(method)]; ok {
+		method = m
+	}
+
 	ciph, err := core.PickCipher(method, nil, pass)
 	if err != nil {
-		log.Fatalf("PickCipher for '%s', error: %s", method, err)
+		return nil, errors.New("proxy-ss: cipher '" + method + "': " + err.Error())
 	}
+	checkAESMethod("proxy-ss", method)
 
 	s := &SS{
 		Forwarder: NewForwarder(addr, cDialer),
@@ -34,6 +52,25 @@ func NewSS(addr, method, pass string, cDialer Dialer, sDialer Dialer) (*SS, erro
 		Cipher:    ciph,
 	}
 
+	p, _ := url.ParseQuery(rawQuery)
+	if v, ok := p["tarpit"]; ok {
+		if v[0] == "true" {
+			s.tarpit = true
+		}
+	}
+
+	// plugin=PATH[;OPTIONS], url encoded: plugin=v2ray-plugin%3Btls%3Bhost%3Dexample.com
+	if plugin := p.Get("plugin"); plugin != "" {
+		// the plugin connects to the server itself
+		if cDialer != nil && cDialer.Addr() != "DIRECT" {
+			return nil, errors.New("proxy-ss: plugin can only be used in the first forwarder of a chain")
+		}
+
+		if s.plugin, err = newSSPlugin(plugin, addr); err != nil {
+			return nil, errors.New("proxy-ss: plugin '" + plugin + "': " + err.Error())
+		}
+	}
+
 	return s, nil
 }
 
@@ -45,21 +82,41 @@ func (s *SS) ListenAndServe() {
 
 // ListenAndServeTCP serves tcp ss requests.
 func (s *SS) ListenAndServeTCP() {
-	l, err := net.Listen("tcp", s.addr)
+	// the plugin listens on the address, and relays to ss on loopback
+	addr := s.addr
+	if s.plugin != nil {
+		addr = s.plugin.local
+	}
+
+	l, err := listen("tcp", addr)
 	if err != nil {
-		logf("proxy-ss failed to listen on %s: %v", s.addr, err)
+		logf("proxy-ss failed to listen on %s: %v", addr, err)
 		return
 	}
 
-	logf("proxy-ss listening TCP on %s", s.addr)
+	logf("proxy-ss listening TCP on %s", addr)
 
+	b := budgetOf(s.addr)
 	for {
 		c, err := l.Accept()
 		if err != nil {
+			if isClosed(err) {
+				return
+			}
 			logf("proxy-ss failed to accept: %v", err)
 			continue
 		}
-		go s.ServeTCP(c)
+
+		if !b.acquireConn() {
+			logf("proxy-ss %s rejected, too many connections on %s", c.RemoteAddr(), s.addr)
+			c.Close()
+			continue
+		}
+
+		go func() {
+			defer b.releaseConn()
+			s.ServeTCP(b.limit(c))
+		}()
 	}
 }
 
@@ -71,13 +128,19 @@ func (s *SS) ServeTCP(c net.Conn) {
 		c.SetKeepAlive(true)
 	}
 
+	// the raw conn is drained on an invalid handshake, the cipher conn would fail on the next read
+	raw := c
 	c = s.StreamConn(c)
 
+	// never respond to the invalid handshakes, see defendProbe
+	c.SetReadDeadline(time.Now().Add(handshakeTimeout()))
 	tgt, err := ReadAddr(c)
 	if err != nil {
-		logf("proxy-ss failed to get target address: %v", err)
+		logf("proxy-ss failed to get target address from %s: %v", c.RemoteAddr(), err)
+		defendProbe(raw, err, s.tarpit)
 		return
 	}
+	c.SetReadDeadline(time.Time{})
 
 	dialer := s.sDialer.NextDialer(tgt.String())
 
@@ -122,13 +185,14 @@ func (s *SS) ServeTCP(c net.Conn) {
 	rc, err := dialer.Dial(network, tgt.String())
 	if err != nil {
 		logf("proxy-ss failed to connect to target: %v", err)
+		addResult(resultOfDial(err))
 		return
 	}
 	defer rc.Close()
 
 	logf("proxy-ss %s <-> %s", c.RemoteAddr(), tgt)
 
-	_, _, err = relay(c, rc)
+	err = relayStats(c, rc, tgt.String())
 	if err != nil {
 		if err, ok := err.(net.Error); ok && err.Timeout() {
 			return // ignore i/o timeout
@@ -140,14 +204,15 @@ func (s *SS) ServeTCP(c net.Conn) {
 
 // ListenAndServeUDP serves udp ss requests.
 func (s *SS) ListenAndServeUDP() {
-	lc, err := net.ListenPacket("udp", s.addr)
+	lc, err := listenPacket("udp", s.addr)
 	if err != nil {
 		logf("proxy-ss-udp failed to listen on %s: %v", s.addr, err)
 		return
 	}
 	defer lc.Close()
 
-	lc = s.PacketConn(lc)
+	b := budgetOf(s.addr)
+	lc = s.PacketConn(b.limitPacket(lc))
 
 	logf("proxy-ss-udp listening UDP on %s", s.addr)
 
@@ -159,26 +224,38 @@ func (s *SS) ListenAndServeUDP() {
 
 		n, raddr, err := c.ReadFrom(buf)
 		if err != nil {
+			if isClosed(err) {
+				return
+			}
 			logf("proxy-ss-udp remote read error: %v", err)
 			continue
 		}
 
+		key := udpKeyOf(raddr)
+
 		var pc *PktConn
-		v, ok := nm.Load(raddr.String())
+		v, ok := nm.Load(key)
 		if !ok && v == nil {
+			if !b.acquireUDP() {
+				logf("proxy-ss-udp %s rejected, too many udp sessions on %s", raddr, s.addr)
+				continue
+			}
+
 			lpc, nextHop, err := s.sDialer.DialUDP("udp", c.tgtAddr.String())
 			if err != nil {
+				b.releaseUDP()
 				logf("proxy-ss-udp remote dial error: %v", err)
 				continue
 			}
 
 			pc = NewPktConn(lpc, nextHop, nil, false)
-			nm.Store(raddr.String(), pc)
+			nm.Store(key, pc)
 
 			go func() {
 				timedCopy(c, raddr, pc, 2*time.Minute)
 				pc.Close()
-				nm.Delete(raddr.String())
+				nm.Delete(key)
+				b.releaseUDP()
 			}()
 
 		} else {
@@ -204,14 +281,21 @@ func ListCipher() string {
 func (s *SS) Dial(network, addr string) (net.Conn, error) {
 	target := ParseAddr(addr)
 	if target == nil {
-		return nil, errors.New("Unable to parse address: " + addr)
+		return nil, newError(ErrInvalidAddr, "proxy-ss: unable to parse address: "+addr)
 	}
 
 	if network == "uot" {
 		target[0] = target[0] | 0x8
 	}
 
-	c, err := s.cDialer.Dial("tcp", s.addr)
+	// the plugin relays to the server
+	server := s.addr
+	if s.plugin != nil {
+		server = s.plugin.local
+	}
+
+	start := time.Now()
+	c, err := s.cDialer.Dial("tcp", server)
 	if err != nil {
 		logf("dial to %s error: %s", s.addr, err)
 		return nil, err
@@ -227,7 +311,7 @@ func (s *SS) Dial(network, addr string) (net.Conn, error) {
 		return nil, err
 	}
 
-	return c, err
+	return newTTFBConn(c, start, getLatencyStats("ss", s.addr)), err
 
 }
 
@@ -270,13 +354,24 @@ func (pc *PktConn) ReadFrom(b []byte) (int, net.Addr, error) {
 	}
 
 	buf := make([]byte, len(b))
-	n, raddr, err := pc.PacketConn.ReadFrom(buf)
-	if err != nil {
-		return n, raddr, err
-	}
 
-	tgtAddr := SplitAddr(buf)
-	copy(b, buf[len(tgtAddr):])
+	// a malformed packet is skipped, so the relay goes on with the next one
+	var n int
+	var raddr net.Addr
+	var tgtAddr Addr
+	for {
+		var err error
+		n, raddr, err = pc.PacketConn.ReadFrom(buf)
+		if err != nil {
+			return n, raddr, err
+		}
+
+		if tgtAddr = SplitAddr(buf[:n]); tgtAddr != nil {
+			break
+		}
+		logf("proxy-ss invalid target address in udp packet from %s, dropped", raddr)
+	}
+	copy(b, buf[len(tgtAddr):n])
 
 	//test
 	if pc.writeAddr == nil {
@@ -287,7 +382,7 @@ func (pc *PktConn) ReadFrom(b []byte) (int, net.Addr, error) {
 		pc.tgtAddr = tgtAddr
 	}
 
-	return n - len(tgtAddr), raddr, err
+	return n - len(tgtAddr), raddr, nil
 }
 
 // WriteTo overrides the original function from net.PacketConn
@@ -0,0 +1,321 @@
+// shadowsocks 2022 edition, client side, tcp only:
+// https://github.com/Shadowsocks-NET/shadowsocks-specs/blob/main/2022-1-shadowsocks-2022-edition.md
+
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"lukechampine.com/blake3"
+)
+
+const (
+	ss2022Subkey      = "shadowsocks 2022 session subkey"
+	ss2022MaxPayload  = 0xffff
+	ss2022MaxPadding  = 900
+	ss2022MaxTimeDiff = 30 // seconds
+
+	ss2022Request  = 0
+	ss2022Response = 1
+)
+
+// ss2022KeySizes are the key(and salt) sizes of the supported methods
+var ss2022KeySizes = map[string]int{
+	"2022-blake3-aes-128-gcm": 16,
+	"2022-blake3-aes-256-gcm": 32,
+}
+
+// isSS2022 reports whether method is a shadowsocks 2022 method
+func isSS2022(method string) bool {
+	return strings.HasPrefix(strings.ToLower(method), "2022-")
+}
+
+// SS2022 is a shadowsocks 2022 client
+type SS2022 struct {
+	*Forwarder
+	psk []byte
+}
+
+// NewSS2022 returns a shadowsocks 2022 client, pass is the base64 encoded psk.
+func NewSS2022(addr, method, pass string, cDialer Dialer) (*SS2022, error) {
+	size, ok := ss2022KeySizes[strings.ToLower(method)]
+	if !ok {
+		return nil, errors.New("proxy-ss2022: method '" + method + "' not supported, available: 2022-blake3-aes-128-gcm 2022-blake3-aes-256-gcm")
+	}
+
+	if strings.Contains(pass, ":") {
+		return nil, errors.New("proxy-ss2022: identity psks(multi-user) not supported")
+	}
+
+	psk, err := base64.StdEncoding.DecodeString(pass)
+	if err != nil {
+		return nil, errors.New("proxy-ss2022: invalid psk: " + err.Error())
+	}
+
+	if len(psk) != size {
+		return nil, errors.New("proxy-ss2022: psk must be " + strconv.Itoa(size) + " bytes for " + method)
+	}
+
+	return &SS2022{Forwarder: NewForwarder(addr, cDialer), psk: psk}, nil
+}
+
+// Dial connects to the address addr on the network net via the proxy.
+func (s *SS2022) Dial(network, addr string) (net.Conn, error) {
+	tgt := ParseAddr(addr)
+	if tgt == nil {
+		return nil, newError(ErrInvalidAddr, "proxy-ss2022: unable to parse address: "+addr)
+	}
+
+	start := time.Now()
+	c, err := s.cDialer.Dial("tcp", s.addr)
+	if err != nil {
+		logf("dial to %s error: %s", s.addr, err)
+		return nil, err
+	}
+
+	if c, ok := c.(*net.TCPConn); ok {
+		c.SetKeepAlive(true)
+	}
+
+	// the request header is sent with the first write, so the initial payload goes in the same packet
+	return newTTFBConn(&ss2022Conn{Conn: c, psk: s.psk, tgt: tgt}, start, getLatencyStats("ss", s.addr)), nil
+}
+
+// DialUDP connects to the given address via the proxy.
+func (s *SS2022) DialUDP(network, addr string) (net.PacketConn, net.Addr, error) {
+	return nil, nil, newError(ErrUDPNotSupported, "proxy-ss2022: udp not supported")
+}
+
+// ss2022Conn is a shadowsocks 2022 tcp stream
+type ss2022Conn struct {
+	net.Conn
+	psk []byte
+	tgt Addr
+
+	wmu    sync.Mutex
+	salt   []byte // request salt, nil before the request header is sent
+	enc    cipher.AEAD
+	wnonce []byte
+
+	dec    cipher.AEAD
+	rnonce []byte
+	rbuf   []byte // decrypted but not read payload
+}
+
+// newSS2022AEAD returns the aead cipher of the session with salt
+func newSS2022AEAD(psk, salt []byte) (cipher.AEAD, error) {
+	key := make([]byte, len(psk))
+	blake3.DeriveKey(key, ss2022Subkey, append(append([]byte{}, psk...), salt...))
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func (c *ss2022Conn) seal(dst, plain []byte) []byte {
+	dst = c.enc.Seal(dst, c.wnonce, plain, nil)
+	increment(c.wnonce)
+	return dst
+}
+
+// writeRequest sends the request header with the initial payload b
+func (c *ss2022Conn) writeRequest(b []byte) (int, error) {
+	c.salt = make([]byte, len(c.psk))
+	if _, err := rand.Read(c.salt); err != nil {
+		return 0, err
+	}
+
+	aead, err := newSS2022AEAD(c.psk, c.salt)
+	if err != nil {
+		return 0, err
+	}
+	c.enc, c.wnonce = aead, make([]byte, aead.NonceSize())
+
+	// the variable-length header must fit in a chunk, the rest is sent in chunks
+	n := len(b)
+	if max := ss2022MaxPayload - len(c.tgt) - 2; n > max {
+		n = max
+	}
+
+	// padding is required without initial payload
+	var padding int
+	if n == 0 {
+		var r [2]byte
+		rand.Read(r[:])
+		padding = 1 + int(binary.BigEndian.Uint16(r[:]))%ss2022MaxPadding
+	}
+
+	// variable-length header: addr, padding length(2), padding, initial payload
+	vh := make([]byte, 0, len(c.tgt)+2+padding+n)
+	vh = append(vh, c.tgt...)
+	vh = append(vh, byte(padding>>8), byte(padding))
+	vh = append(vh, make([]byte, padding)...)
+	vh = append(vh, b[:n]...)
+
+	// fixed-length header: type(1), timestamp(8), length(2)
+	fh := make([]byte, 11)
+	fh[0] = ss2022Request
+	binary.BigEndian.PutUint64(fh[1:], uint64(time.Now().Unix()))
+	binary.BigEndian.PutUint16(fh[9:], uint16(len(vh)))
+
+	buf := append([]byte{}, c.salt...)
+	buf = c.seal(buf, fh)
+	buf = c.seal(buf, vh)
+
+	if _, err := c.Conn.Write(buf); err != nil {
+		return 0, err
+	}
+
+	if n < len(b) {
+		m, err := c.writeChunks(b[n:])
+		return n + m, err
+	}
+
+	return n, nil
+}
+
+// writeChunks sends b in chunks: encrypted length(2), encrypted payload
+func (c *ss2022Conn) writeChunks(b []byte) (int, error) {
+	var n int
+	for len(b) > 0 {
+		l := len(b)
+		if l > ss2022MaxPayload {
+			l = ss2022MaxPayload
+		}
+
+		buf := make([]byte, 0, 2+l+2*c.enc.Overhead())
+		buf = c.seal(buf, []byte{byte(l >> 8), byte(l)})
+		buf = c.seal(buf, b[:l])
+
+		if _, err := c.Conn.Write(buf); err != nil {
+			return n, err
+		}
+
+		n += l
+		b = b[l:]
+	}
+
+	return n, nil
+}
+
+func (c *ss2022Conn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	if c.salt == nil {
+		return c.writeRequest(b)
+	}
+
+	return c.writeChunks(b)
+}
+
+// open reads and decrypts a chunk of n bytes plaintext
+func (c *ss2022Conn) open(n int) ([]byte, error) {
+	buf := make([]byte, n+c.dec.Overhead())
+	if _, err := io.ReadFull(c.Conn, buf); err != nil {
+		return nil, err
+	}
+
+	b, err := c.dec.Open(buf[:0], c.rnonce, buf, nil)
+	if err != nil {
+		return nil, wrapError(ErrAuth, "proxy-ss2022: decrypt error", err)
+	}
+	increment(c.rnonce)
+
+	return b, nil
+}
+
+// readResponse reads the response header, and the first payload chunk to rbuf
+func (c *ss2022Conn) readResponse() error {
+	salt := make([]byte, len(c.psk))
+	if _, err := io.ReadFull(c.Conn, salt); err != nil {
+		return err
+	}
+
+	aead, err := newSS2022AEAD(c.psk, salt)
+	if err != nil {
+		return err
+	}
+	c.dec, c.rnonce = aead, make([]byte, aead.NonceSize())
+
+	// fixed-length header: type(1), timestamp(8), request salt, length(2)
+	fh, err := c.open(1 + 8 + len(c.salt) + 2)
+	if err != nil {
+		return err
+	}
+
+	if fh[0] != ss2022Response {
+		return newError(ErrProtocol, "proxy-ss2022: invalid response type "+strconv.Itoa(int(fh[0])))
+	}
+
+	diff := time.Now().Unix() - int64(binary.BigEndian.Uint64(fh[1:]))
+	if diff > ss2022MaxTimeDiff || diff < -ss2022MaxTimeDiff {
+		return newError(ErrProtocol, "proxy-ss2022: response timestamp differs "+strconv.FormatInt(diff, 10)+"s, check the clock")
+	}
+
+	if !bytes.Equal(fh[9:9+len(c.salt)], c.salt) {
+		return newError(ErrProtocol, "proxy-ss2022: request salt mismatch in response")
+	}
+
+	c.rbuf, err = c.open(int(binary.BigEndian.Uint16(fh[9+len(c.salt):])))
+	return err
+}
+
+func (c *ss2022Conn) Read(b []byte) (int, error) {
+	if c.dec == nil {
+		// the server speaks first, send the request header without payload
+		c.wmu.Lock()
+		if c.salt == nil {
+			if _, err := c.writeRequest(nil); err != nil {
+				c.wmu.Unlock()
+				return 0, err
+			}
+		}
+		c.wmu.Unlock()
+
+		if err := c.readResponse(); err != nil {
+			return 0, err
+		}
+	}
+
+	for len(c.rbuf) == 0 {
+		l, err := c.open(2)
+		if err != nil {
+			return 0, err
+		}
+
+		if c.rbuf, err = c.open(int(binary.BigEndian.Uint16(l))); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(b, c.rbuf)
+	c.rbuf = c.rbuf[n:]
+
+	return n, nil
+}
+
+// increment increments the little-endian nonce b
+func increment(b []byte) {
+	for i := range b {
+		b[i]++
+		if b[i] != 0 {
+			return
+		}
+	}
+}
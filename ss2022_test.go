@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"lukechampine.com/blake3"
+)
+
+// blake3Input returns the input of the official test vectors: the repeating bytes 0, 1, ..., 250
+func blake3Input(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i % 251)
+	}
+	return b
+}
+
+// the first 32 bytes of the official BLAKE3 test vectors:
+// https://github.com/BLAKE3-team/BLAKE3/blob/master/test_vectors/test_vectors.json
+var blake3Vectors = []struct {
+	inputLen  int
+	hash      string
+	deriveKey string
+}{
+	{0, "af1349b9f5f9a1a6a0404dea36dcc9499bcb25c9adc112b7cc9a93cae41f3262", "2cc39783c223154fea8dfb7c1b1660f2ac2dcbd1c1de8277b0b0dd39b7e50d7d"},
+	{1, "2d3adedff11b61f14c886e35afa036736dcd87a74d27b5c1510225d0f592e213", "b3e2e340a117a499c6cf2398a19ee0d29cca2bb7404c73063382693bf66cb06c"},
+	{1023, "10108970eeda3eb932baac1428c7a2163b0e924c9a9e25b35bba72b28f70bd11", "74a16c1c3d44368a86e1ca6df64be6a2f64cce8f09220787450722d85725dea5"},
+	{1024, "42214739f095a406f3fc83deb889744ac00df831c10daa55189b5d121c855af7", "7356cd7720d5b66b6d0697eb3177d9f8d73a4a5c5e968896eb6a689684302706"},
+}
+
+func TestBLAKE3(t *testing.T) {
+	const context = "BLAKE3 2019-12-27 16:29:52 test vectors context"
+
+	for _, v := range blake3Vectors {
+		input := blake3Input(v.inputLen)
+
+		h := blake3.Sum256(input)
+		if got := hex.EncodeToString(h[:]); got != v.hash {
+			t.Errorf("hash(%d bytes) = %s, want %s", v.inputLen, got, v.hash)
+		}
+
+		key := make([]byte, 32)
+		blake3.DeriveKey(key, context, input)
+		if got := hex.EncodeToString(key); got != v.deriveKey {
+			t.Errorf("derive_key(%d bytes) = %s, want %s", v.inputLen, got, v.deriveKey)
+		}
+	}
+}
+
+// the session subkeys of psk 00 01 02 ... and salt a0 a1 a2 ..., generated with lukechampine.com/blake3:
+// blake3.DeriveKey(subkey, "shadowsocks 2022 session subkey", psk+salt)
+func TestSS2022Subkey(t *testing.T) {
+	tests := []struct {
+		size   int
+		subkey string
+	}{
+		{16, "4d0d7016c8028969edf2d6ca7fc30b93"},
+		{32, "8a54bdc58e8c56998e5570a1903596333229fcba141429f380cceda6a647b700"},
+	}
+
+	for _, tt := range tests {
+		psk, salt := make([]byte, tt.size), make([]byte, tt.size)
+		for i := 0; i < tt.size; i++ {
+			psk[i], salt[i] = byte(i), byte(0xa0+i)
+		}
+
+		key := make([]byte, tt.size)
+		blake3.DeriveKey(key, ss2022Subkey, append(psk, salt...))
+		if got := hex.EncodeToString(key); got != tt.subkey {
+			t.Errorf("subkey(%d bytes) = %s, want %s", tt.size, got, tt.subkey)
+		}
+
+		if _, err := newSS2022AEAD(psk, salt); err != nil {
+			t.Errorf("newSS2022AEAD(%d bytes) error: %v", tt.size, err)
+		}
+	}
+}
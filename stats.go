@@ -0,0 +1,191 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// hostStats is the traffic stats of a destination host
+type hostStats struct {
+	Host  string `json:"host"`
+	Up    int64  `json:"up"`
+	Down  int64  `json:"down"`
+	Conns int64  `json:"conns"`
+
+	last int64 // unix nano of the last update, atomic
+}
+
+// protoStats is the traffic stats of a sniffed protocol
+type protoStats struct {
+	Proto string `json:"proto"`
+	Up    int64  `json:"up"`
+	Down  int64  `json:"down"`
+	Conns int64  `json:"conns"`
+}
+
+// trafficStats stores the traffic stats, host -> *hostStats
+var trafficStats sync.Map
+
+// maxTrafficHosts is the max number of hosts in trafficStats, the least recently updated
+// ones are evicted when exceeded, so scanning or p2p traffic can not grow it unbounded.
+const maxTrafficHosts = 10000
+
+var (
+	trafficHosts int64  // number of hosts in trafficStats, atomic
+	evicting     uint32 // 1 while evicting, atomic
+)
+
+// protoTraffic stores the traffic stats by protocol, proto -> *protoStats
+var protoTraffic sync.Map
+
+func init() {
+	apiMux.HandleFunc("/stats/domains", handleTopDomains)
+	apiMux.HandleFunc("/stats/protocols", handleProtocols)
+}
+
+// addTraffic adds the relayed bytes of a connection to the stats of host,
+// tgt is the target address, sni is the sniffed server name(if any) and preferred.
+func addTraffic(tgt, sni string, up, down int64) {
+	host := sni
+	if host == "" {
+		host = dstHost(tgt)
+	}
+
+	v, ok := trafficStats.Load(host)
+	if !ok {
+		var loaded bool
+		if v, loaded = trafficStats.LoadOrStore(host, &hostStats{Host: host}); !loaded {
+			if atomic.AddInt64(&trafficHosts, 1) > maxTrafficHosts && atomic.CompareAndSwapUint32(&evicting, 0, 1) {
+				go evictTraffic()
+			}
+		}
+	}
+
+	s := v.(*hostStats)
+	atomic.AddInt64(&s.Up, up)
+	atomic.AddInt64(&s.Down, down)
+	atomic.AddInt64(&s.Conns, 1)
+	atomic.StoreInt64(&s.last, time.Now().UnixNano())
+}
+
+// evictTraffic removes the least recently updated tenth of the hosts in trafficStats
+func evictTraffic() {
+	defer atomic.StoreUint32(&evicting, 0)
+
+	var hosts []*hostStats
+	trafficStats.Range(func(key, value interface{}) bool {
+		hosts = append(hosts, value.(*hostStats))
+		return true
+	})
+
+	sort.Slice(hosts, func(i, j int) bool {
+		return atomic.LoadInt64(&hosts[i].last) < atomic.LoadInt64(&hosts[j].last)
+	})
+
+	n := len(hosts) - maxTrafficHosts*9/10
+	if n <= 0 {
+		return
+	}
+
+	for _, s := range hosts[:n] {
+		trafficStats.Delete(s.Host)
+	}
+	atomic.AddInt64(&trafficHosts, -int64(n))
+
+	logf("stats: evicted %d least recently used hosts", n)
+}
+
+// addProtoTraffic adds the relayed bytes of a connection to the stats of proto
+func addProtoTraffic(proto string, up, down int64) {
+	v, ok := protoTraffic.Load(proto)
+	if !ok {
+		v, _ = protoTraffic.LoadOrStore(proto, &protoStats{Proto: proto})
+	}
+
+	s := v.(*protoStats)
+	atomic.AddInt64(&s.Up, up)
+	atomic.AddInt64(&s.Down, down)
+	atomic.AddInt64(&s.Conns, 1)
+}
+
+// handleProtocols serves the connection counts and traffic by the sniffed protocol: /stats/protocols
+func handleProtocols(w http.ResponseWriter, r *http.Request) {
+	list := []protoStats{}
+	protoTraffic.Range(func(key, value interface{}) bool {
+		s := value.(*protoStats)
+		list = append(list, protoStats{
+			Proto: s.Proto,
+			Up:    atomic.LoadInt64(&s.Up),
+			Down:  atomic.LoadInt64(&s.Down),
+			Conns: atomic.LoadInt64(&s.Conns),
+		})
+		return true
+	})
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Conns > list[j].Conns })
+	writeJSON(w, list)
+}
+
+// topDomains returns the top n hosts sorted by total traffic
+func topDomains(n int) []hostStats {
+	var hosts []hostStats
+	trafficStats.Range(func(key, value interface{}) bool {
+		s := value.(*hostStats)
+		hosts = append(hosts, hostStats{
+			Host:  s.Host,
+			Up:    atomic.LoadInt64(&s.Up),
+			Down:  atomic.LoadInt64(&s.Down),
+			Conns: atomic.LoadInt64(&s.Conns),
+		})
+		return true
+	})
+
+	sort.Slice(hosts, func(i, j int) bool {
+		return hosts[i].Up+hosts[i].Down > hosts[j].Up+hosts[j].Down
+	})
+
+	if n > 0 && len(hosts) > n {
+		hosts = hosts[:n]
+	}
+
+	return hosts
+}
+
+// handleTopDomains serves the "top domains" view: /stats/domains?n=20
+func handleTopDomains(w http.ResponseWriter, r *http.Request) {
+	n, err := strconv.Atoi(r.URL.Query().Get("n"))
+	if err != nil {
+		n = 20
+	}
+
+	writeJSON(w, topDomains(n))
+}
+
+// relayStats relays between the local conn c and the remote conn rc, and records the traffic of tgt.
+// for https traffic to ip destinations(e.g. redir), the server name sniffed from the first data
+// of the client(the tls client hello) is recorded instead, without waiting for it.
+func relayStats(c, rc net.Conn, tgt string) error {
+	f := addFlow(c, rc, tgt)
+	defer removeFlow(f)
+
+	rs, err := relay(&flowConn{Conn: c, f: f, sniff: true}, &flowConn{Conn: rc, f: f})
+
+	var sni string
+	if net.ParseIP(dstHost(tgt)) != nil {
+		sni = f.serverName()
+	}
+	addTraffic(tgt, sni, rs.Up, rs.Down)
+	addProtoTraffic(f.protocol(), rs.Up, rs.Down)
+
+	result := resultOfRelay(c, err)
+	addResult(result)
+
+	logf("proxy-relay %s <-> %s closed: %s, up %d, down %d, duration %s", f.src, tgt, result, rs.Up, rs.Down, rs.Duration.Round(time.Millisecond))
+
+	return err
+}
@@ -2,15 +2,32 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"io"
 	"net"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// StrategyConfig is the config of strategy dialers
+type StrategyConfig struct {
+	Strategy      string
+	CheckWebSite  string
+	CheckDuration int
+	CheckUDP      string
+	CheckTimeout  int
+	MaxFailures   int
+	Tolerance     int
+	RetryTTL      int
+	LearnTTL      int
+	Schedule      []string
+}
+
 // NewStrategyDialer returns a new Strategy Dialer
-func NewStrategyDialer(strategy string, dialers []Dialer, website string, interval int) Dialer {
+func NewStrategyDialer(dialers []Dialer, s *StrategyConfig) Dialer {
 	if len(dialers) == 0 {
 		return Direct
 	}
@@ -19,85 +36,493 @@ func NewStrategyDialer(strategy string, dialers []Dialer, website string, interv
 		return dialers[0]
 	}
 
+	if len(s.Schedule) > 0 && (s.Strategy == "rr" || s.Strategy == "ha") {
+		logf("forward to remote servers in %s mode, switched by the schedule.", s.Strategy)
+		return newSchedDialer(dialers, s)
+	}
+
 	var dialer Dialer
-	switch strategy {
+	switch s.Strategy {
 	case "rr":
-		dialer = newRRDialer(dialers, website, interval)
+		dialer = newRRDialer(dialers, s)
 		logf("forward to remote servers in round robin mode.")
 	case "ha":
-		dialer = newHADialer(dialers, website, interval)
+		dialer = newHADialer(dialers, s)
 		logf("forward to remote servers in high availability mode.")
+	case "lha":
+		dialer = newLHADialer(dialers, s)
+		logf("forward to remote servers in latency based high availability mode.")
+	case "dh":
+		dialer = newHashDialer(dialers, s, false)
+		logf("forward to remote servers in destination hashing mode.")
+	case "sh":
+		dialer = newHashDialer(dialers, s, true)
+		logf("forward to remote servers in source hashing mode.")
 	default:
-		logf("not supported forward mode '%s', just use the first forward server.", conf.Strategy)
+		logf("not supported forward mode '%s', just use the first forward server.", s.Strategy)
 		dialer = dialers[0]
 	}
 
 	return dialer
 }
 
+// validateChecks checks the options of the forwarder checks
+func validateChecks(s *StrategyConfig) error {
+	if s.CheckTimeout <= 0 || s.MaxFailures <= 0 {
+		return errors.New("checktimeout and maxfailures must be positive")
+	}
+	if s.Tolerance < 0 {
+		return errors.New("tolerance must not be negative")
+	}
+	return nil
+}
+
 // rrDialer is the base struct of strategy dialer
 type rrDialer struct {
 	dialers []Dialer
-	idx     int
+	index   map[Dialer]int // dialer -> idx
+	idx     uint32         // index of the current dialer, atomic
+	pref    uint32         // index of the preferred dialer of ha, failed back to when enabled, atomic
+	next    uint32         // round robin counter, atomic
+
+	// status of dialers, 1: enabled, 0: disabled, atomic
+	status []uint32
+
+	// consecutive failed checks of dialers, a dialer is disabled after maxFails, atomic
+	fails []uint32
+
+	// moving average of the check duration of dialers in nanoseconds, 0 if not checked yet, atomic
+	rtt []int64
+
+	// 1: the dialer has passed a check, 0: pending(e.g. the wan is not up yet at startup), atomic
+	ready []uint32
+
+	// the status checked by the peer of a HA pair, 0: unknown, 1: enabled, 2: disabled, atomic,
+	// used while pending, see hapeer.go
+	peer []uint32
 
-	status sync.Map
+	// 1: the dialer is being drained, updated when rebuilt, see drain.go, atomic
+	drained []uint32
+
+	// wakes up the checks, e.g. after the interface addresses changed
+	wake []chan struct{}
+
+	// weights and priorities of dialers, see weight.go
+	weight   []int
+	priority []int
+
+	// precomputed indexes of the enabled dialers with the highest priority(top), and them repeated
+	// by the weights for rr, rebuilt when the status changes, so the selection is O(1) even with
+	// hundreds of dialers.
+	mu    sync.Mutex
+	avail atomic.Value // []int
+	slots atomic.Value // []int
+	top   int64        // atomic
+
+	// lha: the current dialer is switched to the fastest one when rebuilt or checked,
+	// unless it's slower within tolerance
+	lha       bool
+	tolerance time.Duration
 
 	// for checking
 	website  string
+	dialOnly bool // tcp://HOST:PORT, only the connection via the dialer is checked
 	interval int
+	timeout  time.Duration
+	maxFails uint32
+	udpDNS   string // dns server to check the udp relay of ss forwarders
+
+	// for retrying and learning, dstHost -> *dstEntry
+	retryTTL time.Duration
+	learnTTL time.Duration
+	dstMap   sync.Map
+}
+
+// rrDialers is the registry of strategy dialers, for dumping the states
+var rrDialers struct {
+	sync.Mutex
+	list []*rrDialer
+}
+
+// checkSlots limits the forwarder checks running at the same time, they all start
+// at once with long subscription lists.
+var checkSlots = make(chan struct{}, 64)
+
+// the defaults of the check timeout(seconds), so a stalled forwarder doesn't hold the slot,
+// and the failed checks to disable a forwarder
+const (
+	defaultCheckTimeout = 30
+	defaultMaxFailures  = 1
+)
+
+// defaultTolerance is the tolerance of lha in milliseconds
+const defaultTolerance = 50
+
+// checkTCPPrefix is the prefix of checkwebsite to check the connection only, without a http request
+const checkTCPPrefix = "tcp://"
+
+// dstEntry remembers the dialer which works for a destination
+type dstEntry struct {
+	idx    int
+	expire time.Time
 }
 
 // newRRDialer returns a new rrDialer
-func newRRDialer(dialers []Dialer, website string, interval int) *rrDialer {
-	rr := &rrDialer{dialers: dialers}
+func newRRDialer(dialers []Dialer, s *StrategyConfig) *rrDialer {
+	rr := &rrDialer{
+		dialers: dialers,
+		index:   make(map[Dialer]int, len(dialers)),
+		status:  make([]uint32, len(dialers)),
+		fails:   make([]uint32, len(dialers)),
+		rtt:     make([]int64, len(dialers)),
+		ready:   make([]uint32, len(dialers)),
+		peer:    make([]uint32, len(dialers)),
+		drained: make([]uint32, len(dialers)),
+		wake:    make([]chan struct{}, len(dialers)),
+
+		weight:   make([]int, len(dialers)),
+		priority: make([]int, len(dialers)),
+	}
 
-	rr.website = website
-	rr.interval = interval
+	rr.website = s.CheckWebSite
+	if strings.HasPrefix(rr.website, checkTCPPrefix) {
+		rr.website, rr.dialOnly = strings.TrimPrefix(rr.website, checkTCPPrefix), true
+	}
+	rr.interval = s.CheckDuration
+	rr.timeout = time.Duration(s.CheckTimeout) * time.Second
+	if rr.timeout <= 0 {
+		rr.timeout = defaultCheckTimeout * time.Second
+	}
+	rr.maxFails = uint32(s.MaxFailures)
+	if rr.maxFails == 0 {
+		rr.maxFails = defaultMaxFailures
+	}
+	rr.udpDNS = s.CheckUDP
+	rr.retryTTL = time.Duration(s.RetryTTL) * time.Second
+	rr.learnTTL = time.Duration(s.LearnTTL) * time.Second
+
+	for k, d := range dialers {
+		// the first one wins if a dialer is listed more than once
+		if _, ok := rr.index[d]; !ok {
+			rr.index[d] = k
+		}
+		rr.status[k] = 1
+		rr.wake[k] = make(chan struct{}, 1)
+
+		o := optsOf(d)
+		rr.weight[k], rr.priority[k] = o.weight, o.priority
+	}
+	rr.rebuild()
 
 	for k := range dialers {
-		rr.status.Store(k, true)
 		go rr.checkDialer(k)
 	}
 
+	rrDialers.Lock()
+	rrDialers.list = append(rrDialers.list, rr)
+	rrDialers.Unlock()
+
 	return rr
 }
 
+// enabled reports whether the dialer at idx is enabled and not being drained
+func (rr *rrDialer) enabled(idx int) bool {
+	return atomic.LoadUint32(&rr.status[idx]) == 1 && atomic.LoadUint32(&rr.drained[idx]) == 0
+}
+
+// usable reports whether the dialer at idx is enabled and in the highest priority
+func (rr *rrDialer) usable(idx int) bool {
+	return rr.enabled(idx) && int64(rr.priority[idx]) == atomic.LoadInt64(&rr.top)
+}
+
+// setStatus sets the status of the dialer at idx, and rebuilds the selection table if changed
+func (rr *rrDialer) setStatus(idx int, enabled bool) {
+	var v uint32
+	if enabled {
+		v = 1
+	}
+
+	if atomic.SwapUint32(&rr.status[idx], v) != v {
+		rr.rebuild()
+	}
+}
+
+// rebuild recomputes the indexes of the enabled dialers with the highest priority
+func (rr *rrDialer) rebuild() {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+
+	avail := make([]int, 0, len(rr.dialers))
+	for k, d := range rr.dialers {
+		var drained uint32
+		if isDraining(d.Addr()) {
+			drained = 1
+		}
+		atomic.StoreUint32(&rr.drained[k], drained)
+
+		if !rr.enabled(k) {
+			continue
+		}
+
+		if len(avail) > 0 && rr.priority[k] != rr.priority[avail[0]] {
+			if rr.priority[k] < rr.priority[avail[0]] {
+				continue
+			}
+			avail = avail[:0]
+		}
+		avail = append(avail, k)
+	}
+
+	if len(avail) > 0 {
+		top := int64(rr.priority[avail[0]])
+		if old := atomic.SwapInt64(&rr.top, top); old != top && rr.avail.Load() != nil {
+			logf("proxy-strategy switched to the forwarders with priority %d, %d available", top, len(avail))
+		}
+	}
+	rr.avail.Store(avail)
+	rr.slots.Store(weightedSlots(avail, rr.weight))
+
+	if rr.lha {
+		rr.pickFastest()
+	}
+}
+
+// pickFastest switches the current dialer to the enabled one with the lowest check rtt, unless
+// the current one is enabled and slower within tolerance, so it doesn't flap. rr.mu must be held.
+func (rr *rrDialer) pickFastest() {
+	best, bestRTT := -1, int64(0)
+	for _, k := range rr.avail.Load().([]int) {
+		if v := atomic.LoadInt64(&rr.rtt[k]); v > 0 && (best < 0 || v < bestRTT) {
+			best, bestRTT = k, v
+		}
+	}
+
+	// none checked yet
+	if best < 0 {
+		return
+	}
+
+	cur := rr.current()
+	if cur == best {
+		return
+	}
+
+	curRTT := atomic.LoadInt64(&rr.rtt[cur])
+	if rr.usable(cur) && curRTT > 0 && time.Duration(curRTT-bestRTT) <= rr.tolerance {
+		return
+	}
+
+	atomic.StoreUint32(&rr.idx, uint32(best))
+	logf("proxy-lha switched from %s(%s) to %s(%s)", rr.dialers[cur].Addr(), time.Duration(curRTT), rr.dialers[best].Addr(), time.Duration(bestRTT))
+}
+
+// disable disables the dialer at idx after a failed check, but the status from the peer is
+// kept while pending, e.g. the wan of the standby router is down. A ready dialer is disabled
+// after maxFails consecutive failed checks, reports false if the failure is tolerated.
+func (rr *rrDialer) disable(idx int) bool {
+	if rr.pending(idx) {
+		if atomic.LoadUint32(&rr.peer[idx]) == 0 {
+			rr.setStatus(idx, false)
+		}
+		return true
+	}
+
+	if atomic.AddUint32(&rr.fails[idx], 1) < rr.maxFails {
+		return false
+	}
+	rr.setStatus(idx, false)
+	return true
+}
+
+// enable enables the dialer at idx after a passed check in rtt
+func (rr *rrDialer) enable(idx int, rtt time.Duration) {
+	atomic.StoreUint32(&rr.fails[idx], 0)
+	addEWMA(&rr.rtt[idx], rtt)
+	rr.setStatus(idx, true)
+	atomic.StoreUint32(&rr.ready[idx], 1)
+
+	if rr.lha {
+		rr.mu.Lock()
+		rr.pickFastest()
+		rr.mu.Unlock()
+	}
+}
+
+// pending reports whether the dialer at idx has never passed a check
+func (rr *rrDialer) pending(idx int) bool {
+	return atomic.LoadUint32(&rr.ready[idx]) == 0
+}
+
+// recheck marks all the dialers as pending and wakes up their checks,
+// so they are rechecked at once and retried quickly until passed again.
+func (rr *rrDialer) recheck() {
+	for k := range rr.dialers {
+		atomic.StoreUint32(&rr.ready[k], 0)
+		select {
+		case rr.wake[k] <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// current returns the index of the current dialer
+func (rr *rrDialer) current() int {
+	return int(atomic.LoadUint32(&rr.idx))
+}
+
 func (rr *rrDialer) Addr() string { return "STRATEGY" }
 func (rr *rrDialer) Dial(network, addr string) (net.Conn, error) {
-	return rr.NextDialer(addr).Dial(network, addr)
+	return rr.DialVia(network, addr, "")
+}
+
+// DialVia dials addr with the via chain
+func (rr *rrDialer) DialVia(network, addr, via string) (net.Conn, error) {
+	d := rr.NextDialer(addr)
+	c, err := dialVia(d, network, addr, via)
+	return rr.dialed(network, addr, via, d, c, err)
+}
+
+// dialed handles the dial result of d: learns the outcome, and retries via other
+// dialers if the destination is unreachable.
+func (rr *rrDialer) dialed(network, addr, via string, d Dialer, c net.Conn, err error) (net.Conn, error) {
+	if err == nil {
+		rr.learn(addr, d)
+		return trackUpstream(d.Addr(), c), nil
+	}
+
+	rr.forget(addr, d)
+
+	if rr.retryTTL > 0 && isUnreachable(err) {
+		return rr.retryDial(network, addr, via, d, err)
+	}
+
+	return c, err
 }
 
 func (rr *rrDialer) DialUDP(network, addr string) (pc net.PacketConn, writeTo net.Addr, err error) {
-	return rr.NextDialer(addr).DialUDP(network, addr)
+	return dialUDPTracked(rr.NextDialer(addr), network, addr)
 }
 
-func (rr *rrDialer) NextDialer(dstAddr string) Dialer {
-	n := len(rr.dialers)
-	if n == 1 {
-		rr.idx = 0
+// dialUDPTracked dials a udp session via d, tracked for draining
+func dialUDPTracked(d Dialer, network, addr string) (net.PacketConn, net.Addr, error) {
+	pc, writeTo, err := d.DialUDP(network, addr)
+	if err != nil {
+		return pc, writeTo, err
 	}
+	return trackUpstreamPacket(d.Addr(), pc), writeTo, nil
+}
 
-	found := false
-	for i := 0; i < n; i++ {
-		rr.idx = (rr.idx + 1) % n
-		result, ok := rr.status.Load(rr.idx)
-		if ok && result.(bool) {
-			found = true
-			break
-		}
+func (rr *rrDialer) NextDialer(dstAddr string) Dialer {
+	if d := rr.learnedDialer(dstAddr); d != nil {
+		return d
 	}
 
-	if !found {
+	n := atomic.AddUint32(&rr.next, 1)
+
+	slots := rr.slots.Load().([]int)
+	if len(slots) == 0 {
 		logf("NO AVAILABLE PROXY FOUND! please check your network or proxy server settings.")
+		idx := int(n % uint32(len(rr.dialers)))
+		atomic.StoreUint32(&rr.idx, uint32(idx))
+		return rr.dialers[idx]
+	}
+
+	idx := slots[n%uint32(len(slots))]
+	atomic.StoreUint32(&rr.idx, uint32(idx))
+	return rr.dialers[idx]
+}
+
+// dstHost returns the host part of dstAddr, so all ports of a destination share the same entry.
+func dstHost(dstAddr string) string {
+	host, _, err := net.SplitHostPort(dstAddr)
+	if err != nil {
+		return dstAddr
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		return normalizeIP(ip).String()
+	}
+	return host
+}
+
+// learn remembers d worked for dstAddr for learnTTL.
+func (rr *rrDialer) learn(dstAddr string, d Dialer) {
+	if rr.learnTTL == 0 {
+		return
+	}
+
+	if k, ok := rr.index[d]; ok {
+		rr.dstMap.Store(dstHost(dstAddr), &dstEntry{idx: k, expire: time.Now().Add(rr.learnTTL)})
+	}
+}
+
+// forget removes the learned entry for dstAddr if it points to the failed dialer d.
+func (rr *rrDialer) forget(dstAddr string, d Dialer) {
+	host := dstHost(dstAddr)
+	if v, ok := rr.dstMap.Load(host); ok && rr.dialers[v.(*dstEntry).idx] == d {
+		rr.dstMap.Delete(host)
+	}
+}
+
+// learnedDialer returns the remembered available dialer for dstAddr, nil if not found or expired.
+func (rr *rrDialer) learnedDialer(dstAddr string) Dialer {
+	if rr.retryTTL == 0 && rr.learnTTL == 0 {
+		return nil
+	}
+
+	host := dstHost(dstAddr)
+	v, ok := rr.dstMap.Load(host)
+	if !ok {
+		return nil
+	}
+
+	e := v.(*dstEntry)
+	if time.Now().After(e.expire) {
+		rr.dstMap.Delete(host)
+		return nil
+	}
+
+	if rr.enabled(e.idx) {
+		return rr.dialers[e.idx]
+	}
+
+	return nil
+}
+
+// retryDial tries other available dialers when the failed dialer can not reach addr,
+// and remembers the working one for retryTTL.
+func (rr *rrDialer) retryDial(network, addr, via string, failed Dialer, err error) (net.Conn, error) {
+	for k, d := range rr.dialers {
+		if d == failed {
+			continue
+		}
+
+		if !rr.enabled(k) {
+			continue
+		}
+
+		c, e := dialVia(d, network, addr, via)
+		if e != nil {
+			logf("proxy-strategy retry %s via %s error: %s", addr, d.Addr(), e)
+			continue
+		}
+
+		ttl := rr.retryTTL
+		if rr.learnTTL > ttl {
+			ttl = rr.learnTTL
+		}
+		rr.dstMap.Store(dstHost(addr), &dstEntry{idx: k, expire: time.Now().Add(ttl)})
+		logf("proxy-strategy %s unreachable via %s, use %s instead for %s", addr, failed.Addr(), d.Addr(), ttl)
+
+		return trackUpstream(d.Addr(), c), nil
 	}
 
-	return rr.dialers[rr.idx]
+	return nil, err
 }
 
 // Check dialer
 func (rr *rrDialer) checkDialer(idx int) {
 	retry := 1
-	buf := make([]byte, 4)
 
 	if strings.IndexByte(rr.website, ':') == -1 {
 		rr.website = rr.website + ":80"
@@ -105,70 +530,254 @@ func (rr *rrDialer) checkDialer(idx int) {
 
 	d := rr.dialers[idx]
 
+	// retry quickly with backoff until the first successful check,
+	// so the forwarders are ready soon after the network is up.
+	bo := &backoff{min: time.Second, max: time.Duration(rr.interval) * time.Second}
+
+	var dialErr error // the error of the last check while pending
 	for {
-		time.Sleep(time.Duration(rr.interval) * time.Second * time.Duration(retry>>1))
+		wait := time.Duration(rr.interval) * time.Second * time.Duration(retry>>1)
+		if rr.pending(idx) {
+			wait = bo.next()
+			if dialErr != nil {
+				logf("proxy-check %s -> %s, PENDING, retry in %s. error: %s", d.Addr(), rr.website, wait, dialErr)
+				dialErr = nil
+			}
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-rr.wake[idx]:
+			bo.cur, retry = 0, 1
+		}
 		retry <<= 1
 
 		if retry > 16 {
 			retry = 16
 		}
 
+		checkSlots <- struct{}{}
 		startTime := time.Now()
-		c, err := d.Dial("tcp", rr.website)
-		if err != nil {
-			rr.status.Store(idx, false)
-			logf("proxy-check %s -> %s, set to DISABLED. error in dial: %s", d.Addr(), rr.website, err)
+		err := rr.check(d)
+		<-checkSlots
+
+		if err == nil {
+			rtt := time.Since(startTime)
+			rr.enable(idx, rtt)
+			retry = 2
+			logf("proxy-check %s -> %s, set to ENABLED. connect time: %s", d.Addr(), rr.website, rtt)
 			continue
 		}
 
+		if !rr.disable(idx) {
+			// tolerated, check again at the normal interval
+			retry = 2
+			logf("proxy-check %s -> %s, FAILED %d/%d. error: %s", d.Addr(), rr.website, atomic.LoadUint32(&rr.fails[idx]), rr.maxFails, err)
+			continue
+		}
+
+		if rr.pending(idx) {
+			dialErr = err
+			continue
+		}
+		logf("proxy-check %s -> %s, set to DISABLED. error: %s", d.Addr(), rr.website, err)
+	}
+}
+
+// check connects to the website via d and gets the http response(only connects if dialOnly),
+// and checks the udp relay of ss forwarders if udpDNS is set.
+func (rr *rrDialer) check(d Dialer) error {
+	c, err := dialTimeout(d, "tcp", rr.website, rr.timeout)
+	if err != nil {
+		return errors.New("dial: " + err.Error())
+	}
+	defer c.Close()
+
+	c.SetDeadline(time.Now().Add(rr.timeout))
+
+	if !rr.dialOnly {
+		buf := make([]byte, 4)
 		c.Write([]byte("GET / HTTP/1.0\r\n\r\n"))
+		if _, err := io.ReadFull(c, buf); err != nil {
+			return err
+		}
+		if !bytes.Equal([]byte("HTTP"), buf) {
+			return errors.New("server response: " + string(buf))
+		}
+	}
 
-		_, err = io.ReadFull(c, buf)
-		if err != nil {
-			rr.status.Store(idx, false)
-			logf("proxy-check %s -> %s, set to DISABLED. error in read: %s", d.Addr(), rr.website, err)
-		} else if bytes.Equal([]byte("HTTP"), buf) {
-			rr.status.Store(idx, true)
-			retry = 2
-			dialTime := time.Since(startTime)
-			logf("proxy-check %s -> %s, set to ENABLED. connect time: %s", d.Addr(), rr.website, dialTime.String())
-		} else {
-			rr.status.Store(idx, false)
-			logf("proxy-check %s -> %s, set to DISABLED. server response: %s", d.Addr(), rr.website, buf)
+	if _, ok := d.(*direct); ok && conf.DirectCheck {
+		if err := probeDirect(); err != nil {
+			return err
 		}
+	}
+
+	if rr.udpDNS != "" {
+		if _, ok := unwrapDialer(d).(*SS); ok {
+			if err := probeUDP(d, rr.udpDNS, dstHost(rr.website)); err != nil {
+				return errors.New("udp check via " + rr.udpDNS + ": " + err.Error())
+			}
+		}
+	}
+
+	return nil
+}
+
+// dialTimeout dials addr via d within timeout, the dialers may not limit the connect time themselves,
+// e.g. a blackholed forwarder would hold a check slot until the connect timeout of the os.
+// A conn dialed after the timeout is closed.
+func dialTimeout(d Dialer, network, addr string, timeout time.Duration) (net.Conn, error) {
+	type dialed struct {
+		c   net.Conn
+		err error
+	}
 
-		c.Close()
+	ch := make(chan dialed, 1)
+	go func() {
+		c, err := d.Dial(network, addr)
+		ch <- dialed{c, err}
+	}()
+
+	select {
+	case r := <-ch:
+		return r.c, r.err
+	case <-time.After(timeout):
+		go func() {
+			if r := <-ch; r.c != nil {
+				r.c.Close()
+			}
+		}()
+		return nil, &net.OpError{Op: "dial", Net: network, Err: errCheckTimeout}
 	}
 }
 
+// errCheckTimeout is the error of a check dial not finished in time
+var errCheckTimeout = &checkTimeoutError{}
+
+type checkTimeoutError struct{}
+
+func (e *checkTimeoutError) Error() string   { return "timeout" }
+func (e *checkTimeoutError) Timeout() bool   { return true }
+func (e *checkTimeoutError) Temporary() bool { return true }
+
 // high availability proxy
 type haDialer struct {
 	*rrDialer
 }
 
 // newHADialer .
-func newHADialer(dialers []Dialer, webhost string, duration int) Dialer {
-	return &haDialer{rrDialer: newRRDialer(dialers, webhost, duration)}
+func newHADialer(dialers []Dialer, s *StrategyConfig) Dialer {
+	return &haDialer{rrDialer: newRRDialer(dialers, s)}
 }
 
 func (ha *haDialer) Dial(network, addr string) (net.Conn, error) {
-	d := ha.dialers[ha.idx]
+	return ha.DialVia(network, addr, "")
+}
 
-	result, ok := ha.status.Load(ha.idx)
-	if ok && !result.(bool) {
-		d = ha.NextDialer(addr)
+// DialVia dials addr with the via chain
+func (ha *haDialer) DialVia(network, addr, via string) (net.Conn, error) {
+	d := ha.NextDialer(addr)
+	c, err := dialVia(d, network, addr, via)
+	return ha.dialed(network, addr, via, d, c, err)
+}
+
+func (ha *haDialer) DialUDP(network, addr string) (pc net.PacketConn, writeTo net.Addr, err error) {
+	d := ha.learnedDialer(addr)
+	if d == nil {
+		d = ha.dialers[ha.primary()]
 	}
+	return dialUDPTracked(d, network, addr)
+}
 
-	return d.Dial(network, addr)
+// NextDialer returns the learned dialer of dstAddr, or the current dialer.
+func (ha *haDialer) NextDialer(dstAddr string) Dialer {
+	if d := ha.learnedDialer(dstAddr); d != nil {
+		return d
+	}
+	return ha.dialers[ha.primary()]
 }
 
-func (ha *haDialer) DialUDP(network, addr string) (pc net.PacketConn, writeTo net.Addr, err error) {
-	d := ha.dialers[ha.idx]
+// primary returns the index of the preferred dialer if enabled, otherwise the first enabled one
+// after it in the order of the forwarders, so it fails over and back by the checks.
+func (ha *haDialer) primary() int {
+	cur, pref := ha.current(), int(atomic.LoadUint32(&ha.pref))
+	if cur == pref && ha.usable(cur) {
+		return cur
+	}
 
-	result, ok := ha.status.Load(ha.idx)
-	if ok && !result.(bool) {
-		d = ha.NextDialer(addr)
+	avail := ha.avail.Load().([]int)
+	if len(avail) == 0 {
+		logf("NO AVAILABLE PROXY FOUND! please check your network or proxy server settings.")
+		return cur
+	}
+
+	// avail is in the order of the forwarders, find the first one from pref
+	i := sort.SearchInts(avail, pref)
+	if i == len(avail) {
+		i = 0
+	}
+
+	if atomic.SwapUint32(&ha.idx, uint32(avail[i])) != uint32(avail[i]) {
+		logf("proxy-ha switched from %s to %s", ha.dialers[cur].Addr(), ha.dialers[avail[i]].Addr())
+	}
+	return avail[i]
+}
+
+// lhaDialer is the latency based high availability strategy, it uses the enabled dialer with
+// the lowest check rtt, and switches only when another one is faster by more than the tolerance.
+type lhaDialer struct {
+	*rrDialer
+}
+
+// newLHADialer returns a new lhaDialer
+func newLHADialer(dialers []Dialer, s *StrategyConfig) Dialer {
+	rr := newRRDialer(dialers, s)
+
+	rr.mu.Lock()
+	rr.lha = true
+	rr.tolerance = time.Duration(s.Tolerance) * time.Millisecond
+	rr.mu.Unlock()
+
+	return &lhaDialer{rrDialer: rr}
+}
+
+func (lha *lhaDialer) Dial(network, addr string) (net.Conn, error) {
+	return lha.DialVia(network, addr, "")
+}
+
+// DialVia dials addr with the via chain
+func (lha *lhaDialer) DialVia(network, addr, via string) (net.Conn, error) {
+	d := lha.NextDialer(addr)
+	c, err := dialVia(d, network, addr, via)
+	return lha.dialed(network, addr, via, d, c, err)
+}
+
+func (lha *lhaDialer) DialUDP(network, addr string) (pc net.PacketConn, writeTo net.Addr, err error) {
+	return dialUDPTracked(lha.NextDialer(addr), network, addr)
+}
+
+// NextDialer returns the learned dialer of dstAddr, or the current dialer.
+func (lha *lhaDialer) NextDialer(dstAddr string) Dialer {
+	if d := lha.learnedDialer(dstAddr); d != nil {
+		return d
+	}
+	return lha.dialers[lha.primary()]
+}
+
+// primary returns the index of the current dialer if enabled, the fastest one is picked by the checks,
+// before the first checks it's the first enabled one.
+func (lha *lhaDialer) primary() int {
+	cur := lha.current()
+	if lha.usable(cur) {
+		return cur
+	}
+
+	avail := lha.avail.Load().([]int)
+	if len(avail) == 0 {
+		logf("NO AVAILABLE PROXY FOUND! please check your network or proxy server settings.")
+		return cur
 	}
 
-	return d.DialUDP(network, addr)
+	atomic.StoreUint32(&lha.idx, uint32(avail[0]))
+	return avail[0]
 }
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// blackholeDialer never answers, like a forwarder whose packets are dropped
+type blackholeDialer struct {
+	release chan struct{}
+}
+
+func (d *blackholeDialer) Addr() string { return "blackhole" }
+
+func (d *blackholeDialer) Dial(network, addr string) (net.Conn, error) {
+	<-d.release
+	c1, c2 := net.Pipe()
+	c2.Close()
+	return c1, nil
+}
+
+func (d *blackholeDialer) DialUDP(network, addr string) (net.PacketConn, net.Addr, error) {
+	return nil, nil, nil
+}
+
+func (d *blackholeDialer) NextDialer(dstAddr string) Dialer { return d }
+
+func TestCheckDialTimeout(t *testing.T) {
+	d := &blackholeDialer{release: make(chan struct{})}
+	defer close(d.release)
+
+	rr := &rrDialer{website: "192.0.2.1:443", timeout: 100 * time.Millisecond, dialOnly: true}
+
+	start := time.Now()
+	err := rr.check(d)
+	if err == nil {
+		t.Fatal("check via a non-answering dialer succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("check took %s, want about the check timeout %s", elapsed, rr.timeout)
+	}
+}
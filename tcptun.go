@@ -23,7 +23,7 @@ func NewTCPTun(addr, raddr string, sDialer Dialer) (*TCPTun, error) {
 
 // ListenAndServe .
 func (s *TCPTun) ListenAndServe() {
-	l, err := net.Listen("tcp", s.addr)
+	l, err := listen("tcp", s.addr)
 	if err != nil {
 		logf("failed to listen on %s: %v", s.addr, err)
 		return
@@ -31,38 +31,53 @@ func (s *TCPTun) ListenAndServe() {
 
 	logf("listening TCP on %s", s.addr)
 
+	b := budgetOf(s.addr)
 	for {
 		c, err := l.Accept()
 		if err != nil {
+			if isClosed(err) {
+				return
+			}
 			logf("failed to accept: %v", err)
 			continue
 		}
 
-		go func() {
-			defer c.Close()
+		if !b.acquireConn() {
+			logf("proxy-tcptun %s rejected, too many connections on %s", c.RemoteAddr(), s.addr)
+			c.Close()
+			continue
+		}
 
-			if c, ok := c.(*net.TCPConn); ok {
-				c.SetKeepAlive(true)
-			}
+		go func() {
+			defer b.releaseConn()
+			s.ServeTCP(b.limit(c))
+		}()
+	}
+}
 
-			rc, err := s.sDialer.Dial("tcp", s.raddr)
-			if err != nil {
+// ServeTCP relays a connection to the remote address.
+func (s *TCPTun) ServeTCP(c net.Conn) {
+	defer c.Close()
 
-				logf("failed to connect to target: %v", err)
-				return
-			}
-			defer rc.Close()
+	if c, ok := c.(*net.TCPConn); ok {
+		c.SetKeepAlive(true)
+	}
 
-			logf("proxy-tcptun %s <-> %s", c.RemoteAddr(), s.raddr)
+	rc, err := s.sDialer.Dial("tcp", s.raddr)
+	if err != nil {
+		logf("failed to connect to target: %v", err)
+		addResult(resultOfDial(err))
+		return
+	}
+	defer rc.Close()
 
-			_, _, err = relay(c, rc)
-			if err != nil {
-				if err, ok := err.(net.Error); ok && err.Timeout() {
-					return // ignore i/o timeout
-				}
-				logf("relay error: %v", err)
-			}
+	logf("proxy-tcptun %s <-> %s", c.RemoteAddr(), s.raddr)
 
-		}()
+	err = relayStats(c, rc, s.raddr)
+	if err != nil {
+		if err, ok := err.(net.Error); ok && err.Timeout() {
+			return // ignore i/o timeout
+		}
+		logf("relay error: %v", err)
 	}
 }
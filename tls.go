@@ -0,0 +1,498 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+// TLS is a tls transport, it wraps the inner protocol of a listener
+// or the next forwarder in a chain:
+//
+//	listen:  tls://:443?cert=/path/to/cert&key=/path/to/key,socks5://
+//	forward: tls://host:443?serverName=example.com&alpn=h2&alpn=http/1.1&fingerprint=chrome,socks5://host:443
+type TLS struct {
+	*Forwarder
+	sDialer Dialer
+
+	tlsConfig *tls.Config
+	tlsFP     *utls.ClientHelloID // as client, the client hello fingerprint
+	serve     func(c net.Conn)    // as server, serves the inner protocol
+}
+
+// NewTLS returns a tls transport client
+func NewTLS(addr, rawQuery string, cDialer Dialer) (*TLS, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+		addr = net.JoinHostPort(host, "443")
+	}
+
+	p, _ := url.ParseQuery(rawQuery)
+
+	s := &TLS{Forwarder: NewForwarder(addr, cDialer)}
+	if s.tlsConfig, err = tlsClientConfig(host, p); err != nil {
+		return nil, err
+	}
+	s.tlsConfig.NextProtos = p["alpn"]
+
+	// client certificate
+	if p.Get("cert") != "" {
+		cert, err := tls.LoadX509KeyPair(p.Get("cert"), p.Get("key"))
+		if err != nil {
+			return nil, errors.New("proxy-tls: load cert error: " + err.Error())
+		}
+		s.tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if s.tlsFP, err = parseFingerprint(p.Get("fingerprint")); err != nil {
+		return nil, errors.New("proxy-tls: " + err.Error())
+	}
+
+	return s, nil
+}
+
+// tlsClientConfig returns the tls config of the tls based forwarders(https, trojan, tls, wss, grpc),
+// host is the default server name, the params: serverName, sni, skipverify, ca, pin, resume, pq.
+// sni=false omits the server name in the client hello for the fronting cdns which block by sni,
+// the certificate is still verified against serverName.
+// pin=sha256/BASE64 pins the sha256 hash of the SPKI or the whole certificate of the server chain,
+// so MITM of the upstream is still detected with skipverify, it can be set multiple times for rotation.
+// The sessions are cached for resumption to save a round trip of the full handshakes, resume=false
+// disables it, e.g. the session tickets should not link the connections. crypto/tls has no 0-RTT
+// early data over tcp, see quic for it.
+func tlsClientConfig(host string, p url.Values) (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: p.Get("skipverify") == "true",
+	}
+
+	if v := p.Get("serverName"); v != "" {
+		config.ServerName = v
+	}
+
+	if ca := p.Get("ca"); ca != "" {
+		var err error
+		if config.RootCAs, err = loadCertPool(ca); err != nil {
+			return nil, err
+		}
+	}
+
+	var verifiers []func(cs tls.ConnectionState) error
+
+	// verify manually as crypto/tls can not verify without the server name
+	if p.Get("sni") == "false" {
+		name, skip := config.ServerName, config.InsecureSkipVerify
+		config.ServerName, config.InsecureSkipVerify = "", true
+		if !skip {
+			verifiers = append(verifiers, func(cs tls.ConnectionState) error {
+				return verifyChain(cs.PeerCertificates, name, config.RootCAs)
+			})
+		}
+	}
+
+	if pins := p["pin"]; len(pins) > 0 {
+		pinned := make(map[string]bool)
+		for _, pin := range pins {
+			b, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(pin, "sha256/"))
+			if !strings.HasPrefix(pin, "sha256/") || err != nil || len(b) != sha256.Size {
+				return nil, errors.New("invalid pin '" + pin + "', format: sha256/BASE64")
+			}
+			pinned[string(b)] = true
+		}
+		verifiers = append(verifiers, func(cs tls.ConnectionState) error {
+			return verifyPins(cs.PeerCertificates, pinned)
+		})
+	}
+
+	if len(verifiers) > 0 {
+		config.VerifyConnection = func(cs tls.ConnectionState) error {
+			for _, verify := range verifiers {
+				if err := verify(cs); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+
+	if p.Get("resume") != "false" {
+		config.ClientSessionCache = tls.NewLRUClientSessionCache(64)
+	}
+
+	if p.Get("pq") == "true" {
+		preferPQ(config)
+	}
+
+	return config, nil
+}
+
+// tlsX25519MLKEM768 is the post-quantum hybrid key exchange X25519 + ML-KEM-768(Kyber),
+// supported by crypto/tls since go 1.24, the handshakes fail with older versions.
+const tlsX25519MLKEM768 tls.CurveID = 0x11ec
+
+// preferPQ prefers the post-quantum hybrid key exchange, the classic ones are kept for the peers without it.
+// It's an option of the tls transports(pq=true) for long-term confidentiality: the recorded traffic
+// can not be decrypted by a future quantum computer.
+func preferPQ(c *tls.Config) {
+	curves := c.CurvePreferences
+	if len(curves) == 0 {
+		curves = []tls.CurveID{tls.X25519, tls.CurveP256, tls.CurveP384}
+	}
+	c.CurvePreferences = append([]tls.CurveID{tlsX25519MLKEM768}, curves...)
+}
+
+// verifyChain verifies the certificate chain against name with roots, the system roots if nil
+func verifyChain(certs []*x509.Certificate, name string, roots *x509.CertPool) error {
+	if len(certs) == 0 {
+		return newError(ErrAuth, "tls: no certificate from the server")
+	}
+
+	opts := x509.VerifyOptions{DNSName: name, Roots: roots, Intermediates: x509.NewCertPool()}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+
+	if _, err := certs[0].Verify(opts); err != nil {
+		return wrapError(ErrAuth, "tls: verify certificate of "+name+" error", err)
+	}
+	return nil
+}
+
+// verifyPins checks that a certificate in the chain matches a pin, by its SPKI or the whole certificate.
+// It's checked on the resumed connections too, with the certificates of the session.
+func verifyPins(certs []*x509.Certificate, pinned map[string]bool) error {
+	for _, cert := range certs {
+		spki := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		whole := sha256.Sum256(cert.Raw)
+		if pinned[string(spki[:])] || pinned[string(whole[:])] {
+			return nil
+		}
+	}
+	return newError(ErrAuth, "tls: no certificate of the server matches the pins")
+}
+
+// NewTLSServer returns a tls transport server which serves the inner protocol
+func NewTLSServer(addr, rawQuery, inner string, sDialer Dialer) (*TLS, error) {
+	if inner == "" {
+		return nil, errors.New("proxy-tls: inner protocol must be specified, e.g. tls://:443?cert=x&key=y,socks5://")
+	}
+
+	p, _ := url.ParseQuery(rawQuery)
+
+	tlsConfig, err := tlsServerConfig(p)
+	if err != nil {
+		return nil, errors.New("proxy-tls: " + err.Error())
+	}
+	tlsConfig.NextProtos = p["alpn"]
+
+	s := &TLS{Forwarder: NewForwarder(addr, nil), sDialer: sDialer, tlsConfig: tlsConfig}
+
+	// verify the client certificates with ca
+	if ca := p.Get("ca"); ca != "" {
+		if s.tlsConfig.ClientCAs, err = loadCertPool(ca); err != nil {
+			return nil, err
+		}
+		s.tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	if s.serve, err = innerServer(inner, sDialer); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// tls policy presets of the listeners, see https://wiki.mozilla.org/Security/Server_Side_TLS
+var tlsPolicies = map[string]func(c *tls.Config){
+	// tls 1.3 only, the cipher suites of tls 1.3 are all modern
+	"modern": func(c *tls.Config) {
+		c.MinVersion = tls.VersionTLS13
+	},
+	// tls 1.2 with the forward secret aead suites, and tls 1.3
+	"intermediate": func(c *tls.Config) {
+		c.MinVersion = tls.VersionTLS12
+		c.CipherSuites = []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+		}
+		c.CurvePreferences = []tls.CurveID{tls.X25519, tls.CurveP256, tls.CurveP384}
+	},
+}
+
+var tlsMinVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsServerConfig returns the tls config of the tls based listeners(tls, trojan, quic), the params:
+// cert, key, ocsp: the DER encoded OCSP response to staple, they are reloaded when the files change.
+// policy: modern(tls 1.3 only) or intermediate(tls 1.2 with the aead suites), minversion: 1.0 - 1.3,
+// pq=true: prefer the post-quantum hybrid key exchange, see preferPQ.
+func tlsServerConfig(p url.Values) (*tls.Config, error) {
+	l := &tlsCertLoader{certFile: p.Get("cert"), keyFile: p.Get("key"), ocspFile: p.Get("ocsp")}
+	if err := l.load(); err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{GetCertificate: l.get}
+
+	if v := p.Get("policy"); v != "" {
+		policy, ok := tlsPolicies[v]
+		if !ok {
+			return nil, errors.New("unknown tls policy '" + v + "', available: modern intermediate")
+		}
+		policy(config)
+	}
+
+	if v := p.Get("minversion"); v != "" {
+		ver, ok := tlsMinVersions[v]
+		if !ok {
+			return nil, errors.New("invalid tls minversion '" + v + "', available: 1.0 1.1 1.2 1.3")
+		}
+		config.MinVersion = ver
+	}
+
+	if p.Get("pq") == "true" {
+		preferPQ(config)
+	}
+
+	return config, nil
+}
+
+// tlsCertLoader loads the certificate and the stapled OCSP response, reloads them when the files change,
+// so the renewed certificates and the refreshed OCSP responses(e.g. by a cron job) are used without restart.
+type tlsCertLoader struct {
+	certFile, keyFile, ocspFile string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time // the latest modification time of the files
+	checked time.Time
+}
+
+// load loads the files
+func (l *tlsCertLoader) load() error {
+	cert, err := tls.LoadX509KeyPair(l.certFile, l.keyFile)
+	if err != nil {
+		return errors.New("load cert error: " + err.Error())
+	}
+
+	if l.ocspFile != "" {
+		if cert.OCSPStaple, err = ioutil.ReadFile(l.ocspFile); err != nil {
+			return errors.New("load ocsp response error: " + err.Error())
+		}
+	}
+
+	l.cert, l.modTime = &cert, l.lastModified()
+	return nil
+}
+
+// lastModified returns the latest modification time of the files
+func (l *tlsCertLoader) lastModified() time.Time {
+	var t time.Time
+	for _, f := range []string{l.certFile, l.keyFile, l.ocspFile} {
+		if fi, err := os.Stat(f); err == nil && fi.ModTime().After(t) {
+			t = fi.ModTime()
+		}
+	}
+	return t
+}
+
+// get returns the certificate, the files are checked at most once a minute
+func (l *tlsCertLoader) get(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if time.Since(l.checked) > time.Minute {
+		l.checked = time.Now()
+		if l.lastModified().After(l.modTime) {
+			if err := l.load(); err != nil {
+				logf("proxy-tls reload %s error: %s, the old one is used", l.certFile, err)
+			} else {
+				logf("proxy-tls %s reloaded", l.certFile)
+			}
+		}
+	}
+
+	return l.cert, nil
+}
+
+// innerServer returns the serve function of the inner protocol of a transport listener(tls, quic, mux, shadowtls),
+// tcptun://HOST:PORT relays the streams to HOST:PORT, mux://,INNER serves the inner protocol in mux streams.
+func innerServer(s string, sDialer Dialer) (func(c net.Conn), error) {
+	var inner string
+	if i := strings.IndexByte(s, ','); i > 0 {
+		s, inner = s[:i], s[i+1:]
+	}
+
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+
+	var user, pass string
+	if u.User != nil {
+		user = u.User.Username()
+		pass, _ = u.User.Password()
+	}
+
+	switch u.Scheme {
+	case "mixed":
+		p, err := NewMixedProxy("", user, pass, u.RawQuery, sDialer)
+		if err != nil {
+			return nil, err
+		}
+		return p.Serve, nil
+	case "http":
+		p, err := NewHTTP("", user, pass, u.RawQuery, nil, sDialer)
+		if err != nil {
+			return nil, err
+		}
+		return p.Serve, nil
+	case "socks5":
+		p, err := NewSOCKS5("", user, pass, u.RawQuery, nil, sDialer)
+		if err != nil {
+			return nil, err
+		}
+		return p.ServeTCP, nil
+	case "socks4", "socks4a":
+		p, err := NewSOCKS4("", user, pass, u.RawQuery, true, nil, sDialer)
+		if err != nil {
+			return nil, err
+		}
+		return p.ServeTCP, nil
+	case "ss":
+		p, err := NewSS("", user, pass, u.RawQuery, nil, sDialer)
+		if err != nil {
+			return nil, err
+		}
+		return p.ServeTCP, nil
+	case "tcptun":
+		p, err := NewTCPTun("", u.Host, sDialer)
+		if err != nil {
+			return nil, err
+		}
+		return p.ServeTCP, nil
+	case "mux":
+		p, err := NewMuxServer("", u.RawQuery, inner, sDialer)
+		if err != nil {
+			return nil, err
+		}
+		return p.ServeTCP, nil
+	}
+
+	return nil, newError(ErrUnknownSchema, "inner schema '"+u.Scheme+"' not supported, available: mixed http socks5 socks4 socks4a ss tcptun mux")
+}
+
+// loadCertPool loads the pem certificates in file
+func loadCertPool(file string) (*x509.CertPool, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.New("proxy-tls: load ca error: " + err.Error())
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, errors.New("proxy-tls: no certificates in " + file)
+	}
+
+	return pool, nil
+}
+
+// ListenAndServe serves the inner protocol over tls.
+func (s *TLS) ListenAndServe() {
+	l, err := listen("tcp", s.addr)
+	if err != nil {
+		logf("proxy-tls failed to listen on %s: %v", s.addr, err)
+		return
+	}
+
+	logf("proxy-tls listening TCP on %s", s.addr)
+
+	b := budgetOf(s.addr)
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if isClosed(err) {
+				return
+			}
+			logf("proxy-tls failed to accept: %v", err)
+			continue
+		}
+
+		if !b.acquireConn() {
+			logf("proxy-tls %s rejected, too many connections on %s", c.RemoteAddr(), s.addr)
+			c.Close()
+			continue
+		}
+
+		go func() {
+			defer b.releaseConn()
+			s.ServeTCP(b.limit(c))
+		}()
+	}
+}
+
+// ServeTCP serves a tls connection.
+func (s *TLS) ServeTCP(c net.Conn) {
+	defer c.Close()
+
+	if c, ok := c.(*net.TCPConn); ok {
+		c.SetKeepAlive(true)
+	}
+
+	tc := tls.Server(c, s.tlsConfig)
+	tc.SetDeadline(time.Now().Add(handshakeTimeout()))
+	if err := tc.Handshake(); err != nil {
+		logf("proxy-tls handshake with %s error: %v", c.RemoteAddr(), err)
+		return
+	}
+	tc.SetDeadline(time.Time{})
+
+	s.serve(tc)
+}
+
+// Dial connects to the tls server, addr is decided by the next forwarder and ignored.
+func (s *TLS) Dial(network, addr string) (net.Conn, error) {
+	rc, err := s.cDialer.Dial("tcp", s.addr)
+	if err != nil {
+		logf("dial to %s error: %s", s.addr, err)
+		return nil, err
+	}
+
+	if c, ok := rc.(*net.TCPConn); ok {
+		c.SetKeepAlive(true)
+	}
+
+	tc, err := tlsClient(rc, s.tlsConfig, s.tlsFP)
+	if err != nil {
+		rc.Close()
+		logf("proxy-tls handshake with %s error: %s", s.addr, err)
+		return nil, err
+	}
+
+	return tc, nil
+}
+
+// DialUDP connects to the given address via the proxy.
+func (s *TLS) DialUDP(network, addr string) (net.PacketConn, net.Addr, error) {
+	return nil, nil, newError(ErrUDPNotSupported, "proxy-tls: udp not supported")
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// tokens stores the issued session tokens, token -> *tokenEntry
+var tokens sync.Map
+
+// tokenEntry is an issued session token
+type tokenEntry struct {
+	user   string
+	expire time.Time
+}
+
+// tokenBackend authenticates the token requests, see conf.TokenAuth
+var tokenBackend Authenticator
+
+// initTokenAuth sets up the backend to authenticate the token requests
+func initTokenAuth() error {
+	if conf.TokenAuth == "" {
+		return nil
+	}
+
+	// the passwords are sent in the token requests, so they are served over tls on their own listener,
+	// not on the api which has no authentication and may be reachable by the roaming clients then.
+	if conf.TokenListen == "" || conf.TokenCert == "" || conf.TokenKey == "" {
+		return errors.New("the tokens are issued over tls, -tokenlisten, -tokencert and -tokenkey must be set")
+	}
+
+	a, err := newAuthBackend(conf.TokenAuth)
+	if err != nil {
+		return err
+	}
+
+	tokenBackend = a
+	return nil
+}
+
+// tokenListenAndServe serves the token requests over tls on addr
+func tokenListenAndServe(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/auth/token", handleToken)
+
+	logf("token listening TCP(TLS) on %s", addr)
+	if err := http.ListenAndServeTLS(addr, conf.TokenCert, conf.TokenKey, mux); err != nil {
+		logf("token failed to listen on %s: %v", addr, err)
+	}
+}
+
+// issueToken returns a new session token for user, valid for conf.TokenTTL seconds
+func issueToken(user string) (string, time.Time) {
+	b := make([]byte, 16)
+	rand.Read(b)
+	token := hex.EncodeToString(b)
+	expire := time.Now().Add(time.Duration(conf.TokenTTL) * time.Second)
+
+	// remove the expired ones
+	tokens.Range(func(key, value interface{}) bool {
+		if time.Now().After(value.(*tokenEntry).expire) {
+			tokens.Delete(key)
+		}
+		return true
+	})
+
+	tokens.Store(token, &tokenEntry{user: user, expire: expire})
+	return token, expire
+}
+
+// tokenAuth accepts the valid session tokens as the user, from any client address,
+// falls back to the wrapped authenticator(if any).
+type tokenAuth struct {
+	Authenticator
+}
+
+func (a *tokenAuth) Auth(user, pass string) bool {
+	if v, ok := tokens.Load(user); ok {
+		if e := v.(*tokenEntry); time.Now().Before(e.expire) {
+			logf("auth token of %s accepted, expires at %s", e.user, e.expire.Format(time.RFC3339))
+			return true
+		}
+		tokens.Delete(user)
+	}
+
+	return a.Authenticator != nil && a.Authenticator.Auth(user, pass)
+}
+
+// handleToken issues a session token to the user authenticated by http basic auth:
+// curl -u USER:PASSWORD -X POST https://TOKEN_ADDR/auth/token
+func handleToken(w http.ResponseWriter, r *http.Request) {
+	if tokenBackend == nil {
+		http.Error(w, "token auth not enabled", http.StatusNotFound)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, pass, ok := r.BasicAuth()
+	if !ok || !tokenBackend.Auth(user, pass) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="glider"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		logf("token request from %s: authentication failed", r.RemoteAddr)
+		return
+	}
+
+	token, expire := issueToken(user)
+	logf("token issued to %s from %s, expires at %s", user, r.RemoteAddr, expire.Format(time.RFC3339))
+
+	writeJSON(w, struct {
+		Token  string `json:"token"`
+		Expire string `json:"expire"`
+	}{token, expire.Format(time.RFC3339)})
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/url"
+)
+
+// tor isolation modes, the streams with different socks usernames and passwords
+// are isolated on different circuits by tor(IsolateSOCKSAuth, enabled by default)
+const (
+	torIsolateNone = "none"
+	torIsolateDest = "dest" // by destination host
+	torIsolateConn = "conn" // every connection
+)
+
+// torReplies are the extended socks5 replies of tor for the onion services, with ExtendedErrors
+// in the SocksPort flags, see https://spec.torproject.org/socks-extensions.html
+var torReplies = map[byte]string{
+	0xf0: "onion service descriptor can not be found",
+	0xf1: "onion service descriptor is invalid",
+	0xf2: "onion service introduction failed",
+	0xf3: "onion service rendezvous failed",
+	0xf4: "onion service client authorization missing",
+	0xf5: "onion service client authorization incorrect",
+	0xf6: "onion service address is invalid",
+	0xf7: "onion service introduction timed out",
+}
+
+// Tor connects through the SocksPort of a local tor: tor://127.0.0.1:9050?isolation=dest,
+// the domain names are always resolved by tor so the .onion destinations can be used in rules.
+type Tor struct {
+	*Forwarder
+
+	user, pass string
+	isolation  string
+	session    string // random password of this process for the isolation
+}
+
+// NewTor returns a tor forwarder
+func NewTor(addr, user, pass, rawQuery string, cDialer Dialer) (*Tor, error) {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "9050")
+	}
+
+	s := &Tor{
+		Forwarder: NewForwarder(addr, cDialer),
+		user:      user,
+		pass:      pass,
+		session:   torRandom(),
+	}
+
+	p, _ := url.ParseQuery(rawQuery)
+	switch s.isolation = p.Get("isolation"); s.isolation {
+	case "":
+		s.isolation = torIsolateDest
+	case torIsolateNone, torIsolateDest, torIsolateConn:
+	default:
+		return nil, errors.New("proxy-tor: unknown isolation '" + s.isolation + "', available: none dest conn")
+	}
+
+	return s, nil
+}
+
+func torRandom() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// Dial connects to the address addr on the network net via tor.
+func (s *Tor) Dial(network, addr string) (net.Conn, error) {
+	user, pass := s.user, s.pass
+
+	// the credentials of the url take precedence over the isolation
+	if user == "" {
+		switch s.isolation {
+		case torIsolateDest:
+			user, _, _ = net.SplitHostPort(addr)
+			pass = s.session
+		case torIsolateConn:
+			user, pass = "glider", torRandom()
+		}
+	}
+
+	socks5, err := NewSOCKS5(s.addr, user, pass, "", s.cDialer, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return socks5.Dial(network, addr)
+}
+
+// DialUDP connects to the given address via the proxy.
+func (s *Tor) DialUDP(network, addr string) (net.PacketConn, net.Addr, error) {
+	return nil, nil, newError(ErrUDPNotSupported, "proxy-tor: udp not supported by tor")
+}
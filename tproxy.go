@@ -11,7 +11,9 @@ import (
 	"fmt"
 	"net"
 	"strconv"
+	"sync"
 	"syscall"
+	"time"
 	"unsafe"
 )
 
@@ -76,9 +78,11 @@ func (s *TProxy) ListenAndServeUDP() {
 		return
 	}
 
+	var nm sync.Map
+	buf := make([]byte, udpBufSize)
+
 	for {
-		buf := make([]byte, 1024)
-		_, srcAddr, dstAddr, err := ReadFromUDP(lc, buf)
+		n, srcAddr, dstAddr, err := ReadFromUDP(lc, buf)
 		if err != nil {
 			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
 				logf("proxy-tproxy temporary reading data error: %s", netErr)
@@ -89,10 +93,102 @@ func (s *TProxy) ListenAndServeUDP() {
 			continue
 		}
 
-		logf("proxy-tproxy Accepting UDP connection from %s with destination of %s", srcAddr.String(), dstAddr.String())
+		key := srcAddr.String() + "-" + dstAddr.String()
+
+		var sess *udpTunSession
+		v, ok := nm.Load(key)
+		if !ok {
+			dialer := s.sDialer
+			if isMcastOrBcast(dstAddr.IP) {
+				dialer = mcastDialer(conf.MCastPolicy, s.sDialer)
+				if dialer == nil {
+					logf("proxy-tproxy drop multicast/broadcast packet from %s to %s", srcAddr, dstAddr)
+					continue
+				}
+			}
+
+			pc, writeAddr, err := dialUDPFrom(dialer, "udp", dstAddr.String(), srcAddr.IP)
+			if err != nil {
+				logf("proxy-tproxy remote dial error: %v", err)
+				continue
+			}
+
+			sess = &udpTunSession{pc, writeAddr}
+			nm.Store(key, sess)
+
+			go func() {
+				relayTProxyReplies(pc, srcAddr, dstAddr, 2*time.Minute)
+				pc.Close()
+				nm.Delete(key)
+			}()
+
+			logf("proxy-tproxy Accepting UDP connection from %s with destination of %s via %s", srcAddr.String(), dstAddr.String(), dialer.Addr())
+		} else {
+			sess = v.(*udpTunSession)
+		}
+
+		if _, err := sess.pc.WriteTo(buf[:n], sess.writeAddr); err != nil {
+			logf("proxy-tproxy remote write error: %v", err)
+		}
+	}
+}
+
+// relayTProxyReplies sends the replies read from pc to the client src with the source address
+// spoofed(IP_TRANSPARENT): the original destination dst, or the replying host for multicast/broadcast.
+func relayTProxyReplies(pc net.PacketConn, src, dst *net.UDPAddr, timeout time.Duration) {
+	conns := make(map[string]*net.UDPConn)
+	defer func() {
+		for _, c := range conns {
+			c.Close()
+		}
+	}()
+
+	buf := make([]byte, udpBufSize)
+	for {
+		pc.SetReadDeadline(time.Now().Add(timeout))
+		n, from, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		laddr := dst
+		if a, ok := from.(*net.UDPAddr); ok && isMcastOrBcast(dst.IP) {
+			laddr = a
+		}
+
+		c, ok := conns[laddr.String()]
+		if !ok {
+			if c, err = dialTransparent(laddr, src); err != nil {
+				logf("proxy-tproxy reply from %s to %s error: %v", laddr, src, err)
+				continue
+			}
+			conns[laddr.String()] = c
+		}
+
+		c.Write(buf[:n])
+	}
+}
 
+// dialTransparent returns a udp conn to raddr bound to the non-local address laddr
+func dialTransparent(laddr, raddr *net.UDPAddr) (*net.UDPConn, error) {
+	d := &net.Dialer{
+		LocalAddr: laddr,
+		Control: func(network, address string, c syscall.RawConn) error {
+			var err error
+			c.Control(func(fd uintptr) {
+				if err = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1); err == nil {
+					err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+				}
+			})
+			return err
+		},
 	}
 
+	c, err := d.Dial("udp", raddr.String())
+	if err != nil {
+		return nil, err
+	}
+	return c.(*net.UDPConn), nil
 }
 
 // ReadFromUDP reads a UDP packet from c, copying the payload into b.
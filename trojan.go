@@ -0,0 +1,446 @@
+// trojan: https://trojan-gfw.github.io/trojan/protocol
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+// trojan commands
+const (
+	trojanConnect      = 1
+	trojanUDPAssociate = 3
+)
+
+var crlf = []byte{'\r', '\n'}
+
+// Trojan struct
+type Trojan struct {
+	*Forwarder
+	sDialer Dialer
+
+	hash      []byte // hex(sha224(password))
+	tlsConfig *tls.Config
+	tlsFP     *utls.ClientHelloID // as client, the client hello fingerprint
+	fallback  string              // as server, relay the connections with a wrong password to fallback
+}
+
+// NewTrojan returns a trojan proxy:
+//
+//	server: trojan://pass@:443?cert=/path/to/cert&key=/path/to/key&fallback=127.0.0.1:80
+//	client: trojan://pass@host:443?serverName=example.com&skipverify=true&fingerprint=chrome
+func NewTrojan(addr, pass, rawQuery string, cDialer Dialer, sDialer Dialer) (*Trojan, error) {
+	if pass == "" {
+		return nil, errors.New("proxy-trojan: password must be specified")
+	}
+
+	h := sha256.Sum224([]byte(pass))
+	s := &Trojan{
+		Forwarder: NewForwarder(addr, cDialer),
+		sDialer:   sDialer,
+		hash:      []byte(hex.EncodeToString(h[:])),
+	}
+
+	p, _ := url.ParseQuery(rawQuery)
+
+	if sDialer != nil {
+		var err error
+		if s.tlsConfig, err = tlsServerConfig(p); err != nil {
+			return nil, errors.New("proxy-trojan: " + err.Error())
+		}
+		s.fallback = p.Get("fallback")
+		return s, nil
+	}
+
+	host, _, _ := net.SplitHostPort(addr)
+
+	var err error
+	if s.tlsConfig, err = tlsClientConfig(host, p); err != nil {
+		return nil, errors.New("proxy-trojan: " + err.Error())
+	}
+
+	if s.tlsFP, err = parseFingerprint(p.Get("fingerprint")); err != nil {
+		return nil, errors.New("proxy-trojan: " + err.Error())
+	}
+
+	return s, nil
+}
+
+// ListenAndServe serves trojan requests.
+func (s *Trojan) ListenAndServe() {
+	l, err := listen("tcp", s.addr)
+	if err != nil {
+		logf("proxy-trojan failed to listen on %s: %v", s.addr, err)
+		return
+	}
+
+	logf("proxy-trojan listening TCP on %s", s.addr)
+
+	b := budgetOf(s.addr)
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if isClosed(err) {
+				return
+			}
+			logf("proxy-trojan failed to accept: %v", err)
+			continue
+		}
+
+		if !b.acquireConn() {
+			logf("proxy-trojan %s rejected, too many connections on %s", c.RemoteAddr(), s.addr)
+			c.Close()
+			continue
+		}
+
+		go func() {
+			defer b.releaseConn()
+			s.ServeTCP(b.limit(c))
+		}()
+	}
+}
+
+// ServeTCP serves a trojan connection.
+func (s *Trojan) ServeTCP(nc net.Conn) {
+	defer nc.Close()
+
+	if c, ok := nc.(*net.TCPConn); ok {
+		c.SetKeepAlive(true)
+	}
+
+	tc := tls.Server(nc, s.tlsConfig)
+	tc.SetDeadline(time.Now().Add(handshakeTimeout()))
+	if err := tc.Handshake(); err != nil {
+		logf("proxy-trojan tls handshake with %s error: %v", nc.RemoteAddr(), err)
+		return
+	}
+
+	// the request is peeked, so the fallback server gets the whole stream
+	c := newConn(tc)
+
+	// hex(sha224(password)) CRLF CMD ATYP DST.ADDR DST.PORT CRLF
+	head, err := s.peekHash(c)
+	if err != nil || subtle.ConstantTimeCompare(head[:len(s.hash)], s.hash) != 1 || !bytes.Equal(head[len(s.hash):], crlf) {
+		tc.SetDeadline(time.Time{})
+		s.serveFallback(c, err)
+		return
+	}
+	c.r.Discard(len(head))
+
+	cmd, err := c.r.ReadByte()
+	if err != nil {
+		return
+	}
+
+	tgt, err := ReadAddr(c)
+	if err != nil {
+		logf("proxy-trojan failed to get target address from %s: %v", c.RemoteAddr(), err)
+		return
+	}
+
+	if _, err := io.ReadFull(c, make([]byte, 2)); err != nil {
+		return
+	}
+	tc.SetDeadline(time.Time{})
+
+	switch cmd {
+	case trojanConnect:
+		rc, err := dialFrom(s.sDialer, "tcp", tgt.String(), "", srcIP(c.RemoteAddr()))
+		if err != nil {
+			logf("proxy-trojan failed to connect to target: %v", err)
+			addResult(resultOfDial(err))
+			return
+		}
+		defer rc.Close()
+
+		logf("proxy-trojan %s <-> %s", c.RemoteAddr(), tgt)
+
+		err = relayStats(c, rc, tgt.String())
+		if err != nil {
+			if err, ok := err.(net.Error); ok && err.Timeout() {
+				return // ignore i/o timeout
+			}
+			logf("proxy-trojan relay error: %v", err)
+		}
+
+	case trojanUDPAssociate:
+		s.serveUDP(c)
+
+	default:
+		logf("proxy-trojan unknown command %d from %s", cmd, c.RemoteAddr())
+	}
+}
+
+var errTrojanRequest = newError(ErrProtocol, "proxy-trojan: not a trojan request")
+
+// peekHash peeks the hash and CRLF of the request, it returns as soon as the bytes received
+// can not be a hex hash, so a short non-trojan request goes to the fallback without waiting.
+func (s *Trojan) peekHash(c conn) ([]byte, error) {
+	size := len(s.hash) + 2
+	checked := 0
+	for {
+		n := c.r.Buffered()
+		if n <= checked {
+			n = checked + 1
+		}
+		if n > size {
+			n = size
+		}
+
+		b, err := c.Peek(n)
+		for ; checked < len(b) && checked < len(s.hash); checked++ {
+			if !isLowerHex(b[checked]) {
+				return b, errTrojanRequest
+			}
+		}
+
+		if err != nil || len(b) == size {
+			return b, err
+		}
+	}
+}
+
+func isLowerHex(b byte) bool {
+	return b >= '0' && b <= '9' || b >= 'a' && b <= 'f'
+}
+
+// serveFallback relays the connection with a wrong password to the fallback server,
+// so the server looks like a normal https site.
+func (s *Trojan) serveFallback(c conn, err error) {
+	if s.fallback == "" {
+		logf("proxy-trojan invalid request from %s", c.RemoteAddr())
+		defendProbe(c, err, false)
+		return
+	}
+
+	rc, err := net.Dial("tcp", s.fallback)
+	if err != nil {
+		logf("proxy-trojan failed to connect to fallback %s: %v", s.fallback, err)
+		return
+	}
+	defer rc.Close()
+
+	logf("proxy-trojan %s <-> fallback %s", c.RemoteAddr(), s.fallback)
+	relay(c, rc)
+}
+
+// serveUDP relays the udp packets over the trojan stream:
+// ATYP DST.ADDR DST.PORT LENGTH(2) CRLF PAYLOAD
+func (s *Trojan) serveUDP(c conn) {
+	tc := &trojanPktConn{Conn: c}
+
+	buf := make([]byte, udpBufSize)
+	n, tgt, err := tc.readPacket(buf)
+	if err != nil {
+		return
+	}
+
+	pc, writeTo, err := dialUDPFrom(s.sDialer, "udp", tgt.String(), srcIP(c.RemoteAddr()))
+	if err != nil {
+		logf("proxy-trojan-udp remote dial error: %v", err)
+		return
+	}
+	defer pc.Close()
+
+	go func() {
+		rbuf := make([]byte, udpBufSize)
+		for {
+			pc.SetReadDeadline(time.Now().Add(2 * time.Minute))
+			n, src, err := pc.ReadFrom(rbuf)
+			if err != nil {
+				c.Close()
+				return
+			}
+
+			if _, err := tc.writePacket(rbuf[:n], ParseAddr(src.String())); err != nil {
+				return
+			}
+		}
+	}()
+
+	logf("proxy-trojan-udp %s <-> %s", c.RemoteAddr(), tgt)
+
+	first := tgt.String()
+	for {
+		// a direct udp socket can write to any peers, the forwarders are bound to the first target.
+		to := writeTo
+		if t := tgt.String(); t != first {
+			if _, ok := pc.(*net.UDPConn); !ok {
+				logf("proxy-trojan-udp %s -> %s dropped, the session via forwarder is bound to %s", c.RemoteAddr(), t, first)
+				to = nil
+			} else if to, err = net.ResolveUDPAddr("udp", t); err != nil {
+				logf("proxy-trojan-udp resolve %s error: %v", t, err)
+				to = nil
+			}
+		}
+
+		if to != nil {
+			if _, err := pc.WriteTo(buf[:n], to); err != nil {
+				logf("proxy-trojan-udp remote write error: %v", err)
+			}
+		}
+
+		if n, tgt, err = tc.readPacket(buf); err != nil {
+			return
+		}
+	}
+}
+
+// request writes the trojan request header of cmd and tgt to c
+func (s *Trojan) request(c net.Conn, cmd byte, tgt Addr) error {
+	buf := make([]byte, 0, len(s.hash)+2+1+len(tgt)+2)
+	buf = append(buf, s.hash...)
+	buf = append(buf, crlf...)
+	buf = append(buf, cmd)
+	buf = append(buf, tgt...)
+	buf = append(buf, crlf...)
+
+	_, err := c.Write(buf)
+	return err
+}
+
+// dial connects to the trojan server over tls
+func (s *Trojan) dial() (net.Conn, error) {
+	rc, err := s.cDialer.Dial("tcp", s.addr)
+	if err != nil {
+		logf("dial to %s error: %s", s.addr, err)
+		return nil, err
+	}
+
+	if c, ok := rc.(*net.TCPConn); ok {
+		c.SetKeepAlive(true)
+	}
+
+	tc, err := tlsClient(rc, s.tlsConfig, s.tlsFP)
+	if err != nil {
+		rc.Close()
+		logf("proxy-trojan tls handshake with %s error: %s", s.addr, err)
+		return nil, err
+	}
+
+	return tc, nil
+}
+
+// Dial connects to the address addr on the network net via the proxy.
+func (s *Trojan) Dial(network, addr string) (net.Conn, error) {
+	tgt := ParseAddr(addr)
+	if tgt == nil {
+		return nil, newError(ErrInvalidAddr, "proxy-trojan: unable to parse address: "+addr)
+	}
+
+	start := time.Now()
+	c, err := s.dial()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.request(c, trojanConnect, tgt); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	logf("proxy-trojan connect to %s via %s, handshake: %s", addr, s.addr, time.Since(start))
+	return newTTFBConn(c, start, getLatencyStats("trojan", s.addr)), nil
+}
+
+// DialUDP connects to the given address via the proxy.
+func (s *Trojan) DialUDP(network, addr string) (net.PacketConn, net.Addr, error) {
+	tgt := ParseAddr(addr)
+	if tgt == nil {
+		return nil, nil, newError(ErrInvalidAddr, "proxy-trojan: unable to parse address: "+addr)
+	}
+
+	c, err := s.dial()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := s.request(c, trojanUDPAssociate, tgt); err != nil {
+		c.Close()
+		return nil, nil, err
+	}
+
+	return &trojanPktConn{Conn: c, tgt: tgt}, c.RemoteAddr(), nil
+}
+
+// trojanPktConn is a udp packet conn over the trojan stream
+type trojanPktConn struct {
+	net.Conn
+	tgt Addr // as client, all the packets are sent to tgt
+}
+
+// readPacket reads a packet to b, returns the payload length and the address in the header
+func (pc *trojanPktConn) readPacket(b []byte) (int, Addr, error) {
+	addr, err := ReadAddr(pc.Conn)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var head [4]byte
+	if _, err := io.ReadFull(pc.Conn, head[:]); err != nil {
+		return 0, nil, err
+	}
+
+	n := int(binary.BigEndian.Uint16(head[:2]))
+	if n > len(b) {
+		return 0, nil, newError(ErrProtocol, "proxy-trojan: udp packet too large: "+strconv.Itoa(n))
+	}
+
+	if _, err := io.ReadFull(pc.Conn, b[:n]); err != nil {
+		return 0, nil, err
+	}
+
+	return n, addr, nil
+}
+
+// writePacket writes b with addr in the header
+func (pc *trojanPktConn) writePacket(b []byte, addr Addr) (int, error) {
+	if addr == nil {
+		return 0, newError(ErrInvalidAddr, "proxy-trojan: invalid udp address")
+	}
+
+	if len(b) > 0xffff {
+		return 0, errors.New("proxy-trojan: udp packet too large: " + strconv.Itoa(len(b)))
+	}
+
+	buf := make([]byte, 0, len(addr)+4+len(b))
+	buf = append(buf, addr...)
+	buf = append(buf, byte(len(b)>>8), byte(len(b)))
+	buf = append(buf, crlf...)
+	buf = append(buf, b...)
+
+	if _, err := pc.Conn.Write(buf); err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+// ReadFrom reads a packet, addr is the sender in the header
+func (pc *trojanPktConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := pc.readPacket(b)
+	if err != nil {
+		return n, nil, err
+	}
+
+	raddr, err := net.ResolveUDPAddr("udp", addr.String())
+	return n, raddr, err
+}
+
+// WriteTo writes a packet to the target of the session, addr is ignored
+func (pc *trojanPktConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return pc.writePacket(b, pc.tgt)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestTUICAddr(t *testing.T) {
+	tests := []struct {
+		addr string
+		want string
+	}{
+		{"1.2.3.4:53", "01010203040035"},
+		{"[2001:db8::1]:443", "0220010db800000000000000000000000101bb"},
+		{"example.com:80", "000b6578616d706c652e636f6d0050"},
+	}
+
+	for _, tt := range tests {
+		b, err := tuicAddr(tt.addr)
+		if err != nil || hex.EncodeToString(b) != tt.want {
+			t.Errorf("tuicAddr(%s) = %x, %v, want %s", tt.addr, b, err, tt.want)
+			continue
+		}
+
+		addr, n, err := parseTUICAddr(append(b, "data"...))
+		if err != nil || addr != tt.addr || n != len(b) {
+			t.Errorf("parseTUICAddr(%x) = %s, %d, %v", b, addr, n, err)
+		}
+	}
+
+	if _, err := tuicAddr("example.com"); err == nil {
+		t.Error("address without port is accepted")
+	}
+	if _, _, err := parseTUICAddr([]byte{tuicAddrDomain, 11, 'e', 'x'}); err == nil {
+		t.Error("truncated domain is accepted")
+	}
+}
+
+func TestTUICPacket(t *testing.T) {
+	m := udpMsg{sid: 0x0102, pktID: 0x0304, fragID: 1, fragCount: 2, data: []byte("hi")}
+	b := tuicMarshal(&m, nil)
+	if got := hex.EncodeToString(b); got != "05020102030402010002ff6869" {
+		t.Fatalf("tuicMarshal = %s", got)
+	}
+
+	got, err := parseTUICPacket(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.sid != m.sid || got.pktID != m.pktID || got.fragID != 1 || got.fragCount != 2 ||
+		got.addr != "" || string(got.data) != "hi" {
+		t.Fatalf("parse = %+v", got)
+	}
+
+	if _, err := parseTUICPacket(b[:len(b)-1]); err == nil {
+		t.Error("truncated packet is accepted")
+	}
+
+	// only the first fragment has the address
+	tgt, _ := tuicAddr("8.8.8.8:53")
+	first := udpMsg{sid: 1, pktID: 9, fragID: 0, fragCount: 2, data: []byte("hello ")}
+	second := udpMsg{sid: 1, pktID: 9, fragID: 1, fragCount: 2, data: []byte("world")}
+
+	var f udpFrags
+	m1, _ := parseTUICPacket(tuicMarshal(&first, tgt))
+	m2, _ := parseTUICPacket(tuicMarshal(&second, nil))
+	if _, ok := f.add(m2); ok {
+		t.Fatal("incomplete packet returned")
+	}
+	m, ok := f.add(m1)
+	if !ok || m.addr != "8.8.8.8:53" || string(m.data) != "hello world" {
+		t.Fatalf("reassembled %+v, %v", m, ok)
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/rawfile"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/fdbased"
+	"gvisor.dev/gvisor/pkg/tcpip/link/tun"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+const (
+	tunNIC         = 1
+	tunMaxInFlight = 2048 // max tcp connections in handshake
+	tunUDPTimeout  = 2 * time.Minute
+)
+
+// Tun is a tun device listener, the ip packets are terminated by the userspace tcp/ip stack
+// of gvisor, the tcp connections and udp sessions are routed to their destinations by sDialer.
+type Tun struct {
+	name    string
+	mtu     int
+	addrs   []string // addresses of the device, e.g. 198.18.0.1/15
+	sDialer Dialer
+}
+
+// NewTun returns a tun listener, tun://NAME?addr=198.18.0.1/15&mtu=1500
+func NewTun(name, rawQuery string, sDialer Dialer) (*Tun, error) {
+	if name == "" {
+		return nil, errors.New("proxy-tun: device name must be specified, e.g. tun://tun0")
+	}
+
+	s := &Tun{name: name, mtu: 1500, sDialer: sDialer}
+
+	p, _ := url.ParseQuery(rawQuery)
+	if v := p.Get("mtu"); v != "" {
+		mtu, err := strconv.Atoi(v)
+		if err != nil || mtu < 576 || mtu > 65535 {
+			return nil, errors.New("proxy-tun: invalid mtu '" + v + "'")
+		}
+		s.mtu = mtu
+	}
+
+	for _, addr := range p["addr"] {
+		if _, _, err := net.ParseCIDR(addr); err != nil {
+			return nil, errors.New("proxy-tun: invalid addr '" + addr + "', format: IP/PREFIX")
+		}
+		s.addrs = append(s.addrs, addr)
+	}
+
+	return s, nil
+}
+
+// ListenAndServe creates the device and serves the packets from it
+func (s *Tun) ListenAndServe() {
+	fd, err := tun.Open(s.name)
+	if err != nil {
+		logf("proxy-tun failed to open %s: %v", s.name, err)
+		return
+	}
+
+	if err := s.setup(); err != nil {
+		logf("proxy-tun failed to set up %s: %v", s.name, err)
+		return
+	}
+
+	mtu, err := rawfile.GetMTU(s.name)
+	if err != nil {
+		logf("proxy-tun failed to get the mtu of %s: %v", s.name, err)
+		return
+	}
+
+	ep, err := fdbased.New(&fdbased.Options{FDs: []int{fd}, MTU: mtu})
+	if err != nil {
+		logf("proxy-tun failed to create the link of %s: %v", s.name, err)
+		return
+	}
+
+	st := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol},
+	})
+
+	if err := st.CreateNIC(tunNIC, ep); err != nil {
+		logf("proxy-tun failed to create the nic of %s: %s", s.name, err)
+		return
+	}
+
+	// accept the packets to any addresses, and reply from them
+	st.SetPromiscuousMode(tunNIC, true)
+	st.SetSpoofing(tunNIC, true)
+	st.SetRouteTable([]tcpip.Route{
+		{Destination: header.IPv4EmptySubnet, NIC: tunNIC},
+		{Destination: header.IPv6EmptySubnet, NIC: tunNIC},
+	})
+
+	b := budgetOf(s.name)
+
+	tcpFwd := tcp.NewForwarder(st, 0, tunMaxInFlight, func(r *tcp.ForwarderRequest) {
+		if !b.acquireConn() {
+			logf("proxy-tun tcp %s rejected, too many connections on %s", tunAddr(r.ID().RemoteAddress, r.ID().RemotePort), s.name)
+			r.Complete(true)
+			return
+		}
+		defer b.releaseConn()
+		s.serveTCP(r, b)
+	})
+	st.SetTransportProtocolHandler(tcp.ProtocolNumber, tcpFwd.HandlePacket)
+
+	udpFwd := udp.NewForwarder(st, func(r *udp.ForwarderRequest) bool {
+		if !b.acquireUDP() {
+			logf("proxy-tun udp %s rejected, too many udp sessions on %s", tunAddr(r.ID().RemoteAddress, r.ID().RemotePort), s.name)
+			return true
+		}
+
+		var wq waiter.Queue
+		ep, err := r.CreateEndpoint(&wq)
+		if err != nil {
+			b.releaseUDP()
+			logf("proxy-tun udp create endpoint error: %s", err)
+			return true
+		}
+
+		c := gonet.NewUDPConn(&wq, ep)
+		tgt := tunAddr(r.ID().LocalAddress, r.ID().LocalPort)
+		go func() {
+			defer b.releaseUDP()
+			s.serveUDP(c, tgt)
+		}()
+		return true
+	})
+	st.SetTransportProtocolHandler(udp.ProtocolNumber, udpFwd.HandlePacket)
+
+	logf("proxy-tun serving on %s, mtu: %d", s.name, mtu)
+	st.Wait()
+}
+
+// setup sets the mtu and the addresses of the device and brings it up,
+// and routes the traffic to it with -autoroute.
+func (s *Tun) setup() error {
+	cmds := [][]string{{"ip", "link", "set", "dev", s.name, "mtu", strconv.Itoa(s.mtu)}}
+	v6 := false
+	for _, addr := range s.addrs {
+		cmds = append(cmds, []string{"ip", "addr", "replace", addr, "dev", s.name})
+		v6 = v6 || strings.Contains(addr, ":")
+	}
+	cmds = append(cmds, []string{"ip", "link", "set", "dev", s.name, "up"})
+
+	for _, args := range cmds {
+		if err := runCmd(args); err != nil {
+			return err
+		}
+	}
+
+	if conf.AutoRoute {
+		return setupTunRoutes(s.name, v6)
+	}
+	return nil
+}
+
+// serveTCP connects to the destination first, so the client gets a reset if it fails
+func (s *Tun) serveTCP(r *tcp.ForwarderRequest, b *budget) {
+	id := r.ID()
+	src, tgt := tunAddr(id.RemoteAddress, id.RemotePort), tunAddr(id.LocalAddress, id.LocalPort)
+
+	rc, err := dialFrom(s.sDialer, "tcp", tgt, "", net.ParseIP(id.RemoteAddress.String()))
+	if err != nil {
+		logf("proxy-tun %s <-> %s, dial error: %v", src, tgt, err)
+		addResult(resultOfDial(err))
+		r.Complete(true)
+		return
+	}
+	defer rc.Close()
+
+	var wq waiter.Queue
+	ep, tcpErr := r.CreateEndpoint(&wq)
+	if tcpErr != nil {
+		logf("proxy-tun %s <-> %s, create endpoint error: %s", src, tgt, tcpErr)
+		r.Complete(true)
+		return
+	}
+	r.Complete(false)
+
+	c := gonet.NewTCPConn(&wq, ep)
+	defer c.Close()
+
+	logf("proxy-tun %s <-> %s", src, tgt)
+
+	if err = relayStats(b.limit(c), rc, tgt); err != nil {
+		if err, ok := err.(net.Error); ok && err.Timeout() {
+			return // ignore i/o timeout
+		}
+		logf("proxy-tun relay error: %v", err)
+	}
+}
+
+// serveUDP relays the udp session of c to tgt until idle for tunUDPTimeout
+func (s *Tun) serveUDP(c *gonet.UDPConn, tgt string) {
+	defer c.Close()
+
+	pc, writeTo, err := dialUDPFrom(s.sDialer, "udp", tgt, srcIP(c.RemoteAddr()))
+	if err != nil {
+		logf("proxy-tun udp %s <-> %s, dial error: %v", c.RemoteAddr(), tgt, err)
+		return
+	}
+	defer pc.Close()
+
+	logf("proxy-tun udp %s <-> %s", c.RemoteAddr(), tgt)
+
+	go func() {
+		buf := make([]byte, udpBufSize)
+		for {
+			pc.SetReadDeadline(time.Now().Add(tunUDPTimeout))
+			n, _, err := pc.ReadFrom(buf)
+			if err != nil {
+				break
+			}
+			if _, err := c.Write(buf[:n]); err != nil {
+				break
+			}
+		}
+		c.Close()
+	}()
+
+	buf := make([]byte, udpBufSize)
+	for {
+		c.SetReadDeadline(time.Now().Add(tunUDPTimeout))
+		n, err := c.Read(buf)
+		if err != nil {
+			return
+		}
+		if _, err := pc.WriteTo(buf[:n], writeTo); err != nil {
+			logf("proxy-tun udp %s <-> %s, write error: %v", c.RemoteAddr(), tgt, err)
+			return
+		}
+	}
+}
+
+// tunAddr returns "HOST:PORT" of the stack address
+func tunAddr(addr tcpip.Address, port uint16) string {
+	return net.JoinHostPort(addr.String(), strconv.Itoa(int(port)))
+}
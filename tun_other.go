@@ -0,0 +1,21 @@
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"log"
+)
+
+// Tun struct
+type Tun struct{}
+
+// NewTun returns a tun listener.
+func NewTun(name, rawQuery string, sDialer Dialer) (*Tun, error) {
+	return nil, errors.New("tun not supported on this os")
+}
+
+// ListenAndServe .
+func (s *Tun) ListenAndServe() {
+	log.Fatal("tun not supported on this os")
+}
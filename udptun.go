@@ -27,13 +27,16 @@ func NewUDPTun(addr, raddr string, sDialer Dialer) (*UDPTun, error) {
 
 // ListenAndServe .
 func (s *UDPTun) ListenAndServe() {
-	c, err := net.ListenPacket("udp", s.addr)
+	c, err := listenPacket("udp", s.addr)
 	if err != nil {
 		logf("proxy-udptun failed to listen on %s: %v", s.addr, err)
 		return
 	}
 	defer c.Close()
 
+	b := budgetOf(s.addr)
+	c = b.limitPacket(c)
+
 	logf("proxy-udptun listening UDP on %s", s.addr)
 
 	var nm sync.Map
@@ -42,35 +45,46 @@ func (s *UDPTun) ListenAndServe() {
 	for {
 		n, raddr, err := c.ReadFrom(buf)
 		if err != nil {
+			if isClosed(err) {
+				return
+			}
 			logf("proxy-udptun read error: %v", err)
 			continue
 		}
 
-		var pc net.PacketConn
-		var writeAddr net.Addr
+		key := udpKeyOf(raddr)
 
-		v, ok := nm.Load(raddr.String())
+		var sess *udpTunSession
+		v, ok := nm.Load(key)
 		if !ok && v == nil {
+			if !b.acquireUDP() {
+				logf("proxy-udptun %s rejected, too many udp sessions on %s", raddr, s.addr)
+				continue
+			}
 
-			pc, writeAddr, err = s.sDialer.DialUDP("udp", s.raddr)
+			pc, writeAddr, err := s.sDialer.DialUDP("udp", s.raddr)
 			if err != nil {
+				b.releaseUDP()
 				logf("proxy-udptun remote dial error: %v", err)
 				continue
 			}
 
-			nm.Store(raddr.String(), pc)
+			sess = &udpTunSession{pc, writeAddr}
+			nm.Store(key, sess)
 
 			go func() {
 				timedCopy(c, raddr, pc, 2*time.Minute)
 				pc.Close()
-				nm.Delete(raddr.String())
+				nm.Delete(key)
+				b.releaseUDP()
 			}()
 
 		} else {
-			pc = v.(net.PacketConn)
+			sess = v.(*udpTunSession)
 		}
 
-		_, err = pc.WriteTo(buf[:n], writeAddr)
+		// the write address is kept in the session, it's needed by the following packets too
+		_, err = sess.pc.WriteTo(buf[:n], sess.writeAddr)
 		if err != nil {
 			logf("proxy-udptun remote write error: %v", err)
 			continue
@@ -80,3 +94,9 @@ func (s *UDPTun) ListenAndServe() {
 
 	}
 }
+
+// udpTunSession is the udp session of a client
+type udpTunSession struct {
+	pc        net.PacketConn
+	writeAddr net.Addr
+}
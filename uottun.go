@@ -27,13 +27,16 @@ func NewUoTTun(addr, raddr string, sDialer Dialer) (*UoTTun, error) {
 
 // ListenAndServe .
 func (s *UoTTun) ListenAndServe() {
-	c, err := net.ListenPacket("udp", s.addr)
+	c, err := listenPacket("udp", s.addr)
 	if err != nil {
 		logf("proxy-uottun failed to listen on %s: %v", s.addr, err)
 		return
 	}
 	defer c.Close()
 
+	b := budgetOf(s.addr)
+	c = b.limitPacket(c)
+
 	logf("proxy-uottun listening UDP on %s", s.addr)
 
 	buf := make([]byte, udpBufSize)
@@ -41,17 +44,28 @@ func (s *UoTTun) ListenAndServe() {
 	for {
 		n, clientAddr, err := c.ReadFrom(buf)
 		if err != nil {
+			if isClosed(err) {
+				return
+			}
 			logf("proxy-uottun read error: %v", err)
 			continue
 		}
 
+		if !b.acquireUDP() {
+			logf("proxy-uottun %s rejected, too many udp sessions on %s", clientAddr, s.addr)
+			continue
+		}
+
 		rc, err := s.sDialer.Dial("uot", s.raddr)
 		if err != nil {
+			b.releaseUDP()
 			logf("proxy-uottun failed to connect to server %v: %v", s.raddr, err)
 			continue
 		}
 
 		go func() {
+			defer b.releaseUDP()
+
 			// no remote forwarder, just a local udp forwarder
 			if urc, ok := rc.(*net.UDPConn); ok {
 				timedCopy(c, clientAddr, urc, 2*time.Minute)
@@ -2,8 +2,10 @@ package main
 
 import (
 	"io/ioutil"
+	"net"
 	"os"
 	"strings"
+	"time"
 )
 
 func listDir(dirPth string, suffix string) (files []string, err error) {
@@ -24,3 +26,42 @@ func listDir(dirPth string, suffix string) (files []string, err error) {
 	}
 	return files, nil
 }
+
+// normalizeIP converts the ipv4-mapped ipv6 address(::ffff:a.b.c.d) to ipv4,
+// so rules written for ipv4 also apply to the addresses from dual-stack listeners.
+func normalizeIP(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
+// hostOf returns the normalized host of addr, e.g. "1.2.3.4" for "[::ffff:1.2.3.4]:1080"
+func hostOf(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		return normalizeIP(ip).String()
+	}
+	return host
+}
+
+// backoff returns exponentially increasing delays from 0, min, 2*min... up to max
+type backoff struct {
+	min, max time.Duration
+	cur      time.Duration
+}
+
+// next returns the next delay
+func (b *backoff) next() time.Duration {
+	d := b.cur
+	if b.cur == 0 {
+		b.cur = b.min
+	} else if b.cur *= 2; b.cur > b.max {
+		b.cur = b.max
+	}
+	return d
+}
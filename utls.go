@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+// tlsFingerprints are the client hello fingerprints of the tls based forwarders(https, trojan, tls, wss),
+// set with the fingerprint option, e.g. trojan://pass@host:443?fingerprint=chrome
+var tlsFingerprints = map[string]utls.ClientHelloID{
+	"chrome":     utls.HelloChrome_Auto,
+	"firefox":    utls.HelloFirefox_Auto,
+	"safari":     utls.HelloSafari_Auto,
+	"ios":        utls.HelloIOS_Auto,
+	"edge":       utls.HelloEdge_Auto,
+	"randomized": utls.HelloRandomized,
+}
+
+// utlsSessionCache is the session cache of the uTLS conns for resumption
+var utlsSessionCache = utls.NewLRUClientSessionCache(256)
+
+// parseFingerprint returns the client hello fingerprint of name, nil for go's crypto/tls
+func parseFingerprint(name string) (*utls.ClientHelloID, error) {
+	if name == "" || name == "go" {
+		return nil, nil
+	}
+
+	id, ok := tlsFingerprints[name]
+	if !ok {
+		return nil, errors.New("unknown tls fingerprint '" + name + "', available: go chrome firefox safari ios edge randomized")
+	}
+
+	return &id, nil
+}
+
+// tlsClient performs the tls handshake over c, the client hello emulates fp with uTLS if not nil.
+// The browser parrots advertise h2 in alpn but the conns are used as http/1.1 or raw streams,
+// so the alpn is replaced with config.NextProtos(http/1.1 if empty), and the handshake fails
+// if the server still negotiates a protocol not offered.
+func tlsClient(c net.Conn, config *tls.Config, fp *utls.ClientHelloID) (net.Conn, error) {
+	if fp == nil {
+		tc := tls.Client(c, config)
+		return tc, tc.Handshake()
+	}
+
+	alpn := config.NextProtos
+	if len(alpn) == 0 {
+		alpn = []string{"http/1.1"}
+	}
+
+	uc, err := newUConn(c, config, *fp, alpn)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := uc.Handshake(); err != nil {
+		return nil, err
+	}
+
+	proto := uc.ConnectionState().NegotiatedProtocol
+	if proto == "" {
+		return uc, nil
+	}
+
+	for _, p := range alpn {
+		if p == proto {
+			return uc, nil
+		}
+	}
+
+	uc.Close()
+	return nil, errors.New("tls fingerprint: server negotiated unsupported alpn '" + proto + "'")
+}
+
+// newUConn returns a uTLS client conn over c emulating fp, the alpn of the fingerprint is replaced with alpn.
+func newUConn(c net.Conn, config *tls.Config, fp utls.ClientHelloID, alpn []string) (*utls.UConn, error) {
+	if len(config.Certificates) > 0 {
+		return nil, errors.New("client certificates are not supported with tls fingerprints")
+	}
+
+	uconfig := &utls.Config{
+		ServerName:         config.ServerName,
+		InsecureSkipVerify: config.InsecureSkipVerify,
+		RootCAs:            config.RootCAs,
+		NextProtos:         alpn,
+	}
+
+	if config.VerifyConnection != nil {
+		uconfig.VerifyConnection = func(cs utls.ConnectionState) error {
+			return config.VerifyConnection(tls.ConnectionState{PeerCertificates: cs.PeerCertificates})
+		}
+	}
+
+	// the sessions of the uTLS conns are cached separately, keyed by the server name
+	if config.ClientSessionCache != nil {
+		uconfig.ClientSessionCache = utlsSessionCache
+	}
+
+	spec, err := utls.UTLSIdToSpec(fp)
+	if err != nil {
+		// the randomized hellos have no fixed spec, the negotiated protocol is checked by the callers
+		return utls.UClient(c, uconfig, fp), nil
+	}
+
+	for _, ext := range spec.Extensions {
+		if e, ok := ext.(*utls.ALPNExtension); ok {
+			e.AlpnProtocols = alpn
+		}
+	}
+
+	uc := utls.UClient(c, uconfig, utls.HelloCustom)
+	if err := uc.ApplyPreset(&spec); err != nil {
+		return nil, err
+	}
+	return uc, nil
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// v2rayConf is the part of the v2ray config converted by -import
+type v2rayConf struct {
+	Inbounds []struct {
+		Listen   string `json:"listen"`
+		Port     int    `json:"port"`
+		Protocol string `json:"protocol"`
+		Settings struct {
+			FollowRedirect bool `json:"followRedirect"`
+		} `json:"settings"`
+	} `json:"inbounds"`
+
+	Outbounds []v2rayOutbound `json:"outbounds"`
+
+	Routing struct {
+		Rules []struct {
+			Domain      []string `json:"domain"`
+			IP          []string `json:"ip"`
+			OutboundTag string   `json:"outboundTag"`
+			BalancerTag string   `json:"balancerTag"`
+
+			// the conditions glider can't match
+			Port        json.RawMessage `json:"port"`
+			Network     string          `json:"network"`
+			Source      []string        `json:"source"`
+			User        []string        `json:"user"`
+			InboundTag  []string        `json:"inboundTag"`
+			Protocol    []string        `json:"protocol"`
+			Attrs       string          `json:"attrs"`
+			DomainsFile string          `json:"domains"`
+		} `json:"rules"`
+		Balancers []struct {
+			Tag      string   `json:"tag"`
+			Selector []string `json:"selector"`
+			Strategy struct {
+				Type string `json:"type"`
+			} `json:"strategy"`
+		} `json:"balancers"`
+	} `json:"routing"`
+}
+
+// v2rayOutbound is an outbound of v2ray
+type v2rayOutbound struct {
+	Tag      string `json:"tag"`
+	Protocol string `json:"protocol"`
+	Settings struct {
+		Vnext []struct {
+			Address string `json:"address"`
+			Port    int    `json:"port"`
+			Users   []struct {
+				ID       string `json:"id"`
+				AlterID  int    `json:"alterId"`
+				Security string `json:"security"`
+			} `json:"users"`
+		} `json:"vnext"`
+		Servers []struct {
+			Address  string `json:"address"`
+			Port     int    `json:"port"`
+			Method   string `json:"method"`
+			Password string `json:"password"`
+			Users    []struct {
+				User string `json:"user"`
+				Pass string `json:"pass"`
+			} `json:"users"`
+		} `json:"servers"`
+	} `json:"settings"`
+	StreamSettings struct {
+		Network     string `json:"network"`
+		Security    string `json:"security"`
+		TLSSettings struct {
+			ServerName    string `json:"serverName"`
+			AllowInsecure bool   `json:"allowInsecure"`
+		} `json:"tlsSettings"`
+		WSSettings struct {
+			Path    string            `json:"path"`
+			Headers map[string]string `json:"headers"`
+		} `json:"wsSettings"`
+		GRPCSettings struct {
+			ServiceName string `json:"serviceName"`
+		} `json:"grpcSettings"`
+	} `json:"streamSettings"`
+}
+
+// v2ray converts the v2ray config: the inbounds to listeners, the outbounds to forwarders,
+// the targets of the routing rules to glider rules, and the first outbound to the global forwarders.
+func (im *importer) v2ray(b []byte) error {
+	var c v2rayConf
+	if err := json.Unmarshal(b, &c); err != nil {
+		return errors.New("parse v2ray config error: " + err.Error())
+	}
+
+	for _, in := range c.Inbounds {
+		scheme := ""
+		switch in.Protocol {
+		case "socks":
+			scheme = "socks5"
+		case "http":
+			scheme = "http"
+		case "dokodemo-door":
+			if in.Settings.FollowRedirect {
+				scheme = "redir"
+			}
+		}
+		if scheme == "" {
+			im.skipped[in.Protocol+" inbounds"]++
+			continue
+		}
+		im.y.Listen = append(im.y.Listen, listenAddr(scheme, in.Port, in.Listen != "127.0.0.1"))
+	}
+
+	// tag -> forwarders, nil for freedom
+	outbounds := make(map[string][]string)
+	for i, o := range c.Outbounds {
+		if o.Tag == "" && i > 0 {
+			continue
+		}
+
+		u, err := v2rayOutboundURL(&o)
+		if err != nil {
+			im.warn("outbound %s skipped: %s", o.Tag, err)
+			continue
+		}
+
+		var forward []string
+		if u != "" {
+			forward = []string{u}
+		}
+		outbounds[o.Tag] = forward
+
+		// the first outbound is the default one
+		if i == 0 {
+			im.y.Forward = forward
+		}
+	}
+
+	balancers := make(map[string]*yamlRule)
+	for _, bl := range c.Routing.Balancers {
+		s := yamlStrategy{Strategy: "ha"}
+		switch bl.Strategy.Type {
+		case "", "random", "roundRobin":
+			s.Strategy = "rr"
+		case "leastPing", "leastLoad":
+			s.Strategy = "lha"
+		}
+
+		r := &yamlRule{Name: bl.Tag, Strategy: s}
+		for _, o := range c.Outbounds {
+			for _, prefix := range bl.Selector {
+				if strings.HasPrefix(o.Tag, prefix) && len(outbounds[o.Tag]) > 0 {
+					r.Forward = append(r.Forward, outbounds[o.Tag]...)
+					break
+				}
+			}
+		}
+		balancers[bl.Tag] = r
+	}
+
+	for _, rule := range c.Routing.Rules {
+		if len(rule.Port) > 0 || rule.Network != "" || len(rule.Source) > 0 || len(rule.User) > 0 ||
+			len(rule.InboundTag) > 0 || len(rule.Protocol) > 0 || rule.Attrs != "" || rule.DomainsFile != "" {
+			im.skipped["rules with port, network, source, user, inbound, protocol or attrs conditions"]++
+			continue
+		}
+
+		var r *yamlRule
+		if forward, ok := outbounds[rule.OutboundTag]; ok && rule.OutboundTag != "" {
+			r = im.rule(rule.OutboundTag, forward, yamlStrategy{})
+		} else if bl, ok := balancers[rule.BalancerTag]; ok {
+			r = im.rule(bl.Name, bl.Forward, bl.Strategy)
+		} else {
+			im.warn("rule to %s%s skipped: no such outbound or balancer, or it's skipped", rule.OutboundTag, rule.BalancerTag)
+			continue
+		}
+
+		for _, d := range rule.Domain {
+			switch {
+			case strings.HasPrefix(d, "domain:"), strings.HasPrefix(d, "full:"):
+				addDest(r, d[strings.Index(d, ":")+1:])
+			case strings.HasPrefix(d, "geosite:"):
+				im.skipped["geosite domains"]++
+			case strings.HasPrefix(d, "regexp:"), strings.HasPrefix(d, "ext:"):
+				im.skipped["regexp and ext domains"]++
+			default:
+				im.skipped["keyword domains"]++
+			}
+		}
+
+		for _, ip := range rule.IP {
+			if strings.HasPrefix(ip, "geoip:") || strings.HasPrefix(ip, "ext:") {
+				im.skipped["geoip and ext ips"]++
+				continue
+			}
+			addDest(r, ip)
+		}
+	}
+
+	return nil
+}
+
+// v2rayOutboundURL returns the forwarder url(chain) of an outbound, empty for freedom
+func v2rayOutboundURL(o *v2rayOutbound) (string, error) {
+	var u, host, port string
+	switch o.Protocol {
+	case "freedom":
+		return "", nil
+
+	case "blackhole":
+		return "reject://", nil
+
+	case "vmess":
+		if len(o.Settings.Vnext) == 0 || len(o.Settings.Vnext[0].Users) == 0 {
+			return "", errors.New("no server")
+		}
+		v, user := o.Settings.Vnext[0], o.Settings.Vnext[0].Users[0]
+		if user.AlterID != 0 {
+			return "", errors.New("alterId must be 0, only the aead header is supported")
+		}
+
+		q := url.Values{}
+		switch user.Security {
+		case "":
+		case "auto", "aes-128-gcm", "chacha20-poly1305", "none":
+			q.Set("security", user.Security)
+		default:
+			return "", errors.New("security " + user.Security + " not supported")
+		}
+		host, port = v.Address, strconv.Itoa(v.Port)
+		u = proxyURL("vmess", user.ID, "", host, port, "", q)
+
+	case "shadowsocks", "trojan", "socks", "http":
+		if len(o.Settings.Servers) == 0 {
+			return "", errors.New("no server")
+		}
+		s := o.Settings.Servers[0]
+		host, port = s.Address, strconv.Itoa(s.Port)
+
+		switch o.Protocol {
+		case "shadowsocks":
+			u = proxyURL("ss", s.Method, s.Password, host, port, "", nil)
+		case "trojan":
+			u = proxyURL("trojan", s.Password, "", host, port, "", tlsQuery(o.StreamSettings.TLSSettings.ServerName, o.StreamSettings.TLSSettings.AllowInsecure))
+			return u, nil
+		default:
+			var user, pass string
+			if len(s.Users) > 0 {
+				user, pass = s.Users[0].User, s.Users[0].Pass
+			}
+			scheme := o.Protocol
+			if scheme == "socks" {
+				scheme = "socks5"
+			}
+			u = proxyURL(scheme, user, pass, host, port, "", nil)
+		}
+
+	default:
+		return "", errors.New("protocol " + o.Protocol + " not supported")
+	}
+
+	ss := o.StreamSettings
+	q := tlsQuery(ss.TLSSettings.ServerName, ss.TLSSettings.AllowInsecure)
+	secure := ss.Security == "tls"
+	switch ss.Network {
+	case "", "tcp":
+		if !secure {
+			return u, nil
+		}
+		return proxyURL("tls", "", "", host, port, "", q) + "," + u, nil
+
+	case "ws":
+		if h := ss.WSSettings.Headers["Host"]; h != "" {
+			q.Set("host", h)
+		}
+		scheme := "ws"
+		if secure {
+			scheme = "wss"
+		}
+		return proxyURL(scheme, "", "", host, port, ss.WSSettings.Path, q) + "," + u, nil
+
+	case "grpc", "gun":
+		return proxyURL("grpc", "", "", host, port, "/"+ss.GRPCSettings.ServiceName, q) + "," + u, nil
+	}
+
+	return "", errors.New("network " + ss.Network + " not supported")
+}
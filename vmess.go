@@ -0,0 +1,364 @@
+// vmess client with the aead header(alterId=0), tcp only:
+// https://github.com/v2fly/v2fly-github-io/blob/master/docs/developer/protocols/vmess.md
+
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"hash/fnv"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// vmess security types
+const (
+	vmessSecurityAES128GCM        = 3
+	vmessSecurityChacha20Poly1305 = 4
+	vmessSecurityNone             = 5
+)
+
+const (
+	vmessVersion     = 1
+	vmessOptChunk    = 0x01 // chunk stream
+	vmessCmdTCP      = 1
+	vmessMaxChunk    = 8192
+	vmessCmdKeySalt  = "c48619fe-8f02-49e0-b9e9-edf763e17e21"
+	vmessKDFSaltRoot = "VMess AEAD KDF"
+)
+
+// VMess is a vmess client
+type VMess struct {
+	*Forwarder
+
+	cmdKey   []byte
+	security byte
+}
+
+// NewVMess returns a vmess client: vmess://UUID@host:port?security=auto&alterId=0
+func NewVMess(addr, uuid, rawQuery string, cDialer Dialer) (*VMess, error) {
+	id, err := hex.DecodeString(strings.Replace(uuid, "-", "", -1))
+	if err != nil || len(id) != 16 {
+		return nil, errors.New("proxy-vmess: invalid uuid '" + uuid + "'")
+	}
+
+	s := &VMess{Forwarder: NewForwarder(addr, cDialer)}
+
+	k := md5.Sum(append(id, vmessCmdKeySalt...))
+	s.cmdKey = k[:]
+
+	p, _ := url.ParseQuery(rawQuery)
+	switch p.Get("security") {
+	case "", "auto":
+		// the client chooses, by the cpu features or -aead
+		s.security = vmessSecurityChacha20Poly1305
+		if aeadPreferAES {
+			s.security = vmessSecurityAES128GCM
+		}
+	case "aes-128-gcm":
+		s.security = vmessSecurityAES128GCM
+	case "chacha20-poly1305":
+		s.security = vmessSecurityChacha20Poly1305
+	case "none":
+		s.security = vmessSecurityNone
+	default:
+		return nil, errors.New("proxy-vmess: security '" + p.Get("security") + "' not supported, available: auto aes-128-gcm chacha20-poly1305 none")
+	}
+
+	if v := p.Get("alterId"); v != "" && v != "0" {
+		return nil, errors.New("proxy-vmess: legacy header(alterId > 0) not supported, use alterId=0")
+	}
+
+	return s, nil
+}
+
+// Dial connects to the address addr on the network net via the proxy.
+func (s *VMess) Dial(network, addr string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 1 || port > 0xffff {
+		return nil, newError(ErrInvalidAddr, "proxy-vmess: invalid port "+portStr)
+	}
+
+	start := time.Now()
+	rc, err := s.cDialer.Dial("tcp", s.addr)
+	if err != nil {
+		logf("dial to %s error: %s", s.addr, err)
+		return nil, err
+	}
+
+	if c, ok := rc.(*net.TCPConn); ok {
+		c.SetKeepAlive(true)
+	}
+
+	c := &vmessConn{Conn: rc, security: s.security}
+	if err := c.writeRequest(s.cmdKey, host, port); err != nil {
+		rc.Close()
+		return nil, err
+	}
+
+	logf("proxy-vmess connect to %s via %s", addr, s.addr)
+	return newTTFBConn(c, start, getLatencyStats("vmess", s.addr)), nil
+}
+
+// DialUDP connects to the given address via the proxy.
+func (s *VMess) DialUDP(network, addr string) (net.PacketConn, net.Addr, error) {
+	return nil, nil, newError(ErrUDPNotSupported, "proxy-vmess: udp not supported")
+}
+
+// vmessConn is a vmess tcp stream
+type vmessConn struct {
+	net.Conn
+	security byte
+
+	reqKey, reqIV   [16]byte
+	respKey, respIV [16]byte
+	respV           byte
+
+	wmu    sync.Mutex
+	enc    cipher.AEAD
+	wcount uint16
+
+	dec    cipher.AEAD
+	rcount uint16
+	rbuf   []byte
+	rhead  bool // the response header has been read
+}
+
+// writeRequest sends the aead request header
+func (c *vmessConn) writeRequest(cmdKey []byte, host string, port int) error {
+	var r [33]byte
+	if _, err := rand.Read(r[:]); err != nil {
+		return err
+	}
+	copy(c.reqIV[:], r[:16])
+	copy(c.reqKey[:], r[16:32])
+	c.respV = r[32]
+
+	k, iv := sha256.Sum256(c.reqKey[:]), sha256.Sum256(c.reqIV[:])
+	copy(c.respKey[:], k[:16])
+	copy(c.respIV[:], iv[:16])
+
+	switch c.security {
+	case vmessSecurityAES128GCM:
+		c.enc, _ = newAESGCM(c.reqKey[:])
+		c.dec, _ = newAESGCM(c.respKey[:])
+	case vmessSecurityChacha20Poly1305:
+		c.enc, _ = chacha20poly1305.New(vmessChachaKey(c.reqKey[:]))
+		c.dec, _ = chacha20poly1305.New(vmessChachaKey(c.respKey[:]))
+	}
+
+	// Ver(1) IV(16) Key(16) V(1) Opt(1) P|Sec(1) Rsv(1) Cmd(1) Port(2) AddrType(1) Addr Padding(P) F(4)
+	b := []byte{vmessVersion}
+	b = append(b, c.reqIV[:]...)
+	b = append(b, c.reqKey[:]...)
+	b = append(b, c.respV, vmessOptChunk, c.security, 0, vmessCmdTCP, byte(port>>8), byte(port))
+
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return newError(ErrInvalidAddr, "proxy-vmess: domain too long: "+host)
+		}
+		b = append(b, 2, byte(len(host)))
+		b = append(b, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		b = append(b, 1)
+		b = append(b, ip4...)
+	} else {
+		b = append(b, 3)
+		b = append(b, ip.To16()...)
+	}
+
+	h := fnv.New32a()
+	h.Write(b)
+	b = h.Sum(b)
+
+	_, err := c.Conn.Write(vmessSealHeader(cmdKey, b))
+	return err
+}
+
+// vmessSealHeader seals the request header: AuthID(16) Len(2+16) Nonce(8) Header(n+16)
+func vmessSealHeader(cmdKey, header []byte) []byte {
+	var authID [16]byte
+	binary.BigEndian.PutUint64(authID[:], uint64(time.Now().Unix()))
+	rand.Read(authID[8:12])
+	binary.BigEndian.PutUint32(authID[12:], crc32.ChecksumIEEE(authID[:12]))
+
+	block, _ := aes.NewCipher(vmessKDF(cmdKey, "AES Auth ID Encryption")[:16])
+	block.Encrypt(authID[:], authID[:])
+
+	var nonce [8]byte
+	rand.Read(nonce[:])
+
+	id, n := string(authID[:]), string(nonce[:])
+
+	b := append([]byte{}, authID[:]...)
+
+	lenAEAD, _ := newAESGCM(vmessKDF(cmdKey, "VMess Header AEAD Key_Length", id, n)[:16])
+	b = lenAEAD.Seal(b, vmessKDF(cmdKey, "VMess Header AEAD Nonce_Length", id, n)[:12],
+		[]byte{byte(len(header) >> 8), byte(len(header))}, authID[:])
+
+	b = append(b, nonce[:]...)
+
+	headerAEAD, _ := newAESGCM(vmessKDF(cmdKey, "VMess Header AEAD Key", id, n)[:16])
+	return headerAEAD.Seal(b, vmessKDF(cmdKey, "VMess Header AEAD Nonce", id, n)[:12], header, authID[:])
+}
+
+// readResponse reads the aead response header
+func (c *vmessConn) readResponse() error {
+	lenAEAD, _ := newAESGCM(vmessKDF(c.respKey[:], "AEAD Resp Header Len Key")[:16])
+	buf := make([]byte, 2+lenAEAD.Overhead())
+	if _, err := io.ReadFull(c.Conn, buf); err != nil {
+		return err
+	}
+
+	l, err := lenAEAD.Open(nil, vmessKDF(c.respIV[:], "AEAD Resp Header Len IV")[:12], buf, nil)
+	if err != nil {
+		return wrapError(ErrAuth, "proxy-vmess: decrypt response header length error", err)
+	}
+
+	headerAEAD, _ := newAESGCM(vmessKDF(c.respKey[:], "AEAD Resp Header Key")[:16])
+	buf = make([]byte, int(binary.BigEndian.Uint16(l))+headerAEAD.Overhead())
+	if _, err := io.ReadFull(c.Conn, buf); err != nil {
+		return err
+	}
+
+	// V(1) Opt(1) Cmd(1) CmdLen(1) Cmd
+	h, err := headerAEAD.Open(nil, vmessKDF(c.respIV[:], "AEAD Resp Header IV")[:12], buf, nil)
+	if err != nil {
+		return wrapError(ErrAuth, "proxy-vmess: decrypt response header error", err)
+	}
+
+	if len(h) < 4 || h[0] != c.respV {
+		return newError(ErrProtocol, "proxy-vmess: unexpected response header")
+	}
+
+	return nil
+}
+
+// chunkNonce returns the nonce of the count-th chunk: count(2) iv[2:12]
+func chunkNonce(iv []byte, count uint16) []byte {
+	n := append([]byte{}, iv[:12]...)
+	binary.BigEndian.PutUint16(n, count)
+	return n
+}
+
+// Write sends b in chunks: size(2) payload, the payload is sealed with the aead security.
+func (c *vmessConn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	var n int
+	for len(b) > 0 {
+		l := len(b)
+		if l > vmessMaxChunk {
+			l = vmessMaxChunk
+		}
+
+		var buf []byte
+		if c.enc != nil {
+			size := l + c.enc.Overhead()
+			buf = c.enc.Seal([]byte{byte(size >> 8), byte(size)}, chunkNonce(c.reqIV[:], c.wcount), b[:l], nil)
+			c.wcount++
+		} else {
+			buf = append([]byte{byte(l >> 8), byte(l)}, b[:l]...)
+		}
+
+		if _, err := c.Conn.Write(buf); err != nil {
+			return n, err
+		}
+
+		n += l
+		b = b[l:]
+	}
+
+	return n, nil
+}
+
+func (c *vmessConn) Read(b []byte) (int, error) {
+	if !c.rhead {
+		if err := c.readResponse(); err != nil {
+			return 0, err
+		}
+		c.rhead = true
+	}
+
+	for len(c.rbuf) == 0 {
+		var size [2]byte
+		if _, err := io.ReadFull(c.Conn, size[:]); err != nil {
+			return 0, err
+		}
+
+		buf := make([]byte, binary.BigEndian.Uint16(size[:]))
+		if _, err := io.ReadFull(c.Conn, buf); err != nil {
+			return 0, err
+		}
+
+		if c.dec != nil {
+			var err error
+			if buf, err = c.dec.Open(buf[:0], chunkNonce(c.respIV[:], c.rcount), buf, nil); err != nil {
+				return 0, wrapError(ErrProtocol, "proxy-vmess: decrypt error", err)
+			}
+			c.rcount++
+		}
+
+		// an empty chunk marks the end of the stream
+		if len(buf) == 0 {
+			return 0, io.EOF
+		}
+		c.rbuf = buf
+	}
+
+	n := copy(b, c.rbuf)
+	c.rbuf = c.rbuf[n:]
+
+	return n, nil
+}
+
+// vmessKDF is the nested hmac-sha256 key derivation of the vmess aead header
+func vmessKDF(key []byte, path ...string) []byte {
+	h := sha256.New
+	for _, p := range append([]string{vmessKDFSaltRoot}, path...) {
+		h = func(parent func() hash.Hash, k []byte) func() hash.Hash {
+			return func() hash.Hash { return hmac.New(parent, k) }
+		}(h, []byte(p))
+	}
+
+	m := h()
+	m.Write(key)
+	return m.Sum(nil)
+}
+
+// vmessChachaKey expands the 16 bytes key to the chacha20-poly1305 key: md5(key) md5(md5(key))
+func vmessChachaKey(key []byte) []byte {
+	k := md5.Sum(key)
+	kk := md5.Sum(k[:])
+	return append(k[:], kk[:]...)
+}
+
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/aes"
+	"encoding/binary"
+	"encoding/hex"
+	"hash/crc32"
+	"testing"
+	"time"
+)
+
+// the vectors are generated with github.com/v2fly/v2ray-core/v5 of the uuid below
+const (
+	vmessTestUUID   = "b831381d-6324-4d53-ad4f-8cda48b30811"
+	vmessTestCmdKey = "b50d916ac0cec067981af8e5f38a758f"
+)
+
+func vmessTestKey(t *testing.T) []byte {
+	k, err := hex.DecodeString(vmessTestCmdKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+// protocol.NewID(uuid).CmdKey() and aead.KDF(cmdKey, path...)
+func TestVMessKDF(t *testing.T) {
+	s, err := NewVMess("127.0.0.1:10086", vmessTestUUID, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := hex.EncodeToString(s.cmdKey); got != vmessTestCmdKey {
+		t.Errorf("cmdKey = %s, want %s", got, vmessTestCmdKey)
+	}
+
+	tests := []struct {
+		path []string
+		want string
+	}{
+		{[]string{"AES Auth ID Encryption"}, "1415ba74ca8b3d041a8f583fb4116315c589ae7b6e81765b601aa166c62871f7"},
+		{[]string{"VMess Header AEAD Key", "0123456789abcdef", "01234567"}, "109475b86a22e05bbaf31a71e35080033e980b23c227e228fc06c246b2c3e967"},
+		{[]string{"VMess Header AEAD Nonce", "0123456789abcdef", "01234567"}, "eec0bae729a4e82d3afbfdb29dab6dc90e1a5d71eb9b1a8a7b700dd63741295f"},
+	}
+
+	for _, tt := range tests {
+		if got := hex.EncodeToString(vmessKDF(vmessTestKey(t), tt.path...)); got != tt.want {
+			t.Errorf("vmessKDF(%q) = %s, want %s", tt.path, got, tt.want)
+		}
+	}
+}
+
+// vmessOpenHeader opens a sealed request header as the server, returns the timestamp of the auth id
+func vmessOpenHeader(t *testing.T, cmdKey, b []byte) (int64, []byte) {
+	if len(b) < 16+18+8 {
+		t.Fatalf("sealed header too short: %d bytes", len(b))
+	}
+
+	var authID [16]byte
+	block, _ := aes.NewCipher(vmessKDF(cmdKey, "AES Auth ID Encryption")[:16])
+	block.Decrypt(authID[:], b[:16])
+	if crc32.ChecksumIEEE(authID[:12]) != binary.BigEndian.Uint32(authID[12:]) {
+		t.Fatalf("auth id checksum mismatch: %x", authID)
+	}
+
+	id, n := string(b[:16]), string(b[34:42])
+
+	lenAEAD, _ := newAESGCM(vmessKDF(cmdKey, "VMess Header AEAD Key_Length", id, n)[:16])
+	l, err := lenAEAD.Open(nil, vmessKDF(cmdKey, "VMess Header AEAD Nonce_Length", id, n)[:12], b[16:34], b[:16])
+	if err != nil {
+		t.Fatalf("open header length: %v", err)
+	}
+
+	headerAEAD, _ := newAESGCM(vmessKDF(cmdKey, "VMess Header AEAD Key", id, n)[:16])
+	h, err := headerAEAD.Open(nil, vmessKDF(cmdKey, "VMess Header AEAD Nonce", id, n)[:12], b[42:], b[:16])
+	if err != nil {
+		t.Fatalf("open header: %v", err)
+	}
+	if len(h) != int(binary.BigEndian.Uint16(l)) {
+		t.Fatalf("header length = %d, want %d", len(h), binary.BigEndian.Uint16(l))
+	}
+
+	return int64(binary.BigEndian.Uint64(authID[:8])), h
+}
+
+func TestVMessSealHeader(t *testing.T) {
+	key := vmessTestKey(t)
+
+	// aead.SealVMessAEADHeader(cmdKey, "vmess aead header")
+	sealed, _ := hex.DecodeString("31d7b9e631228e16de82046b8fc095f93bb9587ce0fd2701ef04e20a026ed751" +
+		"19b70c5fd7fb87592441cd90af7cc5d0a1ea31202b6c53fc8515fdcc48738c5e606b51d496d52a2fe2a39c")
+	if _, h := vmessOpenHeader(t, key, sealed); string(h) != "vmess aead header" {
+		t.Errorf("v2ray header = %q", h)
+	}
+
+	ts, h := vmessOpenHeader(t, key, vmessSealHeader(key, []byte("glider header")))
+	if string(h) != "glider header" {
+		t.Errorf("header = %q", h)
+	}
+	if d := time.Now().Unix() - ts; d < 0 || d > 60 {
+		t.Errorf("auth id timestamp is %ds off", d)
+	}
+}
+
+// encoding.GenerateChunkNonce(iv, 12)
+func TestChunkNonce(t *testing.T) {
+	iv := make([]byte, 16)
+	for i := range iv {
+		iv[i] = byte(0xa0 + i)
+	}
+
+	tests := []struct {
+		count uint16
+		want  string
+	}{
+		{0, "0000a2a3a4a5a6a7a8a9aaab"},
+		{1, "0001a2a3a4a5a6a7a8a9aaab"},
+		{257, "0101a2a3a4a5a6a7a8a9aaab"},
+	}
+
+	for _, tt := range tests {
+		if got := hex.EncodeToString(chunkNonce(iv, tt.count)); got != tt.want {
+			t.Errorf("chunkNonce(%d) = %s, want %s", tt.count, got, tt.want)
+		}
+	}
+	if iv[0] != 0xa0 {
+		t.Error("chunkNonce modified the iv")
+	}
+}
+
+// encoding.GenerateChacha20Poly1305Key(key): md5(key) md5(md5(key))
+func TestVMessChachaKey(t *testing.T) {
+	key := make([]byte, 16)
+	for i := range key {
+		key[i] = byte(i)
+	}
+
+	want := "1ac1ef01e96caf1be0d329331a4fc2a8e0542db5418c43d256a6a643afa553fe"
+	if got := hex.EncodeToString(vmessChachaKey(key)); got != want {
+		t.Errorf("vmessChachaKey = %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// weight=N and priority=N on a hop of a forwarder chain: the strategies only use the available
+// forwarders with the highest priority(0 by default), the others are the backups, and within them
+// rr, dh and sh split the connections in proportion to the weights(1 by default).
+const (
+	defaultWeight = 1
+	maxWeight     = 100
+)
+
+// fwdOpts are the strategy options of a forwarder chain
+type fwdOpts struct {
+	weight   int
+	priority int
+}
+
+// chainOpts returns the strategy options of chain, the last hop setting one wins
+func chainOpts(chain string) (fwdOpts, error) {
+	o := fwdOpts{weight: defaultWeight}
+	for _, s := range strings.Split(chain, ",") {
+		i := strings.IndexByte(s, '?')
+		if i < 0 {
+			continue
+		}
+
+		p, _ := url.ParseQuery(s[i+1:])
+		if v := p.Get("weight"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > maxWeight {
+				return o, errors.New("forward: invalid weight '" + v + "' in '" + chain + "', 1-" + strconv.Itoa(maxWeight))
+			}
+			o.weight = n
+		}
+		if v := p.Get("priority"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return o, errors.New("forward: invalid priority '" + v + "' in '" + chain + "'")
+			}
+			o.priority = n
+		}
+	}
+	return o, nil
+}
+
+// chainOptsOf are the strategy options of the dialers of the forwarder chains, Dialer -> fwdOpts
+var chainOptsOf sync.Map
+
+// optsOf returns the strategy options of the forwarder d, the defaults if it's not a chain
+func optsOf(d Dialer) fwdOpts {
+	if v, ok := chainOptsOf.Load(d); ok {
+		return v.(fwdOpts)
+	}
+	return fwdOpts{weight: defaultWeight}
+}
+
+// weightedSlots returns the indexes in avail repeated by their weights in the order of the
+// smooth weighted round robin, so the heavy ones are interleaved with the others.
+func weightedSlots(avail, weights []int) []int {
+	total := 0
+	for _, k := range avail {
+		total += weights[k]
+	}
+	if total == len(avail) {
+		return avail
+	}
+
+	slots := make([]int, 0, total)
+	cur := make([]int, len(avail))
+	for len(slots) < total {
+		best := 0
+		for i, k := range avail {
+			cur[i] += weights[k]
+			if cur[i] > cur[best] {
+				best = i
+			}
+		}
+		cur[best] -= total
+		slots = append(slots, avail[best])
+	}
+	return slots
+}
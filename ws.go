@@ -0,0 +1,354 @@
+// websocket transport: https://tools.ietf.org/html/rfc6455
+
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// websocket opcodes
+const (
+	wsContinuation = 0x0
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+)
+
+// WS is a websocket transport, it carries the stream of the next forwarder in a chain
+// to the websocket server, which decides the backend, e.g. through a cdn:
+//
+//	ws://cdn.example.com:80/path?host=origin.example.com,socks5://origin.example.com:1080
+//	wss://cdn.example.com:443/path?header=X-Token:abc&fingerprint=chrome,trojan://pass@origin.example.com:443
+//
+// The connect address, the tls server name and the Host header are set separately for domain fronting:
+// wss://CONNECT_IP:443/path?serverName=front.example.com&host=origin.example.com, sni=false omits the server name.
+// keepalive=SECONDS pings the server on each connection, e.g. for the long idle ssh sessions behind a NAT,
+// the connection is closed if nothing is received for 4 intervals, disabled by default.
+type WS struct {
+	*Forwarder
+
+	path      string
+	host      string // Host header
+	header    http.Header
+	tlsConfig *tls.Config // wss
+	tlsFP     *utls.ClientHelloID
+	keepAlive time.Duration
+}
+
+// NewWS returns a websocket transport
+func NewWS(addr, path, rawQuery string, secure bool, cDialer Dialer) (*WS, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, port = addr, "80"
+		if secure {
+			port = "443"
+		}
+		addr = net.JoinHostPort(host, port)
+	}
+
+	if path == "" {
+		path = "/"
+	}
+
+	s := &WS{
+		Forwarder: NewForwarder(addr, cDialer),
+		path:      path,
+		host:      host,
+		header:    make(http.Header),
+	}
+
+	p, _ := url.ParseQuery(rawQuery)
+	if v := p.Get("host"); v != "" {
+		s.host = v
+	}
+
+	if s.keepAlive, err = parseKeepAlive(p, 0); err != nil {
+		return nil, errors.New("proxy-ws: " + err.Error())
+	}
+
+	for _, h := range p["header"] {
+		kv := strings.SplitN(h, ":", 2)
+		if len(kv) != 2 {
+			return nil, errors.New("proxy-ws: invalid header '" + h + "', format: NAME:VALUE")
+		}
+		s.header.Add(strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1]))
+	}
+
+	if secure {
+		if s.tlsConfig, err = tlsClientConfig(s.host, p); err != nil {
+			return nil, errors.New("proxy-ws: " + err.Error())
+		}
+
+		if s.tlsFP, err = parseFingerprint(p.Get("fingerprint")); err != nil {
+			return nil, errors.New("proxy-ws: " + err.Error())
+		}
+	}
+
+	return s, nil
+}
+
+// Dial connects to the websocket server, addr is decided by the server and ignored.
+func (s *WS) Dial(network, addr string) (net.Conn, error) {
+	start := time.Now()
+	rc, err := s.cDialer.Dial("tcp", s.addr)
+	if err != nil {
+		logf("dial to %s error: %s", s.addr, err)
+		return nil, err
+	}
+
+	if c, ok := rc.(*net.TCPConn); ok {
+		c.SetKeepAlive(true)
+	}
+
+	if s.tlsConfig != nil {
+		tc, err := tlsClient(rc, s.tlsConfig, s.tlsFP)
+		if err != nil {
+			rc.Close()
+			logf("proxy-ws tls handshake with %s error: %s", s.addr, err)
+			return nil, err
+		}
+		rc = tc
+	}
+
+	c, err := s.handshake(rc)
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+
+	if s.keepAlive > 0 {
+		go c.keepAlive(s.keepAlive)
+	}
+
+	logf("proxy-ws connect to %s via %s%s, handshake: %s", addr, s.addr, s.path, time.Since(start))
+	return c, nil
+}
+
+// handshake upgrades the connection to websocket
+func (s *WS) handshake(rc net.Conn) (*wsConn, error) {
+	var k [16]byte
+	rand.Read(k[:])
+	key := base64.StdEncoding.EncodeToString(k[:])
+
+	req := &http.Request{
+		Method:     "GET",
+		URL:        &url.URL{Path: s.path},
+		Host:       s.host,
+		Header:     make(http.Header),
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+	}
+
+	for k, v := range s.header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+
+	if err := req.Write(rc); err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(rc)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		return nil, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusSwitchingProtocols:
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return nil, newError(ErrAuth, "proxy-ws: handshake with "+s.addr+" failed: "+resp.Status)
+	default:
+		return nil, newError(ErrProtocol, "proxy-ws: handshake with "+s.addr+" failed: "+resp.Status)
+	}
+
+	h := sha1.Sum([]byte(key + wsGUID))
+	if resp.Header.Get("Sec-WebSocket-Accept") != base64.StdEncoding.EncodeToString(h[:]) {
+		return nil, newError(ErrProtocol, "proxy-ws: invalid Sec-WebSocket-Accept from "+s.addr)
+	}
+
+	return &wsConn{Conn: rc, r: r, lastRead: time.Now().UnixNano(), done: make(chan struct{})}, nil
+}
+
+// DialUDP connects to the given address via the proxy.
+func (s *WS) DialUDP(network, addr string) (net.PacketConn, net.Addr, error) {
+	return nil, nil, newError(ErrUDPNotSupported, "proxy-ws: udp not supported, chain a protocol with udp over stream(e.g. trojan)")
+}
+
+// wsConn is a client side websocket connection, the data are sent in binary frames
+type wsConn struct {
+	net.Conn
+	r *bufio.Reader
+
+	wmu    sync.Mutex
+	remain int64 // unread payload of the current frame
+
+	lastRead  int64 // unix nano of the last frame received, atomic
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// keepAlive pings the server every interval until closed, closes the connection if nothing
+// is received for keepAliveMisses intervals, so the relay doesn't hang on a dead connection.
+func (c *wsConn) keepAlive(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-t.C:
+		}
+
+		if idle := time.Since(time.Unix(0, atomic.LoadInt64(&c.lastRead))); idle > interval*keepAliveMisses {
+			logf("proxy-ws connection to %s closed, nothing received for %s", c.RemoteAddr(), idle)
+			c.Conn.Close()
+			return
+		}
+
+		if err := c.writeFrame(wsPing, nil); err != nil {
+			return
+		}
+	}
+}
+
+// writeFrame writes a masked frame
+func (c *wsConn) writeFrame(op byte, b []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	buf := make([]byte, 0, 14+len(b))
+	buf = append(buf, 0x80|op) // FIN
+
+	switch l := len(b); {
+	case l < 126:
+		buf = append(buf, 0x80|byte(l))
+	case l <= 0xffff:
+		buf = append(buf, 0x80|126, byte(l>>8), byte(l))
+	default:
+		buf = append(buf, 0x80|127)
+		buf = buf[:len(buf)+8]
+		binary.BigEndian.PutUint64(buf[len(buf)-8:], uint64(l))
+	}
+
+	var mask [4]byte
+	rand.Read(mask[:])
+	buf = append(buf, mask[:]...)
+
+	for i, v := range b {
+		buf = append(buf, v^mask[i&3])
+	}
+
+	_, err := c.Conn.Write(buf)
+	return err
+}
+
+func (c *wsConn) Write(b []byte) (int, error) {
+	if err := c.writeFrame(wsBinary, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// nextFrame reads the header of the next data frame, handles the control frames
+func (c *wsConn) nextFrame() error {
+	for {
+		var h [2]byte
+		if _, err := io.ReadFull(c.r, h[:]); err != nil {
+			return err
+		}
+		atomic.StoreInt64(&c.lastRead, time.Now().UnixNano())
+
+		op := h[0] & 0x0f
+		l := int64(h[1] & 0x7f)
+		switch l {
+		case 126:
+			var b [2]byte
+			if _, err := io.ReadFull(c.r, b[:]); err != nil {
+				return err
+			}
+			l = int64(binary.BigEndian.Uint16(b[:]))
+		case 127:
+			var b [8]byte
+			if _, err := io.ReadFull(c.r, b[:]); err != nil {
+				return err
+			}
+			l = int64(binary.BigEndian.Uint64(b[:]))
+		}
+
+		// the frames from the server must not be masked
+		if h[1]&0x80 != 0 {
+			return newError(ErrProtocol, "proxy-ws: masked frame from server")
+		}
+
+		switch op {
+		case wsBinary, wsContinuation, 0x1:
+			c.remain = l
+			return nil
+		case wsClose:
+			return io.EOF
+		}
+
+		// control frames
+		if l > 125 {
+			return newError(ErrProtocol, "proxy-ws: invalid control frame")
+		}
+
+		payload := make([]byte, l)
+		if _, err := io.ReadFull(c.r, payload); err != nil {
+			return err
+		}
+
+		if op == wsPing {
+			if err := c.writeFrame(wsPong, payload); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (c *wsConn) Read(b []byte) (int, error) {
+	for c.remain == 0 {
+		if err := c.nextFrame(); err != nil {
+			return 0, err
+		}
+	}
+
+	if int64(len(b)) > c.remain {
+		b = b[:c.remain]
+	}
+
+	n, err := c.r.Read(b)
+	c.remain -= int64(n)
+	return n, err
+}
+
+func (c *wsConn) Close() error {
+	c.closeOnce.Do(func() { close(c.done) })
+	c.writeFrame(wsClose, []byte{0x03, 0xe8}) // 1000: normal closure
+	return c.Conn.Close()
+}
@@ -0,0 +1,537 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// yamlConf is the structured config file format, an alternative to the flag-style config file
+type yamlConf struct {
+	Verbose  bool         `yaml:"verbose,omitempty"`
+	Listen   []string     `yaml:"listen,omitempty"`
+	Forward  []string     `yaml:"forward,omitempty"`
+	Strategy yamlStrategy `yaml:"strategy,omitempty"`
+
+	DNS       yamlDNS `yaml:"dns,omitempty"`
+	IPSet     string  `yaml:"ipset,omitempty"`
+	Mark      int     `yaml:"mark,omitempty"`
+	Interface string  `yaml:"interface,omitempty"`
+	SourceIP  string  `yaml:"sourceip,omitempty"`
+	AutoRoute bool    `yaml:"autoroute,omitempty"`
+
+	LoopDetect  bool   `yaml:"loopdetect,omitempty"`
+	MCastPolicy string `yaml:"mcastpolicy,omitempty"`
+	BitTorrent  string `yaml:"bittorrent,omitempty"`
+
+	Country []string `yaml:"country,omitempty"`
+
+	RuleFile []string   `yaml:"rulefile,omitempty"`
+	RulesDir string     `yaml:"rulesdir,omitempty"`
+	Rules    []yamlRule `yaml:"rules,omitempty"`
+
+	// named profiles, the selected one overrides the sections above
+	Profiles map[string]*yamlConf `yaml:"profiles,omitempty"`
+}
+
+// yamlStrategy is the strategy section
+type yamlStrategy struct {
+	Strategy      string   `yaml:"strategy,omitempty"`
+	CheckWebSite  string   `yaml:"checkwebsite,omitempty"`
+	CheckDuration int      `yaml:"checkduration,omitempty"`
+	CheckUDP      string   `yaml:"checkudp,omitempty"`
+	CheckTimeout  int      `yaml:"checktimeout,omitempty"`
+	MaxFailures   int      `yaml:"maxfailures,omitempty"`
+	Tolerance     int      `yaml:"tolerance,omitempty"`
+	RetryTTL      int      `yaml:"retryttl,omitempty"`
+	LearnTTL      int      `yaml:"learnttl,omitempty"`
+	Schedule      []string `yaml:"schedule,omitempty"`
+}
+
+// yamlDNS is the dns section
+type yamlDNS struct {
+	Listen string   `yaml:"listen,omitempty"`
+	Server []string `yaml:"server,omitempty"`
+}
+
+// yamlRule is a rule section, the same as a rule file
+type yamlRule struct {
+	Name     string       `yaml:"name"`
+	Forward  []string     `yaml:"forward,omitempty"`
+	Strategy yamlStrategy `yaml:"strategy,omitempty"`
+
+	DNSServer []string `yaml:"dnsserver,omitempty"`
+	IPSet     string   `yaml:"ipset,omitempty"`
+
+	DSCP int `yaml:"dscp,omitempty"`
+	Mark int `yaml:"mark,omitempty"`
+
+	BlockQUIC  bool   `yaml:"blockquic,omitempty"`
+	BitTorrent string `yaml:"bittorrent,omitempty"`
+
+	Domain []string `yaml:"domain,omitempty"`
+	TLD    []string `yaml:"tld,omitempty"`
+	IP     []string `yaml:"ip,omitempty"`
+	CIDR   []string `yaml:"cidr,omitempty"`
+
+	Rewrite []string `yaml:"rewrite,omitempty"`
+
+	Redirect  string `yaml:"redirect,omitempty"`
+	BlockPage string `yaml:"blockpage,omitempty"`
+
+	Expect []string `yaml:"expect,omitempty"`
+
+	GeoIPURL   []string `yaml:"geoipurl,omitempty"`
+	GeoSiteURL []string `yaml:"geositeurl,omitempty"`
+	GeoUpdate  int      `yaml:"geoupdate,omitempty"`
+	GeoVerify  *bool    `yaml:"geoverify,omitempty"`
+}
+
+// loadYAMLConf loads the structured config file and applies it to conf,
+// values in the yaml file override the flag-style ones.
+func loadYAMLConf(file string) error {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	var y yamlConf
+	if err := yaml.UnmarshalStrict(b, &y); err != nil {
+		return errors.New("parse " + file + " error: " + err.Error())
+	}
+
+	if conf.Profile != "" {
+		p, ok := y.Profiles[conf.Profile]
+		if !ok {
+			return errors.New("profile '" + conf.Profile + "' not found in " + file)
+		}
+
+		y.override(p)
+		logf("use profile '%s' in %s", conf.Profile, file)
+	}
+
+	if err := y.validate(); err != nil {
+		return errors.New("invalid config " + file + ": " + err.Error())
+	}
+
+	if y.Verbose {
+		conf.Verbose = true
+	}
+
+	conf.Listen = append(conf.Listen, y.Listen...)
+	conf.Forward = append(conf.Forward, y.Forward...)
+	y.Strategy.apply(&conf.StrategyConfig)
+
+	if y.DNS.Listen != "" {
+		conf.DNS = y.DNS.Listen
+	}
+	if len(y.DNS.Server) > 0 {
+		conf.DNSServer = y.DNS.Server
+	}
+	if y.IPSet != "" {
+		conf.IPSet = y.IPSet
+	}
+	if y.Mark != 0 {
+		conf.Mark = y.Mark
+	}
+	if y.Interface != "" {
+		conf.Interface = y.Interface
+	}
+	if y.SourceIP != "" {
+		conf.SourceIP = y.SourceIP
+	}
+	if y.AutoRoute {
+		conf.AutoRoute = true
+	}
+
+	if y.LoopDetect {
+		conf.LoopDetect = true
+	}
+	if y.MCastPolicy != "" {
+		conf.MCastPolicy = y.MCastPolicy
+	}
+	if y.BitTorrent != "" {
+		conf.BitTorrent = y.BitTorrent
+	}
+	conf.Country = append(conf.Country, y.Country...)
+
+	conf.RuleFile = append(conf.RuleFile, y.RuleFile...)
+	if y.RulesDir != "" {
+		conf.RulesDir = y.RulesDir
+	}
+
+	for _, yr := range y.Rules {
+		conf.rules = append(conf.rules, yr.ruleConf())
+	}
+
+	return nil
+}
+
+// override replaces the sections with the non-empty ones in profile p,
+// so forwarders, rules and dns of a profile are swapped as a whole, an empty profile changes nothing.
+func (y *yamlConf) override(p *yamlConf) {
+	if p == nil {
+		return
+	}
+
+	if p.Verbose {
+		y.Verbose = true
+	}
+	if len(p.Listen) > 0 {
+		y.Listen = p.Listen
+	}
+	if len(p.Forward) > 0 {
+		y.Forward = p.Forward
+	}
+	if !p.Strategy.empty() {
+		y.Strategy = p.Strategy
+	}
+	if p.DNS.Listen != "" || len(p.DNS.Server) > 0 {
+		y.DNS = p.DNS
+	}
+	if p.IPSet != "" {
+		y.IPSet = p.IPSet
+	}
+	if p.Mark != 0 {
+		y.Mark = p.Mark
+	}
+	if p.Interface != "" {
+		y.Interface = p.Interface
+	}
+	if p.SourceIP != "" {
+		y.SourceIP = p.SourceIP
+	}
+	if p.AutoRoute {
+		y.AutoRoute = true
+	}
+	if p.LoopDetect {
+		y.LoopDetect = true
+	}
+	if p.MCastPolicy != "" {
+		y.MCastPolicy = p.MCastPolicy
+	}
+	if p.BitTorrent != "" {
+		y.BitTorrent = p.BitTorrent
+	}
+	if len(p.Country) > 0 {
+		y.Country = p.Country
+	}
+	if len(p.RuleFile) > 0 || p.RulesDir != "" || len(p.Rules) > 0 {
+		y.RuleFile, y.RulesDir, y.Rules = p.RuleFile, p.RulesDir, p.Rules
+	}
+}
+
+// validate checks the config and returns the first error found
+func (y *yamlConf) validate() error {
+	for _, l := range y.Listen {
+		if !strings.Contains(l, "://") {
+			l = "mixed://" + l
+		}
+		if head, tail, from, _, ok := portRange(l); ok {
+			l = head + strconv.Itoa(from) + tail
+		}
+		if _, err := url.Parse(l); err != nil {
+			return errors.New("listen: " + err.Error())
+		}
+	}
+
+	if err := validateForward(y.Forward); err != nil {
+		return err
+	}
+
+	if y.SourceIP != "" && net.ParseIP(y.SourceIP) == nil {
+		return errors.New("sourceip: invalid ip '" + y.SourceIP + "'")
+	}
+
+	if err := y.Strategy.validate(); err != nil {
+		return err
+	}
+
+	if err := validateMCastPolicy(y.MCastPolicy); err != nil {
+		return err
+	}
+
+	if err := validateBitTorrent(y.BitTorrent); err != nil {
+		return err
+	}
+
+	if _, err := parseCountries(y.Country); err != nil {
+		return err
+	}
+
+	names := make(map[string]bool)
+	for _, r := range y.Rules {
+		if r.Name == "" {
+			return errors.New("rules: rule name must be specified")
+		}
+
+		if names[r.Name] {
+			return errors.New("rules: duplicate rule name '" + r.Name + "'")
+		}
+		names[r.Name] = true
+
+		if err := validateForward(r.Forward); err != nil {
+			return errors.New("rule " + r.Name + ": " + err.Error())
+		}
+
+		if err := r.Strategy.validate(); err != nil {
+			return errors.New("rule " + r.Name + ": " + err.Error())
+		}
+
+		if err := validateBitTorrent(r.BitTorrent); err != nil {
+			return errors.New("rule " + r.Name + ": " + err.Error())
+		}
+
+		if r.DSCP < 0 || r.DSCP > 63 {
+			return errors.New("rule " + r.Name + ": dscp must be in range 0-63")
+		}
+
+		for _, ip := range r.IP {
+			if net.ParseIP(ip) == nil {
+				return errors.New("rule " + r.Name + ": invalid ip '" + ip + "'")
+			}
+		}
+
+		for _, cidr := range r.CIDR {
+			if _, _, err := net.ParseCIDR(cidr); err != nil {
+				return errors.New("rule " + r.Name + ": " + err.Error())
+			}
+		}
+
+		if _, err := parseRewrites(r.Rewrite); err != nil {
+			return errors.New("rule " + r.Name + ": " + err.Error())
+		}
+
+		if err := validateStatic(r.Redirect, r.BlockPage); err != nil {
+			return errors.New("rule " + r.Name + ": " + err.Error())
+		}
+
+		if _, err := parseExpects(r.Expect); err != nil {
+			return errors.New("rule " + r.Name + ": " + err.Error())
+		}
+	}
+
+	return nil
+}
+
+func validateBitTorrent(policy string) error {
+	switch policy {
+	case "", btAllow, btDeny, btDirect:
+		return nil
+	}
+	return errors.New("bittorrent: unknown policy '" + policy + "', available: allow deny direct")
+}
+
+func validateForward(forward []string) error {
+	for _, chain := range forward {
+		for _, s := range strings.Split(chain, ",") {
+			u, err := url.Parse(s)
+			if err != nil {
+				return errors.New("forward: " + err.Error())
+			}
+
+			switch u.Scheme {
+			case "group":
+				if u.Opaque == "" || strings.Contains(chain, ",") {
+					return errors.New("forward: invalid group '" + chain + "', format: group:CC")
+				}
+			case "http", "https", "socks5", "socks4", "socks4a", "ss", "trojan", "vmess", "hysteria2", "hy2", "tuic", "naive", "ws", "wss", "grpc", "tls", "shadowtls", "quic", "mux", "tor", "i2p", "dnstunnel", "icmptunnel", "reject":
+			default:
+				return errors.New("forward: unknown schema '" + u.Scheme + "'")
+			}
+		}
+
+		if err := checkChain(chain); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *yamlStrategy) validate() error {
+	switch s.Strategy {
+	case "", "rr", "ha", "lha", "dh", "sh":
+	default:
+		return errors.New("strategy: unknown strategy '" + s.Strategy + "'")
+	}
+
+	if s.CheckDuration < 0 || s.CheckTimeout < 0 || s.RetryTTL < 0 || s.LearnTTL < 0 {
+		return errors.New("strategy: durations must not be negative")
+	}
+
+	if s.MaxFailures < 0 || s.Tolerance < 0 {
+		return errors.New("strategy: maxfailures and tolerance must not be negative")
+	}
+
+	_, err := parseSchedule(s.Schedule)
+	return err
+}
+
+// empty reports whether no value is set
+func (s *yamlStrategy) empty() bool {
+	return s.Strategy == "" && s.CheckWebSite == "" && s.CheckDuration == 0 && s.CheckUDP == "" &&
+		s.CheckTimeout == 0 && s.MaxFailures == 0 && s.Tolerance == 0 && s.RetryTTL == 0 && s.LearnTTL == 0 && len(s.Schedule) == 0
+}
+
+// apply sets the non-empty values to sc
+func (s *yamlStrategy) apply(sc *StrategyConfig) {
+	if s.Strategy != "" {
+		sc.Strategy = s.Strategy
+	}
+	if s.CheckWebSite != "" {
+		sc.CheckWebSite = s.CheckWebSite
+	}
+	if s.CheckDuration != 0 {
+		sc.CheckDuration = s.CheckDuration
+	}
+	if s.CheckUDP != "" {
+		sc.CheckUDP = s.CheckUDP
+	}
+	if s.CheckTimeout != 0 {
+		sc.CheckTimeout = s.CheckTimeout
+	}
+	if s.MaxFailures != 0 {
+		sc.MaxFailures = s.MaxFailures
+	}
+	if s.Tolerance != 0 {
+		sc.Tolerance = s.Tolerance
+	}
+	if s.RetryTTL != 0 {
+		sc.RetryTTL = s.RetryTTL
+	}
+	if s.LearnTTL != 0 {
+		sc.LearnTTL = s.LearnTTL
+	}
+	if len(s.Schedule) > 0 {
+		sc.Schedule = s.Schedule
+	}
+}
+
+// ruleConf converts the yaml rule to a RuleConf, with the same defaults as a rule file
+func (r *yamlRule) ruleConf() *RuleConf {
+	p := &RuleConf{
+		name:    r.Name,
+		Forward: r.Forward,
+		StrategyConfig: StrategyConfig{
+			Strategy:      "rr",
+			CheckWebSite:  "www.apple.com",
+			CheckDuration: 30,
+			CheckTimeout:  defaultCheckTimeout,
+			MaxFailures:   defaultMaxFailures,
+			Tolerance:     defaultTolerance,
+		},
+
+		DNSServer: r.DNSServer,
+		IPSet:     r.IPSet,
+
+		DSCP: r.DSCP,
+		Mark: r.Mark,
+
+		BlockQUIC:  r.BlockQUIC,
+		BitTorrent: r.BitTorrent,
+
+		Domain: r.Domain,
+		TLD:    r.TLD,
+		IP:     r.IP,
+		CIDR:   r.CIDR,
+
+		Rewrite: r.Rewrite,
+
+		Redirect:  r.Redirect,
+		BlockPage: r.BlockPage,
+
+		Expect: r.Expect,
+
+		GeoIPURL:   r.GeoIPURL,
+		GeoSiteURL: r.GeoSiteURL,
+		GeoUpdate:  24,
+		GeoVerify:  true,
+	}
+
+	r.Strategy.apply(&p.StrategyConfig)
+
+	if r.GeoUpdate != 0 {
+		p.GeoUpdate = r.GeoUpdate
+	}
+	if r.GeoVerify != nil {
+		p.GeoVerify = *r.GeoVerify
+	}
+
+	return p
+}
+
+// dumpYAMLConf converts the current config(including rule files) to the structured format
+func dumpYAMLConf() ([]byte, error) {
+	y := &yamlConf{
+		Verbose: conf.Verbose,
+		Listen:  conf.Listen,
+		Forward: conf.Forward,
+		Strategy: yamlStrategy{
+			Strategy:      conf.Strategy,
+			CheckWebSite:  conf.CheckWebSite,
+			CheckDuration: conf.CheckDuration,
+			CheckUDP:      conf.CheckUDP,
+			CheckTimeout:  conf.CheckTimeout,
+			MaxFailures:   conf.MaxFailures,
+			Tolerance:     conf.Tolerance,
+			RetryTTL:      conf.RetryTTL,
+			LearnTTL:      conf.LearnTTL,
+			Schedule:      conf.Schedule,
+		},
+		DNS:         yamlDNS{Listen: conf.DNS, Server: conf.DNSServer},
+		IPSet:       conf.IPSet,
+		Mark:        conf.Mark,
+		Interface:   conf.Interface,
+		SourceIP:    conf.SourceIP,
+		AutoRoute:   conf.AutoRoute,
+		LoopDetect:  conf.LoopDetect,
+		MCastPolicy: conf.MCastPolicy,
+		BitTorrent:  conf.BitTorrent,
+		Country:     conf.Country,
+	}
+
+	for _, r := range conf.rules {
+		verify := r.GeoVerify
+		y.Rules = append(y.Rules, yamlRule{
+			Name:    r.name,
+			Forward: r.Forward,
+			Strategy: yamlStrategy{
+				Strategy:      r.Strategy,
+				CheckWebSite:  r.CheckWebSite,
+				CheckDuration: r.CheckDuration,
+				CheckUDP:      r.CheckUDP,
+				CheckTimeout:  r.CheckTimeout,
+				MaxFailures:   r.MaxFailures,
+				Tolerance:     r.Tolerance,
+				RetryTTL:      r.RetryTTL,
+				LearnTTL:      r.LearnTTL,
+				Schedule:      r.Schedule,
+			},
+			DNSServer:  r.DNSServer,
+			IPSet:      r.IPSet,
+			DSCP:       r.DSCP,
+			Mark:       r.Mark,
+			BlockQUIC:  r.BlockQUIC,
+			BitTorrent: r.BitTorrent,
+			Domain:     r.Domain,
+			TLD:        r.TLD,
+			IP:         r.IP,
+			CIDR:       r.CIDR,
+			Rewrite:    r.Rewrite,
+			Redirect:   r.Redirect,
+			BlockPage:  r.BlockPage,
+			Expect:     r.Expect,
+			GeoIPURL:   r.GeoIPURL,
+			GeoSiteURL: r.GeoSiteURL,
+			GeoUpdate:  r.GeoUpdate,
+			GeoVerify:  &verify,
+		})
+	}
+
+	return yaml.Marshal(y)
+}